@@ -0,0 +1,689 @@
+// Package analysis computes exact probability distributions for compiled
+// roll programs, and estimates them by sampling where that is too costly.
+//
+// Rather than sampling, the analyzer walks a program's bytecode the same way
+// the roll VM does, but each stack value holds every possible outcome and its
+// probability. Keep and drop limits are resolved with order statistics,
+// rerolls by conditioning the die's faces, and explosion chains are followed
+// until they either stop or reach Options.MaxExplosionDepth, at which point
+// the final die is treated as not exploding.
+//
+// Sample instead rolls a program many times, reporting the empirical
+// distribution with confidence intervals.
+package analysis
+
+import (
+	"fmt"
+
+	"github.com/darkliquid/roll"
+)
+
+// ErrUnsupported is raised when a program uses a feature the analyzer cannot
+// model exactly.
+type ErrUnsupported string
+
+func (e ErrUnsupported) Error() string {
+	return fmt.Sprintf("unsupported for exact analysis: %s", string(e))
+}
+
+// ErrUnbounded is raised when a roll can never terminate, such as a reroll
+// that matches every face of its die.
+type ErrUnbounded string
+
+func (e ErrUnbounded) Error() string {
+	return fmt.Sprintf("roll never terminates: %s", string(e))
+}
+
+// ErrTooComplex is raised when the analysis would track more intermediate
+// states than Options.MaxStates allows.
+type ErrTooComplex int
+
+func (e ErrTooComplex) Error() string {
+	return fmt.Sprintf("analysis exceeded maximum of %d states", int(e))
+}
+
+// Options configures the exact analyzer.
+type Options struct {
+	// MaxExplosionDepth is the number of additional rolls followed for each
+	// exploding die before the chain is cut off.
+	MaxExplosionDepth int
+	// MaxStates bounds the number of distinct intermediate outcomes tracked
+	// at any step, protecting against expressions with huge outcome spaces.
+	// It also bounds the pairs of outcomes combined for all the counts and
+	// sizes of a term with a computed count or die size, as in (1d4)d6.
+	MaxStates int
+}
+
+// DefaultOptions are the options used by Analyze.
+var DefaultOptions = Options{
+	MaxExplosionDepth: 20,
+	MaxStates:         1 << 20,
+}
+
+func (o Options) normalized() Options {
+	if o.MaxExplosionDepth <= 0 {
+		o.MaxExplosionDepth = DefaultOptions.MaxExplosionDepth
+	}
+	if o.MaxStates <= 0 {
+		o.MaxStates = DefaultOptions.MaxStates
+	}
+	return o
+}
+
+// Report is the exact distribution of a program's result.
+type Report struct {
+	// Total is the distribution of Result.Total.
+	Total Distribution
+	// Successes is the distribution of Result.Successes, which is always zero
+	// for programs without success or failure checks.
+	Successes Distribution
+	// Comparison is the outcome of a roll comparing two expressions, as in
+	// 1d20+5 vs 1d20+3 or 2d6 >= 8, and nil for other rolls. Total then
+	// holds the distribution of the comparison's total with ties drawn. For
+	// a repeated comparison it is the outcome of a single repetition.
+	Comparison *ComparisonReport
+}
+
+// ComparisonReport is the exact outcome of a roll comparing two expressions.
+type ComparisonReport struct {
+	Kind roll.CompareKind
+	// Margin is the distribution of the left total less the right total.
+	Margin Distribution
+	// Win, Tie and Loss are the chances of the left side beating, tying
+	// with and losing to the right. A check passes with chance Win and fails
+	// with chance Loss, and never ties.
+	Win  float64
+	Tie  float64
+	Loss float64
+}
+
+// PWin returns the chance of the left side winning, with ties settled by
+// the given policy.
+func (c *ComparisonReport) PWin(ties roll.TiePolicy) float64 {
+	if ties == roll.TiesToLeft {
+		return c.Win + c.Tie
+	}
+	return c.Win
+}
+
+// Analyze computes the exact distribution of a program using DefaultOptions.
+func Analyze(program *roll.Program) (*Report, error) {
+	return AnalyzeWithOptions(program, DefaultOptions)
+}
+
+// AnalyzeWithOptions computes the exact distribution of a program.
+func AnalyzeWithOptions(program *roll.Program, opts Options) (*Report, error) {
+	a := &analyzer{opts: opts.normalized()}
+
+	j := point(0, 0)
+	if program != nil {
+		var err error
+		if j, err = a.run(program); err != nil {
+			return nil, err
+		}
+	}
+
+	totals := make(map[int]float64)
+	successes := make(map[int]float64)
+	for o, p := range j {
+		totals[o.total] += p
+		successes[o.successes] += p
+	}
+
+	return &Report{
+		Total:      NewDistribution(totals),
+		Successes:  NewDistribution(successes),
+		Comparison: a.comparison,
+	}, nil
+}
+
+type analyzer struct {
+	opts Options
+	// work counts the pairs of outcomes combined by convolutions so far.
+	work int
+	// maxWork, when set, is the work at which convolving fails.
+	maxWork int
+	// comparison is the outcome of the program's comparison, if it has one.
+	comparison *ComparisonReport
+}
+
+// value is the analyzer's counterpart of a VM stack value.
+type value struct {
+	joint joint
+	// results returns the values the result exposes to a combined group.
+	results  func() (pool, error)
+	modifier int
+	computed bool
+}
+
+func (a *analyzer) run(program *roll.Program) (joint, error) {
+	stack := make([]value, 0, len(program.Code))
+
+	for pc, instruction := range program.Code {
+		switch instruction.Op {
+		case roll.OpRollDice:
+			if instruction.Arg < 0 || instruction.Arg >= len(program.DiceTerms) {
+				return nil, fmt.Errorf("invalid dice term index %d", instruction.Arg)
+			}
+			v, err := a.dice(program.DiceTerms[instruction.Arg])
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, v)
+		case roll.OpRollDiceCount, roll.OpRollDiceSides, roll.OpRollDiceCountSides:
+			if instruction.Arg < 0 || instruction.Arg >= len(program.DiceTerms) {
+				return nil, fmt.Errorf("invalid dice term index %d", instruction.Arg)
+			}
+			n := 1
+			if instruction.Op == roll.OpRollDiceCountSides {
+				n = 2
+			}
+			if n > len(stack) {
+				return nil, fmt.Errorf("%s requires %d operands, stack has %d", instruction.Op, n, len(stack))
+			}
+			v, err := a.computedDice(instruction.Op, program.DiceTerms[instruction.Arg], stack[len(stack)-n:])
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack[:len(stack)-n], v)
+		case roll.OpRollGroup:
+			if instruction.Arg < 0 || instruction.Arg >= len(program.GroupTerms) {
+				return nil, fmt.Errorf("invalid group term index %d", instruction.Arg)
+			}
+			term := program.GroupTerms[instruction.Arg]
+			if term.ChildCount > len(stack) {
+				return nil, fmt.Errorf("group term %d requires %d child values, stack has %d", instruction.Arg, term.ChildCount, len(stack))
+			}
+			children := stack[len(stack)-term.ChildCount:]
+			v, err := a.group(term, children)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack[:len(stack)-term.ChildCount], v)
+		case roll.OpConst:
+			stack = append(stack, value{joint: point(instruction.Arg, 0), computed: true})
+		case roll.OpNeg:
+			if len(stack) < 1 {
+				return nil, fmt.Errorf("%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			negated := make(joint, len(stack[len(stack)-1].joint))
+			for o, p := range stack[len(stack)-1].joint {
+				negated[pair{total: -o.total, successes: -o.successes}] += p
+			}
+			stack[len(stack)-1] = value{joint: negated, computed: true}
+		case roll.OpLabel:
+			// Labels only attribute totals; the distribution is unchanged.
+			if len(stack) < 1 {
+				return nil, fmt.Errorf("%s requires 1 operand, stack has 0", instruction.Op)
+			}
+		case roll.OpAdd, roll.OpSub, roll.OpMul, roll.OpDiv:
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("%s requires 2 operands, stack has %d", instruction.Op, len(stack))
+			}
+			left, right := stack[len(stack)-2].joint, stack[len(stack)-1].joint
+			op := arithmeticOps[instruction.Op]
+			if instruction.Op == roll.OpDiv {
+				op = divideWith(rounding(program.Code, pc))
+			}
+			combined, err := a.convolve(left, right, op)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack[:len(stack)-2], value{joint: combined, computed: true})
+		case roll.OpCompare:
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("%s requires 2 operands, stack has %d", instruction.Op, len(stack))
+			}
+			left, right := stack[len(stack)-2].joint, stack[len(stack)-1].joint
+			outcome, err := a.compare(roll.CompareKind(instruction.Arg), left, right)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack[:len(stack)-2], value{joint: outcome, computed: true})
+		case roll.OpRepeat:
+			if len(stack) != 1 {
+				return nil, fmt.Errorf("%s requires 1 operand, stack has %d", instruction.Op, len(stack))
+			}
+			if instruction.Arg < 0 || instruction.Arg >= len(program.RepeatTerms) {
+				return nil, fmt.Errorf("invalid repeat term index %d", instruction.Arg)
+			}
+			// The repetitions are independent, so their sum is the body's
+			// distribution convolved with itself once per repetition.
+			body := stack[0].joint
+			sum := body
+			for range program.RepeatTerms[instruction.Arg].Count - 1 {
+				var err error
+				if sum, err = a.convolve(sum, body, opAdd); err != nil {
+					return nil, err
+				}
+			}
+			stack[0] = value{joint: sum, computed: true}
+		case roll.OpMax, roll.OpMin, roll.OpSum, roll.OpAvg, roll.OpCount:
+			if instruction.Arg < 0 || instruction.Arg >= len(program.AggregateTerms) {
+				return nil, fmt.Errorf("invalid aggregate term index %d", instruction.Arg)
+			}
+			term := program.AggregateTerms[instruction.Arg]
+			if term.ChildCount > len(stack) {
+				return nil, fmt.Errorf("aggregate term %d requires %d child values, stack has %d", instruction.Arg, term.ChildCount, len(stack))
+			}
+			children := stack[len(stack)-term.ChildCount:]
+			combined, err := a.aggregate(instruction.Op, term, children, rounding(program.Code, pc))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack[:len(stack)-term.ChildCount], value{joint: combined, computed: true})
+		case roll.OpFloor, roll.OpCeil, roll.OpRound:
+			// The division or average being rounded has already used this
+			// rounding, and whole values are unchanged.
+			if len(stack) < 1 {
+				return nil, fmt.Errorf("%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			stack[len(stack)-1] = value{joint: stack[len(stack)-1].joint, computed: true}
+		case roll.OpAbs:
+			if len(stack) < 1 {
+				return nil, fmt.Errorf("%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			absolute := make(joint, len(stack[len(stack)-1].joint))
+			for o, p := range stack[len(stack)-1].joint {
+				if o.total < 0 {
+					o = pair{total: -o.total, successes: -o.successes}
+				}
+				absolute[o] += p
+			}
+			stack[len(stack)-1] = value{joint: absolute, computed: true}
+		default:
+			return nil, ErrUnsupported(fmt.Sprintf("opcode %s", instruction.Op))
+		}
+	}
+
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("program left %d results on the VM stack", len(stack))
+	}
+	return stack[0].joint, nil
+}
+
+func (a *analyzer) dice(term roll.DiceTerm) (value, error) {
+	if term.Multiplier == 0 {
+		return value{joint: point(0, 0), results: func() (pool, error) { return nil, nil }}, nil
+	}
+	if term.Match != nil && term.Match.Count {
+		return value{}, ErrUnsupported("counting matched sets")
+	}
+
+	fresh, err := faces(term.Die)
+	if err != nil {
+		return value{}, err
+	}
+	initial, err := applyRerolls(fresh, term.Rerolls)
+	if err != nil {
+		return value{}, err
+	}
+	it, err := a.chain(initial, fresh, term.Exploding)
+	if err != nil {
+		return value{}, err
+	}
+
+	sign := 1
+	if term.Multiplier < 0 {
+		sign = -1
+	}
+	p := pool{{item: it, count: term.Multiplier * sign}}
+
+	sc := scorer{success: term.Success, failure: term.Failure, modifier: term.Modifier}
+	kept, err := a.limitedJoint(p, term.Limit, sc)
+	if err != nil {
+		return value{}, err
+	}
+
+	return value{
+		joint:    finalise(kept, sc, sign),
+		results:  func() (pool, error) { return a.collapse(p, term.Limit) },
+		modifier: term.Modifier,
+	}, nil
+}
+
+// computedDice mixes the distributions of a dice term rolled with each
+// possible count and die size taken from its operands.
+func (a *analyzer) computedDice(op roll.Opcode, term roll.DiceTerm, operands []value) (value, error) {
+	counts, sizes := map[int]float64{1: 1}, map[int]float64{0: 1}
+	if op != roll.OpRollDiceSides {
+		counts, operands = totals(operands[0].joint), operands[1:]
+	}
+	if op != roll.OpRollDiceCount {
+		sizes = totals(operands[0].joint)
+	}
+
+	// Each count and size is analyzed as a term of its own, so the work they
+	// do together is bounded as well as the states of each.
+	if a.maxWork == 0 {
+		a.maxWork = a.work + a.opts.MaxStates
+		defer func() { a.maxWork = 0 }()
+	}
+	mixed := make(joint)
+	for count, cp := range counts {
+		if count < 0 {
+			return value{}, roll.ErrNegativeDiceCount(count)
+		}
+		for size, sp := range sizes {
+			t := term
+			t.Multiplier *= count
+			if op != roll.OpRollDiceCount {
+				if size < 2 {
+					return value{}, roll.ErrUnsafeDie(roll.NormalDie(size).String())
+				}
+				t.Die = roll.NormalDie(size)
+			}
+			v, err := a.dice(t)
+			if err != nil {
+				return value{}, err
+			}
+			for o, p := range v.joint {
+				mixed[o] += cp * sp * p
+			}
+			if len(mixed) > a.opts.MaxStates {
+				return value{}, ErrTooComplex(a.opts.MaxStates)
+			}
+		}
+	}
+
+	return value{
+		joint: mixed,
+		results: func() (pool, error) {
+			return nil, ErrUnsupported("computed dice in a combined group")
+		},
+		modifier: term.Modifier,
+	}, nil
+}
+
+// totals returns the distribution of the totals of a joint distribution.
+func totals(j joint) map[int]float64 {
+	dist := make(map[int]float64)
+	for o, p := range j {
+		dist[o.total] += p
+	}
+	return dist
+}
+
+func (a *analyzer) group(term roll.GroupTerm, children []value) (value, error) {
+	var p pool
+	for _, child := range children {
+		if !term.Combined || child.computed {
+			p = append(p, poolEntry{item: singleValues(totals(child.joint)), count: 1})
+			continue
+		}
+
+		results, err := child.results()
+		if err != nil {
+			return value{}, err
+		}
+		modifier := child.modifier
+		p = append(p, results.mapValues(func(v int) int { return v + modifier })...)
+	}
+
+	sc := scorer{success: term.Success, failure: term.Failure, modifier: term.Modifier}
+	kept, err := a.limitedJoint(p, term.Limit, sc)
+	if err != nil {
+		return value{}, err
+	}
+	j := finalise(kept, sc, 1)
+
+	if term.Negative {
+		negated := make(joint, len(j))
+		for o, prob := range j {
+			negated[pair{total: -o.total, successes: o.successes}] += prob
+		}
+		j = negated
+	}
+
+	return value{
+		joint: j,
+		results: func() (pool, error) {
+			kept, err := a.collapse(p, term.Limit)
+			if err != nil || !term.Negative {
+				return kept, err
+			}
+			return kept.mapValues(func(v int) int { return -v }), nil
+		},
+		modifier: term.Modifier,
+	}, nil
+}
+
+// finalise turns the kept sum and successes of a term into its total, as the
+// VM does once limits have been applied.
+func finalise(kept joint, sc scorer, sign int) joint {
+	result := make(joint, len(kept))
+	for o, p := range kept {
+		if sc.success != nil || sc.failure != nil {
+			result[pair{total: o.successes, successes: o.successes}] += p
+		} else {
+			result[pair{total: (o.total + sc.modifier) * sign}] += p
+		}
+	}
+	return result
+}
+
+type arithmeticOp func(left, right pair) (pair, bool)
+
+func opAdd(left, right pair) (pair, bool) {
+	return pair{total: left.total + right.total, successes: left.successes + right.successes}, true
+}
+
+func opSub(left, right pair) (pair, bool) {
+	return pair{total: left.total - right.total, successes: left.successes - right.successes}, true
+}
+
+func opMul(left, right pair) (pair, bool) {
+	return pair{total: left.total * right.total, successes: left.successes + right.successes}, true
+}
+
+func opDiv(left, right pair) (pair, bool) {
+	if right.total == 0 {
+		return pair{}, false
+	}
+	return pair{total: divideRounded(left.total, right.total), successes: left.successes + right.successes}, true
+}
+
+var arithmeticOps = map[roll.Opcode]arithmeticOp{
+	roll.OpAdd: opAdd,
+	roll.OpSub: opSub,
+	roll.OpMul: opMul,
+	roll.OpDiv: opDiv,
+}
+
+// divideRounded mirrors the VM's division, rounding to the nearest integer
+// with halves rounded up.
+func divideRounded(a, b int) int {
+	if b < 0 {
+		a, b = -a, -b
+	}
+	num, den := 2*a+b, 2*b
+	quotient := num / den
+	if num%den != 0 && num < 0 {
+		quotient--
+	}
+	return quotient
+}
+
+// rounding returns the rounding function applied to the value computed at
+// pc, looking past any labels, or OpDiv when the value is not rounded.
+func rounding(code []roll.Instruction, pc int) roll.Opcode {
+	next := pc + 1
+	for next < len(code) && code[next].Op == roll.OpLabel {
+		next++
+	}
+	if next < len(code) {
+		switch op := code[next].Op; op {
+		case roll.OpFloor, roll.OpCeil, roll.OpRound:
+			return op
+		}
+	}
+	return roll.OpDiv
+}
+
+// roundedQuotient mirrors the VM's division of a by b when the exact quotient
+// is passed to the rounding function round, or is rounded as OpDiv does.
+func roundedQuotient(a, b int, round roll.Opcode) int {
+	if b < 0 {
+		a, b = -a, -b
+	}
+	switch round {
+	case roll.OpFloor:
+		return floorDiv(a, b)
+	case roll.OpCeil:
+		return -floorDiv(-a, b)
+	case roll.OpRound:
+		// Halves round away from zero.
+		if a < 0 {
+			return -floorDiv(-2*a+b, 2*b)
+		}
+		return floorDiv(2*a+b, 2*b)
+	}
+	return divideRounded(a, b)
+}
+
+// floorDiv divides a by the positive b, rounding down.
+func floorDiv(a, b int) int {
+	quotient := a / b
+	if a%b != 0 && a < 0 {
+		quotient--
+	}
+	return quotient
+}
+
+// divideWith returns the division op rounding its quotient with round.
+func divideWith(round roll.Opcode) arithmeticOp {
+	return func(left, right pair) (pair, bool) {
+		if right.total == 0 {
+			return pair{}, false
+		}
+		return pair{total: roundedQuotient(left.total, right.total, round), successes: left.successes + right.successes}, true
+	}
+}
+
+// aggregate works out the distribution of an aggregate function of
+// independent values. An average is rounded with round.
+func (a *analyzer) aggregate(op roll.Opcode, term roll.AggregateTerm, children []value, round roll.Opcode) (joint, error) {
+	if len(children) == 0 {
+		return nil, fmt.Errorf("%s requires at least 1 child value", op)
+	}
+	if op == roll.OpCount && term.Count == nil {
+		return nil, fmt.Errorf("%s has no comparison", op)
+	}
+
+	combine := opAdd
+	switch op {
+	case roll.OpMax:
+		combine = opMax
+	case roll.OpMin:
+		combine = opMin
+	}
+
+	var result joint
+	for _, child := range children {
+		// Only a sum keeps its children's successes, and count gathers
+		// whether each child passed.
+		gathered := make(joint, len(child.joint))
+		for o, p := range child.joint {
+			switch op {
+			case roll.OpSum:
+				gathered[o] += p
+			case roll.OpCount:
+				if term.Count.Match(o.total) {
+					gathered[pair{total: 1}] += p
+				} else {
+					gathered[pair{total: 0}] += p
+				}
+			default:
+				gathered[pair{total: o.total}] += p
+			}
+		}
+
+		if result == nil {
+			result = gathered
+			continue
+		}
+		var err error
+		if result, err = a.convolve(result, gathered, combine); err != nil {
+			return nil, err
+		}
+	}
+
+	if op == roll.OpAvg {
+		averaged := make(joint, len(result))
+		for o, p := range result {
+			averaged[pair{total: roundedQuotient(o.total, len(children), round)}] += p
+		}
+		result = averaged
+	}
+	return result, nil
+}
+
+func opMax(left, right pair) (pair, bool) {
+	return pair{total: max(left.total, right.total)}, true
+}
+
+func opMin(left, right pair) (pair, bool) {
+	return pair{total: min(left.total, right.total)}, true
+}
+
+// compare works out the outcome of comparing two independent values,
+// recording it in a.comparison, and returns the distribution of the VM's
+// total for the comparison with ties drawn.
+func (a *analyzer) compare(kind roll.CompareKind, left, right joint) (joint, error) {
+	margins, err := a.convolve(left, right, opMargin)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ComparisonReport{Kind: kind, Margin: NewDistribution(totals(margins))}
+	outcome := make(joint)
+	for o, p := range margins {
+		switch {
+		case kind != roll.CompareVersus && kind.Passes(o.total):
+			report.Win += p
+			outcome[pair{total: 1}] += p
+		case kind != roll.CompareVersus:
+			report.Loss += p
+			outcome[pair{total: 0}] += p
+		case o.total > 0:
+			report.Win += p
+			outcome[pair{total: 1}] += p
+		case o.total < 0:
+			report.Loss += p
+			outcome[pair{total: -1}] += p
+		default:
+			report.Tie += p
+			outcome[pair{total: 0}] += p
+		}
+	}
+	a.comparison = report
+	return outcome, nil
+}
+
+// opMargin takes the right total from the left, as the VM does when
+// comparing them.
+func opMargin(left, right pair) (pair, bool) {
+	return pair{total: left.total - right.total}, true
+}
+
+// convolve combines every pair of outcomes of two independent distributions.
+func (a *analyzer) convolve(left, right joint, op arithmeticOp) (joint, error) {
+	a.work += len(left) * len(right)
+	if a.maxWork > 0 && a.work > a.maxWork {
+		return nil, ErrTooComplex(a.opts.MaxStates)
+	}
+	result := make(joint, max(len(left), len(right)))
+	for lo, lp := range left {
+		for ro, rp := range right {
+			o, ok := op(lo, ro)
+			if !ok {
+				return nil, roll.ErrDivisionByZero
+			}
+			result[o] += lp * rp
+		}
+		if len(result) > a.opts.MaxStates {
+			return nil, ErrTooComplex(a.opts.MaxStates)
+		}
+	}
+	return result, nil
+}
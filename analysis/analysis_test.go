@@ -0,0 +1,314 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+
+	"github.com/darkliquid/roll"
+)
+
+func analyze(t *testing.T, input string) *Report {
+	t.Helper()
+	program, err := roll.CompileString(input)
+	if err != nil {
+		t.Fatalf("compile %q: %v", input, err)
+	}
+	report, err := Analyze(program)
+	if err != nil {
+		t.Fatalf("analyze %q: %v", input, err)
+	}
+	return report
+}
+
+func approxEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestAnalyze_Moments(t *testing.T) {
+	tests := []struct {
+		input    string
+		mean     float64
+		variance float64
+		min      int
+		max      int
+	}{
+		{input: "1d6", mean: 3.5, variance: 35.0 / 12, min: 1, max: 6},
+		{input: "2d6+3", mean: 10, variance: 35.0 / 6, min: 5, max: 15},
+		{input: "-1d4", mean: -2.5, variance: 15.0 / 12, min: -4, max: -1},
+		{input: "4dF", mean: 0, variance: 8.0 / 3, min: -4, max: 4},
+		{input: "(1d6+1)*2", mean: 9, variance: 35.0 / 3, min: 4, max: 14},
+		{input: "2d20kh1", mean: 13.825, variance: 22.194375, min: 1, max: 20},
+		{input: "2d20kl1", mean: 7.175, variance: 22.194375, min: 1, max: 20},
+		{input: "{1d20, 1d20}kh1", mean: 13.825, variance: 22.194375, min: 1, max: 20},
+		{input: "1d6r1", mean: 4, variance: 2, min: 2, max: 6},
+		{input: "1d6ro1", mean: 4.0*5/6 + 3.5/6, variance: -1, min: 1, max: 6},
+		{input: "5d10>7", mean: 1.5, variance: 1.05, min: 0, max: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			report := analyze(t, tt.input)
+			if got := report.Total.Mean(); !approxEqual(got, tt.mean, 1e-9) {
+				t.Errorf("mean mismatch: exp=%v got=%v", tt.mean, got)
+			}
+			if got := report.Total.Variance(); tt.variance >= 0 && !approxEqual(got, tt.variance, 1e-9) {
+				t.Errorf("variance mismatch: exp=%v got=%v", tt.variance, got)
+			}
+			if got := report.Total.Min(); got != tt.min {
+				t.Errorf("min mismatch: exp=%d got=%d", tt.min, got)
+			}
+			if got := report.Total.Max(); got != tt.max {
+				t.Errorf("max mismatch: exp=%d got=%d", tt.max, got)
+			}
+		})
+	}
+}
+
+func TestAnalyze_KeepHighest(t *testing.T) {
+	report := analyze(t, "4d6kh3")
+
+	// Known values for the classic ability score roll.
+	if got := report.Total.Mean(); !approxEqual(got, 15869.0/1296, 1e-9) {
+		t.Fatalf("mean mismatch: got %v", got)
+	}
+	if got := report.Total.Probability(18); !approxEqual(got, 21.0/1296, 1e-12) {
+		t.Fatalf("P(18) mismatch: got %v", got)
+	}
+	if got := report.Total.Probability(3); !approxEqual(got, 1.0/1296, 1e-12) {
+		t.Fatalf("P(3) mismatch: got %v", got)
+	}
+	if dh := analyze(t, "4d6dl"); !approxEqual(dh.Total.Mean(), report.Total.Mean(), 1e-9) {
+		t.Fatalf("4d6dl should match 4d6kh3: got %v", dh.Total.Mean())
+	}
+}
+
+func TestAnalyze_Explosions(t *testing.T) {
+	tests := []struct {
+		input string
+		mean  float64
+	}{
+		{input: "1d6!6", mean: 4.2},
+		{input: "1d6!!6", mean: 4.2},
+		{input: "1d6!p6", mean: 3.5 + (1.0/6)*3.5/(1-1.0/6) - (1.0/6)/(1-1.0/6)},
+		{input: "1d6!o=6", mean: 3.5 + 3.5/6},
+		{input: "1d6!!o2=6", mean: 3.5 + 3.5/6 + 3.5/36},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			report := analyze(t, tt.input)
+			if got := report.Total.Mean(); !approxEqual(got, tt.mean, 1e-9) {
+				t.Fatalf("mean mismatch: exp=%v got=%v", tt.mean, got)
+			}
+		})
+	}
+
+	program, _ := roll.CompileString("1d2!2")
+	report, err := AnalyzeWithOptions(program, Options{MaxExplosionDepth: 3})
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if got, want := report.Total.Max(), 8; got != want {
+		t.Fatalf("depth cutoff mismatch: exp max %d got %d", want, got)
+	}
+}
+
+func TestAnalyze_Successes(t *testing.T) {
+	report := analyze(t, "3d6>4f=1+1d4")
+
+	if got, want := report.Successes.Min(), -3; got != want {
+		t.Fatalf("min successes mismatch: exp=%d got=%d", want, got)
+	}
+	if got, want := report.Successes.Max(), 3; got != want {
+		t.Fatalf("max successes mismatch: exp=%d got=%d", want, got)
+	}
+	if got, want := report.Successes.Mean(), 3*(2.0/6-1.0/6); !approxEqual(got, want, 1e-9) {
+		t.Fatalf("mean successes mismatch: exp=%v got=%v", want, got)
+	}
+	if got, want := report.Total.Mean(), 0.5+2.5; !approxEqual(got, want, 1e-9) {
+		t.Fatalf("mean total mismatch: exp=%v got=%v", want, got)
+	}
+}
+
+func TestAnalyze_Compare(t *testing.T) {
+	tests := []struct {
+		input string
+		win   float64
+		tie   float64
+		loss  float64
+		mean  float64
+	}{
+		{input: "1d6 vs 1d6", win: 15.0 / 36, tie: 6.0 / 36, loss: 15.0 / 36},
+		{input: "1d6+1 vs 1d6", win: 21.0 / 36, tie: 5.0 / 36, loss: 10.0 / 36, mean: 11.0 / 36},
+		{input: "2d6 >= 8", win: 15.0 / 36, loss: 21.0 / 36, mean: 15.0 / 36},
+		{input: "1d20 < 1d20", win: 190.0 / 400, loss: 210.0 / 400, mean: 190.0 / 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			report := analyze(t, tt.input)
+			c := report.Comparison
+			if c == nil {
+				t.Fatal("expected comparison report")
+			}
+			if !approxEqual(c.Win, tt.win, 1e-9) || !approxEqual(c.Tie, tt.tie, 1e-9) || !approxEqual(c.Loss, tt.loss, 1e-9) {
+				t.Fatalf("outcome mismatch: exp=%v/%v/%v got=%v/%v/%v", tt.win, tt.tie, tt.loss, c.Win, c.Tie, c.Loss)
+			}
+			if got := c.PWin(roll.TiesToLeft); !approxEqual(got, tt.win+tt.tie, 1e-9) {
+				t.Fatalf("win with ties to left mismatch: exp=%v got=%v", tt.win+tt.tie, got)
+			}
+			if got := c.PWin(roll.TiesToRight); !approxEqual(got, tt.win, 1e-9) {
+				t.Fatalf("win with ties to right mismatch: exp=%v got=%v", tt.win, got)
+			}
+			if got := report.Total.Mean(); !approxEqual(got, tt.mean, 1e-9) {
+				t.Fatalf("mean total mismatch: exp=%v got=%v", tt.mean, got)
+			}
+		})
+	}
+
+	if got := analyze(t, "1d6+1 vs 1d6").Comparison.Margin.Mean(); !approxEqual(got, 1, 1e-9) {
+		t.Fatalf("mean margin mismatch: exp=1 got=%v", got)
+	}
+	if report := analyze(t, "2d6>=8"); report.Comparison != nil {
+		t.Fatalf("unexpected comparison report for a success check: %+v", report.Comparison)
+	}
+}
+
+func TestAnalyze_Repeat(t *testing.T) {
+	report := analyze(t, "6 x 4d6kh3")
+	single := analyze(t, "4d6kh3")
+	if got, want := report.Total.Mean(), 6*single.Total.Mean(); !approxEqual(got, want, 1e-9) {
+		t.Fatalf("mean mismatch: exp=%v got=%v", want, got)
+	}
+	if got, want := report.Total.Variance(), 6*single.Total.Variance(); !approxEqual(got, want, 1e-9) {
+		t.Fatalf("variance mismatch: exp=%v got=%v", want, got)
+	}
+	if got, want := report.Total.Min(), 18; got != want {
+		t.Fatalf("min mismatch: exp=%d got=%d", want, got)
+	}
+
+	// Three checks at 15/36 pass twice or more with chance 3p²(1-p) + p³.
+	p := 15.0 / 36
+	if got, want := analyze(t, "3 x 2d6 >= 8").Total.AtLeast(2), 3*p*p*(1-p)+p*p*p; !approxEqual(got, want, 1e-9) {
+		t.Fatalf("at least two passes mismatch: exp=%v got=%v", want, got)
+	}
+}
+
+func TestAnalyze_Functions(t *testing.T) {
+	tests := []struct {
+		input string
+		mean  float64
+	}{
+		// E[max] sums k(2k-1)/400 over the faces.
+		{input: "max{1d20, 1d20}", mean: 5530.0 / 400},
+		{input: "min{1d20, 1d20}", mean: 21 - 5530.0/400},
+		{input: "sum{2d6, 1d4}", mean: 9.5},
+		// Odd sums are halved and rounded up half the time.
+		{input: "avg{1d6, 1d6}", mean: 3.75},
+		{input: "floor(avg{1d6, 1d6})", mean: 3.25},
+		{input: "count{1d6, 1d6, 1d6}>4", mean: 1},
+		{input: "1d6/2", mean: 2},
+		{input: "floor(1d6/2)", mean: 1.5},
+		{input: "ceil(1d6/2)", mean: 2},
+		{input: "round(-1d6/2)", mean: -2},
+		{input: "floor(1d6/2+1)", mean: 3},
+		{input: "abs(1d6-1d6)", mean: 70.0 / 36},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			report := analyze(t, tt.input)
+			if got := report.Total.Mean(); !approxEqual(got, tt.mean, 1e-9) {
+				t.Fatalf("mean mismatch: exp=%v got=%v", tt.mean, got)
+			}
+		})
+	}
+
+	if got, want := analyze(t, "count{1d6, 1d6, 1d6}>4").Total.AtLeast(3), 1.0/27; !approxEqual(got, want, 1e-9) {
+		t.Fatalf("all three counted mismatch: exp=%v got=%v", want, got)
+	}
+}
+
+func TestAnalyze_Errors(t *testing.T) {
+	tests := []struct {
+		input string
+		opts  Options
+		err   string
+	}{
+		{input: "1d6r<7", err: "roll never terminates: reroll r<7 matches every face"},
+		{input: "1d6/(1d2-1)", err: "division by zero"},
+		{input: "100d100", opts: Options{MaxStates: 100}, err: "analysis exceeded maximum of 100 states"},
+		{input: "(51d4)d(1d6+1)", err: "analysis exceeded maximum of 1048576 states"},
+		{input: "(10d4)d(1d6+1)", opts: Options{MaxStates: 5000}, err: "analysis exceeded maximum of 5000 states"},
+		{input: "(1d4-2)d6", err: "cannot roll -1 dice"},
+		{input: "{(1d2)d6 + 1d4}", err: "unsupported for exact analysis: computed dice in a combined group"},
+		{input: "6d6mt", err: "unsupported for exact analysis: counting matched sets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program, err := roll.CompileStringWithLimits(tt.input, roll.Limits{MaxExpectedRolls: -1})
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			_, err = AnalyzeWithOptions(program, tt.opts)
+			if err == nil {
+				t.Fatal("expected analysis error")
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("unexpected error: exp=%q got=%q", tt.err, err.Error())
+			}
+		})
+	}
+}
+
+// TestAnalyze_MatchesEvaluation checks exact results against sampled VM
+// evaluations for expressions that exercise the trickier code paths.
+func TestAnalyze_MatchesEvaluation(t *testing.T) {
+	const samples = 40000
+
+	inputs := []string{
+		"{3d6+2d8-{4d4-1}dl}kh3<4f>3",
+		"{3d6+4, 2d8}dl=1f>5",
+		"4d6!>5dh2",
+		"3d6!!6kl2+1d4*2",
+		"{2d4!4 + 1d6}kh2",
+		"5d6ro<2r6>4",
+		"(1d4)d6kh2+1",
+		"{1d3+1}d(2*1d3)",
+		"4d{0,0,1,1,2,3}kh2",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			report := analyze(t, input)
+			program, _ := roll.CompileString(input)
+			src := roll.NewPCGSource(1, 2)
+
+			counts := make(map[int]int)
+			for range samples {
+				result, err := roll.EvaluateProgramWithOptions(program, roll.EvalOptions{Source: src})
+				if err != nil {
+					t.Fatalf("evaluate: %v", err)
+				}
+				counts[result.Total]++
+			}
+
+			var distance float64
+			for value, n := range counts {
+				if report.Total.Probability(value) == 0 {
+					t.Fatalf("sampled impossible total %d", value)
+				}
+				distance += math.Abs(float64(n)/samples - report.Total.Probability(value))
+			}
+			for _, o := range report.Total.Outcomes() {
+				if counts[o.Value] == 0 {
+					distance += o.Probability
+				}
+			}
+			if distance/2 > 0.02 {
+				t.Fatalf("sampled distribution diverges from exact: total variation %.4f", distance/2)
+			}
+		})
+	}
+}
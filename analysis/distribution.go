@@ -0,0 +1,120 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+)
+
+// Outcome is a single value of a distribution and its probability.
+type Outcome struct {
+	Value       int
+	Probability float64
+}
+
+// Distribution is a discrete probability distribution over integer outcomes.
+type Distribution struct {
+	outcomes []Outcome
+}
+
+// NewDistribution builds a distribution from a map of values to probabilities.
+// Values with zero probability are discarded.
+func NewDistribution(probs map[int]float64) Distribution {
+	outcomes := make([]Outcome, 0, len(probs))
+	for value, p := range probs {
+		if p > 0 {
+			outcomes = append(outcomes, Outcome{Value: value, Probability: p})
+		}
+	}
+	sort.Slice(outcomes, func(i, j int) bool { return outcomes[i].Value < outcomes[j].Value })
+	return Distribution{outcomes: outcomes}
+}
+
+// Outcomes returns every possible value in ascending order with its probability.
+func (d Distribution) Outcomes() []Outcome {
+	return append([]Outcome(nil), d.outcomes...)
+}
+
+// Probability returns the probability of exactly value.
+func (d Distribution) Probability(value int) float64 {
+	i := sort.Search(len(d.outcomes), func(i int) bool { return d.outcomes[i].Value >= value })
+	if i < len(d.outcomes) && d.outcomes[i].Value == value {
+		return d.outcomes[i].Probability
+	}
+	return 0
+}
+
+// Min returns the smallest possible value.
+func (d Distribution) Min() int {
+	if len(d.outcomes) == 0 {
+		return 0
+	}
+	return d.outcomes[0].Value
+}
+
+// Max returns the largest possible value.
+func (d Distribution) Max() int {
+	if len(d.outcomes) == 0 {
+		return 0
+	}
+	return d.outcomes[len(d.outcomes)-1].Value
+}
+
+// Mean returns the expected value.
+func (d Distribution) Mean() float64 {
+	var mean float64
+	for _, o := range d.outcomes {
+		mean += float64(o.Value) * o.Probability
+	}
+	return mean
+}
+
+// Variance returns the variance of the distribution.
+func (d Distribution) Variance() float64 {
+	mean := d.Mean()
+	var variance float64
+	for _, o := range d.outcomes {
+		delta := float64(o.Value) - mean
+		variance += delta * delta * o.Probability
+	}
+	return variance
+}
+
+// StdDev returns the standard deviation of the distribution.
+func (d Distribution) StdDev() float64 {
+	return math.Sqrt(d.Variance())
+}
+
+// Percentile returns the smallest value whose cumulative probability is at
+// least p, where p is in the range [0, 1].
+func (d Distribution) Percentile(p float64) int {
+	var cumulative float64
+	for _, o := range d.outcomes {
+		cumulative += o.Probability
+		if cumulative >= p-1e-12 {
+			return o.Value
+		}
+	}
+	return d.Max()
+}
+
+// AtLeast returns the probability of a value greater than or equal to n.
+func (d Distribution) AtLeast(n int) float64 {
+	var p float64
+	for _, o := range d.outcomes {
+		if o.Value >= n {
+			p += o.Probability
+		}
+	}
+	return p
+}
+
+// AtMost returns the probability of a value less than or equal to n.
+func (d Distribution) AtMost(n int) float64 {
+	var p float64
+	for _, o := range d.outcomes {
+		if o.Value <= n {
+			p += o.Probability
+		}
+	}
+	return p
+}
@@ -0,0 +1,50 @@
+package analysis
+
+import "testing"
+
+func TestDistribution(t *testing.T) {
+	d := NewDistribution(map[int]float64{1: 0.25, 2: 0.5, 4: 0.25, 7: 0})
+
+	if got, want := len(d.Outcomes()), 3; got != want {
+		t.Fatalf("outcome count mismatch: exp=%d got=%d", want, got)
+	}
+	if got, want := d.Min(), 1; got != want {
+		t.Fatalf("min mismatch: exp=%d got=%d", want, got)
+	}
+	if got, want := d.Max(), 4; got != want {
+		t.Fatalf("max mismatch: exp=%d got=%d", want, got)
+	}
+	if got, want := d.Mean(), 2.25; got != want {
+		t.Fatalf("mean mismatch: exp=%v got=%v", want, got)
+	}
+	if got, want := d.Variance(), 1.1875; got != want {
+		t.Fatalf("variance mismatch: exp=%v got=%v", want, got)
+	}
+	if got, want := d.Probability(3), 0.0; got != want {
+		t.Fatalf("probability mismatch: exp=%v got=%v", want, got)
+	}
+
+	percentiles := []struct {
+		p    float64
+		want int
+	}{
+		{p: 0, want: 1},
+		{p: 0.25, want: 1},
+		{p: 0.5, want: 2},
+		{p: 0.75, want: 2},
+		{p: 0.9, want: 4},
+		{p: 1, want: 4},
+	}
+	for _, tt := range percentiles {
+		if got := d.Percentile(tt.p); got != tt.want {
+			t.Errorf("percentile %v mismatch: exp=%d got=%d", tt.p, tt.want, got)
+		}
+	}
+
+	if got, want := d.AtLeast(2), 0.75; got != want {
+		t.Fatalf("at least mismatch: exp=%v got=%v", want, got)
+	}
+	if got, want := d.AtMost(2), 0.75; got != want {
+		t.Fatalf("at most mismatch: exp=%v got=%v", want, got)
+	}
+}
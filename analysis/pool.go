@@ -0,0 +1,537 @@
+package analysis
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/darkliquid/roll"
+)
+
+// pair is a joint outcome of a result's total and its success count.
+type pair struct {
+	total     int
+	successes int
+}
+
+// joint is a probability distribution over pairs.
+type joint map[pair]float64
+
+func point(total, successes int) joint {
+	return joint{{total: total, successes: successes}: 1}
+}
+
+// bag is a weighted multiset of die values, kept in ascending order.
+type bag struct {
+	values []int
+	p      float64
+}
+
+// item is the distribution of values a single independent source, such as
+// one die and its explosions, contributes to a pool.
+type item []bag
+
+// poolEntry is an item repeated count times with independent outcomes.
+type poolEntry struct {
+	item  item
+	count int
+}
+
+// pool is the collection of independent sources whose values make up a
+// dice or group result before any keep or drop limit is applied.
+type pool []poolEntry
+
+func singleValues(dist map[int]float64) item {
+	it := make(item, 0, len(dist))
+	for v, p := range dist {
+		it = append(it, bag{values: []int{v}, p: p})
+	}
+	return it
+}
+
+// mapValues returns a copy of the pool with every value transformed by fn.
+func (p pool) mapValues(fn func(int) int) pool {
+	mapped := make(pool, len(p))
+	for i, entry := range p {
+		it := make(item, len(entry.item))
+		for j, b := range entry.item {
+			values := make([]int, len(b.values))
+			for k, v := range b.values {
+				values[k] = fn(v)
+			}
+			sort.Ints(values)
+			it[j] = bag{values: values, p: b.p}
+		}
+		mapped[i] = poolEntry{item: it, count: entry.count}
+	}
+	return mapped
+}
+
+func bagKey(values []int) string {
+	buf := make([]byte, 0, len(values)*4)
+	for _, v := range values {
+		buf = strconv.AppendInt(buf, int64(v), 36)
+		buf = append(buf, ',')
+	}
+	return string(buf)
+}
+
+// bagSet accumulates bags, merging identical multisets.
+type bagSet map[string]*bag
+
+func (s bagSet) add(values []int, p float64) {
+	key := bagKey(values)
+	if b, ok := s[key]; ok {
+		b.p += p
+		return
+	}
+	s[key] = &bag{values: values, p: p}
+}
+
+func (s bagSet) item() item {
+	it := make(item, 0, len(s))
+	for _, b := range s {
+		it = append(it, *b)
+	}
+	return it
+}
+
+// scorer counts the successes and failures a single value contributes.
+type scorer struct {
+	success  *roll.ComparisonOp
+	failure  *roll.ComparisonOp
+	modifier int
+}
+
+func (s scorer) score(v int) int {
+	var n int
+	if s.success != nil && s.success.Match(v+s.modifier) {
+		n++
+	}
+	if s.failure != nil && s.failure.Match(v+s.modifier) {
+		n--
+	}
+	return n
+}
+
+func (s scorer) scoreAll(values []int) (sum, successes int) {
+	for _, v := range values {
+		sum += v
+		successes += s.score(v)
+	}
+	return sum, successes
+}
+
+// faces returns the distribution of a single roll of die.
+func faces(die roll.Die) (map[int]float64, error) {
+	var lo, hi int
+	switch d := die.(type) {
+	case roll.NormalDie:
+		lo, hi = 1, int(d)
+	case roll.PercentileDie:
+		lo, hi = 1, 100
+	case roll.FateDie:
+		lo, hi = -1, 1
+	case roll.CustomDie:
+		if len(d.Faces) == 0 {
+			return nil, ErrUnsupported("die type " + die.String())
+		}
+		dist := make(map[int]float64)
+		for _, face := range d.Faces {
+			dist[face.Value] += 1 / float64(len(d.Faces))
+		}
+		return dist, nil
+	default:
+		return nil, ErrUnsupported("die type " + die.String())
+	}
+	if hi < lo {
+		return nil, ErrUnsupported("die type " + die.String())
+	}
+
+	dist := make(map[int]float64, hi-lo+1)
+	p := 1 / float64(hi-lo+1)
+	for v := lo; v <= hi; v++ {
+		dist[v] = p
+	}
+	return dist, nil
+}
+
+// applyRerolls returns the distribution of a die after the reroll operations
+// have been applied in the same order as the evaluator applies them.
+func applyRerolls(fresh map[int]float64, rerolls []roll.RerollOp) (map[int]float64, error) {
+	type state struct {
+		value   int
+		stopped bool
+	}
+
+	current := make(map[state]float64, len(fresh))
+	for v, p := range fresh {
+		current[state{value: v}] = p
+	}
+
+	for _, reroll := range rerolls {
+		var kept float64
+		for v, p := range fresh {
+			if !reroll.Match(v) {
+				kept += p
+			}
+		}
+
+		next := make(map[state]float64, len(current))
+		for st, p := range current {
+			if st.stopped || !reroll.Match(st.value) {
+				next[st] += p
+				continue
+			}
+			for v, q := range fresh {
+				if reroll.Once {
+					next[state{value: v, stopped: true}] += p * q
+				} else if !reroll.Match(v) {
+					next[state{value: v}] += p * q / kept
+				}
+			}
+			if !reroll.Once && kept == 0 {
+				return nil, ErrUnbounded("reroll " + reroll.String() + " matches every face")
+			}
+		}
+		current = next
+	}
+
+	dist := make(map[int]float64, len(fresh))
+	for st, p := range current {
+		dist[st.value] += p
+	}
+	return dist, nil
+}
+
+// chain returns the values a single die contributes once explosions are
+// resolved. Chains longer than the configured depth, or the explosion's own
+// cap, stop exploding.
+func (a *analyzer) chain(initial, fresh map[int]float64, exp *roll.ExplodingOp) (item, error) {
+	if exp == nil {
+		return singleValues(initial), nil
+	}
+
+	grow := func(values []int, raw, depth int) []int {
+		switch {
+		case exp.Type == roll.Compounded && depth > 0:
+			return []int{values[0] + raw}
+		case exp.Type == roll.Penetrating && depth > 0:
+			raw--
+		}
+		grown := make([]int, len(values), len(values)+1)
+		copy(grown, values)
+		grown = append(grown, raw)
+		sort.Ints(grown)
+		return grown
+	}
+
+	maxDepth := a.opts.MaxExplosionDepth
+	if exp.MaxExplosions > 0 {
+		maxDepth = min(maxDepth, exp.MaxExplosions)
+	}
+
+	final := bagSet{}
+	frontier := bagSet{"": {p: 1}}
+	draw := initial
+	for depth := 0; len(frontier) > 0; depth++ {
+		next := bagSet{}
+		for _, b := range frontier {
+			for raw, q := range draw {
+				values := grow(b.values, raw, depth)
+				if exp.Match(raw) && depth < maxDepth {
+					next.add(values, b.p*q)
+				} else {
+					final.add(values, b.p*q)
+				}
+			}
+		}
+		if len(final)+len(next) > a.opts.MaxStates {
+			return nil, ErrTooComplex(a.opts.MaxStates)
+		}
+		frontier = next
+		draw = fresh
+	}
+
+	return final.item(), nil
+}
+
+// keptCount converts a limit over n values into the number of values kept
+// and whether those are the highest or lowest values.
+func keptCount(limit *roll.LimitOp, n int) (keep int, highest bool) {
+	amount := min(max(limit.Amount, 0), n)
+	switch limit.Type {
+	case roll.KeepHighest:
+		return amount, true
+	case roll.KeepLowest:
+		return amount, false
+	case roll.DropHighest:
+		return n - amount, false
+	case roll.DropLowest:
+		return n - amount, true
+	}
+	return n, true
+}
+
+// limitedJoint returns the joint distribution of the sum and successes of the
+// values of a pool that survive the limit.
+func (a *analyzer) limitedJoint(p pool, limit *roll.LimitOp, sc scorer) (joint, error) {
+	if limit == nil {
+		return a.sumJoint(p, sc)
+	}
+
+	if len(p) == 1 {
+		single := true
+		for _, b := range p[0].item {
+			single = single && len(b.values) == 1
+		}
+		if single {
+			return a.orderStatistics(p[0], limit, sc)
+		}
+	}
+
+	return a.extremes(p, limit, sc)
+}
+
+// sumJoint convolves every value of an unlimited pool.
+func (a *analyzer) sumJoint(p pool, sc scorer) (joint, error) {
+	result := point(0, 0)
+	for _, entry := range p {
+		single := joint{}
+		for _, b := range entry.item {
+			sum, successes := sc.scoreAll(b.values)
+			single[pair{total: sum, successes: successes}] += b.p
+		}
+
+		repeated, err := a.power(single, entry.count)
+		if err != nil {
+			return nil, err
+		}
+		if result, err = a.convolve(result, repeated, opAdd); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// power convolves j with itself n times by repeated squaring.
+func (a *analyzer) power(j joint, n int) (joint, error) {
+	result := point(0, 0)
+	var err error
+	for n > 0 {
+		if n&1 == 1 {
+			if result, err = a.convolve(result, j, opAdd); err != nil {
+				return nil, err
+			}
+		}
+		n >>= 1
+		if n > 0 {
+			if j, err = a.convolve(j, j, opAdd); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// orderStatistics computes the kept sum of n identically distributed single
+// values by assigning dice to faces from the most to least preferred face.
+func (a *analyzer) orderStatistics(entry poolEntry, limit *roll.LimitOp, sc scorer) (joint, error) {
+	type state struct {
+		assigned  int
+		sum       int
+		successes int
+	}
+
+	n := entry.count
+	keep, highest := keptCount(limit, n)
+
+	type face struct {
+		value int
+		p     float64
+	}
+	order := make([]face, 0, len(entry.item))
+	for _, b := range entry.item {
+		order = append(order, face{value: b.values[0], p: b.p})
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if highest {
+			return order[i].value > order[j].value
+		}
+		return order[i].value < order[j].value
+	})
+
+	states := map[state]float64{{}: 1}
+	remaining := 1.0
+	for i, f := range order {
+		// The number of the unassigned dice showing this face is binomial in
+		// the probability of this face given none of the earlier faces.
+		r := 1.0
+		if i < len(order)-1 && remaining > 0 {
+			r = min(f.p/remaining, 1)
+		}
+		remaining -= f.p
+
+		next := make(map[state]float64, len(states))
+		for st, p := range states {
+			rem := n - st.assigned
+			for c, q := range binomial(rem, r) {
+				if q == 0 {
+					continue
+				}
+				added := min(st.assigned+c, keep) - min(st.assigned, keep)
+				next[state{
+					assigned:  st.assigned + c,
+					sum:       st.sum + added*f.value,
+					successes: st.successes + added*sc.score(f.value),
+				}] += p * q
+			}
+		}
+		if len(next) > a.opts.MaxStates {
+			return nil, ErrTooComplex(a.opts.MaxStates)
+		}
+		states = next
+	}
+
+	result := joint{}
+	for st, p := range states {
+		if st.assigned == n {
+			result[pair{total: st.sum, successes: st.successes}] += p
+		}
+	}
+	return result, nil
+}
+
+// binomial returns the probability mass function of Binomial(n, r).
+func binomial(n int, r float64) []float64 {
+	pmf := make([]float64, n+1)
+	switch {
+	case r <= 0:
+		pmf[0] = 1
+		return pmf
+	case r >= 1:
+		pmf[n] = 1
+		return pmf
+	}
+
+	lgN, _ := math.Lgamma(float64(n + 1))
+	for c := 0; c <= n; c++ {
+		lgC, _ := math.Lgamma(float64(c + 1))
+		lgR, _ := math.Lgamma(float64(n - c + 1))
+		pmf[c] = math.Exp(lgN - lgC - lgR + float64(c)*math.Log(r) + float64(n-c)*math.Log1p(-r))
+	}
+	return pmf
+}
+
+// extremes tracks the k highest or lowest values seen so far, which is
+// enough to resolve any keep or drop limit over pools whose size or values
+// vary, such as exploding dice or grouped rolls.
+func (a *analyzer) extremes(p pool, limit *roll.LimitOp, sc scorer) (joint, error) {
+	type state struct {
+		extreme   []int
+		sum       int
+		successes int
+		p         float64
+	}
+
+	k := max(limit.Amount, 0)
+	highest := limit.Type == roll.KeepHighest || limit.Type == roll.DropHighest
+	drop := limit.Type == roll.DropHighest || limit.Type == roll.DropLowest
+
+	insert := func(extreme []int, v int) []int {
+		switch {
+		case len(extreme) < k:
+			extreme = append(slices.Clone(extreme), v)
+		case k > 0 && highest && v > extreme[0]:
+			extreme = slices.Clone(extreme)
+			extreme[0] = v
+		case k > 0 && !highest && v < extreme[len(extreme)-1]:
+			extreme = slices.Clone(extreme)
+			extreme[len(extreme)-1] = v
+		default:
+			return extreme
+		}
+		sort.Ints(extreme)
+		return extreme
+	}
+
+	states := map[string]*state{"": {p: 1}}
+	for _, entry := range p {
+		for range entry.count {
+			next := make(map[string]*state, len(states))
+			for _, st := range states {
+				for _, b := range entry.item {
+					extreme := st.extreme
+					sum, successes := st.sum, st.successes
+					for _, v := range b.values {
+						extreme = insert(extreme, v)
+						if drop {
+							sum += v
+							successes += sc.score(v)
+						}
+					}
+
+					key := bagKey(extreme) + "|" + strconv.Itoa(sum) + "|" + strconv.Itoa(successes)
+					if existing, ok := next[key]; ok {
+						existing.p += st.p * b.p
+					} else {
+						next[key] = &state{extreme: extreme, sum: sum, successes: successes, p: st.p * b.p}
+					}
+				}
+			}
+			if len(next) > a.opts.MaxStates {
+				return nil, ErrTooComplex(a.opts.MaxStates)
+			}
+			states = next
+		}
+	}
+
+	result := joint{}
+	for _, st := range states {
+		sum, successes := sc.scoreAll(st.extreme)
+		if drop {
+			sum, successes = st.sum-sum, st.successes-successes
+		}
+		result[pair{total: sum, successes: successes}] += st.p
+	}
+	return result, nil
+}
+
+// collapse returns the distribution of the exact values kept from a pool as
+// a single item, for use when a limited result is nested in a combined group.
+func (a *analyzer) collapse(p pool, limit *roll.LimitOp) (pool, error) {
+	if limit == nil {
+		return p, nil
+	}
+
+	states := bagSet{"": {p: 1}}
+	for _, entry := range p {
+		for range entry.count {
+			next := bagSet{}
+			for _, st := range states {
+				for _, b := range entry.item {
+					values := append(slices.Clone(st.values), b.values...)
+					sort.Ints(values)
+					next.add(values, st.p*b.p)
+				}
+			}
+			if len(next) > a.opts.MaxStates {
+				return nil, ErrTooComplex(a.opts.MaxStates)
+			}
+			states = next
+		}
+	}
+
+	kept := bagSet{}
+	for _, st := range states {
+		keep, highest := keptCount(limit, len(st.values))
+		if highest {
+			kept.add(st.values[len(st.values)-keep:], st.p)
+		} else {
+			kept.add(st.values[:keep], st.p)
+		}
+	}
+
+	return pool{{item: kept.item(), count: 1}}, nil
+}
@@ -0,0 +1,209 @@
+package analysis
+
+import (
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sort"
+
+	"github.com/darkliquid/roll"
+)
+
+// SampleOptions configures the Monte Carlo sampler.
+type SampleOptions struct {
+	// Limits are the safety limits every sampled roll is evaluated with.
+	Limits roll.Limits
+	// Samples is the most rolls taken.
+	Samples int
+	// BatchSize is the number of rolls taken between convergence checks.
+	BatchSize int
+	// Workers is the number of goroutines rolling each batch. Zero uses
+	// GOMAXPROCS.
+	Workers int
+	// Seed, when set, makes the sample reproducible whatever the number of
+	// workers. Otherwise a random seed is used.
+	Seed *uint64
+	// Tolerance, when positive, stops sampling once the confidence interval
+	// of the mean is no wider than Tolerance either side of it.
+	Tolerance float64
+	// Confidence is the confidence level of the sample's intervals, such as
+	// 0.95.
+	Confidence float64
+}
+
+// DefaultSampleOptions are the options used by Sample.
+var DefaultSampleOptions = SampleOptions{
+	Limits:     roll.DefaultLimits,
+	Samples:    100000,
+	BatchSize:  1000,
+	Confidence: 0.95,
+}
+
+func (o SampleOptions) normalized() SampleOptions {
+	if o.Samples <= 0 {
+		o.Samples = DefaultSampleOptions.Samples
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultSampleOptions.BatchSize
+	}
+	if o.Workers <= 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+	if o.Confidence <= 0 || o.Confidence >= 1 {
+		o.Confidence = DefaultSampleOptions.Confidence
+	}
+	return o
+}
+
+// Bin is the number of times a value was rolled.
+type Bin struct {
+	Value int
+	Count int
+}
+
+// Interval is a confidence interval.
+type Interval struct {
+	Lo, Hi float64
+}
+
+// SampleReport is the empirical distribution of a program's result, estimated
+// by rolling it.
+type SampleReport struct {
+	// Report holds the empirical distributions of Result.Total and
+	// Result.Successes.
+	Report
+	// Histogram counts the rolls of each total, in ascending order.
+	Histogram []Bin
+	// Rolls is the number of rolls taken.
+	Rolls int
+	// Mean and StdDev are the sample mean and standard deviation of the
+	// totals.
+	Mean   float64
+	StdDev float64
+	// Converged is set when sampling stopped early because the mean was
+	// known to within SampleOptions.Tolerance.
+	Converged bool
+	// Confidence is the confidence level of the report's intervals.
+	Confidence float64
+}
+
+// Sample estimates the distribution of a program by rolling it using
+// DefaultSampleOptions.
+func Sample(program *roll.Program) (*SampleReport, error) {
+	return SampleWithOptions(program, DefaultSampleOptions)
+}
+
+// SampleWithOptions estimates the distribution of a program by rolling it
+// up to opts.Samples times, for programs too costly to analyze exactly. The
+// rolls are evaluated in batches across opts.Workers goroutines under
+// opts.Limits, and the first evaluation error is returned.
+func SampleWithOptions(program *roll.Program, opts SampleOptions) (*SampleReport, error) {
+	opts = opts.normalized()
+	seed := rand.Uint64()
+	if opts.Seed != nil {
+		seed = *opts.Seed
+	}
+
+	totals := make(map[int]int)
+	successes := make(map[int]int)
+	report := &SampleReport{Confidence: opts.Confidence}
+	for batch := uint64(0); report.Rolls < opts.Samples; batch++ {
+		// Each batch has its own seed, giving every roll its own stream.
+		batchSeed := seed + batch
+		results, err := program.Repeat(min(opts.BatchSize, opts.Samples-report.Rolls), roll.RepeatOptions{
+			EvalOptions: roll.EvalOptions{Limits: opts.Limits},
+			Workers:     opts.Workers,
+			Seed:        &batchSeed,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			totals[result.Total]++
+			successes[result.Successes]++
+		}
+		report.Rolls += len(results)
+
+		report.Mean, report.StdDev = moments(totals, report.Rolls)
+		if opts.Tolerance > 0 && report.Rolls > 1 {
+			interval := report.MeanInterval()
+			if (interval.Hi-interval.Lo)/2 <= opts.Tolerance {
+				report.Converged = true
+				break
+			}
+		}
+	}
+
+	report.Total = frequencies(totals, report.Rolls)
+	report.Successes = frequencies(successes, report.Rolls)
+	report.Histogram = make([]Bin, 0, len(totals))
+	for value, count := range totals {
+		report.Histogram = append(report.Histogram, Bin{Value: value, Count: count})
+	}
+	sort.Slice(report.Histogram, func(i, j int) bool { return report.Histogram[i].Value < report.Histogram[j].Value })
+	return report, nil
+}
+
+// MeanInterval returns the confidence interval of the mean total.
+func (r *SampleReport) MeanInterval() Interval {
+	if r.Rolls == 0 {
+		return Interval{}
+	}
+	margin := zScore(r.Confidence) * r.StdDev / math.Sqrt(float64(r.Rolls))
+	return Interval{Lo: r.Mean - margin, Hi: r.Mean + margin}
+}
+
+// AtLeastInterval returns the Wilson score confidence interval of the
+// probability of a total greater than or equal to n.
+func (r *SampleReport) AtLeastInterval(n int) Interval {
+	if r.Rolls == 0 {
+		return Interval{}
+	}
+	p := r.Total.AtLeast(n)
+	z := zScore(r.Confidence)
+	rolls := float64(r.Rolls)
+	denominator := 1 + z*z/rolls
+	centre := (p + z*z/(2*rolls)) / denominator
+	margin := z / denominator * math.Sqrt(p*(1-p)/rolls+z*z/(4*rolls*rolls))
+	return Interval{Lo: max(0, centre-margin), Hi: min(1, centre+margin)}
+}
+
+// zScore returns the number of standard deviations either side of the mean
+// of a normal distribution covering the given confidence.
+func zScore(confidence float64) float64 {
+	return math.Sqrt2 * math.Erfinv(confidence)
+}
+
+// moments returns the mean and sample standard deviation of the counted
+// values. The values are summed in order so the same counts always give the
+// same result.
+func moments(counts map[int]int, n int) (mean, stdDev float64) {
+	values := make([]int, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Ints(values)
+
+	for _, value := range values {
+		mean += float64(value) * float64(counts[value])
+	}
+	mean /= float64(n)
+	if n < 2 {
+		return mean, 0
+	}
+	var squares float64
+	for _, value := range values {
+		delta := float64(value) - mean
+		squares += delta * delta * float64(counts[value])
+	}
+	return mean, math.Sqrt(squares / float64(n-1))
+}
+
+// frequencies returns the distribution of the counted values.
+func frequencies(counts map[int]int, n int) Distribution {
+	probs := make(map[int]float64, len(counts))
+	for value, count := range counts {
+		probs[value] = float64(count) / float64(n)
+	}
+	return NewDistribution(probs)
+}
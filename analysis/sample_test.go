@@ -0,0 +1,100 @@
+package analysis
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/darkliquid/roll"
+)
+
+func sample(t *testing.T, input string, opts SampleOptions) *SampleReport {
+	t.Helper()
+	program, err := roll.CompileString(input)
+	if err != nil {
+		t.Fatalf("compile %q: %v", input, err)
+	}
+	report, err := SampleWithOptions(program, opts)
+	if err != nil {
+		t.Fatalf("sample %q: %v", input, err)
+	}
+	return report
+}
+
+func TestSample_MatchesAnalysis(t *testing.T) {
+	seed := uint64(7)
+	for _, input := range []string{"3d6", "4d6kh3+2", "2d20kl1", "5d10>7", "{1d8, 1d10}kh1"} {
+		t.Run(input, func(t *testing.T) {
+			exact := analyze(t, input)
+			report := sample(t, input, SampleOptions{Samples: 20000, Seed: &seed})
+
+			if report.Rolls != 20000 || report.Converged {
+				t.Fatalf("expected all 20000 rolls, got %d (converged %v)", report.Rolls, report.Converged)
+			}
+			interval := report.MeanInterval()
+			if mean := exact.Total.Mean(); mean < interval.Lo || mean > interval.Hi {
+				t.Errorf("mean %v outside interval %+v", mean, interval)
+			}
+			if !approxEqual(report.StdDev, exact.Total.StdDev(), 0.1) {
+				t.Errorf("standard deviation mismatch: exp=%v got=%v", exact.Total.StdDev(), report.StdDev)
+			}
+			median := exact.Total.Percentile(0.5)
+			if got := report.Total.Percentile(0.5); got < median-1 || got > median+1 {
+				t.Errorf("median mismatch: exp=%d got=%d", median, got)
+			}
+			p := exact.Total.AtLeast(median)
+			if interval := report.AtLeastInterval(median); p < interval.Lo || p > interval.Hi {
+				t.Errorf("probability %v outside interval %+v", p, interval)
+			}
+
+			rolls := 0
+			for i, bin := range report.Histogram {
+				rolls += bin.Count
+				if i > 0 && bin.Value <= report.Histogram[i-1].Value {
+					t.Fatalf("histogram out of order: %v", report.Histogram)
+				}
+			}
+			if rolls != report.Rolls {
+				t.Fatalf("histogram counts %d rolls, expected %d", rolls, report.Rolls)
+			}
+		})
+	}
+}
+
+func TestSample_Reproducible(t *testing.T) {
+	seed := uint64(3)
+	a := sample(t, "10d10!>8", SampleOptions{Samples: 5000, BatchSize: 700, Workers: 1, Seed: &seed})
+	b := sample(t, "10d10!>8", SampleOptions{Samples: 5000, BatchSize: 700, Workers: 8, Seed: &seed})
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("samples with the same seed differ")
+	}
+}
+
+func TestSample_Convergence(t *testing.T) {
+	seed := uint64(11)
+	report := sample(t, "100d100!>2", SampleOptions{
+		Limits:    roll.Limits{Explosions: roll.TruncateExplosions, MaxRollsTotal: 1000},
+		Samples:   100000,
+		BatchSize: 100,
+		Seed:      &seed,
+		Tolerance: 50,
+	})
+	if !report.Converged || report.Rolls >= 100000 {
+		t.Fatalf("expected early convergence, got %d rolls", report.Rolls)
+	}
+	if interval := report.MeanInterval(); (interval.Hi-interval.Lo)/2 > 50 {
+		t.Fatalf("interval %+v wider than tolerance", interval)
+	}
+}
+
+func TestSample_Limits(t *testing.T) {
+	program, err := roll.CompileString("100d6!>1")
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	_, err = SampleWithOptions(program, SampleOptions{Limits: roll.Limits{MaxRollsTotal: 100}, Samples: 10})
+	var limitErr roll.ErrLimitExceeded
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected limit error, got %v", err)
+	}
+}
@@ -1,10 +1,13 @@
 package roll
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Opcode identifies a bytecode instruction executed by the roll VM.
@@ -15,6 +18,67 @@ const (
 	OpRollDice Opcode = iota
 	// OpRollGroup aggregates previously computed child results into a grouped result.
 	OpRollGroup
+	// OpConst pushes the constant held in the instruction argument.
+	OpConst
+	// OpAdd pops two values and pushes their sum.
+	OpAdd
+	// OpSub pops two values and pushes the first minus the second.
+	OpSub
+	// OpMul pops two values and pushes their product.
+	OpMul
+	// OpDiv pops two values and pushes the first divided by the second,
+	// rounded to the nearest integer with halves rounded up.
+	OpDiv
+	// OpNeg pops a value and pushes its negation.
+	OpNeg
+	// OpLabel attributes the whole of the value on top of the stack to the
+	// label Program.Labels[Arg]. It is used for labelled constants; dice and
+	// group terms carry their own label.
+	OpLabel
+	// OpRollDiceCount pops the number of dice to roll and rolls that many of
+	// the dice term DiceTerms[Arg], whose Multiplier only carries the sign.
+	OpRollDiceCount
+	// OpRollDiceSides pops the number of sides and rolls the dice term
+	// DiceTerms[Arg] with a normal die of that size.
+	OpRollDiceSides
+	// OpRollDiceCountSides pops the number of sides, then the number of dice,
+	// and rolls the dice term DiceTerms[Arg] with both.
+	OpRollDiceCountSides
+	// OpCompare pops two values and compares them as the CompareKind held in
+	// Arg. It only appears as the last instruction of a program, or just
+	// before a closing OpRepeat.
+	OpCompare
+	// OpRepeat pops the result of one repetition of the repeat term
+	// RepeatTerms[Arg] and jumps back to the start of the program until every
+	// repetition has been rolled, then pushes their list. It only appears as
+	// the last instruction of a program.
+	OpRepeat
+	// OpMax pops the values gathered by the aggregate term
+	// AggregateTerms[Arg] and pushes the highest of their totals.
+	OpMax
+	// OpMin pops the values of the aggregate term AggregateTerms[Arg] and
+	// pushes the lowest of their totals.
+	OpMin
+	// OpSum pops the values of the aggregate term AggregateTerms[Arg] and
+	// pushes the sum of their totals and successes.
+	OpSum
+	// OpAvg pops the values of the aggregate term AggregateTerms[Arg] and
+	// pushes the mean of their totals, rounded as OpDiv rounds.
+	OpAvg
+	// OpCount pops the values of the aggregate term AggregateTerms[Arg] and
+	// pushes the number of totals that pass the term's Count check.
+	OpCount
+	// OpFloor pops a value and pushes it rounded down. Only the quotient of
+	// an OpDiv or OpAvg directly before it can be fractional; other values
+	// pass through unchanged.
+	OpFloor
+	// OpCeil pops a value and pushes it rounded up, as OpFloor rounds down.
+	OpCeil
+	// OpRound pops a value and pushes it rounded to the nearest integer, with
+	// halves rounded away from zero, as OpFloor rounds down.
+	OpRound
+	// OpAbs pops a value and pushes its absolute value.
+	OpAbs
 )
 
 func (op Opcode) String() string {
@@ -23,11 +87,85 @@ func (op Opcode) String() string {
 		return "roll_dice"
 	case OpRollGroup:
 		return "roll_group"
+	case OpConst:
+		return "const"
+	case OpAdd:
+		return "add"
+	case OpSub:
+		return "sub"
+	case OpMul:
+		return "mul"
+	case OpDiv:
+		return "div"
+	case OpNeg:
+		return "neg"
+	case OpLabel:
+		return "label"
+	case OpRollDiceCount:
+		return "roll_dice_count"
+	case OpRollDiceSides:
+		return "roll_dice_sides"
+	case OpRollDiceCountSides:
+		return "roll_dice_count_sides"
+	case OpCompare:
+		return "compare"
+	case OpRepeat:
+		return "repeat"
+	case OpMax:
+		return "max"
+	case OpMin:
+		return "min"
+	case OpSum:
+		return "sum"
+	case OpAvg:
+		return "avg"
+	case OpCount:
+		return "count"
+	case OpFloor:
+		return "floor"
+	case OpCeil:
+		return "ceil"
+	case OpRound:
+		return "round"
+	case OpAbs:
+		return "abs"
 	default:
 		return "unknown"
 	}
 }
 
+// operands returns the number of values a computed dice opcode pops.
+func (op Opcode) operands() int {
+	switch op {
+	case OpRollDiceCount, OpRollDiceSides:
+		return 1
+	case OpRollDiceCountSides:
+		return 2
+	}
+	return 0
+}
+
+// aggregates reports whether the opcode is an aggregate function, whose Arg
+// indexes Program.AggregateTerms.
+func (op Opcode) aggregates() bool {
+	return op >= OpMax && op <= OpCount
+}
+
+// symbol returns the infix notation used to render arithmetic opcodes.
+func (op Opcode) symbol() string {
+	switch op {
+	case OpAdd:
+		return "+"
+	case OpSub, OpNeg:
+		return "-"
+	case OpMul:
+		return "*"
+	case OpDiv:
+		return "/"
+	}
+	return ""
+}
+
 // Instruction is a single bytecode operation.
 type Instruction struct {
 	Op  Opcode
@@ -39,8 +177,26 @@ type Program struct {
 	Code       []Instruction
 	DiceTerms  []DiceTerm
 	GroupTerms []GroupTerm
-	Rendered   string
-	MaxDepth   int
+	// RepeatTerms holds the repetitions referenced by OpRepeat instructions.
+	RepeatTerms []RepeatTerm
+	// AggregateTerms holds the values gathered by aggregate functions such
+	// as OpMax.
+	AggregateTerms []AggregateTerm
+	// Labels holds the labels referenced by OpLabel instructions.
+	Labels   []string
+	Rendered string
+	MaxDepth int
+}
+
+// labelIndex returns the index of label in p.Labels, adding it if needed.
+func (p *Program) labelIndex(label string) int {
+	for i, l := range p.Labels {
+		if l == label {
+			return i
+		}
+	}
+	p.Labels = append(p.Labels, label)
+	return len(p.Labels) - 1
 }
 
 // String returns the normalized notation generated by the compiler.
@@ -51,7 +207,30 @@ func (p *Program) String() string {
 	return p.Rendered
 }
 
+// TermKind identifies the table a TermRef points into.
+type TermKind uint8
+
+const (
+	// TermNone marks values that did not come from a dice or group term,
+	// such as constants and arithmetic.
+	TermNone TermKind = iota
+	// TermDice refers to an entry in Program.DiceTerms.
+	TermDice
+	// TermGroup refers to an entry in Program.GroupTerms.
+	TermGroup
+)
+
+// TermRef identifies the term of a program that produced a roll.
+type TermRef struct {
+	Kind  TermKind
+	Index int
+}
+
 // DiceTerm captures the semantics of a single dice instruction.
+//
+// The count and die of a term such as (1d4)d6 or 2d(1d4*2) are computed when
+// it is rolled. Its Multiplier then holds only the sign of the count, and its
+// Die is NormalDie(0) when the die size is computed.
 type DiceTerm struct {
 	Multiplier int
 	Die        Die
@@ -60,19 +239,38 @@ type DiceTerm struct {
 	Limit      *LimitOp
 	Success    *ComparisonOp
 	Failure    *ComparisonOp
-	Rerolls    []RerollOp
-	Sort       SortType
+	// CritSuccess and CritFailure flag dice as critical successes and
+	// failures, as in cs>19 and cf<2, without changing the total. When unset
+	// they default to the highest and lowest faces of the die.
+	CritSuccess *ComparisonOp
+	CritFailure *ComparisonOp
+	Rerolls     []RerollOp
+	Sort        SortType
+	// Match finds sets of dice showing the same value, as in 6d6mt.
+	Match *MatchOp
+	// Label is the annotation written after the term, as in 8d6[fire].
+	Label string
+	// Notation is the normalized notation the term was compiled from.
+	Notation string
 }
 
 // GroupTerm captures the aggregation semantics of a grouped instruction.
 type GroupTerm struct {
-	Modifier   int
-	Limit      *LimitOp
-	Success    *ComparisonOp
-	Failure    *ComparisonOp
-	Combined   bool
-	Negative   bool
-	ChildCount int
+	Modifier int
+	Limit    *LimitOp
+	Success  *ComparisonOp
+	Failure  *ComparisonOp
+	// CritSuccess and CritFailure flag the values of the group as critical
+	// successes and failures. Unlike dice terms, groups have no defaults.
+	CritSuccess *ComparisonOp
+	CritFailure *ComparisonOp
+	Combined    bool
+	Negative    bool
+	ChildCount  int
+	// Label is the annotation written after the group, as in {2d6,1d8}kh1[best].
+	Label string
+	// Notation is the normalized notation the group was compiled from.
+	Notation string
 }
 
 // ComparisonType is the type of comparison.
@@ -148,6 +346,9 @@ const (
 type ExplodingOp struct {
 	*ComparisonOp
 	Type ExplodingType
+	// MaxExplosions caps the number of times a single die may explode, as in
+	// !o for once or !o3 for up to three times. Zero means no cap.
+	MaxExplosions int
 }
 
 // String returns the string representation of the exploding dice operation.
@@ -161,7 +362,21 @@ func (e ExplodingOp) String() (output string) {
 		output = "!p"
 	}
 
-	return output + strings.TrimPrefix(e.ComparisonOp.String(), "=")
+	if e.MaxExplosions <= 0 {
+		return output + strings.TrimPrefix(e.ComparisonOp.String(), "=")
+	}
+	output += "o"
+	if e.MaxExplosions > 1 {
+		output += strconv.Itoa(e.MaxExplosions)
+	}
+	// The comparison keeps its = so its value is not read as the cap.
+	return output + e.ComparisonOp.String()
+}
+
+// explodes reports whether a die showing face explodes again after already
+// exploding n times.
+func (e ExplodingOp) explodes(face, n int) bool {
+	return e.Match(face) && (e.MaxExplosions <= 0 || n < e.MaxExplosions)
 }
 
 // LimitType is the type of roll limitation.
@@ -219,6 +434,41 @@ func (e RerollOp) String() (output string) {
 	return output + strings.TrimPrefix(e.ComparisonOp.String(), "=")
 }
 
+// MatchOp is the operation that finds sets of dice showing the same value,
+// as Roll20 does for 6d6m and 6d6mt.
+type MatchOp struct {
+	// Count makes the total of the term the number of sets found.
+	Count bool
+	// MinSize is the fewest dice showing a value that make up a set.
+	MinSize int
+	// Compare, when set, restricts matching to the values it accepts, as in
+	// 6d6m>3.
+	Compare *ComparisonOp
+}
+
+// String returns the string representation of the match operation.
+func (op MatchOp) String() string {
+	output := "m"
+	if op.Count {
+		output += "t"
+	}
+	if op.MinSize > 2 {
+		output += strconv.Itoa(op.MinSize)
+	}
+	if op.Compare != nil {
+		output += op.Compare.String()
+	}
+	return output
+}
+
+// MatchSet is a set of dice found by a match operation.
+type MatchSet struct {
+	// Value is the face shown by every die in the set.
+	Value int
+	// Count is the number of dice in the set.
+	Count int
+}
+
 // SortType is the type of sorting to use for dice roll results.
 type SortType int
 
@@ -245,12 +495,37 @@ const (
 	Descending
 )
 
+// ExplosionPolicy decides what happens when exploding dice run into the roll
+// limits.
+type ExplosionPolicy int
+
+const (
+	// FailExplosions fails the roll with ErrLimitExceeded.
+	FailExplosions ExplosionPolicy = iota
+	// TruncateExplosions stops exploding and sets Result.Truncated.
+	TruncateExplosions
+)
+
 // Limits configures compiler and evaluator safety limits.
 type Limits struct {
 	MaxDieSize     int
 	MaxRollsPerDie int
 	MaxRollsTotal  int
 	MaxEvalDepth   int
+	// Explosions is the policy applied when exploding dice would exceed
+	// MaxRollsPerDie or MaxRollsTotal.
+	Explosions ExplosionPolicy
+	// MaxDuration bounds the time spent evaluating, failing the roll with an
+	// *InterruptedError once it has passed. Zero means no bound.
+	MaxDuration time.Duration
+	// MaxExpectedRolls rejects programs at compile time whose estimated
+	// Cost is more than this many die rolls. Zero uses MaxRollsTotal, or
+	// means no check when Explosions truncates. A negative value disables
+	// every compile time cost check.
+	MaxExpectedRolls int
+	// MaxRepeats bounds the number of times a roll may be repeated, as in
+	// 6 x 4d6kh3.
+	MaxRepeats int
 }
 
 // DefaultLimits are the package-level defaults used by Parse and ParseString.
@@ -259,6 +534,7 @@ var DefaultLimits = Limits{
 	MaxRollsPerDie: 1000000,
 	MaxRollsTotal:  1000000,
 	MaxEvalDepth:   256,
+	MaxRepeats:     1000,
 }
 
 func (l Limits) normalized() Limits {
@@ -274,6 +550,12 @@ func (l Limits) normalized() Limits {
 	if l.MaxEvalDepth <= 0 {
 		l.MaxEvalDepth = DefaultLimits.MaxEvalDepth
 	}
+	if l.MaxRepeats <= 0 {
+		l.MaxRepeats = DefaultLimits.MaxRepeats
+	}
+	if l.MaxExpectedRolls == 0 && l.Explosions == FailExplosions {
+		l.MaxExpectedRolls = l.MaxRollsTotal
+	}
 	return l
 }
 
@@ -284,34 +566,241 @@ func (e ErrUnsafeDie) Error() string {
 	return fmt.Sprintf("unsafe die type %q", string(e))
 }
 
+// ErrNegativeDiceCount is raised when the computed number of dice to roll is
+// negative, as in (1d4-5)d6.
+type ErrNegativeDiceCount int
+
+func (e ErrNegativeDiceCount) Error() string {
+	return fmt.Sprintf("cannot roll %d dice", int(e))
+}
+
 // ErrLimitExceeded is raised when compiler or evaluator safety limits are exceeded.
 type ErrLimitExceeded string
 
 func (e ErrLimitExceeded) Error() string { return string(e) }
 
+// ErrDivisionByZero is raised when an expression divides by zero.
+var ErrDivisionByZero = errors.New("division by zero")
+
+// InterruptedError is raised when an evaluation is stopped part way through,
+// either because its context is done or because it ran past
+// Limits.MaxDuration. It wraps context.Canceled or context.DeadlineExceeded.
+type InterruptedError struct {
+	Err error
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("roll interrupted: %v", e.Err)
+}
+
+// Unwrap returns the context error that stopped the evaluation.
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// EvalOptions configures a single evaluation of a compiled program.
+type EvalOptions struct {
+	// Limits are the safety limits enforced while rolling.
+	Limits Limits
+	// Source supplies the random numbers for every die rolled. When nil the
+	// automatically seeded math/rand/v2 generator is used.
+	Source Source
+	// Queries answers ?{...} queries when a roll is compiled and evaluated in
+	// one step, as by ParseWithOptions and ParseInlineWithOptions. Programs
+	// that are already compiled have had their queries answered.
+	Queries QueryResolver
+	// Attributes supplies @{...} attribute references when a roll is
+	// compiled and evaluated in one step, like Queries.
+	Attributes AttributeProvider
+	// Dice are the custom dice that can be rolled by name when a roll is
+	// compiled and evaluated in one step, like Queries.
+	Dice map[string]CustomDie
+	// Cancellations are the rules applied, in order, to the narrative
+	// symbols rolled. See NarrativeCancellations.
+	Cancellations []Cancellation
+	// Ties decides the winner of opposed rolls that tie.
+	Ties TiePolicy
+}
+
 type rollContext struct {
-	limits     Limits
-	totalRolls int
+	limits        Limits
+	source        Source
+	cancellations []Cancellation
+	ties          TiePolicy
+	totalRolls    int
+	// interrupt stops the evaluation when it is done, as does passing the
+	// deadline set by Limits.MaxDuration, if any.
+	interrupt context.Context
+	deadline  time.Time
+	// stack is the VM stack, kept between evaluations to be reused.
+	stack []vmValue
+}
+
+// interrupted returns an *InterruptedError once the evaluation should stop.
+func (ctx *rollContext) interrupted() error {
+	if err := ctx.interrupt.Err(); err != nil {
+		return &InterruptedError{Err: err}
+	}
+	if !ctx.deadline.IsZero() && time.Now().After(ctx.deadline) {
+		return &InterruptedError{Err: context.DeadlineExceeded}
+	}
+	return nil
+}
+
+// roll rolls a die using the context's random source.
+func (ctx *rollContext) roll(die Die) DieRoll {
+	return die.Roll(ctx.source)
 }
 
 func (ctx *rollContext) recordRoll(perDie *int) error {
-	(*perDie)++
-	if *perDie > ctx.limits.MaxRollsPerDie {
+	if err := ctx.interrupted(); err != nil {
+		return err
+	}
+	if *perDie >= ctx.limits.MaxRollsPerDie {
 		return ErrLimitExceeded(fmt.Sprintf("die term exceeded maximum roll count of %d", ctx.limits.MaxRollsPerDie))
 	}
-
-	ctx.totalRolls++
-	if ctx.totalRolls > ctx.limits.MaxRollsTotal {
+	if ctx.totalRolls >= ctx.limits.MaxRollsTotal {
 		return ErrLimitExceeded(fmt.Sprintf("roll exceeded maximum total roll count of %d", ctx.limits.MaxRollsTotal))
 	}
+
+	(*perDie)++
+	ctx.totalRolls++
 	return nil
 }
 
+// truncates reports whether an explosion that failed with err should be cut
+// short rather than fail the roll.
+func (ctx *rollContext) truncates(err error) bool {
+	var limitErr ErrLimitExceeded
+	return err != nil && ctx.limits.Explosions == TruncateExplosions && errors.As(err, &limitErr)
+}
+
 // Result is a collection of die rolls and a count of successes.
+//
+// Results holds the values that count towards Total, while Rolls holds every
+// physical die that was rolled, including dropped dice, in the order they
+// were rolled.
 type Result struct {
 	Results   []DieRoll
+	Rolls     []DieRoll
 	Total     int
 	Successes int
+	// CritSuccesses and CritFailures count the kept dice, or group values,
+	// flagged as critical successes and failures.
+	CritSuccesses int
+	CritFailures  int
+	// Tree breaks the result down by the dice and group terms that produced
+	// it. It is only set on the result returned by program evaluation.
+	Tree *ResultNode
+	// Labels subtotals the parts of Total contributed by labelled terms, in
+	// the order each label first appears.
+	Labels []LabelTotal
+	// Symbols is the net pool of narrative symbols on the dice that were
+	// kept, after the evaluation's cancellation rules have been applied. It
+	// is nil when no die carried symbols.
+	Symbols map[string]int
+	// Matches lists the sets of matching dice found by match operations, in
+	// the order their terms were rolled.
+	Matches []MatchSet
+	// Truncated is set when exploding dice were cut short by the roll limits
+	// under the TruncateExplosions policy.
+	Truncated bool
+	// Comparison is the outcome of a roll comparing two expressions, as in
+	// 1d20+5 vs 1d20+3 or 2d6 >= 8. It is nil for other rolls.
+	Comparison *Comparison
+	// Repeats lists the independent results of a repeated roll, as in
+	// 6 x 4d6kh3, in the order rolled unless the roll sorts them. It is nil
+	// for other rolls.
+	Repeats []Result
+
+	// sources maps each entry of Results to the indexes of the Rolls it was
+	// built from.
+	sources [][]int
+}
+
+// LabelTotal is the part of a result's total contributed by the terms
+// sharing a label.
+//
+// Labelled values keep their share through addition, subtraction and
+// negation. Multiplying scales the labels of one operand by the total of the
+// other, preferring the left operand when both are labelled, and dividing
+// scales the labels of the dividend. A group with a label counts wholly
+// towards it; an unlabelled group passes on the labels of its children only
+// when it neither limits nor checks their values.
+type LabelTotal struct {
+	Label string
+	Total int
+}
+
+// Label returns the subtotal for label and whether any term carried it.
+func (r *Result) Label(label string) (int, bool) {
+	for _, l := range r.Labels {
+		if l.Label == label {
+			return l.Total, true
+		}
+	}
+	return 0, false
+}
+
+// mergeLabels adds the subtotals in src, each passed through scale, to dst.
+// New labels are appended so the order of first appearance is kept.
+func mergeLabels(dst, src []LabelTotal, scale func(int) int) []LabelTotal {
+Merge:
+	for _, l := range src {
+		total := scale(l.Total)
+		for i := range dst {
+			if dst[i].Label == l.Label {
+				dst[i].Total += total
+				continue Merge
+			}
+		}
+		dst = append(dst, LabelTotal{Label: l.Label, Total: total})
+	}
+	return dst
+}
+
+func keepLabel(v int) int   { return v }
+func negateLabel(v int) int { return -v }
+
+// arithmeticLabels works out the label subtotals of an arithmetic result.
+func arithmeticLabels(op Opcode, left, right vmValue) []LabelTotal {
+	switch op {
+	case OpAdd:
+		return mergeLabels(mergeLabels(nil, left.labels, keepLabel), right.labels, keepLabel)
+	case OpSub:
+		return mergeLabels(mergeLabels(nil, left.labels, keepLabel), right.labels, negateLabel)
+	case OpMul:
+		if len(left.labels) == 0 {
+			return mergeLabels(nil, right.labels, func(v int) int { return v * left.Result.Total })
+		}
+		return mergeLabels(nil, left.labels, func(v int) int { return v * right.Result.Total })
+	case OpDiv:
+		return mergeLabels(nil, left.labels, func(v int) int {
+			quotient, _ := divideRounded(v, right.Result.Total)
+			return quotient
+		})
+	}
+	return nil
+}
+
+// groupLabels works out the label subtotals of an evaluated group.
+func groupLabels(term GroupTerm, result Result, children []vmValue) []LabelTotal {
+	if term.Label != "" {
+		return []LabelTotal{{Label: term.Label, Total: result.Total}}
+	}
+	if term.Limit != nil || term.Success != nil || term.Failure != nil {
+		return nil
+	}
+
+	scale := keepLabel
+	if term.Negative {
+		scale = negateLabel
+	}
+	var labels []LabelTotal
+	for _, child := range children {
+		labels = mergeLabels(labels, child.labels, scale)
+	}
+	return labels
 }
 
 // Len is the number of results.
@@ -327,11 +816,88 @@ func (r *Result) Less(i, j int) bool {
 // Swap swaps the DieRoll at index i with the one at index j.
 func (r *Result) Swap(i, j int) {
 	r.Results[i], r.Results[j] = r.Results[j], r.Results[i]
+	if len(r.sources) == len(r.Results) {
+		r.sources[i], r.sources[j] = r.sources[j], r.sources[i]
+	}
+}
+
+// rollRange returns the indexes of every roll in the result, offset by base.
+func (r *Result) rollRange(base int) []int {
+	indexes := make([]int, len(r.Rolls))
+	for i := range indexes {
+		indexes[i] = base + i
+	}
+	return indexes
+}
+
+// markRolls applies fn to every roll the entry at index i was built from.
+func (r *Result) markRolls(i int, fn func(*DieRoll)) {
+	if i >= len(r.sources) {
+		return
+	}
+	for _, idx := range r.sources[i] {
+		fn(&r.Rolls[idx])
+	}
+}
+
+// ResultNode is a dice or group term of an evaluated program with the
+// subresult it produced. Constants and arithmetic have no node of their own;
+// the terms inside them become children of the enclosing node.
+type ResultNode struct {
+	Term          TermRef
+	Notation      string
+	Label         string
+	Modifier      int
+	Total         int
+	Successes     int
+	CritSuccesses int
+	CritFailures  int
+	// Results and Rolls are as seen by this term, before any enclosing group
+	// applied its own limits and checks.
+	Results  []DieRoll
+	Rolls    []DieRoll
+	Matches  []MatchSet
+	Children []*ResultNode
+}
+
+func newResultNode(ref TermRef, notation, label string, modifier int, result Result, children []*ResultNode) *ResultNode {
+	return &ResultNode{
+		Term:          ref,
+		Notation:      notation,
+		Label:         label,
+		Modifier:      modifier,
+		Total:         result.Total,
+		Successes:     result.Successes,
+		CritSuccesses: result.CritSuccesses,
+		CritFailures:  result.CritFailures,
+		Results:       result.Results,
+		Rolls:         result.Rolls,
+		Matches:       result.Matches,
+		Children:      children,
+	}
 }
 
 type vmValue struct {
 	Result   Result
 	Modifier int
+	Computed bool
+	Term     TermRef
+	// nodes are the result tree nodes of the terms that make up the value.
+	nodes []*ResultNode
+	// labels are the label subtotals of the value.
+	labels []LabelTotal
+	// exact is the unrounded value of a division or average, kept for a
+	// rounding function directly after it.
+	exact *quotient
+}
+
+// childNodes gathers the result tree nodes of several values.
+func childNodes(values ...vmValue) []*ResultNode {
+	var nodes []*ResultNode
+	for _, v := range values {
+		nodes = append(nodes, v.nodes...)
+	}
+	return nodes
 }
 
 // EvaluateProgram executes a compiled roll program using DefaultLimits.
@@ -341,30 +907,92 @@ func EvaluateProgram(program *Program) (Result, error) {
 
 // EvaluateProgramWithLimits executes a compiled roll program using explicit safety limits.
 func EvaluateProgramWithLimits(program *Program, limits Limits) (Result, error) {
+	return EvaluateProgramWithOptions(program, EvalOptions{Limits: limits})
+}
+
+// EvaluateProgramWithOptions executes a compiled roll program using explicit
+// safety limits and random source.
+func EvaluateProgramWithOptions(program *Program, opts EvalOptions) (Result, error) {
+	return EvaluateProgramContext(context.Background(), program, opts)
+}
+
+// EvaluateProgramContext executes a compiled roll program like
+// EvaluateProgramWithOptions, checking ctx between instructions and before
+// every die is rolled. When ctx is done, or opts.Limits.MaxDuration passes,
+// evaluation stops with an *InterruptedError wrapping the context's error.
+func EvaluateProgramContext(ctx context.Context, program *Program, opts EvalOptions) (Result, error) {
+	return newRollContext(ctx, opts).evaluate(program)
+}
+
+// newRollContext prepares a context for one or more evaluations sharing the
+// same limits, roll counts and deadline.
+func newRollContext(interrupt context.Context, opts EvalOptions) *rollContext {
+	source := opts.Source
+	if source == nil {
+		source = defaultSource
+	}
+	ctx := &rollContext{limits: opts.Limits.normalized(), source: source, cancellations: opts.Cancellations, ties: opts.Ties, interrupt: interrupt}
+	if ctx.limits.MaxDuration > 0 {
+		ctx.deadline = time.Now().Add(ctx.limits.MaxDuration)
+	}
+	return ctx
+}
+
+// evaluate executes a program, counting its rolls against the context.
+func (ctx *rollContext) evaluate(program *Program) (Result, error) {
 	if program == nil {
 		return Result{}, nil
 	}
 
-	limits = limits.normalized()
-	if program.MaxDepth > limits.MaxEvalDepth {
-		return Result{}, ErrLimitExceeded(fmt.Sprintf("roll exceeded maximum evaluation depth of %d", limits.MaxEvalDepth))
+	if program.MaxDepth > ctx.limits.MaxEvalDepth {
+		return Result{}, ErrLimitExceeded(fmt.Sprintf("roll exceeded maximum evaluation depth of %d", ctx.limits.MaxEvalDepth))
 	}
 
-	ctx := &rollContext{limits: limits}
-	stack := make([]vmValue, 0, len(program.Code))
-
-	for _, instruction := range program.Code {
+	stack := ctx.stack[:0]
+	if cap(stack) < len(program.Code) {
+		stack = make([]vmValue, 0, len(program.Code))
+	}
+	defer func() {
+		clear(stack[:cap(stack)])
+		ctx.stack = stack[:0]
+	}()
+
+	// repeats holds the results of the repetitions rolled so far.
+	var repeats []Result
+	for pc := 0; pc < len(program.Code); pc++ {
+		instruction := program.Code[pc]
+		if err := ctx.interrupted(); err != nil {
+			return Result{}, err
+		}
 		switch instruction.Op {
 		case OpRollDice:
 			if instruction.Arg < 0 || instruction.Arg >= len(program.DiceTerms) {
 				return Result{}, fmt.Errorf("invalid dice term index %d", instruction.Arg)
 			}
-			term := program.DiceTerms[instruction.Arg]
-			result, err := evalDiceTerm(ctx, term)
+			value, err := ctx.rollDice(program.DiceTerms[instruction.Arg], instruction.Arg, nil)
 			if err != nil {
 				return Result{}, err
 			}
-			stack = append(stack, vmValue{Result: result, Modifier: term.Modifier})
+			stack = append(stack, value)
+		case OpRollDiceCount, OpRollDiceSides, OpRollDiceCountSides:
+			if instruction.Arg < 0 || instruction.Arg >= len(program.DiceTerms) {
+				return Result{}, fmt.Errorf("invalid dice term index %d", instruction.Arg)
+			}
+			n := instruction.Op.operands()
+			if len(stack) < n {
+				return Result{}, fmt.Errorf("%s requires %d operands, stack has %d", instruction.Op, n, len(stack))
+			}
+			operands := append([]vmValue(nil), stack[len(stack)-n:]...)
+			stack = stack[:len(stack)-n]
+			term, err := computeDiceTerm(instruction.Op, program.DiceTerms[instruction.Arg], operands)
+			if err != nil {
+				return Result{}, err
+			}
+			value, err := ctx.rollDice(term, instruction.Arg, operands)
+			if err != nil {
+				return Result{}, err
+			}
+			stack = append(stack, value)
 		case OpRollGroup:
 			if instruction.Arg < 0 || instruction.Arg >= len(program.GroupTerms) {
 				return Result{}, fmt.Errorf("invalid group term index %d", instruction.Arg)
@@ -375,8 +1003,112 @@ func EvaluateProgramWithLimits(program *Program, limits Limits) (Result, error)
 			}
 			children := append([]vmValue(nil), stack[len(stack)-term.ChildCount:]...)
 			stack = stack[:len(stack)-term.ChildCount]
-			result := evalGroupTerm(term, children)
-			stack = append(stack, vmValue{Result: result, Modifier: term.Modifier})
+			ref := TermRef{Kind: TermGroup, Index: instruction.Arg}
+			result := evalGroupTerm(term, ref, children)
+			node := newResultNode(ref, term.Notation, term.Label, term.Modifier, result, childNodes(children...))
+			labels := groupLabels(term, result, children)
+			stack = append(stack, vmValue{Result: result, Modifier: term.Modifier, Term: ref, nodes: []*ResultNode{node}, labels: labels})
+		case OpConst:
+			stack = append(stack, vmValue{Result: Result{Total: instruction.Arg}, Computed: true})
+		case OpNeg:
+			if len(stack) < 1 {
+				return Result{}, fmt.Errorf("%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			operand := stack[len(stack)-1].Result
+			operand.Total = -operand.Total
+			operand.Successes = -operand.Successes
+			labels := mergeLabels(nil, stack[len(stack)-1].labels, negateLabel)
+			stack[len(stack)-1] = vmValue{Result: operand, Computed: true, nodes: stack[len(stack)-1].nodes, labels: labels}
+		case OpLabel:
+			if len(stack) < 1 {
+				return Result{}, fmt.Errorf("%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			if instruction.Arg < 0 || instruction.Arg >= len(program.Labels) {
+				return Result{}, fmt.Errorf("invalid label index %d", instruction.Arg)
+			}
+			top := &stack[len(stack)-1]
+			top.labels = []LabelTotal{{Label: program.Labels[instruction.Arg], Total: top.Result.Total}}
+		case OpAdd, OpSub, OpMul, OpDiv:
+			if len(stack) < 2 {
+				return Result{}, fmt.Errorf("%s requires 2 operands, stack has %d", instruction.Op, len(stack))
+			}
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+			result, err := evalArithmetic(instruction.Op, left.Result, right.Result)
+			if err != nil {
+				return Result{}, err
+			}
+			value := vmValue{Result: result, Computed: true, nodes: childNodes(left, right), labels: arithmeticLabels(instruction.Op, left, right)}
+			if instruction.Op == OpDiv {
+				value.exact = newQuotient(left.Result.Total, right.Result.Total)
+			}
+			stack = append(stack, value)
+		case OpMax, OpMin, OpSum, OpAvg, OpCount:
+			if instruction.Arg < 0 || instruction.Arg >= len(program.AggregateTerms) {
+				return Result{}, fmt.Errorf("invalid aggregate term index %d", instruction.Arg)
+			}
+			term := program.AggregateTerms[instruction.Arg]
+			if term.ChildCount > len(stack) {
+				return Result{}, fmt.Errorf("aggregate term %d requires %d child values, stack has %d", instruction.Arg, term.ChildCount, len(stack))
+			}
+			children := append([]vmValue(nil), stack[len(stack)-term.ChildCount:]...)
+			stack = stack[:len(stack)-term.ChildCount]
+			result, exact, err := evalAggregate(instruction.Op, term, children)
+			if err != nil {
+				return Result{}, err
+			}
+			stack = append(stack, vmValue{Result: result, Computed: true, nodes: childNodes(children...), labels: aggregateLabels(instruction.Op, children), exact: exact})
+		case OpFloor, OpCeil, OpRound:
+			if len(stack) < 1 {
+				return Result{}, fmt.Errorf("%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			top := stack[len(stack)-1]
+			if top.exact != nil {
+				top.Result.Total = top.exact.round(instruction.Op)
+			}
+			stack[len(stack)-1] = vmValue{Result: top.Result, Computed: true, nodes: top.nodes, labels: top.labels}
+		case OpAbs:
+			if len(stack) < 1 {
+				return Result{}, fmt.Errorf("%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			stack[len(stack)-1] = evalAbs(stack[len(stack)-1])
+		case OpCompare:
+			if len(stack) < 2 {
+				return Result{}, fmt.Errorf("%s requires 2 operands, stack has %d", instruction.Op, len(stack))
+			}
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+			result, err := evalCompare(CompareKind(instruction.Arg), ctx.ties, ctx.cancellations, left, right)
+			if err != nil {
+				return Result{}, err
+			}
+			stack = append(stack, vmValue{Result: result, Computed: true, nodes: childNodes(left, right)})
+		case OpRepeat:
+			if instruction.Arg < 0 || instruction.Arg >= len(program.RepeatTerms) {
+				return Result{}, fmt.Errorf("invalid repeat term index %d", instruction.Arg)
+			}
+			if len(stack) != 1 {
+				return Result{}, fmt.Errorf("%s requires 1 operand, stack has %d", instruction.Op, len(stack))
+			}
+			term := program.RepeatTerms[instruction.Arg]
+			if term.Count < 1 {
+				return Result{}, ErrInvalidRepeat(term.Count)
+			}
+			if term.Count > ctx.limits.MaxRepeats {
+				return Result{}, ErrLimitExceeded(fmt.Sprintf("roll repeats %d times, more than the maximum of %d", term.Count, ctx.limits.MaxRepeats))
+			}
+			repeats = append(repeats, ctx.finish(term.Notation, stack[0]))
+			stack = stack[:0]
+			if len(repeats) < term.Count {
+				pc = -1
+				continue
+			}
+			result := evalRepeatTerm(term, repeats)
+			nodes := make([]*ResultNode, len(result.Repeats))
+			for i, repeat := range result.Repeats {
+				nodes[i] = repeat.Tree
+			}
+			stack = append(stack, vmValue{Result: result, Computed: true, nodes: nodes})
 		default:
 			return Result{}, fmt.Errorf("unsupported opcode %d", instruction.Op)
 		}
@@ -386,10 +1118,74 @@ func EvaluateProgramWithLimits(program *Program, limits Limits) (Result, error)
 		return Result{}, fmt.Errorf("program left %d results on the VM stack", len(stack))
 	}
 
-	return stack[0].Result, nil
+	return ctx.finish(program.Rendered, stack[0]), nil
 }
 
-func evalDiceTerm(ctx *rollContext, term DiceTerm) (result Result, err error) {
+// finish turns the value left by a program, or one repetition of it, into
+// its result, with the notation it was rolled from heading its tree.
+func (ctx *rollContext) finish(notation string, root vmValue) Result {
+	result := root.Result
+	result.Labels = root.labels
+	result.Symbols = tallySymbols(result.Rolls, ctx.cancellations)
+	if len(root.nodes) == 1 && !root.Computed {
+		result.Tree = root.nodes[0]
+	} else {
+		result.Tree = newResultNode(TermRef{}, notation, "", 0, result, root.nodes)
+	}
+	return result
+}
+
+// rollDice evaluates the dice term DiceTerms[index] into a VM value. Operands
+// are the values a computed count or die size was taken from; their rolls
+// are listed ahead of the term's own.
+func (ctx *rollContext) rollDice(term DiceTerm, index int, operands []vmValue) (vmValue, error) {
+	result, err := evalDiceTerm(ctx, term, index)
+	if err != nil {
+		return vmValue{}, err
+	}
+	if len(operands) > 0 {
+		var rolls []DieRoll
+		for _, operand := range operands {
+			rolls = append(rolls, operand.Result.Rolls...)
+			result.Truncated = result.Truncated || operand.Result.Truncated
+		}
+		result.sources = offsetSources(result, len(rolls))
+		result.Rolls = append(rolls, result.Rolls...)
+	}
+
+	ref := TermRef{Kind: TermDice, Index: index}
+	notation := term.Notation
+	if notation == "" {
+		notation = renderDiceTerm(term)
+	}
+	node := newResultNode(ref, notation, term.Label, term.Modifier, result, childNodes(operands...))
+	value := vmValue{Result: result, Modifier: term.Modifier, Term: ref, nodes: []*ResultNode{node}}
+	if term.Label != "" {
+		value.labels = []LabelTotal{{Label: term.Label, Total: result.Total}}
+	}
+	return value, nil
+}
+
+// computeDiceTerm returns the dice term rolled by a computed dice opcode,
+// with the count and die size taken from its operands. The notation is
+// cleared so results describe the dice actually rolled.
+func computeDiceTerm(op Opcode, term DiceTerm, operands []vmValue) (DiceTerm, error) {
+	term.Notation = ""
+	if op == OpRollDiceCount || op == OpRollDiceCountSides {
+		count := operands[0].Result.Total
+		if count < 0 {
+			return DiceTerm{}, ErrNegativeDiceCount(count)
+		}
+		term.Multiplier *= count
+		operands = operands[1:]
+	}
+	if op == OpRollDiceSides || op == OpRollDiceCountSides {
+		term.Die = NormalDie(operands[0].Result.Total)
+	}
+	return term, nil
+}
+
+func evalDiceTerm(ctx *rollContext, term DiceTerm, index int) (result Result, err error) {
 	if err = validateDieLimits(term.Die, ctx.limits); err != nil {
 		return
 	}
@@ -408,23 +1204,39 @@ func evalDiceTerm(ctx *rollContext, term DiceTerm) (result Result, err error) {
 		return Result{}, ErrLimitExceeded(fmt.Sprintf("die term exceeded maximum roll count of %d", ctx.limits.MaxRollsPerDie))
 	}
 
+	ref := TermRef{Kind: TermDice, Index: index}
 	dieRolls := 0
+	next := func() (DieRoll, error) {
+		if err := ctx.recordRoll(&dieRolls); err != nil {
+			return DieRoll{}, err
+		}
+		roll := ctx.roll(term.Die)
+		roll.History = []int{roll.Result}
+		roll.Term = ref
+		return roll, nil
+	}
+
+	rolls := make([]DieRoll, 0, rollCount)
 	for i := 0; i < rollCount; i++ {
-		if err = ctx.recordRoll(&dieRolls); err != nil {
+		roll, err := next()
+		if err != nil {
 			return Result{}, err
 		}
-		result.Results = append(result.Results, term.Die.Roll())
+		rolls = append(rolls, roll)
 	}
 
-	for i, roll := range result.Results {
+	for i := range rolls {
+		roll := &rolls[i]
 	RerollOnce:
 		for _, reroll := range term.Rerolls {
 			for reroll.Match(roll.Result) {
-				if err = ctx.recordRoll(&dieRolls); err != nil {
+				rerolled, err := next()
+				if err != nil {
 					return Result{}, err
 				}
-				roll = term.Die.Roll()
-				result.Results[i] = roll
+				roll.Result, roll.Symbol, roll.Symbols = rerolled.Result, rerolled.Symbol, rerolled.Symbols
+				roll.History = append(roll.History, rerolled.Result)
+				roll.Rerolled = true
 				if reroll.Once {
 					break RerollOnce
 				}
@@ -433,71 +1245,175 @@ func evalDiceTerm(ctx *rollContext, term DiceTerm) (result Result, err error) {
 	}
 
 	if term.Exploding != nil {
+	Explode:
 		switch term.Exploding.Type {
-		case Exploding:
-			for _, roll := range result.Results {
-				for term.Exploding.Match(roll.Result) {
-					if err = ctx.recordRoll(&dieRolls); err != nil {
+		case Exploding, Penetrating:
+			for i, n := 0, len(rolls); i < n; i++ {
+				for last, face, depth := i, rolls[i].Result, 0; term.Exploding.explodes(face, depth); last, depth = len(rolls)-1, depth+1 {
+					roll, err := next()
+					if ctx.truncates(err) {
+						result.Truncated = true
+						break Explode
+					}
+					if err != nil {
 						return Result{}, err
 					}
-					roll = term.Die.Roll()
-					result.Results = append(result.Results, roll)
+					rolls[last].Exploded = true
+					face = roll.Result
+					roll.FromExplosion = true
+					if term.Exploding.Type == Penetrating {
+						roll.Result--
+						roll.Symbol = strconv.Itoa(roll.Result)
+					}
+					rolls = append(rolls, roll)
 				}
 			}
 		case Compounded:
-			compound := 0
-			for _, roll := range result.Results {
-				for term.Exploding.Match(roll.Result) {
-					compound += roll.Result
-					if err = ctx.recordRoll(&dieRolls); err != nil {
-						return Result{}, err
+			for i := range rolls {
+				compound := &rolls[i]
+				for face, depth := compound.Result, 0; term.Exploding.explodes(face, depth); depth++ {
+					roll, err := next()
+					if ctx.truncates(err) {
+						result.Truncated = true
+						break Explode
 					}
-					roll = term.Die.Roll()
-				}
-			}
-			result.Results = append(result.Results, DieRoll{Result: compound, Symbol: strconv.Itoa(compound)})
-		case Penetrating:
-			for _, roll := range result.Results {
-				for term.Exploding.Match(roll.Result) {
-					if err = ctx.recordRoll(&dieRolls); err != nil {
+					if err != nil {
 						return Result{}, err
 					}
-					roll = term.Die.Roll()
-					newRoll := roll
-					newRoll.Result--
-					newRoll.Symbol = strconv.Itoa(newRoll.Result)
-					result.Results = append(result.Results, newRoll)
+					face = roll.Result
+					compound.Exploded = true
+					compound.Result += face
+					compound.Symbol = strconv.Itoa(compound.Result)
+					compound.Symbols = addSymbols(compound.Symbols, roll.Symbols)
+					compound.History = append(compound.History, face)
 				}
 			}
 		}
 	}
 
+	result.Rolls = rolls
+	result.Results = make([]DieRoll, len(rolls))
+	result.sources = make([][]int, len(rolls))
+	for i, roll := range rolls {
+		result.Results[i] = roll
+		result.sources[i] = []int{i}
+	}
+
 	applyLimit(term.Limit, &result)
 	applySuccess(term.Success, term.Modifier, &result)
 	applyFailure(term.Failure, term.Modifier, &result)
+	critSuccess, critFailure := critChecks(term)
+	applyCrits(critSuccess, critFailure, &result)
+	applyMatch(term.Match, &result)
 	applySort(term.Sort, &result)
 	finaliseTotals(term.Success, term.Failure, term.Modifier, totalMultiplier, &result)
+	if term.Match != nil && term.Match.Count {
+		result.Total = (len(result.Matches) + term.Modifier) * totalMultiplier
+	}
 
 	return result, nil
 }
 
-func evalGroupTerm(term GroupTerm, children []vmValue) (result Result) {
+// evalArithmetic combines two operand results. The individual dice of both
+// operands are kept so callers can still list what was rolled.
+func evalArithmetic(op Opcode, left, right Result) (result Result, err error) {
+	result.Results = make([]DieRoll, 0, len(left.Results)+len(right.Results))
+	result.Results = append(result.Results, left.Results...)
+	result.Results = append(result.Results, right.Results...)
+	result.Rolls = make([]DieRoll, 0, len(left.Rolls)+len(right.Rolls))
+	result.Rolls = append(result.Rolls, left.Rolls...)
+	result.Rolls = append(result.Rolls, right.Rolls...)
+	result.sources = append(offsetSources(left, 0), offsetSources(right, len(left.Rolls))...)
+	result.Successes = left.Successes + right.Successes
+	result.CritSuccesses = left.CritSuccesses + right.CritSuccesses
+	result.CritFailures = left.CritFailures + right.CritFailures
+	result.Truncated = left.Truncated || right.Truncated
+	result.Matches = append(append([]MatchSet(nil), left.Matches...), right.Matches...)
+
+	switch op {
+	case OpAdd:
+		result.Total = left.Total + right.Total
+	case OpSub:
+		result.Total = left.Total - right.Total
+		result.Successes = left.Successes - right.Successes
+	case OpMul:
+		result.Total = left.Total * right.Total
+	case OpDiv:
+		result.Total, err = divideRounded(left.Total, right.Total)
+	default:
+		err = fmt.Errorf("unsupported arithmetic opcode %d", op)
+	}
+
+	return result, err
+}
+
+// divideRounded divides a by b rounding to the nearest integer, with halves
+// rounded up towards positive infinity as Roll20 does.
+func divideRounded(a, b int) (int, error) {
+	if b == 0 {
+		return 0, ErrDivisionByZero
+	}
+	if b < 0 {
+		a, b = -a, -b
+	}
+
+	num, den := 2*a+b, 2*b
+	quotient := num / den
+	if num%den != 0 && num < 0 {
+		quotient--
+	}
+	return quotient, nil
+}
+
+// offsetSources returns the roll indexes of each entry in r, shifted by base
+// so they remain valid once r's rolls are appended after others.
+func offsetSources(r Result, base int) [][]int {
+	sources := make([][]int, len(r.Results))
+	for i := range r.Results {
+		if i >= len(r.sources) {
+			sources[i] = r.rollRange(base)
+			continue
+		}
+		sources[i] = make([]int, len(r.sources[i]))
+		for j, idx := range r.sources[i] {
+			sources[i][j] = base + idx
+		}
+	}
+	return sources
+}
+
+func evalGroupTerm(term GroupTerm, ref TermRef, children []vmValue) (result Result) {
 	for _, child := range children {
-		if term.Combined {
-			for _, res := range child.Result.Results {
-				result.Results = append(result.Results, DieRoll{
-					Result: res.Result + child.Modifier,
-					Symbol: strconv.Itoa(res.Result + child.Modifier),
-				})
+		base := len(result.Rolls)
+		result.Rolls = append(result.Rolls, child.Result.Rolls...)
+		result.Matches = append(result.Matches, child.Result.Matches...)
+		result.CritSuccesses += child.Result.CritSuccesses
+		result.CritFailures += child.Result.CritFailures
+		result.Truncated = result.Truncated || child.Result.Truncated
+
+		if term.Combined && !child.Computed {
+			sources := offsetSources(child.Result, base)
+			for i, res := range child.Result.Results {
+				res.Result += child.Modifier
+				res.Symbol = strconv.Itoa(res.Result)
+				result.Results = append(result.Results, res)
+				result.sources = append(result.sources, sources[i])
 			}
-		} else {
-			result.Results = append(result.Results, DieRoll{Result: child.Result.Total, Symbol: strconv.Itoa(child.Result.Total)})
+			continue
 		}
+
+		entry := DieRoll{Result: child.Result.Total, Symbol: strconv.Itoa(child.Result.Total), Term: child.Term}
+		if child.Computed {
+			entry.Term = ref
+		}
+		result.Results = append(result.Results, entry)
+		result.sources = append(result.sources, child.Result.rollRange(base))
 	}
 
 	applyLimit(term.Limit, &result)
 	applySuccess(term.Success, term.Modifier, &result)
 	applyFailure(term.Failure, term.Modifier, &result)
+	applyCrits(term.CritSuccess, term.CritFailure, &result)
 	finaliseTotals(term.Success, term.Failure, term.Modifier, 1, &result)
 
 	if term.Negative {
@@ -525,6 +1441,8 @@ func validateDieLimits(die Die, limits Limits) error {
 		size = 100
 	case FateDie:
 		size = 3
+	case CustomDie:
+		size = len(d.Faces)
 	default:
 		return fmt.Errorf("unsupported die type %T for limit validation", die)
 	}
@@ -540,9 +1458,9 @@ func validateDieLimits(die Die, limits Limits) error {
 
 func applyLimit(limitOp *LimitOp, result *Result) {
 	if limitOp != nil {
+		sort.Sort(result)
 		var rolls Result
-		rolls.Results = result.Results[:]
-		sort.Sort(&rolls)
+		rolls.Results = result.Results
 
 		limit := min(limitOp.Amount, len(rolls.Results))
 
@@ -563,25 +1481,40 @@ func applyLimit(limitOp *LimitOp, result *Result) {
 		}
 
 		newResults := make([]DieRoll, 0, len(rolls.Results))
-		for _, a := range result.Results {
-			if b, ok := m[a.Result]; ok {
-				newResults = append([]DieRoll{a}, newResults...)
-				b--
-				if b == 0 {
-					delete(m, a.Result)
-				}
+		var newSources [][]int
+		for i, a := range result.Results {
+			b, ok := m[a.Result]
+			if !ok {
+				result.markRolls(i, func(roll *DieRoll) { roll.Dropped = true })
+				continue
+			}
+
+			newResults = append([]DieRoll{a}, newResults...)
+			if i < len(result.sources) {
+				newSources = append([][]int{result.sources[i]}, newSources...)
+			}
+			b--
+			if b == 0 {
+				delete(m, a.Result)
+			} else {
+				m[a.Result] = b
 			}
 		}
 
 		result.Results = newResults
+		result.sources = newSources
 	}
 }
 
 func applySuccess(successOp *ComparisonOp, modifier int, result *Result) {
 	if successOp != nil {
-		for _, roll := range result.Results {
+		for i, roll := range result.Results {
 			if successOp.Match(roll.Result + modifier) {
 				result.Successes++
+				result.Results[i].Success = true
+				if i < len(result.sources) && len(result.sources[i]) == 1 {
+					result.markRolls(i, func(roll *DieRoll) { roll.Success = true })
+				}
 			}
 		}
 	}
@@ -589,14 +1522,99 @@ func applySuccess(successOp *ComparisonOp, modifier int, result *Result) {
 
 func applyFailure(failureOp *ComparisonOp, modifier int, result *Result) {
 	if failureOp != nil {
-		for _, roll := range result.Results {
+		for i, roll := range result.Results {
 			if failureOp.Match(roll.Result + modifier) {
 				result.Successes--
+				result.Results[i].Failure = true
+				if i < len(result.sources) && len(result.sources[i]) == 1 {
+					result.markRolls(i, func(roll *DieRoll) { roll.Failure = true })
+				}
 			}
 		}
 	}
 }
 
+// critChecks returns the critical success and failure conditions of a dice
+// term, defaulting to the highest and lowest faces of its die as Roll20 does.
+// Dice whose faces are all the same have no default.
+func critChecks(term DiceTerm) (success, failure *ComparisonOp) {
+	success, failure = term.CritSuccess, term.CritFailure
+	lo, hi, ok := faceRange(term.Die)
+	if !ok || lo == hi {
+		return success, failure
+	}
+	if success == nil {
+		success = &ComparisonOp{Type: Equals, Value: hi}
+	}
+	if failure == nil {
+		failure = &ComparisonOp{Type: Equals, Value: lo}
+	}
+	return success, failure
+}
+
+// applyCrits flags the values of result matching the critical success and
+// failure conditions and counts them. A condition that is set replaces the
+// count carried up from any children.
+func applyCrits(successOp, failureOp *ComparisonOp, result *Result) {
+	if successOp != nil {
+		result.CritSuccesses = 0
+		for i, roll := range result.Results {
+			hit := successOp.Match(roll.Result)
+			result.Results[i].CritSuccess = hit
+			if !hit {
+				continue
+			}
+			result.CritSuccesses++
+			if i < len(result.sources) && len(result.sources[i]) == 1 {
+				result.markRolls(i, func(roll *DieRoll) { roll.CritSuccess = true })
+			}
+		}
+	}
+	if failureOp != nil {
+		result.CritFailures = 0
+		for i, roll := range result.Results {
+			hit := failureOp.Match(roll.Result)
+			result.Results[i].CritFailure = hit
+			if !hit {
+				continue
+			}
+			result.CritFailures++
+			if i < len(result.sources) && len(result.sources[i]) == 1 {
+				result.markRolls(i, func(roll *DieRoll) { roll.CritFailure = true })
+			}
+		}
+	}
+}
+
+// applyMatch finds the sets of matching values among the dice kept, marking
+// the dice that belong to one.
+func applyMatch(matchOp *MatchOp, result *Result) {
+	if matchOp == nil {
+		return
+	}
+
+	counts := map[int]int{}
+	for _, roll := range result.Results {
+		if matchOp.Compare == nil || matchOp.Compare.Match(roll.Result) {
+			counts[roll.Result]++
+		}
+	}
+	minSize := max(matchOp.MinSize, 2)
+	for value, count := range counts {
+		if count >= minSize {
+			result.Matches = append(result.Matches, MatchSet{Value: value, Count: count})
+		}
+	}
+	sort.Slice(result.Matches, func(i, j int) bool { return result.Matches[i].Value < result.Matches[j].Value })
+
+	for i, roll := range result.Results {
+		if counts[roll.Result] >= minSize {
+			result.Results[i].Matched = true
+			result.markRolls(i, func(roll *DieRoll) { roll.Matched = true })
+		}
+	}
+}
+
 func applySort(sortType SortType, result *Result) {
 	switch sortType {
 	case Unsorted:
@@ -1,8 +1,12 @@
 package roll
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func compileProgram(t *testing.T, input string) *Program {
@@ -39,7 +43,7 @@ func TestEvaluateProgram_DiceTerms(t *testing.T) {
 	}{
 		{name: "fate modifier", seed: 0, input: "4dF+2", res: []int{-1, -1, 0, 0}, totl: 0},
 		{name: "exploding", seed: 2, input: "2d6!5", res: []int{5, 1, 1}, totl: 7},
-		{name: "compounded", seed: 2, input: "2d6!!5", res: []int{5, 1, 5}, totl: 11},
+		{name: "compounded", seed: 2, input: "2d6!!5", res: []int{6, 1}, totl: 7},
 		{name: "penetrating", seed: 2, input: "2d6!p5", res: []int{5, 1, 0}, totl: 6},
 		{name: "keep highest", seed: 2, input: "4d6kh3", res: []int{5, 3, 1}, totl: 9},
 		{name: "reroll once", seed: 2, input: "4d6ro<4", res: []int{5, 3, 3, 5}, totl: 16},
@@ -107,6 +111,55 @@ func TestEvaluateProgram_GroupTerms(t *testing.T) {
 	}
 }
 
+func TestEvaluateProgram_Arithmetic(t *testing.T) {
+	tests := []struct {
+		name  string
+		seed  int64
+		input string
+		res   []int
+		totl  int
+	}{
+		{name: "constant", input: "5", res: []int{}, totl: 5},
+		{name: "precedence", input: "2+3*4", res: []int{}, totl: 14},
+		{name: "parentheses", input: "(2+3)*4", res: []int{}, totl: 20},
+		{name: "division rounds half up", input: "7/2", res: []int{}, totl: 4},
+		{name: "negative division rounds half up", input: "-7/2", res: []int{}, totl: -3},
+		{name: "division rounds down", input: "7/3", res: []int{}, totl: 2},
+		{name: "dice sum", seed: 0, input: "2d6+1d8", res: []int{1, 1, 2}, totl: 4},
+		{name: "multiplied dice", seed: 0, input: "(1d8+3)*2", res: []int{3}, totl: 12},
+		{name: "subtraction keeps trailing constant", seed: 0, input: "1d20-1d4+2", res: []int{15, 3}, totl: 14},
+		{name: "negated dice", seed: 0, input: "-3d6", res: []int{1, 1, 2}, totl: -4},
+		{name: "grouped operand", seed: 0, input: "{1d6, 1d6}kh1*2", res: []int{1}, totl: 2},
+		{name: "combined group folds modifier", seed: 0, input: "{3d6 + 3}", res: []int{4, 4, 5}, totl: 13},
+		{name: "combined group computed child", seed: 0, input: "{3d6 + 2*2}", res: []int{1, 1, 2, 4}, totl: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := evaluateProgram(t, tt.seed, tt.input)
+			values := make([]int, len(result.Results))
+			for i, roll := range result.Results {
+				values[i] = roll.Result
+			}
+
+			if !reflect.DeepEqual(tt.res, values) {
+				t.Fatalf("results mismatch: exp=%v got=%v", tt.res, values)
+			}
+			if tt.totl != result.Total {
+				t.Fatalf("total mismatch: exp=%d got=%d", tt.totl, result.Total)
+			}
+		})
+	}
+}
+
+func TestEvaluateProgram_DivisionByZero(t *testing.T) {
+	program := compileProgram(t, "1d6/(2-2)")
+	_, err := EvaluateProgram(program)
+	if err != ErrDivisionByZero {
+		t.Fatalf("expected division by zero, got %v", err)
+	}
+}
+
 func TestProgram_String(t *testing.T) {
 	tests := []struct {
 		input string
@@ -117,6 +170,10 @@ func TestProgram_String(t *testing.T) {
 		{input: "6d6sa>=5", want: "6d6>=5s"},
 		{input: "{3d6+4,2d8}dl=1f>5", want: "{3d6+4, 2d8}dl=1f>5"},
 		{input: "{3d6+2d8-{4d4-1}dl}kh3<4f>3", want: "{3d6 + 2d8 - {4d4-1}dl}kh3<4f>3"},
+		{input: "2d6 + 1d8", want: "2d6+d8"},
+		{input: "( 1d8 + 3 ) * 2", want: "(d8+3)*2"},
+		{input: "1d20+5/2", want: "d20+5/2"},
+		{input: "{3d6,}", want: "{3d6,}"},
 	}
 
 	for _, tt := range tests {
@@ -129,6 +186,678 @@ func TestProgram_String(t *testing.T) {
 	}
 }
 
+func TestEvaluateProgram_RollBreakdown(t *testing.T) {
+	dice := func(index int) TermRef { return TermRef{Kind: TermDice, Index: index} }
+
+	tests := []struct {
+		name  string
+		seed  int64
+		input string
+		rolls []DieRoll
+	}{
+		{name: "dropped", seed: 2, input: "4d6kh3", rolls: []DieRoll{
+			{Result: 5, History: []int{5}, Term: dice(0)},
+			{Result: 1, History: []int{1}, Term: dice(0), CritFailure: true},
+			{Result: 1, History: []int{1}, Term: dice(0), Dropped: true},
+			{Result: 3, History: []int{3}, Term: dice(0)},
+		}},
+		{name: "rerolled", seed: 2, input: "4d6ro<4", rolls: []DieRoll{
+			{Result: 5, History: []int{5}, Term: dice(0)},
+			{Result: 3, History: []int{1, 3}, Term: dice(0), Rerolled: true},
+			{Result: 3, History: []int{1, 3}, Term: dice(0), Rerolled: true},
+			{Result: 5, History: []int{3, 5}, Term: dice(0), Rerolled: true},
+		}},
+		{name: "exploding", seed: 2, input: "2d6!5", rolls: []DieRoll{
+			{Result: 5, History: []int{5}, Term: dice(0), Exploded: true},
+			{Result: 1, History: []int{1}, Term: dice(0), CritFailure: true},
+			{Result: 1, History: []int{1}, Term: dice(0), FromExplosion: true, CritFailure: true},
+		}},
+		{name: "compounded", seed: 2, input: "2d6!!5", rolls: []DieRoll{
+			{Result: 6, History: []int{5, 1}, Term: dice(0), Exploded: true, CritSuccess: true},
+			{Result: 1, History: []int{1}, Term: dice(0), CritFailure: true},
+		}},
+		{name: "penetrating", seed: 2, input: "2d6!p5", rolls: []DieRoll{
+			{Result: 5, History: []int{5}, Term: dice(0), Exploded: true},
+			{Result: 1, History: []int{1}, Term: dice(0), CritFailure: true},
+			{Result: 0, History: []int{1}, Term: dice(0), FromExplosion: true},
+		}},
+		{name: "success failure", seed: 1, input: "3d6=6f=4", rolls: []DieRoll{
+			{Result: 6, History: []int{6}, Term: dice(0), Success: true, CritSuccess: true},
+			{Result: 4, History: []int{4}, Term: dice(0), Failure: true},
+			{Result: 6, History: []int{6}, Term: dice(0), Success: true, CritSuccess: true},
+		}},
+		{name: "separated group", seed: 1, input: "{1d20, 1d20+5}kh1", rolls: []DieRoll{
+			{Result: 2, History: []int{2}, Term: dice(0), Dropped: true},
+			{Result: 8, History: []int{8}, Term: dice(1)},
+		}},
+		{name: "combined group", seed: 1, input: "{2d6+1d4}dl1>3", rolls: []DieRoll{
+			{Result: 6, History: []int{6}, Term: dice(0), Success: true, CritSuccess: true},
+			{Result: 4, History: []int{4}, Term: dice(0), Success: true},
+			{Result: 4, History: []int{4}, Term: dice(1), Dropped: true, CritSuccess: true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := evaluateProgram(t, tt.seed, tt.input)
+			rolls := make([]DieRoll, len(result.Rolls))
+			for i, roll := range result.Rolls {
+				roll.Symbol = ""
+				rolls[i] = roll
+			}
+			if !reflect.DeepEqual(tt.rolls, rolls) {
+				t.Fatalf("rolls mismatch:\nexp=%+v\ngot=%+v", tt.rolls, rolls)
+			}
+		})
+	}
+
+	result := evaluateProgram(t, 1, "{1d20, 1d20+5}kh1")
+	if got, want := result.Results[0].Term, dice(1); got != want {
+		t.Fatalf("kept entry term mismatch: exp=%+v got=%+v", want, got)
+	}
+}
+
+func TestEvaluateProgram_Tree(t *testing.T) {
+	tests := []struct {
+		input string
+		tree  []string
+	}{
+		{input: "3d6+4", tree: []string{"3d6+4=20"}},
+		{input: "{3d6, 2d8}kh1", tree: []string{"{3d6, 2d8}kh=16", "  3d6=16", "  2d8=6"}},
+		{input: "2d6+1d8*2", tree: []string{"2d6+d8*2=26", "  2d6=10", "  d8=8"}},
+		{input: "{1d6+1, 4, {2d4+1}>2}", tree: []string{
+			"{d6+1, 4, {2d4+1}>2}=13",
+			"  d6+1=7",
+			"  {2d4+1}>2=2",
+			"    2d4+1=9",
+		}},
+	}
+
+	var flatten func(node *ResultNode, indent string) []string
+	flatten = func(node *ResultNode, indent string) []string {
+		lines := []string{fmt.Sprintf("%s%s=%d", indent, node.Notation, node.Total)}
+		for _, child := range node.Children {
+			lines = append(lines, flatten(child, indent+"  ")...)
+		}
+		return lines
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := evaluateProgram(t, 1, tt.input)
+			if result.Tree == nil {
+				t.Fatal("expected result tree")
+			}
+			if got := flatten(result.Tree, ""); !reflect.DeepEqual(tt.tree, got) {
+				t.Fatalf("tree mismatch:\nexp=%q\ngot=%q", tt.tree, got)
+			}
+		})
+	}
+
+	result := evaluateProgram(t, 1, "{3d6, 2d8}kh1")
+	if got, want := result.Tree.Children[1].Term, (TermRef{Kind: TermDice, Index: 1}); got != want {
+		t.Fatalf("child term mismatch: exp=%+v got=%+v", want, got)
+	}
+}
+
+func TestEvaluateProgram_Labels(t *testing.T) {
+	tests := []struct {
+		input  string
+		total  int
+		labels []LabelTotal
+	}{
+		{input: "3d6", total: 16},
+		{input: "8d6[fire]", total: 30, labels: []LabelTotal{{Label: "fire", Total: 30}}},
+		{input: "1d20+5[STR]+2[prof]", total: 9, labels: []LabelTotal{{Label: "STR", Total: 5}, {Label: "prof", Total: 2}}},
+		{input: "2d6[slashing]+1d6[fire]+3[slashing]", total: 19, labels: []LabelTotal{{Label: "slashing", Total: 13}, {Label: "fire", Total: 6}}},
+		{input: "8d6[fire]-2[resist]", total: 28, labels: []LabelTotal{{Label: "fire", Total: 30}, {Label: "resist", Total: -2}}},
+		{input: "(2d6[fire]+1d6[cold])*2", total: 32, labels: []LabelTotal{{Label: "fire", Total: 20}, {Label: "cold", Total: 12}}},
+		{input: "2*2d6[fire]", total: 20, labels: []LabelTotal{{Label: "fire", Total: 20}}},
+		{input: "{2d6[fire] + 1d4[cold]}", total: 14, labels: []LabelTotal{{Label: "fire", Total: 10}, {Label: "cold", Total: 4}}},
+		{input: "-{2d6[fire], 3[fire]}", total: -13, labels: []LabelTotal{{Label: "fire", Total: -13}}},
+		{input: "{2d6[fire], 1d8[cold]}kh1", total: 10},
+		{input: "{2d6[fire], 1d8[cold]}kh1[best]", total: 10, labels: []LabelTotal{{Label: "best", Total: 10}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := evaluateProgram(t, 1, tt.input)
+			if result.Total != tt.total {
+				t.Fatalf("total mismatch: exp=%d got=%d", tt.total, result.Total)
+			}
+			if !reflect.DeepEqual(tt.labels, result.Labels) {
+				t.Fatalf("labels mismatch: exp=%+v got=%+v", tt.labels, result.Labels)
+			}
+		})
+	}
+
+	result := evaluateProgram(t, 1, "2d6[fire]+1d6[cold]")
+	if total, ok := result.Label("cold"); !ok || total != 6 {
+		t.Fatalf("unexpected cold subtotal: %d %v", total, ok)
+	}
+	if _, ok := result.Label("acid"); ok {
+		t.Fatal("unexpected acid subtotal")
+	}
+	if got, want := result.Tree.Children[0].Label, "fire"; got != want {
+		t.Fatalf("tree label mismatch: exp=%q got=%q", want, got)
+	}
+}
+
+func TestEvaluateProgram_ComputedDice(t *testing.T) {
+	tests := []struct {
+		input    string
+		notation string
+		dice     int
+		rolls    int
+		operands int
+	}{
+		{input: "(1d4)d6", notation: "3d6", dice: 3, rolls: 4, operands: 1},
+		{input: "{1d3+1}d8", notation: "2d8", dice: 2, rolls: 3, operands: 1},
+		{input: "2d(1d4*2)", notation: "2d6", dice: 2, rolls: 3, operands: 1},
+		{input: "(1d4)d(1d6+4)kh1", notation: "3d5kh", dice: 1, rolls: 5, operands: 2},
+		{input: "(1d4-2)d6", notation: "d6", dice: 1, rolls: 2, operands: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := evaluateProgram(t, 0, tt.input)
+			if got := result.Tree.Notation; got != tt.notation {
+				t.Fatalf("notation mismatch: exp=%q got=%q", tt.notation, got)
+			}
+			if got := len(result.Results); got != tt.dice {
+				t.Fatalf("dice count mismatch: exp=%d got=%d", tt.dice, got)
+			}
+			if got := len(result.Rolls); got != tt.rolls {
+				t.Fatalf("roll count mismatch: exp=%d got=%d", tt.rolls, got)
+			}
+			if got := len(result.Tree.Children); got != tt.operands {
+				t.Fatalf("expected the computed operands as child nodes: exp=%d got=%d", tt.operands, got)
+			}
+		})
+	}
+
+	errs := []struct {
+		input  string
+		limits Limits
+		err    string
+	}{
+		{input: "(1d4-5)d6", err: "cannot roll -2 dice"},
+		{input: "2d(1d4-4)", err: `unsafe die type "d-1"`},
+		{input: "2d(1d4*100)", limits: Limits{MaxDieSize: 50}, err: "die size 300 exceeds maximum 50"},
+		{input: "(1d4*10)d6", limits: Limits{MaxRollsPerDie: 5}, err: "die term exceeded maximum roll count of 5"},
+	}
+	for _, tt := range errs {
+		t.Run(tt.input, func(t *testing.T) {
+			program := compileProgram(t, tt.input)
+			withTestSeed(0, func() {
+				_, err := EvaluateProgramWithLimits(program, tt.limits)
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("unexpected error: exp=%q got=%v", tt.err, err)
+				}
+			})
+		})
+	}
+}
+
+func TestEvaluateProgram_Matches(t *testing.T) {
+	tests := []struct {
+		input   string
+		total   int
+		matches []MatchSet
+		matched int
+	}{
+		{input: "6d{3,3}m", total: 18, matches: []MatchSet{{Value: 3, Count: 6}}, matched: 6},
+		{input: "6d{3,3}mt", total: 1, matches: []MatchSet{{Value: 3, Count: 6}}, matched: 6},
+		{input: "3d{4,4}mt4", total: 0},
+		{input: "2d{1,1}mt>1", total: 0},
+		{input: "3d{2,2}mt+2d{5,5}mt>=5", total: 2, matches: []MatchSet{{Value: 2, Count: 3}, {Value: 5, Count: 2}}, matched: 5},
+		{input: "4d{6,6}kh2mt", total: 1, matches: []MatchSet{{Value: 6, Count: 2}}, matched: 2},
+		{input: "-2d{1,1}mt", total: -1, matches: []MatchSet{{Value: 1, Count: 2}}, matched: 2},
+		{input: "6d{3,3}mt+1", total: 2, matches: []MatchSet{{Value: 3, Count: 6}}, matched: 6},
+		{input: "6d{3,3}mt-1", total: 0, matches: []MatchSet{{Value: 3, Count: 6}}, matched: 6},
+		{input: "1+6d{3,3}mt", total: 2, matches: []MatchSet{{Value: 3, Count: 6}}, matched: 6},
+		{input: "-2d{1,1}mt+3", total: 2, matches: []MatchSet{{Value: 1, Count: 2}}, matched: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := evaluateProgram(t, 0, tt.input)
+			if result.Total != tt.total {
+				t.Fatalf("total mismatch: exp=%d got=%d", tt.total, result.Total)
+			}
+			if !reflect.DeepEqual(result.Matches, tt.matches) {
+				t.Fatalf("matches mismatch: exp=%v got=%v", tt.matches, result.Matches)
+			}
+			matched := 0
+			for _, roll := range result.Rolls {
+				if roll.Matched {
+					matched++
+				}
+			}
+			if matched != tt.matched {
+				t.Fatalf("matched roll count mismatch: exp=%d got=%d", tt.matched, matched)
+			}
+		})
+	}
+}
+
+func TestEvaluateProgram_ExplosionCaps(t *testing.T) {
+	tests := []struct {
+		input string
+		total int
+		rolls int
+	}{
+		{input: "3d{2,2}!o=2", total: 12, rolls: 6},
+		{input: "3d{2,2}!o2=2", total: 18, rolls: 9},
+		{input: "2d{2,2}!!o3=2", total: 16, rolls: 2},
+		{input: "d{2,2}!po=2", total: 3, rolls: 2},
+		{input: "3d{2,2}!o", total: 12, rolls: 6},
+		{input: "2d{2,2}!!o3", total: 16, rolls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := evaluateProgram(t, 0, tt.input)
+			if result.Total != tt.total || len(result.Rolls) != tt.rolls {
+				t.Fatalf("result mismatch: exp total %d from %d rolls, got %d from %d", tt.total, tt.rolls, result.Total, len(result.Rolls))
+			}
+			if result.Truncated {
+				t.Fatal("capped explosions should not be reported as truncated")
+			}
+		})
+	}
+}
+
+func TestEvaluateProgram_TruncateExplosions(t *testing.T) {
+	// Explosions that never stop only compile when they will be truncated.
+	program, err := CompileStringWithLimits("2d{2,2}!=2+1d6", Limits{Explosions: TruncateExplosions})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	limits := Limits{MaxRollsPerDie: 5}
+	if _, err := EvaluateProgramWithLimits(program, limits); err == nil || err.Error() != "die term exceeded maximum roll count of 5" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	limits.Explosions = TruncateExplosions
+	result, err := EvaluateProgramWithLimits(program, limits)
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	if !result.Truncated {
+		t.Fatal("expected the result to be truncated")
+	}
+	if got, want := len(result.Rolls), 6; got != want {
+		t.Fatalf("roll count mismatch: exp=%d got=%d", want, got)
+	}
+
+	limits = Limits{MaxRollsTotal: 4, Explosions: TruncateExplosions}
+	if _, err := EvaluateProgramWithLimits(program, limits); err == nil || err.Error() != "roll exceeded maximum total roll count of 4" {
+		t.Fatalf("rolls beyond explosions should still fail: %v", err)
+	}
+}
+
+func TestEvaluateProgram_Crits(t *testing.T) {
+	tests := []struct {
+		input     string
+		total     int
+		successes int
+		failures  int
+	}{
+		{input: "3d{1,1}+2d{20,20}", total: 43},
+		{input: "3d{20,20}cs>19", total: 60, successes: 3},
+		{input: "2d{1,1}cf1+d{1,1}cf<2", total: 3, failures: 3},
+		{input: "{3d{5,5}, 2d{4,4}}cs>=9cf8", total: 23, successes: 1, failures: 1},
+		{input: "{3d{5,5}, 2d{4,4}}kh1", total: 15},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := evaluateProgram(t, 0, tt.input)
+			if result.Total != tt.total {
+				t.Fatalf("total mismatch: exp=%d got=%d", tt.total, result.Total)
+			}
+			if result.CritSuccesses != tt.successes || result.CritFailures != tt.failures {
+				t.Fatalf("crit mismatch: exp=%d/%d got=%d/%d", tt.successes, tt.failures, result.CritSuccesses, result.CritFailures)
+			}
+		})
+	}
+
+	// A d6 defaults to critical successes on 6 and failures on 1.
+	result := evaluateProgram(t, 1, "20d6")
+	successes, failures := 0, 0
+	for _, roll := range result.Rolls {
+		if roll.CritSuccess != (roll.Result == 6) || roll.CritFailure != (roll.Result == 1) {
+			t.Fatalf("unexpected crit flags on %+v", roll)
+		}
+		if roll.CritSuccess {
+			successes++
+		}
+		if roll.CritFailure {
+			failures++
+		}
+	}
+	if result.CritSuccesses != successes || result.CritFailures != failures {
+		t.Fatalf("crit count mismatch: exp=%d/%d got=%d/%d", successes, failures, result.CritSuccesses, result.CritFailures)
+	}
+}
+
+func TestEvaluateProgram_Compare(t *testing.T) {
+	tests := []struct {
+		input  string
+		ties   TiePolicy
+		total  int
+		margin int
+		winner Side
+	}{
+		{input: "2d{5,5}+3 vs 1d{6,6}+1", total: 1, margin: 6, winner: LeftSide},
+		{input: "1d{4,4} vs 1d{9,9}", total: -1, margin: -5, winner: RightSide},
+		{input: "1d{4,4} vs 4", total: 0, winner: NoSide},
+		{input: "1d{4,4} vs 4", ties: TiesToLeft, total: 1, winner: LeftSide},
+		{input: "1d{4,4} vs 4", ties: TiesToRight, total: -1, winner: RightSide},
+		{input: "2d{4,4} >= 8", total: 1, winner: LeftSide},
+		{input: "2d{4,4} > 8", total: 0, winner: RightSide},
+		{input: "2d{4,4} = 1d{8,8}", ties: TiesToRight, total: 1, winner: LeftSide},
+		{input: "1d{30,30} <= 40", total: 1, margin: -10, winner: LeftSide},
+		{input: "1d{50,50} < 40", total: 0, margin: 10, winner: RightSide},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, err := EvaluateProgramWithOptions(compileProgram(t, tt.input), EvalOptions{Ties: tt.ties})
+			if err != nil {
+				t.Fatalf("evaluate: %v", err)
+			}
+			if result.Total != tt.total {
+				t.Fatalf("total mismatch: exp=%d got=%d", tt.total, result.Total)
+			}
+			c := result.Comparison
+			if c == nil {
+				t.Fatal("expected comparison")
+			}
+			if c.Margin != tt.margin || c.Winner != tt.winner {
+				t.Fatalf("outcome mismatch: exp=%d/%d got=%d/%d", tt.margin, tt.winner, c.Margin, c.Winner)
+			}
+			if c.Margin != c.Left.Total-c.Right.Total {
+				t.Fatalf("margin %d does not match sides %d and %d", c.Margin, c.Left.Total, c.Right.Total)
+			}
+			if len(result.Rolls) != len(c.Left.Rolls)+len(c.Right.Rolls) {
+				t.Fatalf("rolls mismatch: %d rolls for sides of %d and %d", len(result.Rolls), len(c.Left.Rolls), len(c.Right.Rolls))
+			}
+		})
+	}
+
+	result := evaluateProgram(t, 0, "1d20+5[STR] vs 1d20")
+	if got := result.Comparison.Left.Labels; len(got) != 1 || got[0].Label != "STR" {
+		t.Fatalf("left labels mismatch: %+v", got)
+	}
+	if result.Comparison.Right.Tree == nil {
+		t.Fatal("expected a result tree for the right side")
+	}
+
+	program := &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpConst, Arg: 2}, {Op: OpCompare, Arg: 9}}, MaxDepth: 2}
+	var unknown ErrUnknownComparison
+	if _, err := EvaluateProgramWithOptions(program, EvalOptions{}); !errors.As(err, &unknown) {
+		t.Fatalf("expected unknown comparison error, got %v", err)
+	}
+}
+
+func TestEvaluateProgram_Repeat(t *testing.T) {
+	result := evaluateProgram(t, 0, "6 x 4d6kh3")
+	if len(result.Repeats) != 6 {
+		t.Fatalf("expected 6 repeats, got %d", len(result.Repeats))
+	}
+	total, rolls := 0, 0
+	for i, repeat := range result.Repeats {
+		if len(repeat.Rolls) != 4 || len(repeat.Results) != 3 {
+			t.Fatalf("repeat %d: expected 4 dice keeping 3, got %d keeping %d", i, len(repeat.Rolls), len(repeat.Results))
+		}
+		if repeat.Tree == nil || repeat.Tree.Notation != "4d6kh3" {
+			t.Fatalf("repeat %d: unexpected tree %+v", i, repeat.Tree)
+		}
+		total += repeat.Total
+		rolls += len(repeat.Rolls)
+	}
+	if result.Total != total || len(result.Rolls) != rolls {
+		t.Fatalf("totals mismatch: exp=%d/%d got=%d/%d", total, rolls, result.Total, len(result.Rolls))
+	}
+	if result.Tree == nil || len(result.Tree.Children) != 6 {
+		t.Fatalf("expected a tree with a child per repeat, got %+v", result.Tree)
+	}
+
+	// The repetitions are rolled in turn, so sorting only reorders them.
+	unsorted := evaluateProgram(t, 3, "repeat(5, 3d6)")
+	for _, tt := range []struct {
+		input string
+		less  func(a, b int) bool
+	}{
+		{input: "repeat(5, 3d6)s", less: func(a, b int) bool { return a <= b }},
+		{input: "repeat(5, 3d6)sd", less: func(a, b int) bool { return a >= b }},
+	} {
+		sorted := evaluateProgram(t, 3, tt.input)
+		for i := 1; i < len(sorted.Repeats); i++ {
+			if !tt.less(sorted.Repeats[i-1].Total, sorted.Repeats[i].Total) {
+				t.Fatalf("%s: repeats out of order: %d before %d", tt.input, sorted.Repeats[i-1].Total, sorted.Repeats[i].Total)
+			}
+		}
+		if sorted.Total != unsorted.Total {
+			t.Fatalf("%s: total mismatch: exp=%d got=%d", tt.input, unsorted.Total, sorted.Total)
+		}
+	}
+
+	compared := evaluateProgram(t, 0, "3 x 1d{5,5} vs 1d{4,6}")
+	for i, repeat := range compared.Repeats {
+		if repeat.Comparison == nil {
+			t.Fatalf("repeat %d: expected comparison", i)
+		}
+	}
+
+	t.Run("limits", func(t *testing.T) {
+		program := compileProgram(t, "20 x 1d6")
+		_, err := EvaluateProgramWithLimits(program, Limits{MaxRepeats: 10})
+		if err == nil || err.Error() != "roll repeats 20 times, more than the maximum of 10" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err = EvaluateProgramWithLimits(compileProgram(t, "10 x 5d6"), Limits{MaxRollsTotal: 40})
+		if err == nil || err.Error() != "roll exceeded maximum total roll count of 40" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestEvaluateProgram_Functions(t *testing.T) {
+	tests := []struct {
+		input     string
+		total     int
+		successes int
+		labels    []LabelTotal
+	}{
+		{input: "max{1d{5,5}, 1d{9,9}}", total: 9},
+		{input: "min{1d{5,5}, 1d{9,9}}", total: 5},
+		{input: "sum{1d{5,5}, 1d{9,9}}", total: 14},
+		{input: "avg{1d{5,5}, 1d{8,8}}", total: 7},
+		{input: "avg{1d{5,5}, 1d{8,8}, 1d{9,9}}", total: 7},
+		{input: "count{1d{5,5}, 1d{9,9}, 1d{12,12}}>8", total: 2},
+		{input: "count{1d{5,5}, 1d{9,9}, 1d{12,12}}<=5", total: 1},
+		{input: "count{1d{5,5}, 1d{9,9}, 1d{12,12}} > 8", total: 2},
+		{input: "max{4d{6,6}>5, 2d{6,6}>5}", total: 4},
+		{input: "sum{4d{6,6}>5, 2d{6,6}>5}", total: 6, successes: 6},
+		{input: "sum{2[A], 3[B]}", total: 5, labels: []LabelTotal{{Label: "A", Total: 2}, {Label: "B", Total: 3}}},
+		{input: "max{2[A], 3[B]}", total: 3},
+
+		// Rounding applies to the exact value of the division or average
+		// directly inside it.
+		{input: "7/2", total: 4},
+		{input: "floor(7/2)", total: 3},
+		{input: "ceil(7/2)", total: 4},
+		{input: "round(7/2)", total: 4},
+		{input: "-7/2", total: -3},
+		{input: "floor(-7/2)", total: -4},
+		{input: "ceil(-7/2)", total: -3},
+		{input: "round(-7/2)", total: -4},
+		{input: "round(5/3)", total: 2},
+		{input: "floor(6/2)", total: 3},
+		{input: "floor(avg{1d{5,5}, 1d{8,8}})", total: 6},
+		{input: "floor(7/2+1)", total: 5},
+		{input: "floor(1d{5,5})", total: 5},
+
+		{input: "abs(1d{2,2}-5)", total: 3},
+		{input: "abs(2)", total: 2},
+		{input: "abs(-3[C])", total: 3, labels: []LabelTotal{{Label: "C", Total: 3}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := evaluateProgram(t, 0, tt.input)
+			if result.Total != tt.total {
+				t.Fatalf("total mismatch: exp=%d got=%d", tt.total, result.Total)
+			}
+			if result.Successes != tt.successes {
+				t.Fatalf("success mismatch: exp=%d got=%d", tt.successes, result.Successes)
+			}
+			if !reflect.DeepEqual(tt.labels, result.Labels) {
+				t.Fatalf("labels mismatch: exp=%+v got=%+v", tt.labels, result.Labels)
+			}
+		})
+	}
+
+	// An aggregate lists the total of each value it gathers and keeps every
+	// die rolled.
+	result := evaluateProgram(t, 0, "max{2d{3,3}, 1d{9,9}}")
+	if len(result.Results) != 2 || result.Results[0].Result != 6 || result.Results[1].Result != 9 {
+		t.Fatalf("unexpected results %+v", result.Results)
+	}
+	if len(result.Rolls) != 3 {
+		t.Fatalf("expected 3 rolls, got %d", len(result.Rolls))
+	}
+}
+
+// cancellingSource cancels its context after a number of rolls.
+type cancellingSource struct {
+	rolls  int
+	cancel context.CancelFunc
+}
+
+func (s *cancellingSource) IntN(n int) int {
+	s.rolls--
+	if s.rolls == 0 {
+		s.cancel()
+	}
+	return n - 1
+}
+
+// sleepingSource pauses before every roll.
+type sleepingSource time.Duration
+
+func (s sleepingSource) IntN(n int) int {
+	time.Sleep(time.Duration(s))
+	return 0
+}
+
+func TestEvaluateProgramContext(t *testing.T) {
+	limits := Limits{MaxDieSize: 100, MaxRollsPerDie: 1000, MaxRollsTotal: 1000, MaxEvalDepth: 10}
+
+	tests := []struct {
+		name   string
+		input  string
+		source func(cancel context.CancelFunc) Source
+		limits Limits
+		err    error
+	}{
+		{
+			name:   "cancelled before starting",
+			input:  "1d6+2",
+			source: func(cancel context.CancelFunc) Source { cancel(); return newSeededSource(0) },
+			limits: limits,
+			err:    context.Canceled,
+		},
+		{
+			name:   "cancelled while exploding",
+			input:  "1d6!6",
+			source: func(cancel context.CancelFunc) Source { return &cancellingSource{rolls: 5, cancel: cancel} },
+			limits: limits,
+			err:    context.Canceled,
+		},
+		{
+			name:   "cancelled while rerolling",
+			input:  "1d6r6",
+			source: func(cancel context.CancelFunc) Source { return &cancellingSource{rolls: 5, cancel: cancel} },
+			limits: limits,
+			err:    context.Canceled,
+		},
+		{
+			name:   "out of time",
+			input:  "100d6",
+			source: func(context.CancelFunc) Source { return sleepingSource(time.Millisecond) },
+			limits: Limits{MaxDieSize: 100, MaxRollsPerDie: 1000, MaxRollsTotal: 1000, MaxEvalDepth: 10, MaxDuration: 5 * time.Millisecond},
+			err:    context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			program := compileProgram(t, tt.input)
+			_, err := EvaluateProgramContext(ctx, program, EvalOptions{Limits: tt.limits, Source: tt.source(cancel)})
+			var interrupted *InterruptedError
+			if !errors.As(err, &interrupted) {
+				t.Fatalf("expected interrupted error, got %v", err)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+
+	t.Run("completes within budget", func(t *testing.T) {
+		program := compileProgram(t, "3d6+1")
+		result, err := EvaluateProgramContext(context.Background(), program, EvalOptions{
+			Limits: Limits{MaxDieSize: 100, MaxRollsPerDie: 10, MaxRollsTotal: 10, MaxEvalDepth: 10, MaxDuration: time.Minute},
+			Source: newSeededSource(0),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(result.Rolls) != 3 {
+			t.Fatalf("expected 3 rolls, got %d", len(result.Rolls))
+		}
+	})
+}
+
+func TestApplyLimit_Ties(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit LimitOp
+		in    []int
+		want  []int
+	}{
+		{name: "keep highest", limit: LimitOp{Type: KeepHighest, Amount: 2}, in: []int{3, 3, 3, 1}, want: []int{3, 3}},
+		{name: "keep lowest", limit: LimitOp{Type: KeepLowest, Amount: 2}, in: []int{1, 4, 1, 1}, want: []int{1, 1}},
+		{name: "drop lowest", limit: LimitOp{Type: DropLowest, Amount: 1}, in: []int{6, 6, 6, 6}, want: []int{6, 6, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result Result
+			for _, v := range tt.in {
+				result.Results = append(result.Results, DieRoll{Result: v})
+			}
+			applyLimit(&tt.limit, &result)
+
+			values := make([]int, len(result.Results))
+			for i, roll := range result.Results {
+				values[i] = roll.Result
+			}
+			if !reflect.DeepEqual(tt.want, values) {
+				t.Fatalf("results mismatch: exp=%v got=%v", tt.want, values)
+			}
+		})
+	}
+}
+
 func TestComparisonOp_MatchInclusive(t *testing.T) {
 	tests := []struct {
 		name string
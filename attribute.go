@@ -0,0 +1,90 @@
+package roll
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownAttribute is raised when an attribute reference names an
+// attribute that its provider does not have.
+type ErrUnknownAttribute string
+
+func (e ErrUnknownAttribute) Error() string {
+	return fmt.Sprintf("unknown attribute %q", string(e))
+}
+
+// ErrAttributeCycle is raised when the value of an attribute refers back to
+// itself, directly or through other attributes.
+type ErrAttributeCycle string
+
+func (e ErrAttributeCycle) Error() string {
+	return fmt.Sprintf("attribute refers to itself: %s", string(e))
+}
+
+// ErrNotConstant is raised when a query or attribute used in place of a
+// number, as in 4d6kh@{keep} or 1d20>=@{dc}, does not give a constant.
+type ErrNotConstant string
+
+func (e ErrNotConstant) Error() string {
+	return fmt.Sprintf("%s must give a number here", string(e))
+}
+
+// AttributeProvider supplies the values of Roll20 style @{...} attribute
+// references met while compiling a roll.
+//
+// Attribute returns the value of the named attribute as roll notation, which
+// may itself contain dice, queries or further attribute references. The
+// character is empty for a reference of the form @{name}, and false is
+// returned when there is no such attribute.
+type AttributeProvider interface {
+	Attribute(character, name string) (string, bool)
+}
+
+// AttributeProviderFunc adapts a function to an AttributeProvider.
+type AttributeProviderFunc func(character, name string) (string, bool)
+
+// Attribute calls f(character, name).
+func (f AttributeProviderFunc) Attribute(character, name string) (string, bool) {
+	return f(character, name)
+}
+
+// Attributes is an AttributeProvider backed by a map. Keys are either an
+// attribute name, or a character and name in the form "character|name".
+type Attributes map[string]string
+
+// Attribute returns the value stored under "character|name", or under name
+// alone when character is empty.
+func (a Attributes) Attribute(character, name string) (string, bool) {
+	key := name
+	if character != "" {
+		key = character + "|" + name
+	}
+	value, ok := a[key]
+	return value, ok
+}
+
+// attributeRef is a parsed @{...} attribute reference.
+type attributeRef struct {
+	Character string
+	Name      string
+}
+
+// parseAttributeRef reads the @{...} notation of an attribute reference. A
+// reference without a character inherits character, the character whose
+// attribute it appears in, if any.
+func parseAttributeRef(lit, character string) attributeRef {
+	body := strings.TrimSuffix(strings.TrimPrefix(lit, "@{"), "}")
+	ref := attributeRef{Character: character, Name: strings.TrimSpace(body)}
+	if who, name, ok := strings.Cut(body, "|"); ok {
+		ref = attributeRef{Character: strings.TrimSpace(who), Name: strings.TrimSpace(name)}
+	}
+	return ref
+}
+
+// String returns the reference in the form used by Attributes keys.
+func (r attributeRef) String() string {
+	if r.Character == "" {
+		return r.Name
+	}
+	return r.Character + "|" + r.Name
+}
@@ -0,0 +1,205 @@
+package roll
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAttributes(t *testing.T) {
+	attrs := Attributes{"level": "3", "Bob|level": "5"}
+	tests := []struct {
+		character, name string
+		value           string
+		ok              bool
+	}{
+		{name: "level", value: "3", ok: true},
+		{character: "Bob", name: "level", value: "5", ok: true},
+		{character: "Alice", name: "level"},
+		{name: "strength"},
+	}
+
+	for _, tt := range tests {
+		value, ok := attrs.Attribute(tt.character, tt.name)
+		if value != tt.value || ok != tt.ok {
+			t.Errorf("Attribute(%q, %q): exp=%q,%v got=%q,%v", tt.character, tt.name, tt.value, tt.ok, value, ok)
+		}
+	}
+}
+
+func TestCompileWithOptions_Attributes(t *testing.T) {
+	attrs := Attributes{
+		"strength_mod":   "3",
+		"level":          "4",
+		"negative":       "-1",
+		"damage":         "1d8+@{strength_mod}",
+		"hitdie":         "d10",
+		"Bob|level":      "2",
+		"Bob|attack":     "1d20+@{level}",
+		"Bob|weapon":     "@{Alice|damage}",
+		"Alice|damage":   "2d6",
+		"labelled":       "2[prof]",
+		"sneak_attack":   "{@{level}d6}kh2",
+		"query_fallback": "?{Bonus|1}",
+	}
+
+	tests := []struct {
+		input    string
+		rendered string
+	}{
+		{input: "1d20+@{strength_mod}", rendered: "d20+3"},
+		{input: "@{level}d6", rendered: "4d6"},
+		{input: "@{level}d6+1", rendered: "4d6+1"},
+		{input: "2*@{damage}", rendered: "2*(d8+3)"},
+		{input: "5-@{negative}", rendered: "5-(-1)"},
+		{input: "@{Bob|attack}", rendered: "(d20+2)"},
+		{input: "@{Bob|weapon}", rendered: "2d6"},
+		{input: "d20+@{labelled}", rendered: "d20+2[prof]"},
+		{input: "@{sneak_attack}", rendered: "{4d6}kh2"},
+		{input: "@{query_fallback}", rendered: "1"},
+		{input: "@{ level }d4", rendered: "4d4"},
+		{input: "2d(@{level})", rendered: "2d4"},
+		{input: "2d(@{hitdie})", rendered: "2d(d10)"},
+		{input: "@{damage}d6", rendered: "(d8+3)d6"},
+		// A constant attribute can stand in for a number after a die.
+		{input: "1d20>@{level}", rendered: "d20>4"},
+		{input: "1d20>=@{level}", rendered: "d20>=4"},
+		{input: "1d20 >= @{level}", rendered: "d20 >= 4"},
+		{input: "4d6kh@{level}", rendered: "4d6kh4"},
+		{input: "1d6!>@{level}", rendered: "d6!>4"},
+		{input: "1d6r<@{Bob|level}", rendered: "d6r<2"},
+		{input: "2d@{level}", rendered: "2d4"},
+		{input: "2d@{damage}", rendered: "2d(d8+3)"},
+		{input: "count{1d6, 1d6}>@{level}", rendered: "count{d6, d6}>4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program, err := CompileStringWithOptions(tt.input, CompileOptions{Attributes: attrs})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: exp=%q got=%q", tt.rendered, got)
+			}
+		})
+	}
+}
+
+func TestCompileWithOptions_AttributeErrors(t *testing.T) {
+	attrs := Attributes{
+		"loop":    "@{loop}",
+		"a":       "1+@{b}",
+		"b":       "@{a}",
+		"broken":  "1d",
+		"dice":    "1d4",
+		"Bob|ref": "@{missing}",
+	}
+	tests := []struct {
+		input  string
+		attrs  AttributeProvider
+		err    string
+		target error
+	}{
+		{
+			input: "1d20+@{strength_mod}",
+			err:   `unknown attribute "strength_mod" at column 6`,
+		},
+		{
+			input:  "1d20+@{strength_mod}",
+			attrs:  attrs,
+			err:    `unknown attribute "strength_mod" at column 6`,
+			target: ErrUnknownAttribute("strength_mod"),
+		},
+		{
+			input:  "@{Bob|ref}",
+			attrs:  attrs,
+			err:    `attribute "Bob|ref": unknown attribute "Bob|missing" at column 1`,
+			target: ErrUnknownAttribute("Bob|missing"),
+		},
+		{
+			input: "@{loop}",
+			attrs: attrs,
+			err:   `attribute "loop": attribute refers to itself: loop -> loop at column 1`,
+		},
+		{
+			input: "2*@{a}",
+			attrs: attrs,
+			err:   `attribute "a": attribute "b": attribute refers to itself: a -> b -> a at column 3`,
+		},
+		{
+			input: "@{broken}",
+			attrs: attrs,
+			err:   `attribute "broken": unrecognised die type "d" at column 1`,
+		},
+		{
+			input: "4d6kh@{dice}",
+			attrs: attrs,
+			err:   `@{dice} must give a number here at column 6`,
+		},
+		{
+			input: "1d20>=@{dice}",
+			attrs: attrs,
+			err:   `@{dice} must give a number here at column 7`,
+		},
+		{
+			input: "1d6!>@{loop}",
+			attrs: attrs,
+			err:   `attribute "loop": attribute refers to itself: loop -> loop at column 6`,
+		},
+		{
+			input: "@{}",
+			attrs: attrs,
+			err:   `found unexpected token "@{}" at column 1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := CompileStringWithOptions(tt.input, CompileOptions{Attributes: tt.attrs})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("error mismatch: exp=%q got=%q", tt.err, err.Error())
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Fatalf("expected %v to wrap %v", err, tt.target)
+			}
+		})
+	}
+}
+
+func TestCompileWithOptions_AttributeDepth(t *testing.T) {
+	attrs := AttributeProviderFunc(func(_, name string) (string, bool) {
+		if len(name) > 40 {
+			return "1", true
+		}
+		return "@{" + name + "x}", true
+	})
+	_, err := CompileStringWithOptions("@{x}", CompileOptions{Limits: Limits{MaxEvalDepth: 8}, Attributes: attrs})
+	var limitErr ErrLimitExceeded
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected depth error, got %v", err)
+	}
+}
+
+func TestParseStringWithOptions_Attributes(t *testing.T) {
+	attrs := Attributes{"level": "2", "strength_mod": "3"}
+	withTestSeed(0, func() {
+		out, err := ParseStringWithOptions("@{level}d6+@{strength_mod}", EvalOptions{Attributes: attrs})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := `Rolled "2d6+3" and got 1, 1 for a total of 5`; out != want {
+			t.Fatalf("output mismatch: exp=%q got=%q", want, out)
+		}
+
+		inline, err := ParseInlineWithOptions("Bonus of [[@{strength_mod}]]", EvalOptions{Attributes: attrs})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := "Bonus of 3"; inline.Text != want {
+			t.Fatalf("inline text mismatch: exp=%q got=%q", want, inline.Text)
+		}
+	})
+}
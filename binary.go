@@ -0,0 +1,554 @@
+package roll
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// ProgramBinaryVersion is the version of the binary bytecode format written
+// by MarshalBinary. UnmarshalBinary also reads programs written in version 1,
+// which predates labels, and rejects any other version.
+const ProgramBinaryVersion = 2
+
+// binaryLabelsVersion is the first version to encode labels, along with the
+// repeat and aggregate term sections.
+const binaryLabelsVersion = 2
+
+// programMagic opens every binary encoded program.
+var programMagic = [4]byte{'R', 'O', 'L', 'L'}
+
+// Die kinds in the binary encoding.
+const (
+	binaryNormalDie byte = iota
+	binaryPercentileDie
+	binaryFateDie
+	binaryCustomDie
+)
+
+// binaryCappedExplosion is set in the type byte of an exploding op whose
+// MaxExplosions follows its comparison.
+const binaryCappedExplosion byte = 0x80
+
+// Presence flags for the optional parts of a term.
+const (
+	binaryHasExploding byte = 1 << iota
+	binaryHasLimit
+	binaryHasSuccess
+	binaryHasFailure
+	binaryCombined
+	binaryNegative
+	binaryHasMatch
+	binaryHasCrits
+)
+
+// MarshalBinary encodes the program in the compact binary bytecode format:
+//
+//	magic        "ROLL"
+//	version      uvarint
+//	max depth    uvarint
+//	rendered     string
+//	dice terms   uvarint count, then each dice term
+//	group terms  uvarint count, then each group term
+//	labels       uvarint count, then each label as a string; absent in
+//	             version 1
+//	code         uvarint count, then each instruction as an opcode byte and
+//	             a varint argument
+//	repeat terms uvarint count, then each repeat term; absent in version 1
+//	aggregate terms
+//	             uvarint count, then each aggregate term; absent in
+//	             version 1
+//
+// Strings are a uvarint length followed by their bytes, and signed integers
+// are zig-zag varints.
+func (p *Program) MarshalBinary() ([]byte, error) {
+	buf := append([]byte(nil), programMagic[:]...)
+	buf = binary.AppendUvarint(buf, ProgramBinaryVersion)
+	buf = binary.AppendUvarint(buf, uint64(max(p.MaxDepth, 0)))
+	buf = appendString(buf, p.Rendered)
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.DiceTerms)))
+	for i, term := range p.DiceTerms {
+		var err error
+		if buf, err = appendDiceTerm(buf, term); err != nil {
+			return nil, fmt.Errorf("dice term %d: %w", i, err)
+		}
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.GroupTerms)))
+	for _, term := range p.GroupTerms {
+		buf = appendGroupTerm(buf, term)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.Labels)))
+	for _, label := range p.Labels {
+		buf = appendString(buf, label)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.Code)))
+	for _, instruction := range p.Code {
+		buf = append(buf, byte(instruction.Op))
+		buf = binary.AppendVarint(buf, int64(instruction.Arg))
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.RepeatTerms)))
+	for _, term := range p.RepeatTerms {
+		buf = appendRepeatTerm(buf, term)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(p.AggregateTerms)))
+	for _, term := range p.AggregateTerms {
+		buf = appendAggregateTerm(buf, term)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a program written by MarshalBinary and verifies it,
+// so the result is safe to evaluate even if the data came from an untrusted
+// source.
+func (p *Program) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{data: data}
+	if len(data) < len(programMagic) || [4]byte(data[:4]) != programMagic {
+		return ErrInvalidEncoding("missing program header")
+	}
+	r.pos = len(programMagic)
+	if r.version = r.uvarint(); r.err == nil && (r.version < 1 || r.version > ProgramBinaryVersion) {
+		return ErrInvalidEncoding(fmt.Sprintf("unsupported program version %d", r.version))
+	}
+
+	program := Program{
+		MaxDepth: r.int(r.uvarint()),
+		Rendered: r.string(),
+	}
+	for n := r.count(); n > 0; n-- {
+		program.DiceTerms = append(program.DiceTerms, r.diceTerm())
+	}
+	for n := r.count(); n > 0; n-- {
+		program.GroupTerms = append(program.GroupTerms, r.groupTerm())
+	}
+	if r.version >= binaryLabelsVersion {
+		for n := r.count(); n > 0; n-- {
+			program.Labels = append(program.Labels, r.string())
+		}
+	}
+	for n := r.count(); n > 0; n-- {
+		program.Code = append(program.Code, Instruction{Op: Opcode(r.byte()), Arg: int(r.varint())})
+	}
+	if r.version >= binaryLabelsVersion {
+		for n := r.count(); n > 0; n-- {
+			program.RepeatTerms = append(program.RepeatTerms, r.repeatTerm())
+		}
+		for n := r.count(); n > 0; n-- {
+			program.AggregateTerms = append(program.AggregateTerms, r.aggregateTerm())
+		}
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	if r.pos != len(data) {
+		return ErrInvalidEncoding(fmt.Sprintf("%d trailing bytes", len(data)-r.pos))
+	}
+	if err := program.Verify(); err != nil {
+		return err
+	}
+
+	*p = program
+	return nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+
+func appendComparison(buf []byte, op *ComparisonOp) []byte {
+	buf = append(buf, byte(op.Type))
+	buf = binary.AppendVarint(buf, int64(op.Value))
+	return appendBool(buf, op.Inclusive)
+}
+
+// appendOptionalComparison writes whether op is set, followed by op if it is.
+func appendOptionalComparison(buf []byte, op *ComparisonOp) []byte {
+	buf = appendBool(buf, op != nil)
+	if op != nil {
+		buf = appendComparison(buf, op)
+	}
+	return buf
+}
+
+// appendCrits writes the critical success and failure checks of a term, which
+// are flagged by binaryHasCrits.
+func appendCrits(buf []byte, success, failure *ComparisonOp) []byte {
+	if success == nil && failure == nil {
+		return buf
+	}
+	buf = appendOptionalComparison(buf, success)
+	return appendOptionalComparison(buf, failure)
+}
+
+func critFlags(success, failure *ComparisonOp) byte {
+	if success == nil && failure == nil {
+		return 0
+	}
+	return binaryHasCrits
+}
+
+func appendChecks(buf []byte, limit *LimitOp, success, failure *ComparisonOp) []byte {
+	if limit != nil {
+		buf = append(buf, byte(limit.Type))
+		buf = binary.AppendVarint(buf, int64(limit.Amount))
+	}
+	if success != nil {
+		buf = appendComparison(buf, success)
+	}
+	if failure != nil {
+		buf = appendComparison(buf, failure)
+	}
+	return buf
+}
+
+func checkFlags(limit *LimitOp, success, failure *ComparisonOp) (flags byte) {
+	if limit != nil {
+		flags |= binaryHasLimit
+	}
+	if success != nil {
+		flags |= binaryHasSuccess
+	}
+	if failure != nil {
+		flags |= binaryHasFailure
+	}
+	return flags
+}
+
+func appendDiceTerm(buf []byte, term DiceTerm) ([]byte, error) {
+	buf = binary.AppendVarint(buf, int64(term.Multiplier))
+	switch d := term.Die.(type) {
+	case NormalDie:
+		buf = append(buf, binaryNormalDie)
+		buf = binary.AppendVarint(buf, int64(d))
+	case PercentileDie:
+		buf = append(buf, binaryPercentileDie)
+	case FateDie:
+		buf = append(buf, binaryFateDie)
+	case CustomDie:
+		buf = append(buf, binaryCustomDie)
+		buf = appendString(buf, d.Name)
+		buf = binary.AppendUvarint(buf, uint64(len(d.Faces)))
+		for _, face := range d.Faces {
+			buf = binary.AppendVarint(buf, int64(face.Value))
+			buf = appendString(buf, face.Symbol)
+			buf = binary.AppendUvarint(buf, uint64(len(face.Symbols)))
+			for _, symbol := range slices.Sorted(maps.Keys(face.Symbols)) {
+				buf = appendString(buf, symbol)
+				buf = binary.AppendVarint(buf, int64(face.Symbols[symbol]))
+			}
+		}
+	default:
+		return nil, ErrInvalidEncoding(fmt.Sprintf("unsupported die type %T", term.Die))
+	}
+	buf = binary.AppendVarint(buf, int64(term.Modifier))
+
+	flags := checkFlags(term.Limit, term.Success, term.Failure)
+	if term.Exploding != nil {
+		flags |= binaryHasExploding
+	}
+	if term.Match != nil {
+		flags |= binaryHasMatch
+	}
+	flags |= critFlags(term.CritSuccess, term.CritFailure)
+	buf = append(buf, flags)
+	if term.Exploding != nil {
+		typ := byte(term.Exploding.Type)
+		if term.Exploding.MaxExplosions != 0 {
+			typ |= binaryCappedExplosion
+		}
+		buf = append(buf, typ)
+		buf = appendComparison(buf, term.Exploding.ComparisonOp)
+		if term.Exploding.MaxExplosions != 0 {
+			buf = binary.AppendVarint(buf, int64(term.Exploding.MaxExplosions))
+		}
+	}
+	buf = appendChecks(buf, term.Limit, term.Success, term.Failure)
+	buf = appendCrits(buf, term.CritSuccess, term.CritFailure)
+	if term.Match != nil {
+		buf = appendBool(buf, term.Match.Count)
+		buf = binary.AppendVarint(buf, int64(term.Match.MinSize))
+		buf = appendOptionalComparison(buf, term.Match.Compare)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(term.Rerolls)))
+	for _, reroll := range term.Rerolls {
+		buf = appendBool(buf, reroll.Once)
+		buf = appendComparison(buf, reroll.ComparisonOp)
+	}
+	buf = append(buf, byte(term.Sort))
+	buf = appendString(buf, term.Label)
+	return appendString(buf, term.Notation), nil
+}
+
+func appendGroupTerm(buf []byte, term GroupTerm) []byte {
+	buf = binary.AppendVarint(buf, int64(term.Modifier))
+	flags := checkFlags(term.Limit, term.Success, term.Failure)
+	if term.Combined {
+		flags |= binaryCombined
+	}
+	if term.Negative {
+		flags |= binaryNegative
+	}
+	flags |= critFlags(term.CritSuccess, term.CritFailure)
+	buf = append(buf, flags)
+	buf = appendChecks(buf, term.Limit, term.Success, term.Failure)
+	buf = appendCrits(buf, term.CritSuccess, term.CritFailure)
+	buf = binary.AppendUvarint(buf, uint64(term.ChildCount))
+	buf = appendString(buf, term.Label)
+	return appendString(buf, term.Notation)
+}
+
+func appendRepeatTerm(buf []byte, term RepeatTerm) []byte {
+	buf = binary.AppendVarint(buf, int64(term.Count))
+	buf = append(buf, byte(term.Sort))
+	return appendString(buf, term.Notation)
+}
+
+func appendAggregateTerm(buf []byte, term AggregateTerm) []byte {
+	buf = binary.AppendUvarint(buf, uint64(term.ChildCount))
+	return appendOptionalComparison(buf, term.Count)
+}
+
+// binaryReader decodes the binary format, recording the first error it
+// meets and returning zero values from then on.
+type binaryReader struct {
+	data []byte
+	pos  int
+	err  error
+	// version is the format version of the data.
+	version uint64
+}
+
+func (r *binaryReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = ErrInvalidEncoding(fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data) {
+		r.fail("unexpected end of data")
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n == 0 {
+		r.fail("unexpected end of data")
+		return 0
+	}
+	if n < 0 {
+		r.fail("malformed varint at offset %d", r.pos)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.pos:])
+	if n == 0 {
+		r.fail("unexpected end of data")
+		return 0
+	}
+	if n < 0 {
+		r.fail("malformed varint at offset %d", r.pos)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// int converts an unsigned value to an int, failing if it does not fit.
+func (r *binaryReader) int(v uint64) int {
+	if v > uint64(int(^uint(0)>>1)) {
+		r.fail("value %d out of range", v)
+		return 0
+	}
+	return int(v)
+}
+
+// count reads a length prefix, rejecting lengths that could not possibly fit
+// in the remaining data so corrupt input cannot force huge allocations.
+func (r *binaryReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail("count %d exceeds remaining data", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binaryReader) bool() bool {
+	switch b := r.byte(); b {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		r.fail("invalid boolean %d", b)
+		return false
+	}
+}
+
+func (r *binaryReader) string() string {
+	n := r.count()
+	if r.err != nil {
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+n])
+	r.pos += n
+	return s
+}
+
+// label reads the label of a term, which versions before labels omit.
+func (r *binaryReader) label() string {
+	if r.version < binaryLabelsVersion {
+		return ""
+	}
+	return r.string()
+}
+
+func (r *binaryReader) comparison() *ComparisonOp {
+	return &ComparisonOp{
+		Type:      ComparisonType(r.byte()),
+		Value:     int(r.varint()),
+		Inclusive: r.bool(),
+	}
+}
+
+// optionalComparison reads a comparison written by appendOptionalComparison.
+func (r *binaryReader) optionalComparison() *ComparisonOp {
+	if !r.bool() {
+		return nil
+	}
+	return r.comparison()
+}
+
+// crits reads the critical success and failure checks of a term.
+func (r *binaryReader) crits(flags byte) (success, failure *ComparisonOp) {
+	if flags&binaryHasCrits == 0 {
+		return nil, nil
+	}
+	return r.optionalComparison(), r.optionalComparison()
+}
+
+func (r *binaryReader) checks(flags byte) (limit *LimitOp, success, failure *ComparisonOp) {
+	if flags&binaryHasLimit != 0 {
+		limit = &LimitOp{Type: LimitType(r.byte()), Amount: int(r.varint())}
+	}
+	if flags&binaryHasSuccess != 0 {
+		success = r.comparison()
+	}
+	if flags&binaryHasFailure != 0 {
+		failure = r.comparison()
+	}
+	return
+}
+
+func (r *binaryReader) diceTerm() (term DiceTerm) {
+	term.Multiplier = int(r.varint())
+	switch kind := r.byte(); kind {
+	case binaryNormalDie:
+		term.Die = NormalDie(r.varint())
+	case binaryPercentileDie:
+		term.Die = PercentileDie(0)
+	case binaryFateDie:
+		term.Die = FateDie(0)
+	case binaryCustomDie:
+		die := CustomDie{Name: r.string()}
+		for n := r.count(); n > 0; n-- {
+			face := DieFace{Value: int(r.varint()), Symbol: r.string()}
+			for n := r.count(); n > 0; n-- {
+				if face.Symbols == nil {
+					face.Symbols = map[string]int{}
+				}
+				symbol := r.string()
+				face.Symbols[symbol] = int(r.varint())
+			}
+			die.Faces = append(die.Faces, face)
+		}
+		term.Die = die
+	default:
+		r.fail("unknown die kind %d", kind)
+	}
+	term.Modifier = int(r.varint())
+
+	flags := r.byte()
+	if flags&binaryHasExploding != 0 {
+		typ := r.byte()
+		term.Exploding = &ExplodingOp{Type: ExplodingType(typ &^ binaryCappedExplosion), ComparisonOp: r.comparison()}
+		if typ&binaryCappedExplosion != 0 {
+			term.Exploding.MaxExplosions = int(r.varint())
+		}
+	}
+	term.Limit, term.Success, term.Failure = r.checks(flags)
+	term.CritSuccess, term.CritFailure = r.crits(flags)
+	if flags&binaryHasMatch != 0 {
+		term.Match = &MatchOp{Count: r.bool(), MinSize: int(r.varint())}
+		term.Match.Compare = r.optionalComparison()
+	}
+
+	for n := r.count(); n > 0; n-- {
+		once := r.bool()
+		term.Rerolls = append(term.Rerolls, RerollOp{Once: once, ComparisonOp: r.comparison()})
+	}
+	term.Sort = SortType(r.byte())
+	term.Label = r.label()
+	term.Notation = r.string()
+	return term
+}
+
+func (r *binaryReader) repeatTerm() (term RepeatTerm) {
+	term.Count = int(r.varint())
+	term.Sort = SortType(r.byte())
+	term.Notation = r.string()
+	return term
+}
+
+func (r *binaryReader) aggregateTerm() (term AggregateTerm) {
+	term.ChildCount = r.int(r.uvarint())
+	term.Count = r.optionalComparison()
+	return term
+}
+
+func (r *binaryReader) groupTerm() (term GroupTerm) {
+	term.Modifier = int(r.varint())
+	flags := r.byte()
+	term.Combined = flags&binaryCombined != 0
+	term.Negative = flags&binaryNegative != 0
+	term.Limit, term.Success, term.Failure = r.checks(flags)
+	term.CritSuccess, term.CritFailure = r.crits(flags)
+	term.ChildCount = r.int(r.uvarint())
+	term.Label = r.label()
+	term.Notation = r.string()
+	return term
+}
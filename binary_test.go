@@ -0,0 +1,143 @@
+package roll
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestProgram_BinaryRoundTrip(t *testing.T) {
+	inputs := []string{
+		"7",
+		"3d6+4",
+		"4d6kh3sd",
+		"10d10!>8r1ro<2>=7f=1",
+		"2d6!!5+1d20!p20*2",
+		"{4d6kh3, 4d6dl1, 2}kh1/2",
+		"-{2d6+1d4-1}dl1>3+4",
+		"4dF-d%",
+		"1d20+5[STR]+{2d6[fire], 1d4[cold]}kh1[best]-2[STR]",
+		"(1d4)d6kh2+{1d3}d(2*1d4)-2d(1d6+1)",
+		"4d{0,0,1:hit,2:crit}!2kh2",
+		"2d{0,success,success+advantage,advantage+advantage}+d{0,failure,threat+threat}",
+		"6d6mt3+8d10kh6m>=7sd",
+		"1d20cs>=19cf<3+{2d6, 1d8}kh1cs8",
+		"2d6!o3>5+d10!!o=10-d4!po=4",
+		"1d20+5[STR] vs 1d20+3",
+		"(2d6) >= 8",
+		"6 x 4d6kh3",
+		"repeat(3, 1d20+5 vs 1d20)sd",
+		"max{1d20, 1d20}+floor(7/2)-count{4d6kh3, 3d6}>10+abs(1d4-3)+avg{1d6, 1d8}",
+		"repeat(2, round(sum{1d6, 1d8}/3))",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			program := compileProgram(t, input)
+			data, err := program.MarshalBinary()
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+
+			var decoded Program
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(*program, decoded) {
+				t.Fatalf("program mismatch:\nexp=%+v\ngot=%+v", *program, decoded)
+			}
+		})
+	}
+}
+
+func TestProgram_UnmarshalBinaryVersion1(t *testing.T) {
+	tests := []struct {
+		file  string
+		input string
+	}{
+		{file: "testdata/program_v1.bin", input: "3d6+2"},
+		{file: "testdata/program_v1_group.bin", input: "{4d6kh3, 2d8!>7}kh1-1d4r1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			data, err := os.ReadFile(tt.file)
+			if err != nil {
+				t.Fatalf("read fixture: %v", err)
+			}
+			var decoded Program
+			if err := decoded.UnmarshalBinary(data); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+
+			program := compileProgram(t, tt.input)
+			if decoded.String() != program.String() || !reflect.DeepEqual(decoded.Code, program.Code) {
+				t.Fatalf("program mismatch:\nexp=%+v\ngot=%+v", *program, decoded)
+			}
+			exp, got := evaluateProgram(t, 3, tt.input), Result{}
+			withTestSeed(3, func() {
+				if got, err = EvaluateProgram(&decoded); err != nil {
+					t.Fatalf("evaluate: %v", err)
+				}
+			})
+			if got.Total != exp.Total {
+				t.Fatalf("total mismatch: exp=%d got=%d", exp.Total, got.Total)
+			}
+		})
+	}
+}
+
+func TestProgram_UnmarshalBinaryErrors(t *testing.T) {
+	valid, err := compileProgram(t, "{2d6!!6, 1d8r<2}kh1>=5").MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	unbalanced, err := (&Program{
+		Code:      []Instruction{{Op: OpRollDice}, {Op: OpRollDice}},
+		DiceTerms: []DiceTerm{{Multiplier: 1, Die: NormalDie(6)}},
+		MaxDepth:  1,
+	}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{name: "magic", data: []byte("JUNK\x01"), err: "invalid encoding: missing program header"},
+		{name: "version", data: []byte("ROLL\x03"), err: "invalid encoding: unsupported program version 3"},
+		{name: "truncated", data: valid[:len(valid)-3], err: "invalid encoding: unexpected end of data"},
+		{name: "missing sections", data: valid[:len(valid)-2], err: "invalid encoding: unexpected end of data"},
+		{name: "trailing", data: append(append([]byte(nil), valid...), 0), err: "invalid encoding: 1 trailing bytes"},
+		{name: "huge count", data: []byte("ROLL\x01\x01\x00\xff\xff\xff\xff\x0f"), err: "invalid encoding: count 4294967295 exceeds remaining data"},
+		{name: "unverified", data: unbalanced, err: "invalid program: program leaves 2 results on the VM stack"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var program Program
+			err := program.UnmarshalBinary(tt.data)
+			if err == nil {
+				t.Fatal("expected decoding error")
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("unexpected error: exp=%q got=%q", tt.err, err.Error())
+			}
+		})
+	}
+
+	// Every truncation of a valid program must fail cleanly.
+	for n := range valid {
+		var program Program
+		err := program.UnmarshalBinary(valid[:n])
+		var encodingErr ErrInvalidEncoding
+		var programErr ErrInvalidProgram
+		if !errors.As(err, &encodingErr) && !errors.As(err, &programErr) {
+			t.Fatalf("truncated to %d bytes: unexpected error %v", n, err)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	tea "charm.land/bubbletea/v2"
@@ -20,6 +22,17 @@ type rollResultMsg struct {
 	expression string
 	output     string
 	err        error
+	// query is set when the roll stopped at a query that has no answer yet.
+	query *roll.Query
+}
+
+// errQueryPending stops a roll at a query the player has not answered yet.
+type errQueryPending struct {
+	query roll.Query
+}
+
+func (e *errQueryPending) Error() string {
+	return fmt.Sprintf("query %q has not been answered", e.query.Prompt)
 }
 
 type model struct {
@@ -30,8 +43,14 @@ type model struct {
 	historyIndex   int
 	historyDraft   string
 	quitting       bool
-	evaluator      func(string) (string, error)
+	evaluator      func(string, roll.QueryResolver) (string, error)
 	clipboardReady func() tea.Msg
+
+	// pending is the query being asked for pendingExpression, and answers
+	// holds the answers given so far.
+	pending           *roll.Query
+	pendingExpression string
+	answers           map[string]string
 }
 
 func newModel() model {
@@ -41,8 +60,8 @@ func newModel() model {
 	}
 }
 
-func evaluateExpression(expression string) (string, error) {
-	return roll.ParseString(expression)
+func evaluateExpression(expression string, queries roll.QueryResolver) (string, error) {
+	return roll.ParseStringWithOptions(expression, roll.EvalOptions{Limits: roll.DefaultLimits, Queries: queries})
 }
 
 func (m model) Init() tea.Cmd {
@@ -54,9 +73,22 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyPressMsg:
 		switch msg.String() {
 		case "ctrl+c", "esc", "q":
+			if m.pending != nil && msg.String() == "q" {
+				m.insertRunes([]rune("q"))
+				return m, nil
+			}
+			if m.pending != nil && msg.String() == "esc" {
+				m.pending, m.answers = nil, nil
+				m.input = nil
+				m.cursor = 0
+				return m, nil
+			}
 			m.quitting = true
 			return m, tea.Quit
 		case "enter":
+			if m.pending != nil {
+				return m, m.answerQuery()
+			}
 			expression := strings.TrimSpace(string(m.input))
 			if expression == "" {
 				return m, nil
@@ -65,6 +97,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.input = nil
 			m.cursor = 0
 			m.resetHistoryNavigation()
+			m.answers = map[string]string{}
 			return m, m.submitRoll(expression)
 		case "up", "ctrl+p":
 			m.navigateHistory(-1)
@@ -123,6 +156,11 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, nil
 	case rollResultMsg:
+		if msg.query != nil {
+			m.pending = msg.query
+			m.pendingExpression = msg.expression
+			return m, nil
+		}
 		entry := historyEntry{
 			expression: msg.expression,
 			failed:     msg.err != nil,
@@ -141,8 +179,23 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 func (m model) submitRoll(expression string) tea.Cmd {
 	evaluator := m.evaluator
+	answers := make(map[string]string, len(m.answers))
+	for prompt, answer := range m.answers {
+		answers[prompt] = answer
+	}
+	queries := roll.QueryResolverFunc(func(query roll.Query) (string, error) {
+		if answer, ok := answers[query.Prompt]; ok {
+			return answer, nil
+		}
+		return "", &errQueryPending{query: query}
+	})
+
 	return func() tea.Msg {
-		output, err := evaluator(expression)
+		output, err := evaluator(expression, queries)
+		var pending *errQueryPending
+		if errors.As(err, &pending) {
+			return rollResultMsg{expression: expression, query: &pending.query}
+		}
 		return rollResultMsg{
 			expression: expression,
 			output:     output,
@@ -151,6 +204,25 @@ func (m model) submitRoll(expression string) tea.Cmd {
 	}
 }
 
+// answerQuery records the input as the answer to the pending query and
+// rolls the expression again. A dropdown option may be picked by number.
+func (m *model) answerQuery() tea.Cmd {
+	answer := strings.TrimSpace(string(m.input))
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(m.pending.Options) {
+		answer = m.pending.Options[n-1].Value
+	}
+	if m.answers == nil {
+		m.answers = map[string]string{}
+	}
+	m.answers[m.pending.Prompt] = answer
+
+	expression := m.pendingExpression
+	m.pending, m.pendingExpression = nil, ""
+	m.input = nil
+	m.cursor = 0
+	return m.submitRoll(expression)
+}
+
 func (m *model) insertRunes(runes []rune) {
 	if len(runes) == 0 {
 		return
@@ -218,6 +290,7 @@ func (m model) View() tea.View {
 	builder.WriteString("Dice rolling REPL\n")
 	builder.WriteString("Enter a dice expression and press Enter.\n")
 	builder.WriteString("Keys: q/esc/ctrl+c quit, up/down browse history, ctrl+v paste clipboard, left/right move, backspace/delete edit, ctrl+u clear.\n\n")
+	builder.WriteString(m.renderQuery())
 	builder.WriteString(m.renderInput())
 	builder.WriteString("\n\nRecent rolls:\n")
 
@@ -241,10 +314,41 @@ func (m model) View() tea.View {
 	return view
 }
 
+// renderQuery describes the pending query, if there is one.
+func (m model) renderQuery() string {
+	if m.pending == nil {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("%s asks: %s\n", m.pendingExpression, m.pending.Prompt))
+	for i, option := range m.pending.Options {
+		builder.WriteString(fmt.Sprintf("  %d) %s", i+1, option.Label))
+		if option.Value != option.Label {
+			builder.WriteString(fmt.Sprintf(" (%s)", option.Value))
+		}
+		builder.WriteString("\n")
+	}
+	if answer := m.pending.DefaultAnswer(); answer != "" {
+		builder.WriteString(fmt.Sprintf("Press Enter for %s, or esc to cancel.\n", answer))
+	} else {
+		builder.WriteString("Press esc to cancel.\n")
+	}
+	return builder.String()
+}
+
 func (m model) renderInput() string {
 	var builder strings.Builder
-	builder.WriteString("roll> ")
+	if m.pending != nil {
+		builder.WriteString("answer> ")
+	} else {
+		builder.WriteString("roll> ")
+	}
 
+	if m.pending != nil && len(m.input) == 0 {
+		builder.WriteRune('█')
+		return builder.String()
+	}
 	if len(m.input) == 0 {
 		builder.WriteRune('█')
 		builder.WriteString(" try 3d6+2 or {d6, d8}")
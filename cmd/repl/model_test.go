@@ -5,11 +5,12 @@ import (
 	"testing"
 
 	tea "charm.land/bubbletea/v2"
+	"github.com/darkliquid/roll"
 )
 
 func TestModelSubmitSuccess(t *testing.T) {
 	m := newModel()
-	m.evaluator = func(expression string) (string, error) {
+	m.evaluator = func(expression string, _ roll.QueryResolver) (string, error) {
 		if expression != "3d6+2" {
 			t.Fatalf("unexpected expression: %q", expression)
 		}
@@ -46,7 +47,7 @@ func TestModelSubmitSuccess(t *testing.T) {
 
 func TestModelSubmitError(t *testing.T) {
 	m := newModel()
-	m.evaluator = func(expression string) (string, error) {
+	m.evaluator = func(expression string, _ roll.QueryResolver) (string, error) {
 		if expression != "oops" {
 			t.Fatalf("unexpected expression: %q", expression)
 		}
@@ -159,7 +160,7 @@ func TestModelClipboardShortcutReadsClipboard(t *testing.T) {
 
 func TestModelSubmitStoresHistoryWithoutImmediateDuplicate(t *testing.T) {
 	m := newModel()
-	m.evaluator = func(expression string) (string, error) {
+	m.evaluator = func(expression string, _ roll.QueryResolver) (string, error) {
 		return expression, nil
 	}
 	m.input = []rune("2d8")
@@ -181,3 +182,79 @@ func TestModelSubmitStoresHistoryWithoutImmediateDuplicate(t *testing.T) {
 		t.Fatalf("expected duplicate submission to be coalesced, got %#v", updated.historyInputs)
 	}
 }
+
+func TestModelPromptsForQueries(t *testing.T) {
+	m := newModel()
+	m.evaluator = func(expression string, queries roll.QueryResolver) (string, error) {
+		weapon, err := queries.Resolve(roll.Query{Prompt: "Weapon", Options: []roll.QueryOption{
+			{Label: "Sword", Value: "1d8"},
+			{Label: "Axe", Value: "1d10"},
+		}})
+		if err != nil {
+			return "", err
+		}
+		bonus, err := queries.Resolve(roll.Query{Prompt: "Bonus", Default: "0"})
+		if err != nil {
+			return "", err
+		}
+		return weapon + "+" + bonus, nil
+	}
+	m.input = []rune("?{Weapon|Sword,1d8|Axe,1d10}+?{Bonus|0}")
+	m.cursor = len(m.input)
+
+	updatedModel, cmd := m.Update(tea.KeyPressMsg{Code: tea.KeyEnter})
+	updatedModel, _ = updatedModel.Update(cmd())
+	updated := updatedModel.(model)
+	if updated.pending == nil || updated.pending.Prompt != "Weapon" {
+		t.Fatalf("expected weapon query, got %+v", updated.pending)
+	}
+	if len(updated.history) != 0 {
+		t.Fatalf("expected no history while querying, got %d", len(updated.history))
+	}
+
+	updated.input = []rune("2")
+	updated.cursor = 1
+	updatedModel, cmd = updated.Update(tea.KeyPressMsg{Code: tea.KeyEnter})
+	updatedModel, _ = updatedModel.Update(cmd())
+	updated = updatedModel.(model)
+	if updated.pending == nil || updated.pending.Prompt != "Bonus" {
+		t.Fatalf("expected bonus query, got %+v", updated.pending)
+	}
+
+	updatedModel, _ = updated.Update(tea.KeyPressMsg{Code: 'q', Text: "q"})
+	updated = updatedModel.(model)
+	if updated.quitting || string(updated.input) != "q" {
+		t.Fatalf("expected q to be typed into the answer, got %q (quitting=%v)", string(updated.input), updated.quitting)
+	}
+
+	updated.input = []rune("3")
+	updated.cursor = 1
+	updatedModel, cmd = updated.Update(tea.KeyPressMsg{Code: tea.KeyEnter})
+	updatedModel, _ = updatedModel.Update(cmd())
+	updated = updatedModel.(model)
+	if updated.pending != nil {
+		t.Fatalf("expected all queries answered, got %+v", updated.pending)
+	}
+	if len(updated.history) != 1 || updated.history[0].output != "1d10+3" {
+		t.Fatalf("unexpected history: %+v", updated.history)
+	}
+}
+
+func TestModelCancelsQuery(t *testing.T) {
+	m := newModel()
+	m.input = []rune("1d20+?{Bonus}")
+	m.cursor = len(m.input)
+
+	updatedModel, cmd := m.Update(tea.KeyPressMsg{Code: tea.KeyEnter})
+	updatedModel, _ = updatedModel.Update(cmd())
+	updated := updatedModel.(model)
+	if updated.pending == nil || updated.pending.Prompt != "Bonus" {
+		t.Fatalf("expected bonus query, got %+v", updated.pending)
+	}
+
+	updatedModel, _ = updated.Update(tea.KeyPressMsg{Code: tea.KeyEscape})
+	updated = updatedModel.(model)
+	if updated.quitting || updated.pending != nil {
+		t.Fatalf("expected query to be cancelled without quitting (quitting=%v)", updated.quitting)
+	}
+}
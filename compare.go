@@ -0,0 +1,208 @@
+package roll
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// CompareKind is the comparison made by an OpCompare instruction.
+type CompareKind int
+
+const (
+	// CompareVersus pits two opposed rolls against each other, as in
+	// 1d20+5 vs 1d20+3.
+	CompareVersus CompareKind = iota
+	// CompareEqual checks that a roll equals its target, as in 2d6 = 7.
+	CompareEqual
+	// CompareGreater checks that a roll beats its target, as in 2d6 > 7.
+	CompareGreater
+	// CompareGreaterOrEqual checks that a roll meets its target, as in
+	// 2d6 >= 8.
+	CompareGreaterOrEqual
+	// CompareLess checks that a roll is under its target, as in 1d100 < 40.
+	CompareLess
+	// CompareLessOrEqual checks that a roll is at most its target, as in
+	// 1d100 <= 40.
+	CompareLessOrEqual
+)
+
+// String returns the notation of the comparison.
+func (k CompareKind) String() string {
+	switch k {
+	case CompareVersus:
+		return "vs"
+	case CompareEqual:
+		return "="
+	case CompareGreater:
+		return ">"
+	case CompareGreaterOrEqual:
+		return ">="
+	case CompareLess:
+		return "<"
+	case CompareLessOrEqual:
+		return "<="
+	}
+	return "unknown"
+}
+
+// Passes reports whether a check of this kind passes with the given margin,
+// the roll less its target. It is false for CompareVersus.
+func (k CompareKind) Passes(margin int) bool {
+	switch k {
+	case CompareEqual:
+		return margin == 0
+	case CompareGreater:
+		return margin > 0
+	case CompareGreaterOrEqual:
+		return margin >= 0
+	case CompareLess:
+		return margin < 0
+	case CompareLessOrEqual:
+		return margin <= 0
+	}
+	return false
+}
+
+// Side is one side of a comparison.
+type Side int
+
+const (
+	// NoSide is the winner of an opposed roll that ties under TiesDraw.
+	NoSide Side = iota
+	// LeftSide is the roll written first, and the winner of a check that
+	// passes.
+	LeftSide
+	// RightSide is the roll written second, and the winner of a check that
+	// fails.
+	RightSide
+)
+
+// TiePolicy decides the winner of opposed rolls that tie.
+type TiePolicy int
+
+const (
+	// TiesDraw leaves a tied opposed roll without a winner.
+	TiesDraw TiePolicy = iota
+	// TiesToLeft gives tied opposed rolls to the left side.
+	TiesToLeft
+	// TiesToRight gives tied opposed rolls to the right side, as when a
+	// defender wins ties.
+	TiesToRight
+)
+
+// winner returns the side that wins an opposed roll with the given margin.
+func (t TiePolicy) winner(margin int) Side {
+	switch {
+	case margin > 0:
+		return LeftSide
+	case margin < 0:
+		return RightSide
+	case t == TiesToLeft:
+		return LeftSide
+	case t == TiesToRight:
+		return RightSide
+	}
+	return NoSide
+}
+
+// Comparison is the outcome of an opposed roll or a check against a target.
+type Comparison struct {
+	Kind CompareKind
+	// Left and Right are the results of the two sides.
+	Left  Result
+	Right Result
+	// Margin is the left total less the right total.
+	Margin int
+	// Winner is the side that won. A check is won by the left side when it
+	// passes and by the right side, its target, when it fails.
+	Winner Side
+}
+
+// ErrUnknownComparison is raised when evaluating an OpCompare instruction
+// with an unknown CompareKind.
+type ErrUnknownComparison int
+
+func (e ErrUnknownComparison) Error() string {
+	return fmt.Sprintf("unknown comparison kind %d", int(e))
+}
+
+// evalCompare compares two values. The total of the result is 1 when the
+// left side wins, -1 when the right side wins an opposed roll and 0 for a
+// failed check or a draw. Each side tallies its narrative symbols with the
+// cancellation rules given.
+func evalCompare(kind CompareKind, ties TiePolicy, rules []Cancellation, left, right vmValue) (result Result, err error) {
+	margin := left.Result.Total - right.Result.Total
+	comparison := &Comparison{Kind: kind, Left: sideResult(left, rules), Right: sideResult(right, rules), Margin: margin}
+
+	switch {
+	case kind == CompareVersus:
+		comparison.Winner = ties.winner(margin)
+	case kind < CompareVersus || kind > CompareLessOrEqual:
+		return Result{}, ErrUnknownComparison(kind)
+	case kind.Passes(margin):
+		comparison.Winner = LeftSide
+	default:
+		comparison.Winner = RightSide
+	}
+
+	switch comparison.Winner {
+	case LeftSide:
+		result.Total = 1
+	case RightSide:
+		if kind == CompareVersus {
+			result.Total = -1
+		}
+	}
+	result.Rolls = append(append([]DieRoll(nil), left.Result.Rolls...), right.Result.Rolls...)
+	result.Truncated = left.Result.Truncated || right.Result.Truncated
+	result.Comparison = comparison
+	return result, nil
+}
+
+// sideResult returns the result of one side of a comparison, with its labels,
+// narrative symbols and, for a single term, its result tree.
+func sideResult(v vmValue, rules []Cancellation) Result {
+	result := v.Result
+	result.Labels = v.labels
+	result.Symbols = tallySymbols(result.Rolls, rules)
+	if len(v.nodes) == 1 && !v.Computed {
+		result.Tree = v.nodes[0]
+	}
+	return result
+}
+
+// formatComparison describes the outcome of a comparison, as in
+// "17 vs 12 for a win by 5" or "7 against 8 for a fail by 1".
+func formatComparison(c *Comparison) string {
+	var outcome string
+	switch {
+	case c.Kind != CompareVersus && c.Winner == LeftSide:
+		outcome = "pass"
+	case c.Kind != CompareVersus:
+		outcome = "fail"
+	case c.Winner == LeftSide:
+		outcome = "win"
+	case c.Winner == RightSide:
+		outcome = "loss"
+	default:
+		outcome = "tie"
+	}
+
+	output := fmt.Sprintf("%s vs %s for a %s", formatOutcome(c.Left), formatOutcome(c.Right), outcome)
+	if c.Kind != CompareVersus {
+		output = fmt.Sprintf("%s against %s for a %s", formatOutcome(c.Left), formatOutcome(c.Right), outcome)
+	}
+	if c.Margin != 0 {
+		output += " by " + strconv.Itoa(max(c.Margin, -c.Margin))
+	}
+	return output
+}
+
+// formatOutcome describes what a roll came to: its net narrative symbols if
+// it rolled any, and its total otherwise.
+func formatOutcome(result Result) string {
+	if hasSymbols(result.Rolls) {
+		return formatSymbols(result.Symbols)
+	}
+	return strconv.Itoa(result.Total)
+}
@@ -0,0 +1,482 @@
+package roll
+
+import (
+	"fmt"
+	"math"
+)
+
+// CostRange bounds a quantity of work done while evaluating a program. Worst
+// is infinite when nothing but the evaluation limits stops the work, as for
+// uncapped explosions and rerolls.
+type CostRange struct {
+	Min      float64
+	Expected float64
+	Worst    float64
+}
+
+// Cost is a static estimate of the work done evaluating a program.
+type Cost struct {
+	// Rolls counts the dice rolled, including rerolls and explosions, as
+	// MaxRollsTotal does.
+	Rolls CostRange
+	// Dice counts the dice listed in Result.Rolls, which holds each die once
+	// however often it was rerolled or compounded.
+	Dice CostRange
+}
+
+// Cost estimates the number of dice rolled and listed when evaluating the
+// program, without rolling it. Rerolls and explosions are assumed to see a
+// fresh roll of the die each time, and computed counts and die sizes are
+// bounded from the expressions they are taken from, so the estimates are
+// exact for simple pools and close for the rest.
+//
+// The program must verify.
+func (p *Program) Cost() Cost {
+	stack := make([]costValue, 0, p.MaxDepth)
+	for _, instruction := range p.Code {
+		switch instruction.Op {
+		case OpRollDice:
+			term := p.DiceTerms[instruction.Arg]
+			count := math.Abs(float64(term.Multiplier))
+			stack = append(stack, diceCost(term, valueRange{count, count, count}, nil))
+		case OpRollDiceCount, OpRollDiceSides, OpRollDiceCountSides:
+			n := instruction.Op.operands()
+			operands := stack[len(stack)-n:]
+			term := p.DiceTerms[instruction.Arg]
+			count := math.Abs(float64(term.Multiplier))
+			countRange := valueRange{count, count, count}
+			var sidesRange *valueRange
+			switch instruction.Op {
+			case OpRollDiceCount:
+				countRange = operands[0].value.atLeast(0)
+			case OpRollDiceSides:
+				sidesRange = &operands[0].value
+			case OpRollDiceCountSides:
+				countRange = operands[0].value.atLeast(0)
+				sidesRange = &operands[1].value
+			}
+			value := diceCost(term, countRange, sidesRange)
+			for _, operand := range operands {
+				value.rolls = value.rolls.add(operand.rolls)
+				value.dice = value.dice.add(operand.dice)
+			}
+			stack = append(stack[:len(stack)-n], value)
+		case OpRollGroup:
+			term := p.GroupTerms[instruction.Arg]
+			children := stack[len(stack)-term.ChildCount:]
+			value := groupCost(term, children)
+			stack = append(stack[:len(stack)-term.ChildCount], value)
+		case OpConst:
+			v := float64(instruction.Arg)
+			stack = append(stack, costValue{value: valueRange{v, v, v}})
+		case OpNeg:
+			stack[len(stack)-1].value = stack[len(stack)-1].value.neg()
+		case OpAbs:
+			stack[len(stack)-1].value = stack[len(stack)-1].value.abs()
+		case OpFloor, OpCeil, OpRound:
+			// Rounding keeps a value within the whole bounds of its range.
+		case OpMax, OpMin, OpSum, OpAvg, OpCount:
+			term := p.AggregateTerms[instruction.Arg]
+			children := stack[len(stack)-term.ChildCount:]
+			value := aggregateCost(instruction.Op, children)
+			stack = append(stack[:len(stack)-term.ChildCount], value)
+		case OpAdd, OpSub, OpMul, OpDiv:
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			value := costValue{rolls: left.rolls.add(right.rolls), dice: left.dice.add(right.dice)}
+			switch instruction.Op {
+			case OpAdd:
+				value.value = left.value.add(right.value)
+			case OpSub:
+				value.value = left.value.add(right.value.neg())
+			case OpMul:
+				value.value = left.value.mul(right.value)
+			case OpDiv:
+				value.value = left.value.div(right.value)
+			}
+			stack = append(stack[:len(stack)-2], value)
+		case OpCompare:
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			value := costValue{rolls: left.rolls.add(right.rolls), dice: left.dice.add(right.dice), value: valueRange{-1, 0, 1}}
+			stack = append(stack[:len(stack)-2], value)
+		case OpRepeat:
+			count := float64(p.RepeatTerms[instruction.Arg].Count)
+			repetitions := valueRange{count, count, count}
+			body := stack[len(stack)-1]
+			stack[len(stack)-1] = costValue{
+				rolls: body.rolls.scale(repetitions),
+				dice:  body.dice.scale(repetitions),
+				value: body.value.mul(repetitions),
+			}
+		}
+	}
+
+	if len(stack) == 0 {
+		return Cost{}
+	}
+	return Cost{Rolls: stack[len(stack)-1].rolls, Dice: stack[len(stack)-1].dice}
+}
+
+// checkCost returns an error if the program is sure to roll more dice than
+// MaxRollsTotal allows, or is expected to roll more than MaxExpectedRolls.
+// Programs whose explosions are truncated stop at MaxRollsTotal instead.
+func checkCost(program *Program, limits Limits) error {
+	if limits.MaxExpectedRolls < 0 {
+		return nil
+	}
+	cost := program.Cost()
+	if limits.Explosions == FailExplosions && cost.Rolls.Min > float64(limits.MaxRollsTotal) {
+		return ErrLimitExceeded(fmt.Sprintf("roll needs at least %.0f die rolls, more than the maximum of %d", cost.Rolls.Min, limits.MaxRollsTotal))
+	}
+	if limits.MaxExpectedRolls > 0 && cost.Rolls.Expected > float64(limits.MaxExpectedRolls) {
+		return ErrLimitExceeded(fmt.Sprintf("roll expects %.0f die rolls, more than the maximum of %d", cost.Rolls.Expected, limits.MaxExpectedRolls))
+	}
+	return nil
+}
+
+// costValue mirrors a VM stack value: the work done producing it and the
+// range of its total.
+type costValue struct {
+	rolls CostRange
+	dice  CostRange
+	value valueRange
+}
+
+// valueRange bounds the total of a value, with its estimated mean.
+type valueRange struct {
+	lo, mean, hi float64
+}
+
+func (v valueRange) atLeast(n float64) valueRange {
+	return valueRange{max(v.lo, n), max(v.mean, n), max(v.hi, n)}
+}
+
+func (v valueRange) neg() valueRange {
+	return valueRange{-v.hi, -v.mean, -v.lo}
+}
+
+func (v valueRange) abs() valueRange {
+	switch {
+	case v.lo >= 0:
+		return v
+	case v.hi <= 0:
+		return v.neg()
+	}
+	return valueRange{0, math.Abs(v.mean), max(-v.lo, v.hi)}
+}
+
+func (v valueRange) add(o valueRange) valueRange {
+	return valueRange{v.lo + o.lo, v.mean + o.mean, v.hi + o.hi}
+}
+
+func (v valueRange) mul(o valueRange) valueRange {
+	products := []float64{times(v.lo, o.lo), times(v.lo, o.hi), times(v.hi, o.lo), times(v.hi, o.hi)}
+	r := valueRange{products[0], times(v.mean, o.mean), products[0]}
+	for _, p := range products[1:] {
+		r.lo, r.hi = min(r.lo, p), max(r.hi, p)
+	}
+	return r
+}
+
+// div bounds rounded division, which never grows a value's magnitude by more
+// than dividing by one does.
+func (v valueRange) div(o valueRange) valueRange {
+	if o.lo <= 0 && o.hi >= 0 {
+		bound := max(math.Abs(v.lo), math.Abs(v.hi))
+		return valueRange{-bound, 0, bound}
+	}
+	r := v.mul(valueRange{1 / o.hi, 1 / o.mean, 1 / o.lo})
+	return valueRange{math.Floor(r.lo), r.mean, math.Ceil(r.hi)}
+}
+
+func (c CostRange) add(o CostRange) CostRange {
+	return CostRange{c.Min + o.Min, c.Expected + o.Expected, c.Worst + o.Worst}
+}
+
+// scale multiplies the work of one die by a range of dice.
+func (c CostRange) scale(count valueRange) CostRange {
+	return CostRange{times(c.Min, count.lo), times(c.Expected, count.mean), times(c.Worst, count.hi)}
+}
+
+// times multiplies a and b, treating no work as no work even when the other
+// side is unbounded.
+func times(a, b float64) float64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return a * b
+}
+
+// diceCost estimates the cost and total of a dice term rolling count dice,
+// with the die size taken from sides when it is computed.
+func diceCost(term DiceTerm, count valueRange, sides *valueRange) costValue {
+	var rolls, dice CostRange
+	var face valueRange
+	if sides == nil {
+		rolls, dice, face = dieCost(term, term.Die)
+	} else {
+		// Work out the cost for the smallest, average and largest dice and
+		// keep the extremes.
+		size := func(n float64) Die {
+			return NormalDie(max(1, min(math.MaxInt32, math.Round(n))))
+		}
+		loRolls, loDice, loFace := dieCost(term, size(sides.lo))
+		rolls, dice, face = dieCost(term, size(sides.mean))
+		hiRolls, hiDice, hiFace := dieCost(term, size(sides.hi))
+		rolls.Min, rolls.Worst = min(loRolls.Min, hiRolls.Min), max(loRolls.Worst, hiRolls.Worst)
+		dice.Min, dice.Worst = min(loDice.Min, hiDice.Min), max(loDice.Worst, hiDice.Worst)
+		face.lo, face.hi = min(loFace.lo, hiFace.lo), max(loFace.hi, hiFace.hi)
+	}
+
+	value := costValue{rolls: rolls.scale(count), dice: dice.scale(count)}
+	switch {
+	case term.Success != nil || term.Failure != nil:
+		value.value = countRange(value.dice, term.Success != nil, term.Failure != nil)
+		if mean, ok := successMean(term); ok {
+			value.value.mean = times(mean, value.dice.Expected)
+		}
+	case term.Match != nil && term.Match.Count:
+		sets := value.dice.Worst / float64(term.Match.MinSize)
+		value.value = valueRange{0, sets / 2, math.Floor(sets)}
+		value.value = value.value.add(valueRange{float64(term.Modifier), float64(term.Modifier), float64(term.Modifier)})
+	default:
+		kept := keptRange(term.Limit, value.dice)
+		value.value = kept.mul(face)
+		value.value.mean = times(kept.mean, face.mean)
+		value.value = value.value.add(valueRange{float64(term.Modifier), float64(term.Modifier), float64(term.Modifier)})
+	}
+	if term.Multiplier < 0 {
+		value.value = value.value.neg()
+	}
+	return value
+}
+
+// dieCost estimates the rolls and listed dice for a single die of the term,
+// along with the range of the value it contributes.
+func dieCost(term DiceTerm, die Die) (rolls, dice CostRange, value valueRange) {
+	rolls = CostRange{1, 1, 1}
+	dice = CostRange{1, 1, 1}
+	lo, hi, ok := faceRange(die)
+	if !ok {
+		return rolls, dice, valueRange{}
+	}
+	value = valueRange{float64(lo), faceMean(die), float64(hi)}
+
+	for _, reroll := range term.Rerolls {
+		p := matchChance(die, reroll.ComparisonOp)
+		if reroll.Once {
+			rolls = rolls.add(CostRange{math.Floor(p), p, math.Ceil(p)})
+		} else {
+			rolls = rolls.add(chainCost(p, 0))
+		}
+	}
+
+	if term.Exploding != nil {
+		extra := chainCost(matchChance(die, term.Exploding.ComparisonOp), term.Exploding.MaxExplosions)
+		rolls = rolls.add(extra)
+		if term.Exploding.Type != Compounded {
+			dice = dice.add(extra)
+		}
+		// Each explosion adds another face to the value.
+		faces := CostRange{1, 1, 1}.add(extra)
+		value = valueRange{min(value.lo, times(value.lo, faces.Worst)), times(value.mean, faces.Expected), max(value.hi, times(value.hi, faces.Worst))}
+	}
+	return rolls, dice, value
+}
+
+// chainCost returns the extra rolls made by repeating a roll while it
+// matches with chance p, at most limit times when limit is positive.
+func chainCost(p float64, limit int) CostRange {
+	switch {
+	case p <= 0:
+		return CostRange{}
+	case limit > 0 && p >= 1:
+		n := float64(limit)
+		return CostRange{n, n, n}
+	case limit > 0:
+		return CostRange{0, p * (1 - math.Pow(p, float64(limit))) / (1 - p), float64(limit)}
+	case p >= 1:
+		return CostRange{math.Inf(1), math.Inf(1), math.Inf(1)}
+	}
+	return CostRange{0, p / (1 - p), math.Inf(1)}
+}
+
+// matchChance returns the chance that a roll of die matches op.
+func matchChance(die Die, op *ComparisonOp) float64 {
+	if op == nil {
+		return 0
+	}
+	if d, ok := die.(CustomDie); ok {
+		if len(d.Faces) == 0 {
+			return 0
+		}
+		matches := 0
+		for _, face := range d.Faces {
+			if op.Match(face.Value) {
+				matches++
+			}
+		}
+		return float64(matches) / float64(len(d.Faces))
+	}
+
+	lo, hi, ok := faceRange(die)
+	if !ok {
+		return 0
+	}
+	// The faces of other dice run from lo to hi, so count the matches in
+	// that range.
+	from, to := lo, hi
+	switch op.Type {
+	case Equals:
+		from, to = max(lo, op.Value), min(hi, op.Value)
+	case GreaterThan:
+		from = max(lo, op.Value)
+		if !op.Inclusive {
+			from = max(lo, op.Value+1)
+		}
+	case LessThan:
+		to = min(hi, op.Value)
+		if !op.Inclusive {
+			to = min(hi, op.Value-1)
+		}
+	}
+	if to < from {
+		return 0
+	}
+	return float64(to-from+1) / float64(hi-lo+1)
+}
+
+// faceMean returns the average face of die.
+func faceMean(die Die) float64 {
+	if d, ok := die.(CustomDie); ok {
+		sum := 0
+		for _, face := range d.Faces {
+			sum += face.Value
+		}
+		return float64(sum) / float64(len(d.Faces))
+	}
+	lo, hi, _ := faceRange(die)
+	return float64(lo+hi) / 2
+}
+
+// successMean returns the average successes less failures counted per die of
+// a term, using the modifier the checks are made with. It returns false when
+// the term's die is computed or unknown.
+func successMean(term DiceTerm) (float64, bool) {
+	if _, _, ok := faceRange(term.Die); !ok {
+		return 0, false
+	}
+	mean := 0.0
+	if term.Success != nil {
+		mean += matchChance(term.Die, shiftComparison(term.Success, term.Modifier))
+	}
+	if term.Failure != nil {
+		mean -= matchChance(term.Die, shiftComparison(term.Failure, term.Modifier))
+	}
+	return mean, true
+}
+
+// shiftComparison returns op as checked against an unmodified die, when the
+// die is checked with modifier added.
+func shiftComparison(op *ComparisonOp, modifier int) *ComparisonOp {
+	shifted := *op
+	shifted.Value -= modifier
+	return &shifted
+}
+
+// countRange bounds a total counting successes, failures or both across the
+// given number of entries.
+func countRange(entries CostRange, success, failure bool) valueRange {
+	switch {
+	case success && failure:
+		return valueRange{-entries.Worst, 0, entries.Worst}
+	case failure:
+		return valueRange{-entries.Worst, -entries.Expected / 2, 0}
+	}
+	return valueRange{0, entries.Expected / 2, entries.Worst}
+}
+
+// keptRange returns the number of entries a keep or drop limit leaves.
+func keptRange(limit *LimitOp, entries CostRange) valueRange {
+	kept := valueRange{entries.Min, entries.Expected, entries.Worst}
+	if limit == nil {
+		return kept
+	}
+	amount := float64(limit.Amount)
+	switch limit.Type {
+	case KeepHighest, KeepLowest:
+		return valueRange{min(kept.lo, amount), min(kept.mean, amount), min(kept.hi, amount)}
+	}
+	return valueRange{max(0, kept.lo-amount), max(0, kept.mean-amount), max(0, kept.hi-amount)}
+}
+
+// groupCost estimates the cost and total of a group term from its children.
+func groupCost(term GroupTerm, children []costValue) costValue {
+	var value costValue
+	var entries CostRange
+	var total valueRange
+	for _, child := range children {
+		value.rolls = value.rolls.add(child.rolls)
+		value.dice = value.dice.add(child.dice)
+		entries = entries.add(CostRange{1, 1, 1})
+		total = total.add(child.value)
+	}
+
+	switch {
+	case term.Success != nil || term.Failure != nil:
+		if term.Combined {
+			entries = value.dice
+		}
+		value.value = countRange(entries, term.Success != nil, term.Failure != nil)
+	case term.Limit != nil:
+		if term.Combined {
+			entries = value.dice
+		}
+		// Any of the entries may be the ones kept, so only the sign of the
+		// bounds can be relied on.
+		kept := keptRange(term.Limit, entries)
+		value.value = valueRange{min(0, total.lo), total.mean, max(0, total.hi)}
+		if entries.Expected > 0 {
+			value.value.mean = total.mean * kept.mean / entries.Expected
+		}
+	default:
+		value.value = total
+	}
+	if term.Success == nil && term.Failure == nil {
+		modifier := float64(term.Modifier)
+		value.value = value.value.add(valueRange{modifier, modifier, modifier})
+	}
+
+	if term.Negative {
+		value.value = value.value.neg()
+	}
+	return value
+}
+
+// aggregateCost estimates the cost and total of an aggregate function from
+// the values it gathers.
+func aggregateCost(op Opcode, children []costValue) costValue {
+	var value costValue
+	for i, child := range children {
+		value.rolls = value.rolls.add(child.rolls)
+		value.dice = value.dice.add(child.dice)
+		switch {
+		case i == 0:
+			value.value = child.value
+		case op == OpMax:
+			value.value = valueRange{max(value.value.lo, child.value.lo), max(value.value.mean, child.value.mean), max(value.value.hi, child.value.hi)}
+		case op == OpMin:
+			value.value = valueRange{min(value.value.lo, child.value.lo), min(value.value.mean, child.value.mean), min(value.value.hi, child.value.hi)}
+		default:
+			value.value = value.value.add(child.value)
+		}
+	}
+
+	n := float64(len(children))
+	switch op {
+	case OpAvg:
+		value.value = valueRange{math.Floor(value.value.lo / n), value.value.mean / n, math.Ceil(value.value.hi / n)}
+	case OpCount:
+		value.value = valueRange{0, n / 2, n}
+	}
+	return value
+}
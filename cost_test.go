@@ -0,0 +1,122 @@
+package roll
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestProgram_Cost(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		input string
+		rolls CostRange
+		dice  CostRange
+	}{
+		{input: "3d6+2", rolls: CostRange{3, 3, 3}, dice: CostRange{3, 3, 3}},
+		{input: "4d6kh3+{2d8, 1d20}kh1", rolls: CostRange{7, 7, 7}, dice: CostRange{7, 7, 7}},
+		{input: "1d6ro1", rolls: CostRange{1, 7.0 / 6, 2}, dice: CostRange{1, 1, 1}},
+		{input: "1d4r1", rolls: CostRange{1, 4.0 / 3, inf}, dice: CostRange{1, 1, 1}},
+		{input: "2d6!6", rolls: CostRange{2, 2.4, inf}, dice: CostRange{2, 2.4, inf}},
+		{input: "1d6!o=6", rolls: CostRange{1, 7.0 / 6, 2}, dice: CostRange{1, 7.0 / 6, 2}},
+		{input: "2d6!!o2>5", rolls: CostRange{2, 2 + 2*(1.0/6+1.0/36), 6}, dice: CostRange{2, 2, 2}},
+		{input: "1d6r<7", rolls: CostRange{inf, inf, inf}, dice: CostRange{1, 1, 1}},
+		{input: "(1d4)d6", rolls: CostRange{2, 3.5, 5}, dice: CostRange{2, 3.5, 5}},
+		{input: "2d(1d4*2)!>8", rolls: CostRange{3, 3, 3}, dice: CostRange{3, 3, 3}},
+		{input: "4d{0,0,1,1,2,3}", rolls: CostRange{4, 4, 4}, dice: CostRange{4, 4, 4}},
+		{input: "6 x 4d6kh3", rolls: CostRange{24, 24, 24}, dice: CostRange{24, 24, 24}},
+		{input: "3 x 1d6ro1 vs 1d6", rolls: CostRange{6, 6.5, 9}, dice: CostRange{6, 6, 6}},
+		{input: "max{1d20, 1d20}+floor(4d6/3)", rolls: CostRange{6, 6, 6}, dice: CostRange{6, 6, 6}},
+		{input: "count{4d6kh3, 4d6kh3, 1d6!>5}>10", rolls: CostRange{9, 9.2, math.Inf(1)}, dice: CostRange{9, 9.2, math.Inf(1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			// Programs that can never finish are rejected by the default
+			// limits, so skip the cost checks to estimate them.
+			program, err := CompileStringWithLimits(tt.input, Limits{MaxExpectedRolls: -1})
+			if err != nil {
+				t.Fatalf("compile %q: %v", tt.input, err)
+			}
+			cost := program.Cost()
+			if !costNear(cost.Rolls, tt.rolls) {
+				t.Fatalf("unexpected rolls: exp=%+v got=%+v", tt.rolls, cost.Rolls)
+			}
+			if !costNear(cost.Dice, tt.dice) {
+				t.Fatalf("unexpected dice: exp=%+v got=%+v", tt.dice, cost.Dice)
+			}
+		})
+	}
+}
+
+func costNear(a, b CostRange) bool {
+	near := func(x, y float64) bool {
+		return x == y || math.Abs(x-y) < 1e-9
+	}
+	return near(a.Min, b.Min) && near(a.Expected, b.Expected) && near(a.Worst, b.Worst)
+}
+
+func TestCompile_MaxExpectedRolls(t *testing.T) {
+	limits := DefaultLimits
+	limits.MaxExpectedRolls = 1000
+
+	for _, input := range []string{"100d6!>5", "10d6r<6", "(1d100)d6!>5"} {
+		if _, err := CompileStringWithLimits(input, limits); err != nil {
+			t.Fatalf("compile %q: %v", input, err)
+		}
+	}
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "1000000d1000000!>2", err: "roll expects 500000000013 die rolls, more than the maximum of 1000 at column 1"},
+		{input: "1d6r<7", err: "roll needs at least +Inf die rolls, more than the maximum of 1000000 at column 1"},
+		{input: "(20d100)d6", err: "roll expects 1030 die rolls, more than the maximum of 1000 at column 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := CompileStringWithLimits(tt.input, limits)
+			var limitErr ErrLimitExceeded
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("expected limit error, got %v", err)
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("unexpected error: exp=%q got=%q", tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestCompile_DefaultCostLimits(t *testing.T) {
+	tests := []struct {
+		input  string
+		limits Limits
+		err    string
+	}{
+		{input: "1000000d1000000!>2", limits: DefaultLimits, err: "roll expects 500000000013 die rolls, more than the maximum of 1000000 at column 1"},
+		{input: "2d6!>0", limits: DefaultLimits, err: "roll needs at least +Inf die rolls, more than the maximum of 1000000 at column 1"},
+		{input: "6 x 3d6", limits: Limits{MaxRollsTotal: 10}, err: "roll needs at least 18 die rolls, more than the maximum of 10 at column 1"},
+		{input: "(1d4)d6", limits: Limits{MaxRollsTotal: 3}, err: "roll expects 4 die rolls, more than the maximum of 3 at column 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := CompileStringWithLimits(tt.input, tt.limits)
+			var limitErr ErrLimitExceeded
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("expected limit error, got %v", err)
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("unexpected error: exp=%q got=%q", tt.err, err.Error())
+			}
+		})
+	}
+
+	// Truncated explosions stop at the roll limit, and a negative
+	// MaxExpectedRolls opts out of the checks.
+	for _, limits := range []Limits{{Explosions: TruncateExplosions}, {MaxExpectedRolls: -1}} {
+		if _, err := CompileStringWithLimits("1000000d1000000!>2", limits); err != nil {
+			t.Fatalf("compile with %+v: %v", limits, err)
+		}
+	}
+}
@@ -2,21 +2,47 @@ package roll
 
 import (
 	"fmt"
-	"math/rand"
+	"maps"
 	"strconv"
+	"strings"
 )
 
-var randomIntn = rand.Intn
-
 // DieRoll is the result of a die roll
 type DieRoll struct {
 	Result int
 	Symbol string
+	// Symbols counts the narrative symbols on the face rolled, for custom
+	// dice with symbol faces.
+	Symbols map[string]int
+	// History lists every face rolled for this die in order: the original
+	// face, any rerolls and, for compounded dice, each face added on.
+	History []int
+	// Term is the dice or group term the roll belongs to.
+	Term TermRef
+	// Rerolled is set when the original face was replaced by a reroll.
+	Rerolled bool
+	// Exploded is set when the die matched its exploding target.
+	Exploded bool
+	// FromExplosion is set when the die was rolled because another exploded.
+	FromExplosion bool
+	// Dropped is set when a keep or drop limit discarded the die.
+	Dropped bool
+	// Success is set when the die matched the success condition.
+	Success bool
+	// Failure is set when the die matched the failure condition.
+	Failure bool
+	// Matched is set when the die belongs to a set found by a match
+	// operation.
+	Matched bool
+	// CritSuccess is set when the die matched the critical success condition.
+	CritSuccess bool
+	// CritFailure is set when the die matched the critical failure condition.
+	CritFailure bool
 }
 
 // Die is the interface allDice must confirm to
 type Die interface {
-	Roll() DieRoll
+	Roll(src Source) DieRoll
 	String() string
 }
 
@@ -33,8 +59,8 @@ const (
 )
 
 // Roll generates a random number and the appropriate symbol
-func (d FateDie) Roll() DieRoll {
-	val := randomIntn(3) - 1
+func (d FateDie) Roll(src Source) DieRoll {
+	val := src.IntN(3) - 1
 	sym := FateBlank
 
 	switch val {
@@ -59,8 +85,8 @@ func (d FateDie) String() string {
 type NormalDie int
 
 // Roll generates a random number and the appropriate symbol
-func (d NormalDie) Roll() DieRoll {
-	val := randomIntn(int(d)) + 1
+func (d NormalDie) Roll(src Source) DieRoll {
+	val := src.IntN(int(d)) + 1
 	sym := strconv.Itoa(val)
 	return DieRoll{
 		Result: val,
@@ -77,11 +103,101 @@ func (d NormalDie) String() string {
 type PercentileDie int
 
 // Roll generates a percentile result.
-func (d PercentileDie) Roll() DieRoll {
-	return NormalDie(100).Roll()
+func (d PercentileDie) Roll(src Source) DieRoll {
+	return NormalDie(100).Roll(src)
 }
 
 // String returns the string representation of the PercentileDie type.
 func (d PercentileDie) String() string {
 	return "d%"
 }
+
+// DieFace is one face of a CustomDie: the value it adds to a total and the
+// symbol shown for it. An empty symbol shows the face's narrative symbols, or
+// failing that its value.
+type DieFace struct {
+	Value  int
+	Symbol string
+	// Symbols counts the narrative symbols on the face, as in
+	// {"success": 1, "advantage": 1}. Faces with symbols usually have a
+	// Value of 0, and rolls of them are tallied rather than totalled.
+	Symbols map[string]int
+}
+
+// String returns the face in the notation used by inline custom dice: its
+// value, followed by a colon and its symbol when it has one, or its narrative
+// symbols joined by +, as in success+advantage.
+func (f DieFace) String() string {
+	if len(f.Symbols) > 0 && f.Value == 0 {
+		return renderSymbols(f.Symbols)
+	}
+	if f.Symbol == "" || f.Symbol == strconv.Itoa(f.Value) {
+		return strconv.Itoa(f.Value)
+	}
+	return strconv.Itoa(f.Value) + ":" + f.Symbol
+}
+
+// display returns the symbol shown when the face is rolled.
+func (f DieFace) display() string {
+	switch {
+	case f.Symbol != "":
+		return f.Symbol
+	case len(f.Symbols) > 0:
+		return renderSymbols(f.Symbols)
+	}
+	return strconv.Itoa(f.Value)
+}
+
+// CustomDie is a die with an explicit list of faces, each equally likely.
+// Faces may repeat, so d{0,0,1,1,2,3} rolls a 0 a third of the time.
+type CustomDie struct {
+	// Name is the name the die was rolled by, as in dAVG, and is empty for
+	// dice written inline. See CompileOptions.Dice.
+	Name  string
+	Faces []DieFace
+}
+
+// Roll picks one of the die's faces.
+func (d CustomDie) Roll(src Source) DieRoll {
+	face := d.Faces[src.IntN(len(d.Faces))]
+	return DieRoll{
+		Result:  face.Value,
+		Symbol:  face.display(),
+		Symbols: maps.Clone(face.Symbols),
+	}
+}
+
+// String returns the die's registered code, or its faces in inline notation.
+func (d CustomDie) String() string {
+	if d.Name != "" {
+		return "d" + d.Name
+	}
+	faces := make([]string, len(d.Faces))
+	for i, face := range d.Faces {
+		faces[i] = face.String()
+	}
+	return "d{" + strings.Join(faces, ",") + "}"
+}
+
+// faceRange returns the lowest and highest values die can roll. It returns
+// false for dice of unknown type.
+func faceRange(die Die) (lo, hi int, ok bool) {
+	switch d := die.(type) {
+	case NormalDie:
+		return 1, int(d), true
+	case PercentileDie:
+		return 1, 100, true
+	case FateDie:
+		return -1, 1, true
+	case CustomDie:
+		if len(d.Faces) == 0 {
+			return 0, 0, false
+		}
+		lo, hi = d.Faces[0].Value, d.Faces[0].Value
+		for _, face := range d.Faces[1:] {
+			lo, hi = min(lo, face.Value), max(hi, face.Value)
+		}
+		return lo, hi, true
+	}
+	return 0, 0, false
+}
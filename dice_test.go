@@ -5,12 +5,23 @@ import (
 	"testing"
 )
 
+// seededSource adapts a math/rand generator so test expectations remain
+// stable regardless of the default source.
+type seededSource struct {
+	r *rand.Rand
+}
+
+func newSeededSource(seed int64) Source {
+	return seededSource{r: rand.New(rand.NewSource(seed))}
+}
+
+func (s seededSource) IntN(n int) int { return s.r.Intn(n) }
+
 func withTestSeed(seed int64, fn func()) {
-	prev := randomIntn
-	r := rand.New(rand.NewSource(seed))
-	randomIntn = r.Intn
+	prev := defaultSource
+	defaultSource = newSeededSource(seed)
 	defer func() {
-		randomIntn = prev
+		defaultSource = prev
 	}()
 	fn()
 }
@@ -43,16 +54,35 @@ func TestDie_Roll(t *testing.T) {
 
 		// Percentile Die
 		{seed: 0, die: PercentileDie(0), res: 75, sym: "75"},
+
+		// Custom Die
+		{seed: 0, die: CustomDie{Faces: []DieFace{{Value: 0}, {Value: 1, Symbol: "hit"}, {Value: 2, Symbol: "crit"}}}, res: 0, sym: "0"},
+		{seed: 1, die: CustomDie{Faces: []DieFace{{Value: 0}, {Value: 1, Symbol: "hit"}, {Value: 2, Symbol: "crit"}}}, res: 2, sym: "crit"},
 	}
 
 	for i, tt := range tests {
-		withTestSeed(tt.seed, func() {
-			result := tt.die.Roll()
-			if tt.res != result.Result {
-				t.Errorf("%d. result mismatch: exp=%d got=%d", i, tt.res, result.Result)
-			} else if tt.sym != result.Symbol {
-				t.Errorf("%d. symbol mismatch: exp=%q got=%q", i, tt.sym, result.Symbol)
-			}
-		})
+		result := tt.die.Roll(newSeededSource(tt.seed))
+		if tt.res != result.Result {
+			t.Errorf("%d. result mismatch: exp=%d got=%d", i, tt.res, result.Result)
+		} else if tt.sym != result.Symbol {
+			t.Errorf("%d. symbol mismatch: exp=%q got=%q", i, tt.sym, result.Symbol)
+		}
+	}
+}
+
+func TestCustomDie_String(t *testing.T) {
+	tests := []struct {
+		die  CustomDie
+		want string
+	}{
+		{die: CustomDie{Faces: []DieFace{{Value: 0}, {Value: 0}, {Value: 1}}}, want: "d{0,0,1}"},
+		{die: CustomDie{Faces: []DieFace{{Value: -1, Symbol: "minus"}, {Value: 1, Symbol: "1"}}}, want: "d{-1:minus,1}"},
+		{die: CustomDie{Name: "AVG", Faces: []DieFace{{Value: 2}, {Value: 3}}}, want: "dAVG"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.die.String(); got != tt.want {
+			t.Errorf("string mismatch: exp=%q got=%q", tt.want, got)
+		}
 	}
 }
@@ -0,0 +1,150 @@
+package roll
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// AggregateTerm describes the values gathered by an aggregate function, as
+// in max{1d20, 1d20} or count{4d6kh3, 4d6kh3, 4d6kh3}>10.
+type AggregateTerm struct {
+	// ChildCount is the number of values the function gathers.
+	ChildCount int
+	// Count is the check a value's total must pass to be counted by count.
+	// It is nil for the other functions.
+	Count *ComparisonOp
+}
+
+// functionOpcodes maps the names of the aggregate and rounding functions to
+// their opcodes.
+var functionOpcodes = map[string]Opcode{
+	"max":   OpMax,
+	"min":   OpMin,
+	"sum":   OpSum,
+	"avg":   OpAvg,
+	"count": OpCount,
+	"floor": OpFloor,
+	"ceil":  OpCeil,
+	"round": OpRound,
+	"abs":   OpAbs,
+}
+
+// quotient is the exact value num/den of a division or average, with den
+// positive.
+type quotient struct {
+	num, den int
+}
+
+// newQuotient returns the exact value of a/b, or nil when it is whole. b must
+// not be zero.
+func newQuotient(a, b int) *quotient {
+	if a%b == 0 {
+		return nil
+	}
+	if b < 0 {
+		a, b = -a, -b
+	}
+	return &quotient{num: a, den: b}
+}
+
+// round rounds the quotient as the rounding function op does.
+func (q quotient) round(op Opcode) int {
+	switch op {
+	case OpFloor:
+		return floorDiv(q.num, q.den)
+	case OpCeil:
+		return -floorDiv(-q.num, q.den)
+	}
+	if q.num < 0 {
+		return -floorDiv(-2*q.num+q.den, 2*q.den)
+	}
+	return floorDiv(2*q.num+q.den, 2*q.den)
+}
+
+// floorDiv divides a by the positive b, rounding down.
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// evalAggregate gathers the children of an aggregate function. The result
+// lists each child's total, as a separated group does, and keeps every roll.
+func evalAggregate(op Opcode, term AggregateTerm, children []vmValue) (result Result, exact *quotient, err error) {
+	if len(children) == 0 {
+		return Result{}, nil, fmt.Errorf("%s requires at least 1 child value", op)
+	}
+	if op == OpCount && term.Count == nil {
+		return Result{}, nil, fmt.Errorf("%s has no comparison", op)
+	}
+
+	totals := make([]int, len(children))
+	for i, child := range children {
+		base := len(result.Rolls)
+		result.Rolls = append(result.Rolls, child.Result.Rolls...)
+		result.Matches = append(result.Matches, child.Result.Matches...)
+		result.CritSuccesses += child.Result.CritSuccesses
+		result.CritFailures += child.Result.CritFailures
+		result.Truncated = result.Truncated || child.Result.Truncated
+		result.Results = append(result.Results, DieRoll{Result: child.Result.Total, Symbol: strconv.Itoa(child.Result.Total), Term: child.Term})
+		result.sources = append(result.sources, child.Result.rollRange(base))
+		totals[i] = child.Result.Total
+	}
+
+	switch op {
+	case OpMax:
+		result.Total = slices.Max(totals)
+	case OpMin:
+		result.Total = slices.Min(totals)
+	case OpSum:
+		for i, child := range children {
+			result.Total += totals[i]
+			result.Successes += child.Result.Successes
+		}
+	case OpAvg:
+		var sum int
+		for _, total := range totals {
+			sum += total
+		}
+		exact = newQuotient(sum, len(totals))
+		result.Total, err = divideRounded(sum, len(totals))
+	case OpCount:
+		for _, total := range totals {
+			if term.Count.Match(total) {
+				result.Total++
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported aggregate opcode %d", op)
+	}
+	return result, exact, err
+}
+
+// aggregateLabels works out the label subtotals of an aggregate. Only a sum
+// passes on the labels of its children, as an unchecked group does.
+func aggregateLabels(op Opcode, children []vmValue) []LabelTotal {
+	if op != OpSum {
+		return nil
+	}
+	var labels []LabelTotal
+	for _, child := range children {
+		labels = mergeLabels(labels, child.labels, keepLabel)
+	}
+	return labels
+}
+
+// evalAbs returns the absolute value of v, negating its successes and labels
+// along with its total when it is negative.
+func evalAbs(v vmValue) vmValue {
+	result := v.Result
+	labels := v.labels
+	if result.Total < 0 {
+		result.Total = -result.Total
+		result.Successes = -result.Successes
+		labels = mergeLabels(nil, labels, negateLabel)
+	}
+	return vmValue{Result: result, Computed: true, nodes: v.nodes, labels: labels}
+}
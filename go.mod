@@ -3,8 +3,11 @@ module github.com/darkliquid/roll
 go 1.26.1
 
 require (
-	charm.land/bubbletea/v2 v2.0.2 // indirect
+	charm.land/bubbletea/v2 v2.0.2
 	github.com/charmbracelet/colorprofile v0.4.1
+)
+
+require (
 	github.com/charmbracelet/ultraviolet v0.0.0-20260205113103-524a6607adb8 // indirect
 	github.com/charmbracelet/x/ansi v0.11.6 // indirect
 	github.com/charmbracelet/x/term v0.2.2 // indirect
@@ -0,0 +1,181 @@
+package roll
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	inlineOpen  = "[["
+	inlineClose = "]]"
+)
+
+// InlineRoll is a single [[...]] roll found in a message.
+type InlineRoll struct {
+	// Start and End are the byte offsets of the roll in the original
+	// message, including its brackets.
+	Start, End int
+	// Source is the text between the brackets as written.
+	Source string
+	// Expression is the text that was compiled, with the totals of any
+	// nested inline rolls substituted in.
+	Expression string
+	Program    *Program
+	Result     Result
+}
+
+// InlineResult is a message with its inline rolls evaluated.
+type InlineResult struct {
+	// Text is the message with each outermost inline roll replaced by its
+	// total.
+	Text string
+	// Rolls lists every inline roll in the order it was evaluated, so nested
+	// rolls come before the rolls that contain them.
+	Rolls []InlineRoll
+}
+
+// ParseInline evaluates every Roll20 style [[...]] inline roll in a message
+// using DefaultLimits.
+func ParseInline(text string) (*InlineResult, error) {
+	return ParseInlineWithOptions(text, EvalOptions{Limits: DefaultLimits})
+}
+
+// ParseInlineWithOptions evaluates every [[...]] inline roll in a message.
+//
+// An inline roll may contain others, as in [[ [[1d4]]d6 ]], in which case
+// the inner roll is evaluated first and its total used as a number in the
+// outer expression. Limits apply to the message as a whole: every roll counts
+// towards the same MaxRollsTotal, and nested inline rolls count towards
+// MaxEvalDepth. A query is asked once however many rolls it appears in.
+// Brackets that are never closed are left as plain text.
+func ParseInlineWithOptions(text string, opts EvalOptions) (*InlineResult, error) {
+	r := &inlineRoller{ctx: newRollContext(context.Background(), opts), queries: rememberAnswers(opts.Queries), attributes: opts.Attributes, dice: opts.Dice}
+	out, err := r.substitute(text, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &InlineResult{Text: out, Rolls: r.rolls}, nil
+}
+
+// rememberAnswers wraps resolver so each query is only asked once, however
+// many inline rolls it appears in.
+func rememberAnswers(resolver QueryResolver) QueryResolver {
+	if resolver == nil {
+		return nil
+	}
+	answers := map[string]string{}
+	return QueryResolverFunc(func(query Query) (string, error) {
+		if answer, ok := answers[query.Prompt]; ok {
+			return answer, nil
+		}
+		answer, err := resolver.Resolve(query)
+		if err == nil {
+			answers[query.Prompt] = answer
+		}
+		return answer, err
+	})
+}
+
+type inlineRoller struct {
+	ctx        *rollContext
+	queries    QueryResolver
+	attributes AttributeProvider
+	dice       map[string]CustomDie
+	rolls      []InlineRoll
+}
+
+// substitute replaces every inline roll in text with its total. The text
+// starts at byte offset base of the original message and is nested depth
+// inline rolls deep.
+func (r *inlineRoller) substitute(text string, base, depth int) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.Index(text, inlineOpen)
+		if start < 0 {
+			break
+		}
+		end := matchInline(text, start)
+		if end < 0 {
+			break
+		}
+
+		out.WriteString(text[:start])
+		total, err := r.roll(text[start+len(inlineOpen):end], base+start, depth+1)
+		if err != nil {
+			return "", err
+		}
+		if depth > 0 && total < 0 {
+			// Keep a negative total whole within the outer expression, as in
+			// 5 - (-2).
+			out.WriteString("(" + strconv.Itoa(total) + ")")
+		} else {
+			out.WriteString(strconv.Itoa(total))
+		}
+
+		consumed := end + len(inlineClose)
+		text, base = text[consumed:], base+consumed
+	}
+
+	out.WriteString(text)
+	return out.String(), nil
+}
+
+// roll evaluates the inline roll whose brackets start at byte offset start of
+// the original message.
+func (r *inlineRoller) roll(source string, start, depth int) (int, error) {
+	if depth > r.ctx.limits.MaxEvalDepth {
+		return 0, ErrLimitExceeded(fmt.Sprintf("inline rolls exceeded maximum nesting depth of %d", r.ctx.limits.MaxEvalDepth))
+	}
+
+	expression, err := r.substitute(source, start+len(inlineOpen), depth)
+	if err != nil {
+		return 0, err
+	}
+
+	program, err := CompileStringWithOptions(expression, CompileOptions{Limits: r.ctx.limits, Queries: r.queries, Attributes: r.attributes, Dice: r.dice})
+	if err != nil {
+		return 0, fmt.Errorf("inline roll %q: %w", expression, err)
+	}
+	result, err := r.ctx.evaluate(program)
+	if err != nil {
+		return 0, fmt.Errorf("inline roll %q: %w", expression, err)
+	}
+
+	r.rolls = append(r.rolls, InlineRoll{
+		Start:      start,
+		End:        start + len(inlineOpen) + len(source) + len(inlineClose),
+		Source:     source,
+		Expression: expression,
+		Program:    program,
+		Result:     result,
+	})
+	return result.Total, nil
+}
+
+// matchInline returns the index of the "]]" closing the inline roll opened
+// at start, or -1 if it is never closed. Labels such as [STR] are skipped, so
+// the bracket closing a label at the end of the roll, as in [[1d20+5[STR]]],
+// is not taken as part of the "]]".
+func matchInline(text string, start int) int {
+	depth := 0
+	for i := start + len(inlineOpen); i < len(text)-1; i++ {
+		switch {
+		case text[i:i+2] == inlineOpen:
+			depth++
+			i++
+		case text[i:i+2] == inlineClose:
+			if depth == 0 {
+				return i
+			}
+			depth--
+			i++
+		case text[i] == '[':
+			if n := strings.IndexByte(text[i+1:], ']'); n >= 0 {
+				i += n + 1
+			}
+		}
+	}
+	return -1
+}
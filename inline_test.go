@@ -0,0 +1,147 @@
+package roll
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestParseInline(t *testing.T) {
+	var result *InlineResult
+	var err error
+	withTestSeed(0, func() {
+		result, err = ParseInline("I attack for [[1d8+3]] slashing and [[2d6]] fire")
+	})
+	if err != nil {
+		t.Fatalf("parse inline: %v", err)
+	}
+
+	if got, want := result.Text, "I attack for 6 slashing and 3 fire"; got != want {
+		t.Fatalf("text mismatch: exp=%q got=%q", want, got)
+	}
+	if got, want := len(result.Rolls), 2; got != want {
+		t.Fatalf("roll count mismatch: exp=%d got=%d", want, got)
+	}
+	first := result.Rolls[0]
+	if first.Source != "1d8+3" || first.Start != 13 || first.End != 22 || first.Result.Total != 6 {
+		t.Fatalf("unexpected first roll: %+v", first)
+	}
+	if got, want := result.Rolls[1].Program.String(), "2d6"; got != want {
+		t.Fatalf("program mismatch: exp=%q got=%q", want, got)
+	}
+}
+
+func TestParseInline_Nested(t *testing.T) {
+	var result *InlineResult
+	var err error
+	withTestSeed(1, func() {
+		result, err = ParseInline("Fireball: [[ [[1d4+4]]d6 ]] damage, [[ [[ [[1]]+1 ]]*10 ]]ft")
+	})
+	if err != nil {
+		t.Fatalf("parse inline: %v", err)
+	}
+
+	if got, want := len(result.Rolls), 5; got != want {
+		t.Fatalf("roll count mismatch: exp=%d got=%d", want, got)
+	}
+	inner, outer := result.Rolls[0], result.Rolls[1]
+	if inner.Source != "1d4+4" || inner.Start != 13 {
+		t.Fatalf("unexpected inner roll: %+v", inner)
+	}
+	if want := " " + strconv.Itoa(inner.Result.Total) + "d6 "; outer.Expression != want {
+		t.Fatalf("nested total not substituted: exp=%q got=%q", want, outer.Expression)
+	}
+	if outer.Start != 10 || outer.End != 27 {
+		t.Fatalf("unexpected outer span: %d-%d", outer.Start, outer.End)
+	}
+	if got, want := result.Rolls[4].Result.Total, 20; got != want {
+		t.Fatalf("deeply nested total mismatch: exp=%d got=%d", want, got)
+	}
+	if want := "Fireball: " + strconv.Itoa(outer.Result.Total) + " damage, 20ft"; result.Text != want {
+		t.Fatalf("text mismatch: exp=%q got=%q", want, result.Text)
+	}
+}
+
+func TestParseInline_Labels(t *testing.T) {
+	var result *InlineResult
+	var err error
+	withTestSeed(0, func() {
+		result, err = ParseInline("Attack: [[1d20+5[STR]]] and [[ {2d6[fire], 1d4[cold]}kh1[best] ]]!")
+	})
+	if err != nil {
+		t.Fatalf("parse inline: %v", err)
+	}
+
+	first := result.Rolls[0]
+	if first.Source != "1d20+5[STR]" || first.End != 23 {
+		t.Fatalf("unexpected labelled roll: %+v", first)
+	}
+	if total, ok := first.Result.Label("STR"); !ok || total != 5 {
+		t.Fatalf("label mismatch: got %d, %v", total, ok)
+	}
+	want := "Attack: " + strconv.Itoa(first.Result.Total) + " and " + strconv.Itoa(result.Rolls[1].Result.Total) + "!"
+	if result.Text != want {
+		t.Fatalf("text mismatch: exp=%q got=%q", want, result.Text)
+	}
+}
+
+func TestParseInline_NegativeNested(t *testing.T) {
+	var result *InlineResult
+	var err error
+	withTestSeed(0, func() {
+		result, err = ParseInline("[[ 5 - [[1d{1,1}-3]] ]] and [[1d{1,1}-3]]")
+	})
+	if err != nil {
+		t.Fatalf("parse inline: %v", err)
+	}
+	if got, want := result.Rolls[1].Expression, " 5 - (-2) "; got != want {
+		t.Fatalf("expression mismatch: exp=%q got=%q", want, got)
+	}
+	if got, want := result.Text, "7 and -2"; got != want {
+		t.Fatalf("text mismatch: exp=%q got=%q", want, got)
+	}
+}
+
+func TestParseInline_Text(t *testing.T) {
+	tests := []string{"no rolls here", "unclosed [[1d6", "stray ]] brackets"}
+	for _, input := range tests {
+		result, err := ParseInline(input)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", input, err)
+		}
+		if result.Text != input || len(result.Rolls) != 0 {
+			t.Fatalf("%q: expected text unchanged, got %+v", input, result)
+		}
+	}
+}
+
+func TestParseInline_Errors(t *testing.T) {
+	limits := Limits{MaxDieSize: 20, MaxRollsPerDie: 10, MaxRollsTotal: 5, MaxEvalDepth: 3}
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "[[3d6]] and [[3d6]]", err: `inline roll "3d6": roll exceeded maximum total roll count of 5`},
+		{input: "[[ [[ [[ [[1]] ]] ]] ]]", err: "inline rolls exceeded maximum nesting depth of 3"},
+		{input: "hit for [[1dX]]", err: `inline roll "1dX": unrecognised die type "dX" at column 2`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := ParseInlineWithOptions(tt.input, EvalOptions{Limits: limits})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("unexpected error: exp=%q got=%q", tt.err, err.Error())
+			}
+		})
+	}
+
+	_, err := ParseInline("[[2d6+]]")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected ParseError, got %T", err)
+	}
+}
@@ -0,0 +1,779 @@
+package roll
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProgramJSONVersion is the version written to, and required from, the JSON
+// encoding of a Program. It changes whenever the encoding does in a way older
+// readers cannot understand.
+const ProgramJSONVersion = 1
+
+// ErrInvalidEncoding is raised when a serialized program or result cannot be
+// decoded.
+type ErrInvalidEncoding string
+
+func (e ErrInvalidEncoding) Error() string {
+	return fmt.Sprintf("invalid encoding: %s", string(e))
+}
+
+// enumJSON marshals an enum value using its name from names.
+func enumJSON[T comparable](kind string, v T, names map[T]string) ([]byte, error) {
+	name, ok := names[v]
+	if !ok {
+		return nil, ErrInvalidEncoding(fmt.Sprintf("unknown %s %v", kind, v))
+	}
+	return json.Marshal(name)
+}
+
+// parseEnumJSON reads an enum value encoded by enumJSON.
+func parseEnumJSON[T comparable](kind string, data []byte, names map[T]string) (T, error) {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var zero T
+		return zero, err
+	}
+	return lookupEnum(kind, name, names)
+}
+
+// lookupEnum returns the enum value called name.
+func lookupEnum[T comparable](kind, name string, names map[T]string) (T, error) {
+	for v, n := range names {
+		if n == name {
+			return v, nil
+		}
+	}
+	var zero T
+	return zero, ErrInvalidEncoding(fmt.Sprintf("unknown %s %q", kind, name))
+}
+
+var opcodeNames = map[Opcode]string{
+	OpRollDice:           OpRollDice.String(),
+	OpRollGroup:          OpRollGroup.String(),
+	OpConst:              OpConst.String(),
+	OpAdd:                OpAdd.String(),
+	OpSub:                OpSub.String(),
+	OpMul:                OpMul.String(),
+	OpDiv:                OpDiv.String(),
+	OpNeg:                OpNeg.String(),
+	OpLabel:              OpLabel.String(),
+	OpRollDiceCount:      OpRollDiceCount.String(),
+	OpRollDiceSides:      OpRollDiceSides.String(),
+	OpRollDiceCountSides: OpRollDiceCountSides.String(),
+	OpCompare:            OpCompare.String(),
+	OpRepeat:             OpRepeat.String(),
+	OpMax:                OpMax.String(),
+	OpMin:                OpMin.String(),
+	OpSum:                OpSum.String(),
+	OpAvg:                OpAvg.String(),
+	OpCount:              OpCount.String(),
+	OpFloor:              OpFloor.String(),
+	OpCeil:               OpCeil.String(),
+	OpRound:              OpRound.String(),
+	OpAbs:                OpAbs.String(),
+}
+
+// MarshalJSON encodes the opcode by name.
+func (op Opcode) MarshalJSON() ([]byte, error) {
+	return enumJSON("opcode", op, opcodeNames)
+}
+
+// UnmarshalJSON decodes an opcode name.
+func (op *Opcode) UnmarshalJSON(data []byte) (err error) {
+	*op, err = parseEnumJSON("opcode", data, opcodeNames)
+	return err
+}
+
+var comparisonTypeNames = map[ComparisonType]string{
+	Equals:      "equals",
+	GreaterThan: "greater_than",
+	LessThan:    "less_than",
+}
+
+var explodingTypeNames = map[ExplodingType]string{
+	Exploding:   "exploding",
+	Compounded:  "compounded",
+	Penetrating: "penetrating",
+}
+
+var limitTypeNames = map[LimitType]string{
+	KeepHighest: "keep_highest",
+	KeepLowest:  "keep_lowest",
+	DropHighest: "drop_highest",
+	DropLowest:  "drop_lowest",
+}
+
+var sortTypeNames = map[SortType]string{
+	Unsorted:   "unsorted",
+	Ascending:  "ascending",
+	Descending: "descending",
+}
+
+var termKindNames = map[TermKind]string{
+	TermNone:  "none",
+	TermDice:  "dice",
+	TermGroup: "group",
+}
+
+var compareKindNames = map[CompareKind]string{
+	CompareVersus:         "versus",
+	CompareEqual:          "equal",
+	CompareGreater:        "greater",
+	CompareGreaterOrEqual: "greater_or_equal",
+	CompareLess:           "less",
+	CompareLessOrEqual:    "less_or_equal",
+}
+
+var sideNames = map[Side]string{
+	NoSide:    "none",
+	LeftSide:  "left",
+	RightSide: "right",
+}
+
+// MarshalJSON encodes the sort type by name.
+func (t SortType) MarshalJSON() ([]byte, error) {
+	return enumJSON("sort type", t, sortTypeNames)
+}
+
+// UnmarshalJSON decodes a sort type name.
+func (t *SortType) UnmarshalJSON(data []byte) (err error) {
+	*t, err = parseEnumJSON("sort type", data, sortTypeNames)
+	return err
+}
+
+// MarshalJSON encodes the term kind by name.
+func (k TermKind) MarshalJSON() ([]byte, error) {
+	return enumJSON("term kind", k, termKindNames)
+}
+
+// UnmarshalJSON decodes a term kind name.
+func (k *TermKind) UnmarshalJSON(data []byte) (err error) {
+	*k, err = parseEnumJSON("term kind", data, termKindNames)
+	return err
+}
+
+// MarshalJSON encodes the comparison kind by name.
+func (k CompareKind) MarshalJSON() ([]byte, error) {
+	return enumJSON("comparison kind", k, compareKindNames)
+}
+
+// UnmarshalJSON decodes a comparison kind name.
+func (k *CompareKind) UnmarshalJSON(data []byte) (err error) {
+	*k, err = parseEnumJSON("comparison kind", data, compareKindNames)
+	return err
+}
+
+// MarshalJSON encodes the side by name.
+func (s Side) MarshalJSON() ([]byte, error) {
+	return enumJSON("side", s, sideNames)
+}
+
+// UnmarshalJSON decodes a side name.
+func (s *Side) UnmarshalJSON(data []byte) (err error) {
+	*s, err = parseEnumJSON("side", data, sideNames)
+	return err
+}
+
+type comparisonJSON struct {
+	Type      string `json:"type"`
+	Value     int    `json:"value"`
+	Inclusive bool   `json:"inclusive,omitempty"`
+}
+
+// MarshalJSON encodes the comparison as a type name, value and inclusive flag.
+func (op ComparisonOp) MarshalJSON() ([]byte, error) {
+	typ, ok := comparisonTypeNames[op.Type]
+	if !ok {
+		return nil, ErrInvalidEncoding(fmt.Sprintf("unknown comparison type %d", op.Type))
+	}
+	return json.Marshal(comparisonJSON{Type: typ, Value: op.Value, Inclusive: op.Inclusive})
+}
+
+// UnmarshalJSON decodes a comparison encoded by MarshalJSON.
+func (op *ComparisonOp) UnmarshalJSON(data []byte) error {
+	var v comparisonJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	typ, err := lookupEnum("comparison type", v.Type, comparisonTypeNames)
+	if err != nil {
+		return err
+	}
+	*op = ComparisonOp{Type: typ, Value: v.Value, Inclusive: v.Inclusive}
+	return nil
+}
+
+type explodingJSON struct {
+	Type          string        `json:"type"`
+	Compare       *ComparisonOp `json:"compare"`
+	MaxExplosions int           `json:"max_explosions,omitempty"`
+}
+
+// MarshalJSON encodes the explosion type by name with its comparison.
+func (e ExplodingOp) MarshalJSON() ([]byte, error) {
+	typ, ok := explodingTypeNames[e.Type]
+	if !ok {
+		return nil, ErrInvalidEncoding(fmt.Sprintf("unknown exploding type %d", e.Type))
+	}
+	return json.Marshal(explodingJSON{Type: typ, Compare: e.ComparisonOp, MaxExplosions: e.MaxExplosions})
+}
+
+// UnmarshalJSON decodes an explosion encoded by MarshalJSON.
+func (e *ExplodingOp) UnmarshalJSON(data []byte) error {
+	var v explodingJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	typ, err := lookupEnum("exploding type", v.Type, explodingTypeNames)
+	if err != nil {
+		return err
+	}
+	if v.Compare == nil {
+		return ErrInvalidEncoding("exploding op has no comparison")
+	}
+	*e = ExplodingOp{ComparisonOp: v.Compare, Type: typ, MaxExplosions: v.MaxExplosions}
+	return nil
+}
+
+type limitJSON struct {
+	Type   string `json:"type"`
+	Amount int    `json:"amount"`
+}
+
+// MarshalJSON encodes the limit type by name with its amount.
+func (op LimitOp) MarshalJSON() ([]byte, error) {
+	typ, ok := limitTypeNames[op.Type]
+	if !ok {
+		return nil, ErrInvalidEncoding(fmt.Sprintf("unknown limit type %d", op.Type))
+	}
+	return json.Marshal(limitJSON{Type: typ, Amount: op.Amount})
+}
+
+// UnmarshalJSON decodes a limit encoded by MarshalJSON.
+func (op *LimitOp) UnmarshalJSON(data []byte) error {
+	var v limitJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	typ, err := lookupEnum("limit type", v.Type, limitTypeNames)
+	if err != nil {
+		return err
+	}
+	*op = LimitOp{Type: typ, Amount: v.Amount}
+	return nil
+}
+
+type rerollJSON struct {
+	Once    bool          `json:"once,omitempty"`
+	Compare *ComparisonOp `json:"compare"`
+}
+
+// MarshalJSON encodes the reroll comparison and whether it applies once.
+func (e RerollOp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rerollJSON{Once: e.Once, Compare: e.ComparisonOp})
+}
+
+// UnmarshalJSON decodes a reroll encoded by MarshalJSON.
+func (e *RerollOp) UnmarshalJSON(data []byte) error {
+	var v rerollJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Compare == nil {
+		return ErrInvalidEncoding("reroll op has no comparison")
+	}
+	*e = RerollOp{ComparisonOp: v.Compare, Once: v.Once}
+	return nil
+}
+
+type matchJSON struct {
+	Count   bool          `json:"count,omitempty"`
+	MinSize int           `json:"min_size"`
+	Compare *ComparisonOp `json:"compare,omitempty"`
+}
+
+// MarshalJSON encodes the match operation.
+func (op MatchOp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(matchJSON(op))
+}
+
+// UnmarshalJSON decodes a match operation encoded by MarshalJSON.
+func (op *MatchOp) UnmarshalJSON(data []byte) error {
+	var v matchJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*op = MatchOp(v)
+	return nil
+}
+
+type dieJSON struct {
+	Type  string     `json:"type"`
+	Sides int        `json:"sides,omitempty"`
+	Name  string     `json:"name,omitempty"`
+	Faces []faceJSON `json:"faces,omitempty"`
+}
+
+type faceJSON struct {
+	Value   int            `json:"value"`
+	Symbol  string         `json:"symbol,omitempty"`
+	Symbols map[string]int `json:"symbols,omitempty"`
+}
+
+// marshalDie encodes a die by type, along with its sides for normal dice and
+// its name and faces for custom dice.
+func marshalDie(die Die) (dieJSON, error) {
+	switch d := die.(type) {
+	case NormalDie:
+		return dieJSON{Type: "normal", Sides: int(d)}, nil
+	case PercentileDie:
+		return dieJSON{Type: "percentile"}, nil
+	case FateDie:
+		return dieJSON{Type: "fate"}, nil
+	case CustomDie:
+		v := dieJSON{Type: "custom", Name: d.Name, Faces: make([]faceJSON, len(d.Faces))}
+		for i, face := range d.Faces {
+			v.Faces[i] = faceJSON(face)
+		}
+		return v, nil
+	}
+	return dieJSON{}, ErrInvalidEncoding(fmt.Sprintf("unsupported die type %T", die))
+}
+
+func unmarshalDie(v dieJSON) (Die, error) {
+	switch v.Type {
+	case "normal":
+		return NormalDie(v.Sides), nil
+	case "percentile":
+		return PercentileDie(0), nil
+	case "fate":
+		return FateDie(0), nil
+	case "custom":
+		die := CustomDie{Name: v.Name}
+		for _, face := range v.Faces {
+			die.Faces = append(die.Faces, DieFace(face))
+		}
+		return die, nil
+	}
+	return nil, ErrInvalidEncoding(fmt.Sprintf("unknown die type %q", v.Type))
+}
+
+type diceTermJSON struct {
+	Multiplier  int           `json:"multiplier"`
+	Die         dieJSON       `json:"die"`
+	Modifier    int           `json:"modifier,omitempty"`
+	Exploding   *ExplodingOp  `json:"exploding,omitempty"`
+	Limit       *LimitOp      `json:"limit,omitempty"`
+	Success     *ComparisonOp `json:"success,omitempty"`
+	Failure     *ComparisonOp `json:"failure,omitempty"`
+	CritSuccess *ComparisonOp `json:"crit_success,omitempty"`
+	CritFailure *ComparisonOp `json:"crit_failure,omitempty"`
+	Rerolls     []RerollOp    `json:"rerolls,omitempty"`
+	Sort        SortType      `json:"sort,omitempty"`
+	Match       *MatchOp      `json:"match,omitempty"`
+	Label       string        `json:"label,omitempty"`
+	Notation    string        `json:"notation,omitempty"`
+}
+
+// MarshalJSON encodes the dice term, writing its die by type.
+func (t DiceTerm) MarshalJSON() ([]byte, error) {
+	die, err := marshalDie(t.Die)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(diceTermJSON{
+		Multiplier:  t.Multiplier,
+		Die:         die,
+		Modifier:    t.Modifier,
+		Exploding:   t.Exploding,
+		Limit:       t.Limit,
+		Success:     t.Success,
+		Failure:     t.Failure,
+		CritSuccess: t.CritSuccess,
+		CritFailure: t.CritFailure,
+		Rerolls:     t.Rerolls,
+		Sort:        t.Sort,
+		Match:       t.Match,
+		Label:       t.Label,
+		Notation:    t.Notation,
+	})
+}
+
+// UnmarshalJSON decodes a dice term encoded by MarshalJSON.
+func (t *DiceTerm) UnmarshalJSON(data []byte) error {
+	var v diceTermJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	die, err := unmarshalDie(v.Die)
+	if err != nil {
+		return err
+	}
+	*t = DiceTerm{
+		Multiplier:  v.Multiplier,
+		Die:         die,
+		Modifier:    v.Modifier,
+		Exploding:   v.Exploding,
+		Limit:       v.Limit,
+		Success:     v.Success,
+		Failure:     v.Failure,
+		CritSuccess: v.CritSuccess,
+		CritFailure: v.CritFailure,
+		Rerolls:     v.Rerolls,
+		Sort:        v.Sort,
+		Match:       v.Match,
+		Label:       v.Label,
+		Notation:    v.Notation,
+	}
+	return nil
+}
+
+type groupTermJSON struct {
+	Modifier    int           `json:"modifier,omitempty"`
+	Limit       *LimitOp      `json:"limit,omitempty"`
+	Success     *ComparisonOp `json:"success,omitempty"`
+	Failure     *ComparisonOp `json:"failure,omitempty"`
+	CritSuccess *ComparisonOp `json:"crit_success,omitempty"`
+	CritFailure *ComparisonOp `json:"crit_failure,omitempty"`
+	Combined    bool          `json:"combined,omitempty"`
+	Negative    bool          `json:"negative,omitempty"`
+	ChildCount  int           `json:"child_count"`
+	Label       string        `json:"label,omitempty"`
+	Notation    string        `json:"notation,omitempty"`
+}
+
+// MarshalJSON encodes the group term.
+func (t GroupTerm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(groupTermJSON(t))
+}
+
+// UnmarshalJSON decodes a group term encoded by MarshalJSON.
+func (t *GroupTerm) UnmarshalJSON(data []byte) error {
+	var v groupTermJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*t = GroupTerm(v)
+	return nil
+}
+
+type repeatTermJSON struct {
+	Count    int      `json:"count"`
+	Sort     SortType `json:"sort,omitempty"`
+	Notation string   `json:"notation,omitempty"`
+}
+
+// MarshalJSON encodes the repeat term.
+func (t RepeatTerm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(repeatTermJSON(t))
+}
+
+// UnmarshalJSON decodes a repeat term encoded by MarshalJSON.
+func (t *RepeatTerm) UnmarshalJSON(data []byte) error {
+	var v repeatTermJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*t = RepeatTerm(v)
+	return nil
+}
+
+type aggregateTermJSON struct {
+	ChildCount int           `json:"child_count"`
+	Count      *ComparisonOp `json:"count,omitempty"`
+}
+
+// MarshalJSON encodes the aggregate term.
+func (t AggregateTerm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(aggregateTermJSON(t))
+}
+
+// UnmarshalJSON decodes an aggregate term encoded by MarshalJSON.
+func (t *AggregateTerm) UnmarshalJSON(data []byte) error {
+	var v aggregateTermJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*t = AggregateTerm(v)
+	return nil
+}
+
+type instructionJSON struct {
+	Op  Opcode `json:"op"`
+	Arg int    `json:"arg,omitempty"`
+}
+
+type programJSON struct {
+	Version        int               `json:"version"`
+	Code           []instructionJSON `json:"code"`
+	DiceTerms      []DiceTerm        `json:"dice_terms,omitempty"`
+	GroupTerms     []GroupTerm       `json:"group_terms,omitempty"`
+	RepeatTerms    []RepeatTerm      `json:"repeat_terms,omitempty"`
+	AggregateTerms []AggregateTerm   `json:"aggregate_terms,omitempty"`
+	Labels         []string          `json:"labels,omitempty"`
+	Rendered       string            `json:"rendered"`
+	MaxDepth       int               `json:"max_depth"`
+}
+
+// MarshalJSON encodes the program along with ProgramJSONVersion.
+func (p Program) MarshalJSON() ([]byte, error) {
+	v := programJSON{
+		Version:        ProgramJSONVersion,
+		Code:           make([]instructionJSON, len(p.Code)),
+		DiceTerms:      p.DiceTerms,
+		GroupTerms:     p.GroupTerms,
+		RepeatTerms:    p.RepeatTerms,
+		AggregateTerms: p.AggregateTerms,
+		Labels:         p.Labels,
+		Rendered:       p.Rendered,
+		MaxDepth:       p.MaxDepth,
+	}
+	for i, instruction := range p.Code {
+		v.Code[i] = instructionJSON(instruction)
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes a program encoded by MarshalJSON. Programs written by
+// a different encoding version, or that fail Verify, are rejected.
+func (p *Program) UnmarshalJSON(data []byte) error {
+	var v programJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Version != ProgramJSONVersion {
+		return ErrInvalidEncoding(fmt.Sprintf("unsupported program version %d", v.Version))
+	}
+
+	program := Program{
+		Code:           make([]Instruction, len(v.Code)),
+		DiceTerms:      v.DiceTerms,
+		GroupTerms:     v.GroupTerms,
+		RepeatTerms:    v.RepeatTerms,
+		AggregateTerms: v.AggregateTerms,
+		Labels:         v.Labels,
+		Rendered:       v.Rendered,
+		MaxDepth:       v.MaxDepth,
+	}
+	for i, instruction := range v.Code {
+		program.Code[i] = Instruction(instruction)
+	}
+	if err := program.Verify(); err != nil {
+		return err
+	}
+
+	*p = program
+	return nil
+}
+
+type dieRollJSON struct {
+	Result        int            `json:"result"`
+	Symbol        string         `json:"symbol"`
+	Symbols       map[string]int `json:"symbols,omitempty"`
+	History       []int          `json:"history,omitempty"`
+	Term          TermRef        `json:"term"`
+	Rerolled      bool           `json:"rerolled,omitempty"`
+	Exploded      bool           `json:"exploded,omitempty"`
+	FromExplosion bool           `json:"from_explosion,omitempty"`
+	Dropped       bool           `json:"dropped,omitempty"`
+	Success       bool           `json:"success,omitempty"`
+	Failure       bool           `json:"failure,omitempty"`
+	Matched       bool           `json:"matched,omitempty"`
+	CritSuccess   bool           `json:"crit_success,omitempty"`
+	CritFailure   bool           `json:"crit_failure,omitempty"`
+}
+
+// MarshalJSON encodes the die roll and its flags.
+func (r DieRoll) MarshalJSON() ([]byte, error) {
+	return json.Marshal(dieRollJSON(r))
+}
+
+// UnmarshalJSON decodes a die roll encoded by MarshalJSON.
+func (r *DieRoll) UnmarshalJSON(data []byte) error {
+	var v dieRollJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = DieRoll(v)
+	return nil
+}
+
+type termRefJSON struct {
+	Kind  TermKind `json:"kind"`
+	Index int      `json:"index"`
+}
+
+// MarshalJSON encodes the term reference.
+func (r TermRef) MarshalJSON() ([]byte, error) {
+	return json.Marshal(termRefJSON(r))
+}
+
+// UnmarshalJSON decodes a term reference encoded by MarshalJSON.
+func (r *TermRef) UnmarshalJSON(data []byte) error {
+	var v termRefJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = TermRef(v)
+	return nil
+}
+
+type resultNodeJSON struct {
+	Term          TermRef       `json:"term"`
+	Notation      string        `json:"notation"`
+	Label         string        `json:"label,omitempty"`
+	Modifier      int           `json:"modifier,omitempty"`
+	Total         int           `json:"total"`
+	Successes     int           `json:"successes"`
+	CritSuccesses int           `json:"crit_successes,omitempty"`
+	CritFailures  int           `json:"crit_failures,omitempty"`
+	Results       []DieRoll     `json:"results,omitempty"`
+	Rolls         []DieRoll     `json:"rolls,omitempty"`
+	Matches       []MatchSet    `json:"matches,omitempty"`
+	Children      []*ResultNode `json:"children,omitempty"`
+}
+
+// MarshalJSON encodes the node and its children.
+func (n ResultNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(resultNodeJSON(n))
+}
+
+// UnmarshalJSON decodes a node encoded by MarshalJSON.
+func (n *ResultNode) UnmarshalJSON(data []byte) error {
+	var v resultNodeJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*n = ResultNode(v)
+	return nil
+}
+
+type matchSetJSON struct {
+	Value int `json:"value"`
+	Count int `json:"count"`
+}
+
+// MarshalJSON encodes the match set.
+func (m MatchSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(matchSetJSON(m))
+}
+
+// UnmarshalJSON decodes a match set encoded by MarshalJSON.
+func (m *MatchSet) UnmarshalJSON(data []byte) error {
+	var v matchSetJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*m = MatchSet(v)
+	return nil
+}
+
+type outcomeJSON struct {
+	Kind   CompareKind `json:"kind"`
+	Left   Result      `json:"left"`
+	Right  Result      `json:"right"`
+	Margin int         `json:"margin"`
+	Winner Side        `json:"winner"`
+}
+
+// MarshalJSON encodes the comparison and the results of both sides.
+func (c Comparison) MarshalJSON() ([]byte, error) {
+	return json.Marshal(outcomeJSON(c))
+}
+
+// UnmarshalJSON decodes a comparison encoded by MarshalJSON.
+func (c *Comparison) UnmarshalJSON(data []byte) error {
+	var v outcomeJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = Comparison(v)
+	return nil
+}
+
+type labelTotalJSON struct {
+	Label string `json:"label"`
+	Total int    `json:"total"`
+}
+
+// MarshalJSON encodes the label subtotal.
+func (l LabelTotal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(labelTotalJSON(l))
+}
+
+// UnmarshalJSON decodes a label subtotal encoded by MarshalJSON.
+func (l *LabelTotal) UnmarshalJSON(data []byte) error {
+	var v labelTotalJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*l = LabelTotal(v)
+	return nil
+}
+
+type resultJSON struct {
+	Total         int            `json:"total"`
+	Successes     int            `json:"successes"`
+	CritSuccesses int            `json:"crit_successes,omitempty"`
+	CritFailures  int            `json:"crit_failures,omitempty"`
+	Results       []DieRoll      `json:"results"`
+	Rolls         []DieRoll      `json:"rolls,omitempty"`
+	Tree          *ResultNode    `json:"tree,omitempty"`
+	Labels        []LabelTotal   `json:"labels,omitempty"`
+	Symbols       map[string]int `json:"symbols,omitempty"`
+	Matches       []MatchSet     `json:"matches,omitempty"`
+	Truncated     bool           `json:"truncated,omitempty"`
+	Comparison    *Comparison    `json:"comparison,omitempty"`
+	Repeats       []Result       `json:"repeats,omitempty"`
+}
+
+// MarshalJSON encodes the result, its dice and its result tree.
+func (r Result) MarshalJSON() ([]byte, error) {
+	v := resultJSON{
+		Total:         r.Total,
+		Successes:     r.Successes,
+		CritSuccesses: r.CritSuccesses,
+		CritFailures:  r.CritFailures,
+		Results:       r.Results,
+		Rolls:         r.Rolls,
+		Tree:          r.Tree,
+		Labels:        r.Labels,
+		Symbols:       r.Symbols,
+		Matches:       r.Matches,
+		Truncated:     r.Truncated,
+		Comparison:    r.Comparison,
+		Repeats:       r.Repeats,
+	}
+	if v.Results == nil {
+		v.Results = []DieRoll{}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes a result encoded by MarshalJSON.
+func (r *Result) UnmarshalJSON(data []byte) error {
+	var v resultJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = Result{
+		Total:         v.Total,
+		Successes:     v.Successes,
+		CritSuccesses: v.CritSuccesses,
+		CritFailures:  v.CritFailures,
+		Results:       v.Results,
+		Rolls:         v.Rolls,
+		Tree:          v.Tree,
+		Labels:        v.Labels,
+		Symbols:       v.Symbols,
+		Matches:       v.Matches,
+		Truncated:     v.Truncated,
+		Comparison:    v.Comparison,
+		Repeats:       v.Repeats,
+	}
+	if len(r.Results) == 0 {
+		r.Results = nil
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package roll
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestProgram_JSONRoundTrip(t *testing.T) {
+	inputs := []string{
+		"3d6+4",
+		"4d6kh3sd",
+		"10d10!>8r1ro<2>=7f=1",
+		"2d6!!5+1d20!p20*2",
+		"{4d6kh3, 4d6dl1, 2}kh1/2",
+		"-{2d6+1d4-1}dl1>3+4",
+		"4dF-d%",
+		"1d20+5[STR]+{2d6[fire], 1d4[cold]}kh1[best]-2[STR]",
+		"(1d4)d6kh2+{1d3}d(2*1d4)-2d(1d6+1)",
+		"4d{0,0,1:hit,2:crit}!2kh2",
+		"2d{0,success,success+advantage,advantage+advantage}+d{0,failure,threat+threat}",
+		"6d6mt3+8d10kh6m>=7sd",
+		"1d20cs>=19cf<3+{2d6, 1d8}kh1cs8",
+		"2d6!o3>5+d10!!o=10-d4!po=4",
+		"1d20+5[STR] vs 1d20+3",
+		"(2d6) >= 8",
+		"6 x 4d6kh3",
+		"repeat(3, 1d20+5 vs 1d20)sd",
+		"max{1d20, 1d20}+floor(7/2)-count{4d6kh3, 3d6}>10+abs(1d4-3)+avg{1d6, 1d8}",
+		"repeat(2, round(sum{1d6, 1d8}/3))",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			program := compileProgram(t, input)
+			data, err := json.Marshal(program)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+
+			var decoded Program
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(*program, decoded) {
+				t.Fatalf("program mismatch:\nexp=%+v\ngot=%+v", *program, decoded)
+			}
+
+			want := evaluateProgram(t, 3, input)
+			var got Result
+			withTestSeed(3, func() {
+				got, err = EvaluateProgram(&decoded)
+			})
+			if err != nil {
+				t.Fatalf("evaluate decoded: %v", err)
+			}
+			if want.Total != got.Total || want.Successes != got.Successes {
+				t.Fatalf("decoded program evaluated differently: exp=%d/%d got=%d/%d", want.Total, want.Successes, got.Total, got.Successes)
+			}
+		})
+	}
+}
+
+func TestResult_JSONRoundTrip(t *testing.T) {
+	for _, input := range []string{"{3d6!6, 2d8ro1}kh1>4", "2d6+3", "7", "8d6[fire]+2[fire]", "3d{0,success,success+advantage,threat}", "1d20+5[STR] vs 1d20+3"} {
+		t.Run(input, func(t *testing.T) {
+			result := evaluateProgram(t, 1, input)
+			data, err := json.Marshal(result)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+
+			var decoded Result
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			again, err := json.Marshal(decoded)
+			if err != nil {
+				t.Fatalf("marshal decoded: %v", err)
+			}
+			if string(data) != string(again) {
+				t.Fatalf("round trip mismatch:\nexp=%s\ngot=%s", data, again)
+			}
+			if decoded.Total != result.Total || len(decoded.Rolls) != len(result.Rolls) {
+				t.Fatalf("decoded result mismatch: exp=%+v got=%+v", result, decoded)
+			}
+		})
+	}
+}
+
+func TestProgram_MarshalJSONSchema(t *testing.T) {
+	data, err := json.Marshal(compileProgram(t, "{2d6!!6, 1d8r<2}kh1>=5"))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// encoding/json escapes < and > in strings by default.
+	const want = `{"version":1,"code":[{"op":"roll_dice"},{"op":"roll_dice","arg":1},{"op":"roll_group"}],` +
+		`"dice_terms":[{"multiplier":2,"die":{"type":"normal","sides":6},"exploding":{"type":"compounded","compare":{"type":"equals","value":6}},"notation":"2d6!!6"},` +
+		`{"multiplier":1,"die":{"type":"normal","sides":8},"rerolls":[{"compare":{"type":"less_than","value":2}}],"notation":"d8r\u003c2"}],` +
+		`"group_terms":[{"limit":{"type":"keep_highest","amount":1},"success":{"type":"greater_than","value":5,"inclusive":true},"child_count":2,"notation":"{2d6!!6, d8r\u003c2}kh\u003e=5"}],` +
+		`"rendered":"{2d6!!6, d8r\u003c2}kh\u003e=5","max_depth":2}`
+	if string(data) != want {
+		t.Fatalf("encoding mismatch:\nexp=%s\ngot=%s", want, data)
+	}
+}
+
+func TestProgram_UnmarshalJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{name: "version", data: `{"version":2,"code":[]}`, err: "invalid encoding: unsupported program version 2"},
+		{name: "opcode", data: `{"version":1,"code":[{"op":"jump"}]}`, err: `invalid encoding: unknown opcode "jump"`},
+		{name: "die", data: `{"version":1,"dice_terms":[{"multiplier":1,"die":{"type":"coin"}}]}`, err: `invalid encoding: unknown die type "coin"`},
+		{name: "limit", data: `{"version":1,"group_terms":[{"limit":{"type":"keep_most","amount":1}}]}`, err: `invalid encoding: unknown limit type "keep_most"`},
+		{name: "reroll", data: `{"version":1,"dice_terms":[{"multiplier":1,"die":{"type":"fate"},"rerolls":[{"once":true}]}]}`, err: "invalid encoding: reroll op has no comparison"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var program Program
+			err := json.Unmarshal([]byte(tt.data), &program)
+			if err == nil {
+				t.Fatal("expected decoding error")
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("unexpected error: exp=%q got=%q", tt.err, err.Error())
+			}
+			var encodingErr ErrInvalidEncoding
+			if !errors.As(err, &encodingErr) {
+				t.Fatalf("expected ErrInvalidEncoding, got %T", err)
+			}
+		})
+	}
+
+	// Well formed JSON must still describe a program that can run.
+	var program Program
+	err := json.Unmarshal([]byte(`{"version":1,"code":[{"op":"add"}]}`), &program)
+	var programErr ErrInvalidProgram
+	if !errors.As(err, &programErr) {
+		t.Fatalf("expected ErrInvalidProgram, got %v", err)
+	}
+	if want := "invalid program: instruction 0: add requires 2 operands, stack has 0"; err.Error() != want {
+		t.Fatalf("unexpected error: exp=%q got=%q", want, err.Error())
+	}
+}
+
+// TestSchema_Enums keeps the enumerations in roll.schema.json in step with
+// the names used by the encoders.
+func TestSchema_Enums(t *testing.T) {
+	data, err := os.ReadFile("roll.schema.json")
+	if err != nil {
+		t.Fatalf("read schema: %v", err)
+	}
+	var schema struct {
+		Defs map[string]struct {
+			Enum []string `json:"enum"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("parse schema: %v", err)
+	}
+
+	names := func(m any) []string {
+		var out []string
+		v := reflect.ValueOf(m)
+		for _, key := range v.MapKeys() {
+			out = append(out, v.MapIndex(key).String())
+		}
+		sort.Strings(out)
+		return out
+	}
+	enums := map[string][]string{
+		"opcode":          names(opcodeNames),
+		"comparison_type": names(comparisonTypeNames),
+		"exploding_type":  names(explodingTypeNames),
+		"limit_type":      names(limitTypeNames),
+		"sort":            names(sortTypeNames),
+		"term_kind":       names(termKindNames),
+		"compare_kind":    names(compareKindNames),
+		"side":            names(sideNames),
+	}
+
+	for def, want := range enums {
+		got := append([]string(nil), schema.Defs[def].Enum...)
+		sort.Strings(got)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("schema enum %s mismatch: exp=%v got=%v", def, want, got)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package roll
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // ErrUnexpectedToken is raised on unexpected tokens.
@@ -21,7 +23,71 @@ func (e ErrUnknownDie) Error() string {
 	return fmt.Sprintf("unrecognised die type %q", string(e))
 }
 
+// ParseError describes where and why a roll failed to compile. It wraps the
+// underlying error, such as ErrUnexpectedToken or ErrUnknownDie, so those
+// remain reachable with errors.As.
+type ParseError struct {
+	// Pos is the position of the start of the offending span.
+	Pos Position
+	// Span is the offending source text. It is empty at the end of input.
+	Span string
+	// Expected describes the tokens that would have been accepted instead,
+	// when the parser knows them.
+	Expected []string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	if e.Pos.Line > 1 {
+		return fmt.Sprintf("%s at line %d, column %d", e.Err, e.Pos.Line, e.Pos.Column)
+	}
+	return fmt.Sprintf("%s at column %d", e.Err, e.Pos.Column)
+}
+
+// Unwrap returns the underlying error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Render returns the line of source containing the error with the offending
+// span underlined by carets, for example:
+//
+//	3d6+dX
+//	    ^^
+func (e *ParseError) Render(source string) string {
+	lines := strings.Split(source, "\n")
+	if e.Pos.Line < 1 || e.Pos.Line > len(lines) {
+		return ""
+	}
+	line := lines[e.Pos.Line-1]
+
+	var caret strings.Builder
+	col := 1
+	for _, ch := range line {
+		if col >= e.Pos.Column {
+			break
+		}
+		if ch == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+		col++
+	}
+
+	width := utf8.RuneCountInString(strings.SplitN(e.Span, "\n", 2)[0])
+	caret.WriteString(strings.Repeat("^", max(width, 1)))
+	return line + "\n" + caret.String()
+}
+
+// operandTokens are the tokens that may start an operand.
+var operandTokens = []string{"number", "die", "(", "{", "?{", "@{"}
+
 // ErrEndOfRoll is raised when parsing a roll has reached a terminating token.
+//
+// Deprecated: the expression parser detects the end of a roll itself and no
+// longer returns this error.
 type ErrEndOfRoll string
 
 func (e ErrEndOfRoll) Error() string {
@@ -29,6 +95,9 @@ func (e ErrEndOfRoll) Error() string {
 }
 
 // ErrAmbiguousModifier is raised when a multiplier was misread as a modifier.
+//
+// Deprecated: the expression parser resolves modifiers using lookahead and no
+// longer returns this error.
 type ErrAmbiguousModifier int
 
 func (e ErrAmbiguousModifier) Error() string {
@@ -36,16 +105,78 @@ func (e ErrAmbiguousModifier) Error() string {
 }
 
 // Parser compiles dice notation into VM bytecode.
+//
+// The grammar it accepts is, in order of increasing precedence:
+//
+//	expression := term (("+" | "-") term)*
+//	term       := unary (("*" | "/") unary)*
+//	unary      := ["+" | "-"] primary
+//	primary    := NUM [LABEL] | dice | operand
+//	dice       := [NUM | operand] (DIE | "d" ("(" expression ")" | QUERY | ATTRIBUTE)) modifiers [LABEL]
+//	operand    := group | call | QUERY | ATTRIBUTE | "(" expression ")"
+//	group      := "{" expression ("," expression)* [","] "}" modifiers [LABEL]
+//	call       := ("max" | "min" | "sum" | "avg") "{" expression ("," expression)* [","] "}"
+//	            | "count" "{" expression ("," expression)* [","] "}" COMPARISON
+//	            | ("floor" | "ceil" | "round" | "abs") "(" expression ")"
+//	roll       := expression [("vs" | COMPARISON) expression]
+//	program    := [NUM "x"] roll | "repeat" "(" NUM "," roll ")" [SORT]
+//
+// A program may repeat a roll, as in 6 x 4d6kh3 or repeat(6, 4d6dl1), to
+// list the results of rolling it that many times. The repeat form may sort
+// them by total, as in repeat(6, 4d6dl1)sd.
+//
+// A roll may compare two expressions, as in 1d20+5 vs 1d20+3, or check one
+// against a target, as in 2d6 >= 8. A comparison written against a dice term
+// or group without whitespace on both sides of the operator, as in 2d6>=8 or
+// 2d6 >=8, is a success check instead.
+//
+// A constant that directly follows a dice term or group, such as the +4 in
+// 3d6+4, is folded into that term's modifier so success and failure checks
+// continue to see the modified die values. A label, such as the [fire] in
+// 8d6[fire], ends the term it follows, and a labelled constant is never
+// folded.
+//
+// The aggregates max, min, sum and avg gather the totals of the expressions
+// in their braces, and count counts those passing the comparison written
+// after it, as in count{4d6kh3, 4d6kh3, 4d6kh3}>10. Unlike a group, an
+// aggregate of one expression gathers its total rather than its dice. The
+// rounding functions floor, ceil and round round the exact quotient of a
+// division or avg directly inside them, as in floor(7/2), and abs takes the
+// absolute value of its argument.
+//
+// A ?{...} query or @{...} attribute reference is resolved as it is parsed,
+// and the text it stands for compiled in its place as if it were wrapped in
+// parentheses. As in Roll20, a query asked more than once in a roll is
+// answered once. One that gives a constant may also stand for the number in
+// a comparison or keep and drop modifier, as in 1d20>=@{dc} or 4d6kh@{keep}.
+//
+// The count of a dice term may be a parenthesized expression, group, query
+// or attribute, as in (1d4)d6, and the size of its die a parenthesized
+// expression, query or attribute, as in 2d(1d4*2) or 2d@{hitdie}. Counts and sizes that are not constant are
+// rolled first, when the term itself is rolled.
 type Parser struct {
-	s      *Scanner
-	limits Limits
-	buf    struct {
-		tok Token
-		lit string
-		n   int
+	s          *Scanner
+	limits     Limits
+	queries    QueryResolver
+	attributes AttributeProvider
+	dice       map[string]CustomDie
+	// character is the character whose attributes are being expanded, used
+	// by references that do not name one.
+	character string
+	subs      *substitutions
+	depth     int
+	buf       struct {
+		toks []scannedToken
+		pos  int
 	}
 }
 
+type scannedToken struct {
+	tok Token
+	lit string
+	pos Position
+}
+
 // NewParser returns a compiler instance.
 func NewParser(r io.Reader) *Parser {
 	return NewParserWithLimits(r, DefaultLimits)
@@ -53,30 +184,217 @@ func NewParser(r io.Reader) *Parser {
 
 // NewParserWithLimits returns a compiler instance using explicit safety limits.
 func NewParserWithLimits(r io.Reader, limits Limits) *Parser {
-	return &Parser{s: NewScanner(r), limits: limits.normalized()}
+	return NewParserWithOptions(r, CompileOptions{Limits: limits})
 }
 
-// Parse compiles a roll expression into VM bytecode.
-func (p *Parser) Parse() (program *Program, err error) {
-	tok, lit := p.scanIgnoreWhitespace()
+// CompileOptions configures the compilation of a roll.
+type CompileOptions struct {
+	// Limits are the safety limits enforced while compiling.
+	Limits Limits
+	// Queries answers any ?{...} queries in the roll. When nil every query
+	// takes its default.
+	Queries QueryResolver
+	// Attributes supplies the values of @{...} attribute references. When
+	// nil any reference is an error.
+	Attributes AttributeProvider
+	// Dice are the custom dice that can be rolled by name, keyed by the name
+	// written after the d, as in 3dAVG.
+	Dice map[string]CustomDie
+}
 
-	var root compiledNode
-	root, err = p.parseRoll(tok, lit, false)
-	if e, ok := err.(ErrEndOfRoll); ok && e == "" {
-		err = nil
+// NewParserWithOptions returns a compiler instance using explicit options.
+func NewParserWithOptions(r io.Reader, opts CompileOptions) *Parser {
+	return &Parser{
+		s:          NewScanner(r),
+		limits:     opts.Limits.normalized(),
+		queries:    opts.Queries,
+		attributes: opts.Attributes,
+		dice:       opts.Dice,
+		subs:       &substitutions{answers: map[string]string{}, queries: map[string]bool{}},
 	}
+}
+
+// substitutions tracks the queries and attributes of a roll across the
+// parsers compiling it.
+type substitutions struct {
+	answers map[string]string
+	// queries holds the queries whose answers are being compiled.
+	queries map[string]bool
+	// attributes holds the attributes being compiled, outermost first.
+	attributes []string
+}
+
+// Parse compiles a roll expression into VM bytecode.
+func (p *Parser) Parse() (program *Program, err error) {
+	root, err := p.parseProgram()
 	if err != nil {
 		return nil, err
 	}
 
 	program = &Program{
-		Rendered: strings.TrimPrefix(root.render(), "+"),
+		Rendered: root.render(),
 		MaxDepth: root.maxDepth(),
 	}
 	root.emit(program)
+	if err := checkCost(program, p.limits); err != nil {
+		return nil, &ParseError{Pos: Position{Line: 1, Column: 1}, Err: err}
+	}
 	return program, nil
 }
 
+// parseProgram parses a whole roll, repeated or not, up to the end of input.
+func (p *Parser) parseProgram() (compiledNode, error) {
+	start := p.buf.pos
+	tok, lit := p.scanIgnoreWhitespace()
+	switch tok {
+	case tFUNCTION:
+		if lit == "repeat" {
+			return p.parseRepeat()
+		}
+	case tNUM:
+		count := p.buf.pos
+		if next, _ := p.scanIgnoreWhitespace(); next == tTIMES {
+			// Step back to the count so errors point at it.
+			times := p.buf.pos
+			p.buf.pos = count
+			node, err := p.newRepeatNode(lit)
+			if err != nil {
+				return nil, err
+			}
+			p.buf.pos = times
+			if node.body, err = p.parseRoll(tEOF, "end of input"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+	}
+	p.buf.pos = start
+	return p.parseRoll(tEOF, "end of input")
+}
+
+// parseRepeat parses the arguments of a call to repeat and the sort that may
+// follow it.
+func (p *Parser) parseRepeat() (compiledNode, error) {
+	if tok, lit := p.scanIgnoreWhitespace(); tok != tPARENSTART {
+		return nil, p.fail(ErrUnexpectedToken(lit), "(")
+	}
+	tok, lit := p.scanIgnoreWhitespace()
+	if tok != tNUM {
+		return nil, p.fail(ErrUnexpectedToken(lit), "number")
+	}
+	node, err := p.newRepeatNode(lit)
+	if err != nil {
+		return nil, err
+	}
+	if tok, lit := p.scanIgnoreWhitespace(); tok != tGROUPSEP {
+		return nil, p.fail(ErrUnexpectedToken(lit), ",")
+	}
+	if node.body, err = p.parseRoll(tPARENEND, ")"); err != nil {
+		return nil, err
+	}
+
+	tok, lit = p.scanIgnoreWhitespace()
+	switch {
+	case tok == tSORT && lit == "sd":
+		node.term.Sort = Descending
+	case tok == tSORT:
+		node.term.Sort = Ascending
+	case tok != tEOF:
+		return nil, p.fail(ErrUnexpectedToken(lit), "s", "sd", "end of input")
+	default:
+		return node, nil
+	}
+	if tok, lit := p.scanIgnoreWhitespace(); tok != tEOF {
+		return nil, p.fail(ErrUnexpectedToken(lit), "end of input")
+	}
+	return node, nil
+}
+
+// newRepeatNode returns a node repeating a roll the number of times given by
+// the literal count, within the repeat limit.
+func (p *Parser) newRepeatNode(count string) (*repeatNode, error) {
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, p.fail(err)
+	}
+	if n < 1 {
+		return nil, p.fail(ErrInvalidRepeat(n))
+	}
+	if n > p.limits.MaxRepeats {
+		return nil, p.fail(ErrLimitExceeded(fmt.Sprintf("roll repeats %d times, more than the maximum of %d", n, p.limits.MaxRepeats)))
+	}
+	return &repeatNode{term: RepeatTerm{Count: n}}, nil
+}
+
+// parseRoll parses an expression and any comparison following it, then the
+// token end that closes the roll, described as endName.
+func (p *Parser) parseRoll(end Token, endName string) (compiledNode, error) {
+	root, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	tok, lit := p.scanIgnoreWhitespace()
+	switch tok {
+	case tVERSUS, tGREATER, tLESS, tEQUAL:
+		if root, err = p.parseCompare(root, tok); err != nil {
+			return nil, err
+		}
+		if tok, lit = p.scanIgnoreWhitespace(); tok != end {
+			return nil, p.fail(ErrUnexpectedToken(lit), "+", "-", "*", "/", endName)
+		}
+	case end:
+	default:
+		return nil, p.fail(ErrUnexpectedToken(lit), "+", "-", "*", "/", "vs", ">", "<", "=", endName)
+	}
+	return root, nil
+}
+
+// parseCompare parses the right hand side of a roll comparing left against
+// it, following the vs keyword or comparison tok.
+func (p *Parser) parseCompare(left compiledNode, tok Token) (compiledNode, error) {
+	node := &compareNode{kind: CompareVersus, left: left}
+	switch tok {
+	case tEQUAL:
+		node.kind = CompareEqual
+	case tGREATER, tLESS:
+		node.kind = CompareGreater
+		if tok == tLESS {
+			node.kind = CompareLess
+		}
+		if next, _ := p.scan(); next == tEQUAL {
+			node.kind++
+		} else {
+			p.unscan()
+		}
+	}
+
+	right, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	node.right = right
+	return node, nil
+}
+
+// endsTerm reports whether the comparison operator just scanned has
+// whitespace on both sides, as in 2d6 >= 8, so it compares the whole roll
+// rather than checking the dice of the term before it. Spacing on one side
+// only, as in 2d6 >=8, still checks the dice, as it did before rolls could be
+// compared.
+func (p *Parser) endsTerm(op Token) bool {
+	if p.buf.pos < 2 || p.buf.toks[p.buf.pos-2].tok != tWS {
+		return false
+	}
+	start := p.buf.pos
+	defer func() { p.buf.pos = start }()
+	tok, _ := p.scan()
+	if tok == tEQUAL && op != tEQUAL {
+		tok, _ = p.scan()
+	}
+	return tok == tWS
+}
+
 type compiledNode interface {
 	emit(*Program)
 	render() string
@@ -85,20 +403,68 @@ type compiledNode interface {
 
 type diceNode struct {
 	term DiceTerm
+	// count and sides are the expressions giving the number of dice and the
+	// size of the die when they are computed at run time.
+	count, sides compiledNode
 }
 
 func (n *diceNode) emit(program *Program) {
+	op := OpRollDice
+	switch {
+	case n.count != nil && n.sides != nil:
+		op = OpRollDiceCountSides
+	case n.count != nil:
+		op = OpRollDiceCount
+	case n.sides != nil:
+		op = OpRollDiceSides
+	}
+	for _, operand := range []compiledNode{n.count, n.sides} {
+		if operand != nil {
+			operand.emit(program)
+		}
+	}
+
 	idx := len(program.DiceTerms)
-	program.DiceTerms = append(program.DiceTerms, n.term)
-	program.Code = append(program.Code, Instruction{Op: OpRollDice, Arg: idx})
+	term := n.term
+	term.Notation = n.render()
+	program.DiceTerms = append(program.DiceTerms, term)
+	program.Code = append(program.Code, Instruction{Op: op, Arg: idx})
 }
 
 func (n *diceNode) render() string {
-	return renderDiceTerm(n.term)
+	if n.count == nil && n.sides == nil {
+		return renderDiceTerm(n.term)
+	}
+
+	var output strings.Builder
+	switch {
+	case n.count != nil:
+		if n.term.Multiplier < 0 {
+			output.WriteString("-")
+		}
+		output.WriteString(n.count.render())
+	case n.term.Multiplier == -1:
+		output.WriteString("-")
+	case n.term.Multiplier != 1:
+		output.WriteString(strconv.Itoa(n.term.Multiplier))
+	}
+	if n.sides != nil {
+		output.WriteString("d" + n.sides.render())
+	} else {
+		output.WriteString(n.term.Die.String())
+	}
+	output.WriteString(renderDiceModifiers(n.term))
+	return output.String()
 }
 
 func (n *diceNode) maxDepth() int {
-	return 1
+	depth := 1
+	for _, operand := range []compiledNode{n.count, n.sides} {
+		if operand != nil {
+			depth = max(depth, 1+operand.maxDepth())
+		}
+	}
+	return depth
 }
 
 type groupNode struct {
@@ -113,55 +479,52 @@ func (n *groupNode) emit(program *Program) {
 	idx := len(program.GroupTerms)
 	term := n.term
 	term.ChildCount = len(n.children)
+	term.Notation = n.render()
 	program.GroupTerms = append(program.GroupTerms, term)
 	program.Code = append(program.Code, Instruction{Op: OpRollGroup, Arg: idx})
 }
 
 func (n *groupNode) render() string {
-	parts := make([]string, 0, len(n.children))
-	for _, child := range n.children {
-		if child != nil {
-			parts = append(parts, child.render())
+	var output strings.Builder
+	output.WriteString("{")
+	for i, child := range n.children {
+		part := child.render()
+		switch {
+		case i == 0:
+		case !n.term.Combined:
+			output.WriteString(", ")
+		case strings.HasPrefix(part, "-"):
+			output.WriteString(" - ")
+			part = part[1:]
+		default:
+			output.WriteString(" + ")
 		}
+		output.WriteString(part)
 	}
-
-	sep := ", "
-	if n.term.Combined {
-		sep = " + "
-	}
-
-	output := strings.Join(parts, sep)
-	if n.term.Combined {
-		output = strings.ReplaceAll(output, "+-", "-")
-	} else if len(n.children) == 1 {
-		output += ","
+	if !n.term.Combined && len(n.children) == 1 {
+		output.WriteString(",")
 	}
-
-	output = "{" + output + "}"
-	output = strings.ReplaceAll(output, "{+", "{")
-	output = strings.ReplaceAll(output, "{-", "{")
-	output = strings.ReplaceAll(output, ", +", ", ")
-	output = strings.ReplaceAll(output, ", -", ", ")
-	output = strings.ReplaceAll(output, "+ +", "+ ")
-	output = strings.ReplaceAll(output, "+ -", "- ")
+	output.WriteString("}")
 
 	if n.term.Limit != nil {
-		output += n.term.Limit.String()
+		output.WriteString(n.term.Limit.String())
 	}
 	if n.term.Success != nil {
-		output += n.term.Success.String()
+		output.WriteString(n.term.Success.String())
 	}
 	if n.term.Failure != nil {
-		output += "f" + n.term.Failure.String()
+		output.WriteString("f" + n.term.Failure.String())
 	}
+	output.WriteString(renderCrits(n.term.CritSuccess, n.term.CritFailure))
 	if n.term.Modifier != 0 {
-		output += fmt.Sprintf("%+d", n.term.Modifier)
+		output.WriteString(fmt.Sprintf("%+d", n.term.Modifier))
 	}
+	output.WriteString(renderLabel(n.term.Label))
 	if n.term.Negative {
-		output = "-" + output
+		return "-" + output.String()
 	}
 
-	return output
+	return output.String()
 }
 
 func (n *groupNode) maxDepth() int {
@@ -172,18 +535,194 @@ func (n *groupNode) maxDepth() int {
 	return depth
 }
 
+type constNode struct {
+	value int
+	label string
+}
+
+func (n *constNode) emit(program *Program) {
+	program.Code = append(program.Code, Instruction{Op: OpConst, Arg: n.value})
+	if n.label != "" {
+		program.Code = append(program.Code, Instruction{Op: OpLabel, Arg: program.labelIndex(n.label)})
+	}
+}
+
+func (n *constNode) render() string {
+	return strconv.Itoa(n.value) + renderLabel(n.label)
+}
+
+func (n *constNode) maxDepth() int {
+	return 1
+}
+
+type binaryNode struct {
+	op          Opcode
+	left, right compiledNode
+}
+
+func (n *binaryNode) emit(program *Program) {
+	n.left.emit(program)
+	n.right.emit(program)
+	program.Code = append(program.Code, Instruction{Op: n.op})
+}
+
+func (n *binaryNode) render() string {
+	return n.left.render() + n.op.symbol() + n.right.render()
+}
+
+func (n *binaryNode) maxDepth() int {
+	return 1 + max(n.left.maxDepth(), n.right.maxDepth())
+}
+
+type negNode struct {
+	child compiledNode
+}
+
+func (n *negNode) emit(program *Program) {
+	n.child.emit(program)
+	program.Code = append(program.Code, Instruction{Op: OpNeg})
+}
+
+func (n *negNode) render() string {
+	return "-" + n.child.render()
+}
+
+func (n *negNode) maxDepth() int {
+	return 1 + n.child.maxDepth()
+}
+
+type parenNode struct {
+	child compiledNode
+}
+
+func (n *parenNode) emit(program *Program) {
+	n.child.emit(program)
+}
+
+func (n *parenNode) render() string {
+	return "(" + n.child.render() + ")"
+}
+
+func (n *parenNode) maxDepth() int {
+	return n.child.maxDepth()
+}
+
+type compareNode struct {
+	kind        CompareKind
+	left, right compiledNode
+}
+
+func (n *compareNode) emit(program *Program) {
+	n.left.emit(program)
+	n.right.emit(program)
+	program.Code = append(program.Code, Instruction{Op: OpCompare, Arg: int(n.kind)})
+}
+
+func (n *compareNode) render() string {
+	return n.left.render() + " " + n.kind.String() + " " + n.right.render()
+}
+
+func (n *compareNode) maxDepth() int {
+	return 1 + max(n.left.maxDepth(), n.right.maxDepth())
+}
+
+type repeatNode struct {
+	term RepeatTerm
+	body compiledNode
+}
+
+func (n *repeatNode) emit(program *Program) {
+	n.body.emit(program)
+	term := n.term
+	term.Notation = n.body.render()
+	program.RepeatTerms = append(program.RepeatTerms, term)
+	program.Code = append(program.Code, Instruction{Op: OpRepeat, Arg: len(program.RepeatTerms) - 1})
+}
+
+// render writes the repeat as a call when it sorts, since only the call
+// form can.
+func (n *repeatNode) render() string {
+	if n.term.Sort == Unsorted {
+		return strconv.Itoa(n.term.Count) + " x " + n.body.render()
+	}
+	return "repeat(" + strconv.Itoa(n.term.Count) + ", " + n.body.render() + ")" + n.term.Sort.String()
+}
+
+func (n *repeatNode) maxDepth() int {
+	return 1 + n.body.maxDepth()
+}
+
+type aggregateNode struct {
+	op       Opcode
+	term     AggregateTerm
+	children []compiledNode
+}
+
+func (n *aggregateNode) emit(program *Program) {
+	for _, child := range n.children {
+		child.emit(program)
+	}
+	term := n.term
+	term.ChildCount = len(n.children)
+	program.AggregateTerms = append(program.AggregateTerms, term)
+	program.Code = append(program.Code, Instruction{Op: n.op, Arg: len(program.AggregateTerms) - 1})
+}
+
+func (n *aggregateNode) render() string {
+	parts := make([]string, len(n.children))
+	for i, child := range n.children {
+		parts[i] = child.render()
+	}
+	output := n.op.String() + "{" + strings.Join(parts, ", ") + "}"
+	if n.term.Count != nil {
+		output += n.term.Count.String()
+	}
+	return output
+}
+
+func (n *aggregateNode) maxDepth() int {
+	depth := 0
+	for _, child := range n.children {
+		depth = max(depth, child.maxDepth())
+	}
+	return 1 + depth
+}
+
+// callNode is a call to a function of one argument, such as floor.
+type callNode struct {
+	op  Opcode
+	arg compiledNode
+}
+
+func (n *callNode) emit(program *Program) {
+	n.arg.emit(program)
+	program.Code = append(program.Code, Instruction{Op: n.op})
+}
+
+func (n *callNode) render() string {
+	return n.op.String() + "(" + n.arg.render() + ")"
+}
+
+func (n *callNode) maxDepth() int {
+	return 1 + n.arg.maxDepth()
+}
+
 func renderDiceTerm(term DiceTerm) string {
 	var output strings.Builder
-	if term.Multiplier > 1 || term.Multiplier < -1 {
-		output.WriteString(fmt.Sprintf("%+d", term.Multiplier))
-	} else if term.Multiplier == -1 {
+	if term.Multiplier == -1 {
 		output.WriteString("-")
-	} else if term.Multiplier == 1 {
-		output.WriteString("+")
+	} else if term.Multiplier != 1 {
+		output.WriteString(strconv.Itoa(term.Multiplier))
 	}
 
 	output.WriteString(term.Die.String())
+	output.WriteString(renderDiceModifiers(term))
+	return output.String()
+}
 
+// renderDiceModifiers returns the notation that follows the die of a term.
+func renderDiceModifiers(term DiceTerm) string {
+	var output strings.Builder
 	if term.Modifier != 0 {
 		output.WriteString(fmt.Sprintf("%+d", term.Modifier))
 	}
@@ -202,144 +741,504 @@ func renderDiceTerm(term DiceTerm) string {
 	if term.Failure != nil {
 		output.WriteString("f" + term.Failure.String())
 	}
+	output.WriteString(renderCrits(term.CritSuccess, term.CritFailure))
+	if term.Match != nil {
+		output.WriteString(term.Match.String())
+	}
 	output.WriteString(term.Sort.String())
+	output.WriteString(renderLabel(term.Label))
 
 	return output.String()
 }
 
-func (p *Parser) parseRoll(tok Token, lit string, grouped bool) (compiledNode, error) {
-	switch tok {
-	case tNUM, tDIE:
-		return p.parseDiceRoll(grouped)
-	case tGROUPSTART:
-		return p.parseGroupedRoll(grouped)
-	default:
-		return nil, ErrUnexpectedToken(lit)
+// renderCrits returns the notation of critical success and failure checks.
+func renderCrits(success, failure *ComparisonOp) string {
+	var output string
+	if success != nil {
+		output += "cs" + strings.TrimPrefix(success.String(), "=")
+	}
+	if failure != nil {
+		output += "cf" + strings.TrimPrefix(failure.String(), "=")
 	}
+	return output
 }
 
-func (p *Parser) parseGroupedRoll(grouped bool) (compiledNode, error) {
-	node := &groupNode{term: GroupTerm{Combined: true}}
+// renderLabel returns the bracketed notation of a label, if there is one.
+func renderLabel(label string) string {
+	if label == "" {
+		return ""
+	}
+	return "[" + label + "]"
+}
 
-	var negative bool
-	var multiplier int
-	var err error
-	for err == nil {
-		tok, lit := p.scanIgnoreWhitespace()
+// negate flips the sign of a node, preferring to fold the sign into dice and
+// group terms so combined groups keep their per-die semantics.
+func negate(node compiledNode) compiledNode {
+	switch n := node.(type) {
+	case *diceNode:
+		n.term.Multiplier *= -1
+		return n
+	case *groupNode:
+		n.term.Negative = !n.term.Negative
+		return n
+	case *negNode:
+		return n.child
+	}
+	return &negNode{child: node}
+}
 
-		child, childErr := p.parseRoll(tok, lit, true)
-		if child != nil && multiplier != 0 {
-			switch n := child.(type) {
-			case *groupNode:
-				if multiplier < 0 {
-					n.term.Negative = true
-				}
-			case *diceNode:
-				n.term.Multiplier = multiplier
-			}
-			multiplier = 0
+// flattenCombined splits an additive expression into the signed children of
+// a combined group.
+func flattenCombined(node compiledNode, negative bool, children []compiledNode) []compiledNode {
+	switch n := node.(type) {
+	case *binaryNode:
+		if n.op == OpAdd || n.op == OpSub {
+			children = flattenCombined(n.left, negative, children)
+			return flattenCombined(n.right, negative != (n.op == OpSub), children)
 		}
+	case *negNode:
+		return flattenCombined(n.child, !negative, children)
+	}
 
-		if negative {
-			switch n := child.(type) {
-			case *groupNode:
-				n.term.Negative = true
-			case *diceNode:
-				n.term.Multiplier *= -1
-			}
+	if negative {
+		node = negate(node)
+	}
+	return append(children, node)
+}
+
+func (p *Parser) parseExpression() (compiledNode, error) {
+	left, err := p.parseTerm(true)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var op Opcode
+		switch tok, _ := p.scanIgnoreWhitespace(); tok {
+		case tPLUS:
+			op = OpAdd
+		case tMINUS:
+			op = OpSub
+		default:
+			p.unscan()
+			return left, nil
+		}
+
+		if tok, lit := p.scanIgnoreWhitespace(); tok == tPLUS || tok == tMINUS {
+			return nil, p.fail(ErrUnexpectedToken(lit), operandTokens...)
+		}
+		p.unscan()
+
+		right, err := p.parseTerm(op == OpAdd)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *Parser) parseTerm(fold bool) (compiledNode, error) {
+	left, err := p.parseUnary(fold)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var op Opcode
+		switch tok, _ := p.scanIgnoreWhitespace(); tok {
+		case tMULTIPLY:
+			op = OpMul
+		case tDIVIDE:
+			op = OpDiv
+		default:
+			p.unscan()
+			return left, nil
+		}
+
+		right, err := p.parseUnary(false)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+// parseUnary parses an optionally signed operand. When fold is false the
+// operand is being subtracted, negated or multiplied, so trailing constants
+// are left for the enclosing expression instead of being folded into dice
+// terms where they would change the meaning of the roll.
+func (p *Parser) parseUnary(fold bool) (compiledNode, error) {
+	tok, _ := p.scanIgnoreWhitespace()
+	if tok != tPLUS && tok != tMINUS {
+		p.unscan()
+		return p.parsePrimary(fold)
+	}
+
+	if next, lit := p.scanIgnoreWhitespace(); next == tPLUS || next == tMINUS {
+		return nil, p.fail(ErrUnexpectedToken(lit), operandTokens...)
+	}
+	p.unscan()
+
+	if tok == tPLUS {
+		return p.parsePrimary(fold)
+	}
+
+	operand, err := p.parsePrimary(false)
+	if err != nil {
+		return nil, err
+	}
+	return &negNode{child: operand}, nil
+}
+
+func (p *Parser) parsePrimary(fold bool) (compiledNode, error) {
+	tok, lit := p.scanIgnoreWhitespace()
+	switch tok {
+	case tNUM:
+		if next, _ := p.scanIgnoreWhitespace(); next == tDIE {
+			p.unscan()
+			return p.parseDiceRoll(lit, fold)
 		}
+		p.unscan()
 
-		err = childErr
+		value, err := strconv.Atoi(lit)
 		if err != nil {
-			negative = false
-			if child == nil && len(node.children) == 0 {
+			return nil, p.fail(err)
+		}
+		node := &constNode{value: value}
+		if next, lit := p.scanIgnoreWhitespace(); next == tLABEL {
+			if node.label, err = p.parseLabel(lit); err != nil {
 				return nil, err
 			}
+		} else {
+			p.unscan()
+		}
+		return node, nil
+	case tDIE:
+		p.unscan()
+		return p.parseDiceRoll("", fold)
+	case tGROUPSTART, tQUERY, tATTRIBUTE, tPARENSTART, tFUNCTION:
+		p.unscan()
+		operand, err := p.parseOperand(fold)
+		if err != nil {
+			return nil, err
+		}
+		return p.parseDiceCount(operand, fold)
+	default:
+		return nil, p.fail(ErrUnexpectedToken(lit), operandTokens...)
+	}
+}
 
-			if e, ok := err.(ErrAmbiguousModifier); ok {
-				multiplier = int(e)
-				p.unscan()
-				err = nil
-			} else {
-				p.unscan()
-				tok, lit = p.scanIgnoreWhitespace()
-				switch tok {
-				case tPLUS:
-				case tMINUS:
-					negative = true
-				case tGROUPSEP:
-					if len(node.children) > 1 && node.term.Combined {
-						return nil, err
-					}
-					node.term.Combined = false
-					err = nil
-				case tGROUPSTART:
-					p.unscan()
-					err = nil
-				case tGROUPEND:
-					err = ErrEndOfRoll(lit)
-				default:
-					return nil, err
-				}
-			}
+// parseOperand parses a group, query, attribute or parenthesized expression,
+// any of which may also be the count of a dice term.
+func (p *Parser) parseOperand(fold bool) (compiledNode, error) {
+	tok, lit := p.scanIgnoreWhitespace()
+	if tok == tQUERY || tok == tATTRIBUTE {
+		return p.parseSubstituted(tok, lit)
+	}
+
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	switch tok {
+	case tGROUPSTART:
+		return p.parseGroupedRoll(fold)
+	case tFUNCTION:
+		return p.parseCall(lit)
+	}
+	return p.parseParens()
+}
+
+// parseCall parses the arguments of a call to an aggregate or rounding
+// function.
+func (p *Parser) parseCall(name string) (compiledNode, error) {
+	op, ok := functionOpcodes[name]
+	if !ok {
+		// Repeating is only allowed around a whole roll.
+		return nil, p.fail(ErrUnexpectedToken(name), operandTokens...)
+	}
+
+	if !op.aggregates() {
+		if tok, lit := p.scanIgnoreWhitespace(); tok != tPARENSTART {
+			return nil, p.fail(ErrUnexpectedToken(lit), "(")
+		}
+		arg, err := p.parseParens()
+		if err != nil {
+			return nil, err
+		}
+		return &callNode{op: op, arg: arg.(*parenNode).child}, nil
+	}
+
+	if tok, lit := p.scanIgnoreWhitespace(); tok != tGROUPSTART {
+		return nil, p.fail(ErrUnexpectedToken(lit), "{")
+	}
+	children, _, err := p.parseGroupChildren()
+	if err != nil {
+		return nil, err
+	}
+	node := &aggregateNode{op: op, children: children}
+	if op == OpCount {
+		// count always takes a comparison, so unlike a success count it may
+		// be spaced from the brace, as in count{1d20, 1d20} > 10.
+		tok, lit := p.scanIgnoreWhitespace()
+		if tok != tGREATER && tok != tLESS && tok != tEQUAL {
+			return nil, p.fail(ErrUnexpectedToken(lit), "=", ">", "<")
+		}
+		p.unscan()
+		if node.term.Count, err = p.parseComparison(); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// parseParens parses the expression following an opening parenthesis.
+func (p *Parser) parseParens() (compiledNode, error) {
+	child, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if tok, lit := p.scanIgnoreWhitespace(); tok != tPARENEND {
+		return nil, p.fail(ErrUnexpectedToken(lit), "+", "-", "*", "/", ")")
+	}
+	return &parenNode{child: child}, nil
+}
+
+// parseDiceCount makes count the number of dice of a dice term when a die
+// follows it, as in (1d4)d6 or {1d3+1}d8. A count that is a plain number,
+// such as an attribute holding one, is compiled as a literal count.
+func (p *Parser) parseDiceCount(count compiledNode, fold bool) (compiledNode, error) {
+	tok, _ := p.scanIgnoreWhitespace()
+	p.unscan()
+	if tok != tDIE {
+		return count, nil
+	}
+
+	if n, ok := constantValue(count); ok {
+		return p.parseDiceRoll(strconv.Itoa(n), fold)
+	}
+	switch count.(type) {
+	case *parenNode, *groupNode:
+	default:
+		count = &parenNode{child: count}
+	}
+
+	node, err := p.parseDiceRoll("", fold)
+	if err != nil {
+		return nil, err
+	}
+	dice := node.(*diceNode)
+	dice.count = count
+	return dice, nil
+}
+
+// constantValue returns the value of a node that is an unlabelled constant,
+// possibly in parentheses.
+func constantValue(node compiledNode) (int, bool) {
+	for {
+		switch n := node.(type) {
+		case *parenNode:
+			node = n.child
+		case *constNode:
+			return n.value, n.label == ""
+		default:
+			return 0, false
+		}
+	}
+}
+
+// parseQuery answers a query and compiles the answer in its place.
+func (p *Parser) parseQuery(lit string) (compiledNode, error) {
+	query, err := parseQuery(lit)
+	if err != nil {
+		return nil, p.fail(err)
+	}
+	if p.subs.queries[query.Prompt] {
+		return nil, p.fail(ErrInvalidQueryAnswer(fmt.Sprintf("answer to query %q refers to itself", query.Prompt)))
+	}
+	answer, ok := p.subs.answers[query.Prompt]
+	if !ok {
+		if answer, err = query.resolve(p.queries); err != nil {
+			return nil, p.fail(err)
 		}
+		p.subs.answers[query.Prompt] = answer
+	}
+
+	p.subs.queries[query.Prompt] = true
+	defer delete(p.subs.queries, query.Prompt)
+	return p.parseSubstitute(answer, p.character, fmt.Sprintf("answer %q to query %q", answer, query.Prompt))
+}
 
-		if child != nil {
-			node.children = append(node.children, child)
+// parseAttribute looks up an attribute and compiles its value in its place.
+func (p *Parser) parseAttribute(lit string) (compiledNode, error) {
+	ref := parseAttributeRef(lit, p.character)
+	if ref.Name == "" {
+		return nil, p.fail(ErrUnexpectedToken(lit), "attribute name")
+	}
+	for i, open := range p.subs.attributes {
+		if open == ref.String() {
+			cycle := append(append([]string(nil), p.subs.attributes[i:]...), open)
+			return nil, p.fail(ErrAttributeCycle(strings.Join(cycle, " -> ")))
 		}
 	}
 
+	var value string
+	ok := false
+	if p.attributes != nil {
+		value, ok = p.attributes.Attribute(ref.Character, ref.Name)
+	}
+	if !ok {
+		return nil, p.fail(ErrUnknownAttribute(ref.String()))
+	}
+
+	p.subs.attributes = append(p.subs.attributes, ref.String())
+	node, err := p.parseSubstitute(value, ref.Character, fmt.Sprintf("attribute %q", ref.String()))
+	p.subs.attributes = p.subs.attributes[:len(p.subs.attributes)-1]
+	return node, err
+}
+
+// parseSubstituted compiles the query or attribute token just scanned.
+func (p *Parser) parseSubstituted(tok Token, lit string) (compiledNode, error) {
+	if tok == tQUERY {
+		return p.parseQuery(lit)
+	}
+	return p.parseAttribute(lit)
+}
+
+// scanNumber scans the next token, replacing a query or attribute with a
+// number token holding the constant it gives, so they can be used wherever a
+// number can, as in 4d6kh@{keep} or 1d20>=@{dc}.
+func (p *Parser) scanNumber() (tok Token, lit string, err error) {
+	tok, lit = p.scan()
+	if tok != tQUERY && tok != tATTRIBUTE {
+		return tok, lit, nil
+	}
+	node, err := p.parseSubstituted(tok, lit)
+	if err != nil {
+		return tok, lit, err
+	}
+	n, ok := constantValue(node)
+	if !ok {
+		return tok, lit, p.fail(ErrNotConstant(lit), "number")
+	}
+	return tNUM, strconv.Itoa(n), nil
+}
+
+// parseSubstitute compiles the text a query or attribute stands for, with
+// errors prefixed by what the text came from.
+func (p *Parser) parseSubstitute(text, character, source string) (compiledNode, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	sub := &Parser{
+		s:          NewScanner(strings.NewReader(text)),
+		limits:     p.limits,
+		queries:    p.queries,
+		attributes: p.attributes,
+		dice:       p.dice,
+		character:  character,
+		subs:       p.subs,
+		depth:      p.depth,
+	}
+	node, err := sub.parseExpression()
+	if err == nil {
+		if tok, lit := sub.scanIgnoreWhitespace(); tok != tEOF {
+			err = sub.fail(ErrUnexpectedToken(lit), "+", "-", "*", "/", "end of input")
+		}
+	}
+	if err != nil {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			err = parseErr.Err
+		}
+		return nil, p.fail(fmt.Errorf("%s: %w", source, err))
+	}
+
+	// Bracket text whose notation would otherwise bind differently to the
+	// operators around it.
+	switch n := node.(type) {
+	case *binaryNode, *negNode:
+		node = &parenNode{child: node}
+	case *diceNode:
+		if n.term.Modifier != 0 || n.term.Multiplier < 0 {
+			node = &parenNode{child: node}
+		}
+	case *groupNode:
+		if n.term.Modifier != 0 || n.term.Negative {
+			node = &parenNode{child: node}
+		}
+	}
+	return node, nil
+}
+
+// enter records a level of nesting, refusing input nested deeper than the
+// evaluator would accept anyway.
+func (p *Parser) enter() error {
+	p.depth++
+	if p.depth > p.limits.MaxEvalDepth {
+		return p.fail(ErrLimitExceeded(fmt.Sprintf("roll exceeded maximum evaluation depth of %d", p.limits.MaxEvalDepth)))
+	}
+	return nil
+}
+
+func (p *Parser) leave() { p.depth-- }
+
+func (p *Parser) parseGroupedRoll(fold bool) (compiledNode, error) {
+	exprs, separated, err := p.parseGroupChildren()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &groupNode{term: GroupTerm{Combined: !separated}}
+	if separated {
+		node.children = exprs
+	} else {
+		node.children = flattenCombined(exprs[0], false, nil)
+	}
+
 	for {
+		var err error
 		tok, lit := p.scanIgnoreWhitespace()
 		switch tok {
 		case tPLUS, tMINUS:
-			var mod int
-			mod, err = p.parseModifier(tok)
-			if err == nil {
-				node.term.Modifier += mod
-			} else {
-				if tok == tMINUS {
-					mod = -1
-				}
-
+			if !fold {
 				p.unscan()
-				tok, lit = p.scanIgnoreWhitespace()
-				switch tok {
-				case tEOF:
-					return node, ErrEndOfRoll(lit)
-				case tGROUPSTART:
-					if grouped {
-						return node, ErrAmbiguousModifier(mod)
-					}
-					return nil, ErrUnexpectedToken(lit)
-				case tGROUPEND, tGROUPSEP:
-					if grouped {
-						return node, ErrEndOfRoll(lit)
-					}
-					return nil, ErrUnexpectedToken(lit)
-				default:
-					return nil, err
-				}
+				return node, nil
+			}
+			mod, ok, err := p.parseModifier(tok)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return node, nil
 			}
+			node.term.Modifier += mod
 		case tKEEPHIGH, tKEEPLOW, tDROPHIGH, tDROPLOW:
 			node.term.Limit, err = p.parseLimit(tok, lit)
 		case tGREATER, tLESS, tEQUAL:
+			if p.endsTerm(tok) {
+				p.unscan()
+				return node, nil
+			}
 			p.unscan()
 			node.term.Success, err = p.parseComparison()
 		case tFAILURES:
 			node.term.Failure, err = p.parseComparison()
-		case tEOF:
-			return node, ErrEndOfRoll(lit)
-		case tGROUPSEP:
-			if grouped {
-				return node, ErrEndOfRoll(lit)
+		case tCRITSUCCESS:
+			node.term.CritSuccess, err = p.parseComparison()
+		case tCRITFAILURE:
+			node.term.CritFailure, err = p.parseComparison()
+		case tLABEL:
+			if node.term.Label, err = p.parseLabel(lit); err != nil {
+				return nil, err
 			}
-			return nil, ErrUnexpectedToken(lit)
-		case tGROUPEND:
-			p.unscan()
 			return node, nil
 		default:
-			return nil, ErrUnexpectedToken(lit)
+			p.unscan()
+			return node, nil
 		}
 
 		if err != nil {
@@ -348,60 +1247,83 @@ func (p *Parser) parseGroupedRoll(grouped bool) (compiledNode, error) {
 	}
 }
 
-func (p *Parser) parseDiceRoll(grouped bool) (compiledNode, error) {
+// parseGroupChildren parses the expressions following an opening brace up to
+// the closing one, and reports whether they were separated by commas.
+func (p *Parser) parseGroupChildren() (exprs []compiledNode, separated bool, err error) {
+	for {
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, false, err
+		}
+		exprs = append(exprs, expr)
+
+		tok, lit := p.scanIgnoreWhitespace()
+		if tok == tGROUPEND {
+			return exprs, separated, nil
+		}
+		if tok != tGROUPSEP {
+			return nil, false, p.fail(ErrUnexpectedToken(lit), "+", "-", "*", "/", ",", "}")
+		}
+
+		separated = true
+		if tok, _ = p.scanIgnoreWhitespace(); tok == tGROUPEND {
+			return exprs, separated, nil
+		}
+		p.unscan()
+	}
+}
+
+func (p *Parser) parseDiceRoll(count string, fold bool) (compiledNode, error) {
 	node := &diceNode{term: DiceTerm{Multiplier: 1}}
-	tok := p.buf.tok
-	lit := p.buf.lit
 
-	if tok == tNUM {
-		node.term.Multiplier, _ = strconv.Atoi(lit)
-		tok, lit = p.scanIgnoreWhitespace()
-		if tok != tDIE {
-			return nil, ErrUnexpectedToken(lit)
+	if count != "" {
+		var err error
+		node.term.Multiplier, err = strconv.Atoi(count)
+		if err != nil {
+			return nil, p.fail(err)
 		}
 	}
 
-	die, err := p.parseDie(lit)
+	_, lit := p.scanIgnoreWhitespace()
+	sides, err := p.parseDieSize(lit)
+	if err != nil {
+		return nil, err
+	}
+	switch n, ok := constantValue(sides); {
+	case sides == nil:
+		node.term.Die, err = p.parseDie(lit)
+	case ok:
+		node.term.Die, err = p.parseDie("d" + strconv.Itoa(n))
+	default:
+		node.term.Die, node.sides = NormalDie(0), sides
+	}
 	if err != nil {
 		return nil, err
 	}
-	node.term.Die = die
 
-	var mod int
-	var lastTok Token
 	for {
-		tok, lit = p.scanIgnoreWhitespace()
+		tok, lit := p.scanIgnoreWhitespace()
 		switch tok {
 		case tPLUS, tMINUS:
-			mod, err = p.parseModifier(tok)
-			if err == nil {
-				node.term.Modifier += mod
-			} else {
-				if tok == tMINUS {
-					mod = -1
-				}
-
+			if !fold {
 				p.unscan()
-				tok, lit = p.scanIgnoreWhitespace()
-				switch tok {
-				case tEOF:
-					return node, ErrEndOfRoll(lit)
-				case tGROUPSTART:
-					if grouped {
-						return node, ErrAmbiguousModifier(mod)
-					}
-					return nil, ErrUnexpectedToken(lit)
-				case tGROUPEND, tGROUPSEP:
-					if grouped {
-						return node, ErrEndOfRoll(lit)
-					}
-					return nil, ErrUnexpectedToken(lit)
-				default:
-					return nil, err
-				}
+				return node, nil
+			}
+			mod, ok, err := p.parseModifier(tok)
+			if err != nil {
+				return nil, err
 			}
+			if !ok {
+				return node, nil
+			}
+			node.term.Modifier += mod
 		case tEXPLODE, tCOMPOUND, tPENETRATE:
-			node.term.Exploding, err = p.parseExplosion(tok, lit)
+			die := node.term.Die
+			if node.sides != nil {
+				// The size of a computed die is only known once rolled.
+				die = nil
+			}
+			node.term.Exploding, err = p.parseExplosion(tok, lit, die)
 		case tKEEPHIGH, tKEEPLOW, tDROPHIGH, tDROPLOW:
 			node.term.Limit, err = p.parseLimit(tok, lit)
 		case tSORT:
@@ -411,39 +1333,79 @@ func (p *Parser) parseDiceRoll(grouped bool) (compiledNode, error) {
 			case "sd":
 				node.term.Sort = Descending
 			}
+		case tMATCH:
+			node.term.Match, err = p.parseMatch(lit)
 		case tREROLL:
 			var reroll RerollOp
 			reroll, err = p.parseReroll(lit)
 			node.term.Rerolls = append(node.term.Rerolls, reroll)
 		case tGREATER, tLESS, tEQUAL:
+			if p.endsTerm(tok) {
+				p.unscan()
+				return node, nil
+			}
 			p.unscan()
 			node.term.Success, err = p.parseComparison()
 		case tFAILURES:
 			node.term.Failure, err = p.parseComparison()
-		case tEOF:
-			return node, ErrEndOfRoll(lit)
-		case tGROUPEND, tGROUPSEP:
-			if grouped {
-				return node, ErrEndOfRoll(lit)
-			}
-			return nil, ErrUnexpectedToken(lit)
-		case tDIE:
-			if grouped && (lastTok == tPLUS || lastTok == tMINUS) {
-				p.unscan()
-				node.term.Modifier -= mod
-				return node, ErrAmbiguousModifier(mod)
+		case tCRITSUCCESS:
+			node.term.CritSuccess, err = p.parseComparison()
+		case tCRITFAILURE:
+			node.term.CritFailure, err = p.parseComparison()
+		case tLABEL:
+			if node.term.Label, err = p.parseLabel(lit); err != nil {
+				return nil, err
 			}
-			return nil, ErrUnexpectedToken(lit)
+			return node, nil
 		default:
-			return nil, ErrUnexpectedToken(lit)
+			p.unscan()
+			return node, nil
 		}
 
 		if err != nil {
 			return nil, err
 		}
+	}
+}
 
-		lastTok = tok
+// parseDieSize parses the parenthesized expression giving the size of a die
+// written as d(...), as in 2d(1d4*2). It returns nil if lit is any other die.
+func (p *Parser) parseDieSize(lit string) (compiledNode, error) {
+	start := p.buf.pos
+	if lit != "d" {
+		return nil, nil
 	}
+	switch tok, lit := p.scanIgnoreWhitespace(); tok {
+	case tPARENSTART:
+	case tQUERY, tATTRIBUTE:
+		sides, err := p.parseSubstituted(tok, lit)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := sides.(*parenNode); !ok {
+			sides = &parenNode{child: sides}
+		}
+		return sides, nil
+	default:
+		p.buf.pos = start
+		return nil, nil
+	}
+
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	return p.parseParens()
+}
+
+// parseLabel returns the text of a label token, trimmed of surrounding
+// whitespace. Empty labels are rejected.
+func (p *Parser) parseLabel(lit string) (string, error) {
+	label := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(lit, "["), "]"))
+	if label == "" {
+		return "", p.fail(ErrUnexpectedToken(lit), "label")
+	}
+	return label, nil
 }
 
 func (p *Parser) parseReroll(lit string) (rr RerollOp, err error) {
@@ -460,18 +1422,61 @@ func (p *Parser) parseReroll(lit string) (rr RerollOp, err error) {
 	return rr, nil
 }
 
-func (p *Parser) parseModifier(tok Token) (int, error) {
-	mult := 1
-	if tok == tMINUS {
-		mult = -1
+// parseMatch reads a match operation, with the minimum set size given in its
+// token and an optional comparison following it, as in mt3 or m>3.
+func (p *Parser) parseMatch(lit string) (*MatchOp, error) {
+	match := &MatchOp{Count: strings.HasPrefix(lit, "mt"), MinSize: 2}
+	if size := strings.TrimLeft(lit, "mt"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return nil, p.fail(err)
+		}
+		if n < 2 {
+			return nil, p.fail(ErrUnexpectedToken(lit), "set size of 2 or more")
+		}
+		match.MinSize = n
 	}
-	tok, lit := p.scanIgnoreWhitespace()
-	if tok != tNUM {
-		return 0, ErrUnexpectedToken(lit)
+
+	tok, _ := p.scan()
+	p.unscan()
+	switch tok {
+	case tGREATER, tLESS, tEQUAL:
+		compare, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		match.Compare = compare
+	}
+	return match, nil
+}
+
+// parseModifier reads a constant modifier following a + or - token. If the
+// constant is really the start of another operand, such as the 2 in 3d6+2d8,
+// 3d6+2*4 or 3d6+2[fire], the sign is pushed back and ok is false.
+func (p *Parser) parseModifier(tok Token) (mod int, ok bool, err error) {
+	start := p.buf.pos - 1
+
+	num, lit := p.scanIgnoreWhitespace()
+	if num != tNUM {
+		p.buf.pos = start
+		return 0, false, nil
 	}
 
-	mod, err := strconv.Atoi(lit)
-	return mod * mult, err
+	switch next, _ := p.scanIgnoreWhitespace(); next {
+	case tDIE, tMULTIPLY, tDIVIDE, tLABEL:
+		p.buf.pos = start
+		return 0, false, nil
+	}
+	p.unscan()
+
+	mod, err = strconv.Atoi(lit)
+	if err != nil {
+		return 0, false, p.fail(err)
+	}
+	if tok == tMINUS {
+		mod = -mod
+	}
+	return mod, true, err
 }
 
 func (p *Parser) parseDie(dieCode string) (Die, error) {
@@ -479,7 +1484,7 @@ func (p *Parser) parseDie(dieCode string) (Die, error) {
 	if num, err := strconv.Atoi(trimmedDieCode); err == nil {
 		die := NormalDie(num)
 		if err := validateDieLimits(die, p.limits); err != nil {
-			return nil, err
+			return nil, p.fail(err)
 		}
 		return die, nil
 	}
@@ -487,7 +1492,7 @@ func (p *Parser) parseDie(dieCode string) (Die, error) {
 	if trimmedDieCode == "F" {
 		die := FateDie(0)
 		if err := validateDieLimits(die, p.limits); err != nil {
-			return nil, err
+			return nil, p.fail(err)
 		}
 		return die, nil
 	}
@@ -495,15 +1500,64 @@ func (p *Parser) parseDie(dieCode string) (Die, error) {
 	if trimmedDieCode == "%" {
 		die := PercentileDie(0)
 		if err := validateDieLimits(die, p.limits); err != nil {
-			return nil, err
+			return nil, p.fail(err)
+		}
+		return die, nil
+	}
+
+	if strings.HasPrefix(dieCode, "d{") {
+		die, err := parseCustomDie(dieCode)
+		if err != nil {
+			return nil, p.fail(err, "d{face,...}")
+		}
+		if err := validateDieLimits(die, p.limits); err != nil {
+			return nil, p.fail(err)
 		}
 		return die, nil
 	}
 
-	return nil, ErrUnknownDie(dieCode)
+	if die, ok := p.dice[strings.TrimPrefix(dieCode, "d")]; ok {
+		if len(die.Faces) == 0 {
+			return nil, p.fail(ErrUnsafeDie(dieCode))
+		}
+		die.Name = strings.TrimPrefix(dieCode, "d")
+		if err := validateDieLimits(die, p.limits); err != nil {
+			return nil, p.fail(err)
+		}
+		return die, nil
+	}
+
+	return nil, p.fail(ErrUnknownDie(dieCode), "dN", "dF", "d%", "d{face,...}")
+}
+
+// parseCustomDie reads the faces of an inline custom die, such as
+// d{0,0,1,1,2,3}, d{-1:minus,0,1:plus} or d{0,success,success+advantage}.
+func parseCustomDie(lit string) (CustomDie, error) {
+	var die CustomDie
+	body := strings.TrimSuffix(strings.TrimPrefix(lit, "d{"), "}")
+	for _, part := range strings.Split(body, ",") {
+		value, symbol, _ := strings.Cut(part, ":")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			symbols, ok := parseSymbols(part)
+			if !ok || symbol != "" {
+				return CustomDie{}, ErrUnknownDie(lit)
+			}
+			die.Faces = append(die.Faces, DieFace{Symbols: symbols})
+			continue
+		}
+		face := DieFace{Value: n, Symbol: strings.TrimSpace(symbol)}
+		if face.Symbol == strconv.Itoa(n) {
+			face.Symbol = ""
+		}
+		die.Faces = append(die.Faces, face)
+	}
+	return die, nil
 }
 
-func (p *Parser) parseExplosion(tok Token, lit string) (*ExplodingOp, error) {
+// parseExplosion parses an explosion of die. Without a target, a die of known
+// size explodes on its highest face, as in 1d6! or 1d6!o.
+func (p *Parser) parseExplosion(tok Token, lit string, die Die) (*ExplodingOp, error) {
 	exp := &ExplodingOp{}
 
 	switch tok {
@@ -514,9 +1568,33 @@ func (p *Parser) parseExplosion(tok Token, lit string) (*ExplodingOp, error) {
 	case tPENETRATE:
 		exp.Type = Penetrating
 	default:
-		return nil, ErrUnexpectedToken(lit)
+		return nil, p.fail(ErrUnexpectedToken(lit))
+	}
+
+	if _, limit, ok := strings.Cut(lit, "o"); ok {
+		exp.MaxExplosions = 1
+		if limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil {
+				return nil, p.fail(err)
+			}
+			if n < 1 {
+				return nil, p.fail(ErrUnexpectedToken(lit), "explosion cap of 1 or more")
+			}
+			exp.MaxExplosions = n
+		}
 	}
 
+	next, _ := p.scan()
+	p.unscan()
+	switch next {
+	case tNUM, tEQUAL, tGREATER, tLESS, tQUERY, tATTRIBUTE:
+	default:
+		if _, hi, ok := faceRange(die); ok {
+			exp.ComparisonOp = &ComparisonOp{Type: Equals, Value: hi}
+			return exp, nil
+		}
+	}
 	compOp, err := p.parseComparison()
 	if err != nil {
 		return nil, err
@@ -527,7 +1605,10 @@ func (p *Parser) parseExplosion(tok Token, lit string) (*ExplodingOp, error) {
 }
 
 func (p *Parser) parseComparison() (cmp *ComparisonOp, err error) {
-	tok, lit := p.scan()
+	tok, lit, err := p.scanNumber()
+	if err != nil {
+		return nil, err
+	}
 
 	cmp = &ComparisonOp{}
 
@@ -535,7 +1616,7 @@ func (p *Parser) parseComparison() (cmp *ComparisonOp, err error) {
 	case tNUM:
 		cmp.Value, err = strconv.Atoi(lit)
 		if err != nil {
-			return nil, err
+			return nil, p.fail(err)
 		}
 		cmp.Type = Equals
 		return cmp, nil
@@ -546,7 +1627,7 @@ func (p *Parser) parseComparison() (cmp *ComparisonOp, err error) {
 	case tLESS:
 		cmp.Type = LessThan
 	default:
-		return nil, ErrUnexpectedToken(lit)
+		return nil, p.fail(ErrUnexpectedToken(lit), "number", "=", ">", "<")
 	}
 
 	tok, lit = p.scan()
@@ -554,13 +1635,22 @@ func (p *Parser) parseComparison() (cmp *ComparisonOp, err error) {
 		cmp.Inclusive = true
 		tok, lit = p.scan()
 	}
+	if tok != tWS {
+		p.unscan()
+	}
+	if tok, lit, err = p.scanNumber(); err != nil {
+		return nil, err
+	}
 	if tok != tNUM {
-		return nil, ErrUnexpectedToken(lit)
+		if cmp.Type != Equals && !cmp.Inclusive {
+			return nil, p.fail(ErrUnexpectedToken(lit), "number", "=")
+		}
+		return nil, p.fail(ErrUnexpectedToken(lit), "number")
 	}
 
 	cmp.Value, err = strconv.Atoi(lit)
 	if err != nil {
-		return nil, err
+		return nil, p.fail(err)
 	}
 
 	return cmp, nil
@@ -584,26 +1674,50 @@ func (p *Parser) parseLimit(tok Token, lit string) (lmt *LimitOp, err error) {
 		lit = strings.TrimPrefix(lit, "dl")
 	}
 
+	if lit == "" {
+		tok, _ := p.scan()
+		p.unscan()
+		if tok == tQUERY || tok == tATTRIBUTE {
+			if _, lit, err = p.scanNumber(); err != nil {
+				return nil, err
+			}
+		}
+	}
 	if lit != "" {
-		lmt.Amount, err = strconv.Atoi(lit)
+		if lmt.Amount, err = strconv.Atoi(lit); err != nil {
+			return nil, p.fail(err)
+		}
 	}
 
-	return lmt, err
+	return lmt, nil
 }
 
+// scan returns the next token, replaying previously scanned tokens first so
+// the parser can look ahead and backtrack.
 func (p *Parser) scan() (tok Token, lit string) {
-	if p.buf.n != 0 {
-		p.buf.n = 0
-		return p.buf.tok, p.buf.lit
+	if p.buf.pos < len(p.buf.toks) {
+		t := p.buf.toks[p.buf.pos]
+		p.buf.pos++
+		return t.tok, t.lit
 	}
 
 	tok, lit = p.s.Scan()
-	p.buf.tok, p.buf.lit = tok, lit
+	p.buf.toks = append(p.buf.toks, scannedToken{tok: tok, lit: lit, pos: p.s.Pos()})
+	p.buf.pos++
 
 	return tok, lit
 }
 
-func (p *Parser) unscan() { p.buf.n = 1 }
+func (p *Parser) unscan() { p.buf.pos-- }
+
+// fail wraps err in a ParseError located at the most recently scanned token.
+func (p *Parser) fail(err error, expected ...string) error {
+	var t scannedToken
+	if p.buf.pos > 0 {
+		t = p.buf.toks[p.buf.pos-1]
+	}
+	return &ParseError{Pos: t.pos, Span: t.lit, Expected: expected, Err: err}
+}
 
 func (p *Parser) scanIgnoreWhitespace() (tok Token, lit string) {
 	tok, lit = p.scan()
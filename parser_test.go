@@ -1,6 +1,8 @@
 package roll
 
 import (
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -101,6 +103,566 @@ func TestParser_ParseAscendingAliasAndInclusiveComparison(t *testing.T) {
 	}
 }
 
+func TestParser_ParseArithmeticProgram(t *testing.T) {
+	program, err := NewParser(strings.NewReader("(1d8+3)*2 - 5/2")).Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+
+	if got, want := program.String(), "(d8+3)*2-5/2"; got != want {
+		t.Fatalf("program string mismatch: got %q want %q", got, want)
+	}
+
+	want := []Instruction{
+		{Op: OpRollDice, Arg: 0},
+		{Op: OpConst, Arg: 2},
+		{Op: OpMul},
+		{Op: OpConst, Arg: 5},
+		{Op: OpConst, Arg: 2},
+		{Op: OpDiv},
+		{Op: OpSub},
+	}
+	if len(program.Code) != len(want) {
+		t.Fatalf("instruction count mismatch: got %d want %d", len(program.Code), len(want))
+	}
+	for i := range want {
+		if program.Code[i] != want[i] {
+			t.Fatalf("instruction %d mismatch: got %#v want %#v", i, program.Code[i], want[i])
+		}
+	}
+	if got, want := program.DiceTerms[0].Modifier, 3; got != want {
+		t.Fatalf("modifier mismatch: got %d want %d", got, want)
+	}
+}
+
+func TestParser_ParseModifierFolding(t *testing.T) {
+	tests := []struct {
+		input     string
+		diceTerms int
+		modifier  int
+		code      int
+	}{
+		{input: "3d6+4", diceTerms: 1, modifier: 4, code: 1},
+		{input: "3d6+4-1", diceTerms: 1, modifier: 3, code: 1},
+		{input: "3d6+2d8", diceTerms: 2, modifier: 0, code: 3},
+		{input: "3d6+4*2", diceTerms: 1, modifier: 0, code: 5},
+		{input: "2*3d6+4", diceTerms: 1, modifier: 0, code: 5},
+		{input: "1d20-1d4+2", diceTerms: 2, modifier: 0, code: 5},
+		{input: "-3d6+4", diceTerms: 1, modifier: 0, code: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program, err := NewParser(strings.NewReader(tt.input)).Parse()
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if got := len(program.DiceTerms); got != tt.diceTerms {
+				t.Fatalf("dice term count mismatch: got %d want %d", got, tt.diceTerms)
+			}
+			if got := program.DiceTerms[len(program.DiceTerms)-1].Modifier; got != tt.modifier {
+				t.Fatalf("modifier mismatch: got %d want %d", got, tt.modifier)
+			}
+			if got := len(program.Code); got != tt.code {
+				t.Fatalf("instruction count mismatch: got %d want %d", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestParser_ParseLabels(t *testing.T) {
+	tests := []struct {
+		input    string
+		rendered string
+		dice     []string
+		groups   []string
+		labels   []string
+		modifier int
+	}{
+		{input: "8d6[fire]", rendered: "8d6[fire]", dice: []string{"fire"}},
+		{input: "1d20+5[STR]+2[prof]", rendered: "d20+5[STR]+2[prof]", dice: []string{""}, labels: []string{"STR", "prof"}},
+		{input: "1d20[atk]+5", rendered: "d20[atk]+5", dice: []string{"atk"}},
+		{input: "1d20+5[atk]", rendered: "d20+5[atk]", dice: []string{""}, labels: []string{"atk"}},
+		{input: "1d20+2+5[atk]", rendered: "d20+2+5[atk]", dice: []string{""}, labels: []string{"atk"}, modifier: 2},
+		{input: "2d6[fire] + 3[fire]", rendered: "2d6[fire]+3[fire]", dice: []string{"fire"}, labels: []string{"fire"}},
+		{input: "{2d6[fire], 1d8[ cold ]}kh1[best]", rendered: "{2d6[fire], d8[cold]}kh[best]", dice: []string{"fire", "cold"}, groups: []string{"best"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program, err := NewParser(strings.NewReader(tt.input)).Parse()
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+
+			var dice, groups []string
+			for _, term := range program.DiceTerms {
+				dice = append(dice, term.Label)
+			}
+			for _, term := range program.GroupTerms {
+				groups = append(groups, term.Label)
+			}
+			if !reflect.DeepEqual(dice, tt.dice) {
+				t.Fatalf("dice labels mismatch: got %q want %q", dice, tt.dice)
+			}
+			if !reflect.DeepEqual(groups, tt.groups) {
+				t.Fatalf("group labels mismatch: got %q want %q", groups, tt.groups)
+			}
+			if !reflect.DeepEqual(program.Labels, tt.labels) {
+				t.Fatalf("constant labels mismatch: got %q want %q", program.Labels, tt.labels)
+			}
+			if got := program.DiceTerms[0].Modifier; got != tt.modifier {
+				t.Fatalf("modifier mismatch: got %d want %d", got, tt.modifier)
+			}
+
+			reparsed := compileProgram(t, program.String())
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+}
+
+func TestParser_ParseComputedDice(t *testing.T) {
+	tests := []struct {
+		input    string
+		rendered string
+		code     []Opcode
+	}{
+		{input: "(1d4)d6", rendered: "(d4)d6", code: []Opcode{OpRollDice, OpRollDiceCount}},
+		{input: "{1d3+1}d8+2", rendered: "{d3+1}d8+2", code: []Opcode{OpRollDice, OpRollGroup, OpRollDiceCount}},
+		{input: "2d(1d4*2)", rendered: "2d(d4*2)", code: []Opcode{OpRollDice, OpConst, OpMul, OpRollDiceSides}},
+		{input: "(1d2)d(1d3+3)kh1", rendered: "(d2)d(d3+3)kh", code: []Opcode{OpRollDice, OpRollDice, OpRollDiceCountSides}},
+		{input: "-(1d4)d6", rendered: "-(d4)d6", code: []Opcode{OpRollDice, OpRollDiceCount, OpNeg}},
+		{input: "5-(1d4)d6+1", rendered: "5-(d4)d6+1", code: []Opcode{OpConst, OpRollDice, OpRollDiceCount, OpSub, OpConst, OpAdd}},
+		{input: "(2)d6", rendered: "2d6", code: []Opcode{OpRollDice}},
+		{input: "3d(8)", rendered: "3d8", code: []Opcode{OpRollDice}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program, err := NewParser(strings.NewReader(tt.input)).Parse()
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+
+			var code []Opcode
+			for _, instruction := range program.Code {
+				code = append(code, instruction.Op)
+			}
+			if !reflect.DeepEqual(code, tt.code) {
+				t.Fatalf("opcode mismatch: got %v want %v", code, tt.code)
+			}
+
+			reparsed := compileProgram(t, program.String())
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+}
+
+func TestParser_ParseCustomDice(t *testing.T) {
+	opts := CompileOptions{Dice: map[string]CustomDie{
+		"TESTBOOST": {Faces: []DieFace{{Value: 0}, {Value: 1, Symbol: "success"}, {Value: 2, Symbol: "success+advantage"}}},
+		"TESTEMPTY": {},
+	}}
+
+	tests := []struct {
+		input    string
+		rendered string
+		faces    []DieFace
+	}{
+		{input: "4d{0,0,1,1,2,3}", rendered: "4d{0,0,1,1,2,3}", faces: []DieFace{{Value: 0}, {Value: 0}, {Value: 1}, {Value: 1}, {Value: 2}, {Value: 3}}},
+		{input: "d{ -1:minus, 0, 1:plus }+1", rendered: "d{-1:minus,0,1:plus}+1", faces: []DieFace{{Value: -1, Symbol: "minus"}, {Value: 0}, {Value: 1, Symbol: "plus"}}},
+		{input: "2d{1:1,2}kh1", rendered: "2d{1,2}kh", faces: []DieFace{{Value: 1}, {Value: 2}}},
+		{input: "d{0, success, success+advantage, threat + threat}", rendered: "d{0,success,advantage+success,threat+threat}", faces: []DieFace{
+			{Value: 0},
+			{Symbols: map[string]int{"success": 1}},
+			{Symbols: map[string]int{"success": 1, "advantage": 1}},
+			{Symbols: map[string]int{"threat": 2}},
+		}},
+		{input: "3dTESTBOOSTkh2", rendered: "3dTESTBOOSTkh2", faces: []DieFace{{Value: 0}, {Value: 1, Symbol: "success"}, {Value: 2, Symbol: "success+advantage"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program, err := NewParserWithOptions(strings.NewReader(tt.input), opts).Parse()
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+			die, ok := program.DiceTerms[0].Die.(CustomDie)
+			if !ok || !reflect.DeepEqual(die.Faces, tt.faces) {
+				t.Fatalf("die mismatch: got %#v", program.DiceTerms[0].Die)
+			}
+
+			reparsed, err := NewParserWithOptions(strings.NewReader(program.String()), opts).Parse()
+			if err != nil {
+				t.Fatalf("unexpected reparse error: %v", err)
+			}
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+
+	errs := []struct {
+		input string
+		err   string
+	}{
+		{input: "d{}", err: `unrecognised die type "d{}" at column 1`},
+		{input: "2d{1,-x}", err: `unrecognised die type "d{1,-x}" at column 2`},
+		{input: "d{5}", err: `unsafe die type "d{5}" at column 1`},
+		{input: "dTESTMISSING", err: `unrecognised die type "dTESTMISSING" at column 1`},
+		{input: "dTESTEMPTY", err: `unsafe die type "dTESTEMPTY" at column 1`},
+	}
+	for _, tt := range errs {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := NewParserWithOptions(strings.NewReader(tt.input), opts).Parse()
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("unexpected parse error: exp=%q got=%v", tt.err, err)
+			}
+		})
+	}
+
+	// Named dice belong to the options they were given in, not every parser.
+	if _, err := NewParser(strings.NewReader("dTESTBOOST")).Parse(); err == nil || err.Error() != `unrecognised die type "dTESTBOOST" at column 1` {
+		t.Fatalf("named die leaked into another parser: %v", err)
+	}
+}
+
+func TestParser_ParseMatch(t *testing.T) {
+	tests := []struct {
+		input    string
+		rendered string
+		match    MatchOp
+	}{
+		{input: "6d6m", rendered: "6d6m", match: MatchOp{MinSize: 2}},
+		{input: "6d6mt", rendered: "6d6mt", match: MatchOp{Count: true, MinSize: 2}},
+		{input: "6d6m3", rendered: "6d6m3", match: MatchOp{MinSize: 3}},
+		{input: "8d10mt2>=7", rendered: "8d10mt>=7", match: MatchOp{Count: true, MinSize: 2, Compare: &ComparisonOp{Type: GreaterThan, Value: 7, Inclusive: true}}},
+		{input: "6d6m=4>3", rendered: "6d6>3m=4", match: MatchOp{MinSize: 2, Compare: &ComparisonOp{Type: Equals, Value: 4}}},
+		{input: "6d6kh4 mt3 sd", rendered: "6d6kh4mt3sd", match: MatchOp{Count: true, MinSize: 3}},
+		{input: "6d6mt+1", rendered: "6d6+1mt", match: MatchOp{Count: true, MinSize: 2}},
+		{input: "6d6mt-1", rendered: "6d6-1mt", match: MatchOp{Count: true, MinSize: 2}},
+		{input: "1+6d6mt", rendered: "1+6d6mt", match: MatchOp{Count: true, MinSize: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program, err := NewParser(strings.NewReader(tt.input)).Parse()
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+			if got := program.DiceTerms[0].Match; got == nil || !reflect.DeepEqual(*got, tt.match) {
+				t.Fatalf("match mismatch: got %+v want %+v", got, tt.match)
+			}
+
+			reparsed := compileProgram(t, program.String())
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+
+	errs := []struct {
+		input string
+		err   string
+	}{
+		{input: "6d6m1", err: `found unexpected token "m1" at column 4`},
+		{input: "6d6m>", err: `found unexpected token "" at column 6`},
+	}
+	for _, tt := range errs {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := NewParser(strings.NewReader(tt.input)).Parse()
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("unexpected parse error: exp=%q got=%v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestParser_ParseExplosionCaps(t *testing.T) {
+	tests := []struct {
+		input    string
+		rendered string
+		max      int
+	}{
+		{input: "1d6!6", rendered: "d6!6"},
+		{input: "1d6!o=6", rendered: "d6!o=6", max: 1},
+		{input: "3d6!!o3>4", rendered: "3d6!!o3>4", max: 3},
+		{input: "2d10!po2=10", rendered: "2d10!po2=10", max: 2},
+
+		// Without a target a die explodes on its highest face.
+		{input: "1d6!o", rendered: "d6!o=6", max: 1},
+		{input: "1d6!!o", rendered: "d6!!o=6", max: 1},
+		{input: "1d6!o3", rendered: "d6!o3=6", max: 3},
+		{input: "2d10!po2+1", rendered: "2d10+1!po2=10", max: 2},
+		{input: "1d6!", rendered: "d6!6"},
+		{input: "2d{1,5,9}!o", rendered: "2d{1,5,9}!o=9", max: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := compileProgram(t, tt.input)
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+			if got := program.DiceTerms[0].Exploding.MaxExplosions; got != tt.max {
+				t.Fatalf("explosion cap mismatch: got %d want %d", got, tt.max)
+			}
+			reparsed := compileProgram(t, program.String())
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+
+	if _, err := CompileString("1d6!o0=6"); err == nil || err.Error() != `found unexpected token "!o0" at column 4` {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	// A computed die has no highest face until it is rolled.
+	if _, err := CompileString("d(1d4*2)!o"); err == nil || err.Error() != `found unexpected token "" at column 11` {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+}
+
+func TestParser_ParseCrits(t *testing.T) {
+	tests := []struct {
+		input    string
+		rendered string
+	}{
+		{input: "1d20cs>19", rendered: "d20cs>19"},
+		{input: "1d20cs20cf=1", rendered: "d20cs20cf1"},
+		{input: "4d6kh3 cf<=2", rendered: "4d6kh3cf<=2"},
+		{input: "{1d20+5, 1d20+5}kh1cs>=25", rendered: "{d20+5, d20+5}khcs>=25"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := compileProgram(t, tt.input)
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+			reparsed := compileProgram(t, program.String())
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+
+	if _, err := CompileString("1d20cs"); err == nil || err.Error() != `found unexpected token "" at column 7` {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+}
+
+func TestParser_ParseCompare(t *testing.T) {
+	tests := []struct {
+		input    string
+		rendered string
+		kind     CompareKind
+		compare  bool
+	}{
+		{input: "1d20+5 vs 1d20+3", rendered: "d20+5 vs d20+3", compare: true},
+		{input: "1d20+5vs1d20+3", rendered: "d20+5 vs d20+3", compare: true},
+		{input: "2d6 >= 8", rendered: "2d6 >= 8", kind: CompareGreaterOrEqual, compare: true},
+		{input: "(1d100) < 40", rendered: "(d100) < 40", kind: CompareLess, compare: true},
+		{input: "{4d6kh3, 3d6}kh1 > 1d20", rendered: "{4d6kh3, 3d6}kh > d20", kind: CompareGreater, compare: true},
+		{input: "3d6+4 = 2d8 + 1", rendered: "3d6+4 = 2d8+1", kind: CompareEqual, compare: true},
+		// Whitespace on both sides of the operator makes a check, otherwise
+		// it counts successes.
+		{input: "3d6 > 4", rendered: "3d6 > 4", kind: CompareGreater, compare: true},
+		{input: "3d6 >4", rendered: "3d6>4"},
+		{input: "3d6> 4", rendered: "3d6>4"},
+		{input: "3d6>4", rendered: "3d6>4"},
+		{input: "2d6 >= 8", rendered: "2d6 >= 8", kind: CompareGreaterOrEqual, compare: true},
+		{input: "2d6 >=8", rendered: "2d6>=8"},
+		{input: "2d6>= 8", rendered: "2d6>=8"},
+		{input: "2d6 = 7", rendered: "2d6 = 7", kind: CompareEqual, compare: true},
+		{input: "2d6 =7", rendered: "2d6=7"},
+		{input: "{2d6} > 8", rendered: "{2d6} > 8", kind: CompareGreater, compare: true},
+		{input: "{2d6} >8", rendered: "{2d6}>8"},
+		{input: "{2d6}> 8", rendered: "{2d6}>8"},
+		{input: "{2d6, 1d8}>3 + 1", rendered: "{2d6, d8}>3+1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := compileProgram(t, tt.input)
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+			last := program.Code[len(program.Code)-1]
+			if (last.Op == OpCompare) != tt.compare {
+				t.Fatalf("compare mismatch: got %v want %v", last.Op == OpCompare, tt.compare)
+			}
+			if tt.compare && CompareKind(last.Arg) != tt.kind {
+				t.Fatalf("compare kind mismatch: got %v want %v", CompareKind(last.Arg), tt.kind)
+			}
+			reparsed := compileProgram(t, program.String())
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+
+	errs := []struct {
+		input string
+		err   string
+	}{
+		{input: "1d20 vs 1d20 vs 1d20", err: `found unexpected token "vs" at column 14`},
+		{input: "{1d20 vs 2}", err: `found unexpected token "vs" at column 7`},
+		{input: "(1d20 vs 2)", err: `found unexpected token "vs" at column 7`},
+		{input: "1d20 vs", err: `found unexpected token "" at column 8`},
+		{input: "2d6 > 7 = 1", err: `found unexpected token "=" at column 9`},
+	}
+	for _, tt := range errs {
+		if _, err := CompileString(tt.input); err == nil || err.Error() != tt.err {
+			t.Errorf("%q: unexpected parse error: exp=%q got=%v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestParser_ParseRepeat(t *testing.T) {
+	tests := []struct {
+		input    string
+		rendered string
+		term     RepeatTerm
+	}{
+		{input: "6 x 4d6kh3", rendered: "6 x 4d6kh3", term: RepeatTerm{Count: 6, Notation: "4d6kh3"}},
+		{input: "6x4d6kh3", rendered: "6 x 4d6kh3", term: RepeatTerm{Count: 6, Notation: "4d6kh3"}},
+		{input: "repeat(6, 4d6dl1)", rendered: "6 x 4d6dl", term: RepeatTerm{Count: 6, Notation: "4d6dl"}},
+		{input: "repeat(6, 4d6dl1)sd", rendered: "repeat(6, 4d6dl)sd", term: RepeatTerm{Count: 6, Sort: Descending, Notation: "4d6dl"}},
+		{input: "repeat( 3 , 2d6+1 ) s", rendered: "repeat(3, 2d6+1)s", term: RepeatTerm{Count: 3, Sort: Ascending, Notation: "2d6+1"}},
+		{input: "3 x 1d20+5 vs 15", rendered: "3 x d20+5 vs 15", term: RepeatTerm{Count: 3, Notation: "d20+5 vs 15"}},
+		{input: "2 x 1d6 sd", rendered: "2 x d6sd", term: RepeatTerm{Count: 2, Notation: "d6sd"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := compileProgram(t, tt.input)
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+			if len(program.RepeatTerms) != 1 || program.RepeatTerms[0] != tt.term {
+				t.Fatalf("repeat terms mismatch: got %+v want %+v", program.RepeatTerms, tt.term)
+			}
+			if last := program.Code[len(program.Code)-1]; last.Op != OpRepeat {
+				t.Fatalf("expected program to end with %s, got %s", OpRepeat, last.Op)
+			}
+			reparsed := compileProgram(t, program.String())
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+
+	errs := []struct {
+		input string
+		err   string
+	}{
+		{input: "0 x 1d6", err: `cannot repeat a roll 0 times at column 1`},
+		{input: "1001 x 1d6", err: `roll repeats 1001 times, more than the maximum of 1000 at column 1`},
+		{input: "1 + 6 x 1d6", err: `found unexpected token "x" at column 7`},
+		{input: "2 x 3 x 1d6", err: `found unexpected token "x" at column 7`},
+		{input: "{2 x 1d6}", err: `found unexpected token "x" at column 4`},
+		{input: "repeat 6, 1d6", err: `found unexpected token "6" at column 8`},
+		{input: "repeat(1d6, 6)", err: `found unexpected token "d6" at column 9`},
+		{input: "repeat(6, 1d6", err: `found unexpected token "" at column 14`},
+		{input: "repeat(6, 1d6)kh", err: `found unexpected token "kh" at column 15`},
+		{input: "repeat(6, 1d6)s+1", err: `found unexpected token "+" at column 16`},
+		{input: "repeet(6, 1d6)", err: `found unexpected token "repeet" at column 1`},
+	}
+	for _, tt := range errs {
+		if _, err := CompileString(tt.input); err == nil || err.Error() != tt.err {
+			t.Errorf("%q: unexpected parse error: exp=%q got=%v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestParser_ParseFunctions(t *testing.T) {
+	tests := []struct {
+		input    string
+		rendered string
+		ops      []Opcode
+		terms    []AggregateTerm
+	}{
+		{input: "max{1d20, 1d20}", rendered: "max{d20, d20}", ops: []Opcode{OpMax}, terms: []AggregateTerm{{ChildCount: 2}}},
+		{input: "min{ 1d20 ,1d20+2, }", rendered: "min{d20, d20+2}", ops: []Opcode{OpMin}, terms: []AggregateTerm{{ChildCount: 2}}},
+		{input: "sum{3d6}", rendered: "sum{3d6}", ops: []Opcode{OpSum}, terms: []AggregateTerm{{ChildCount: 1}}},
+		{input: "avg{1d6, 1d8, 1d10}", rendered: "avg{d6, d8, d10}", ops: []Opcode{OpAvg}, terms: []AggregateTerm{{ChildCount: 3}}},
+		{input: "count{4d6kh3, 4d6kh3}> 10", rendered: "count{4d6kh3, 4d6kh3}>10", ops: []Opcode{OpCount}, terms: []AggregateTerm{{ChildCount: 2, Count: &ComparisonOp{Type: GreaterThan, Value: 10}}}},
+		{input: "count{4d6kh3, 4d6kh3} > 10", rendered: "count{4d6kh3, 4d6kh3}>10", ops: []Opcode{OpCount}, terms: []AggregateTerm{{ChildCount: 2, Count: &ComparisonOp{Type: GreaterThan, Value: 10}}}},
+		{input: "count{4d6kh3, 4d6kh3} >=10", rendered: "count{4d6kh3, 4d6kh3}>=10", ops: []Opcode{OpCount}, terms: []AggregateTerm{{ChildCount: 2, Count: &ComparisonOp{Type: GreaterThan, Value: 10, Inclusive: true}}}},
+		{input: "count{4d6kh3, 4d6kh3}>10", rendered: "count{4d6kh3, 4d6kh3}>10", ops: []Opcode{OpCount}, terms: []AggregateTerm{{ChildCount: 2, Count: &ComparisonOp{Type: GreaterThan, Value: 10}}}},
+		{input: "floor(7/2)", rendered: "floor(7/2)", ops: []Opcode{OpFloor}},
+		{input: "ceil( 1d6 / 2 )", rendered: "ceil(d6/2)", ops: []Opcode{OpCeil}},
+		{input: "round(avg{1d6, 1d8})", rendered: "round(avg{d6, d8})", ops: []Opcode{OpAvg, OpRound}, terms: []AggregateTerm{{ChildCount: 2}}},
+		{input: "abs(1d4-3)+1", rendered: "abs(d4-3)+1", ops: []Opcode{OpAbs}},
+		{input: "max{1d4, 2}d6", rendered: "(max{d4, 2})d6", ops: []Opcode{OpMax}, terms: []AggregateTerm{{ChildCount: 2}}},
+		{input: "sum{max{1d6, 1d6}, abs(-2)}", rendered: "sum{max{d6, d6}, abs(-2)}", ops: []Opcode{OpMax, OpAbs, OpSum}, terms: []AggregateTerm{{ChildCount: 2}, {ChildCount: 2}}},
+		{input: "3 x max{1d20, 1d20}", rendered: "3 x max{d20, d20}", ops: []Opcode{OpMax, OpRepeat}, terms: []AggregateTerm{{ChildCount: 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program := compileProgram(t, tt.input)
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: got %q want %q", got, tt.rendered)
+			}
+			var ops []Opcode
+			for _, instruction := range program.Code {
+				if instruction.Op >= OpRepeat {
+					ops = append(ops, instruction.Op)
+				}
+			}
+			if !reflect.DeepEqual(ops, tt.ops) {
+				t.Fatalf("opcodes mismatch: got %v want %v", ops, tt.ops)
+			}
+			if !reflect.DeepEqual(program.AggregateTerms, tt.terms) {
+				t.Fatalf("aggregate terms mismatch: got %+v want %+v", program.AggregateTerms, tt.terms)
+			}
+			reparsed := compileProgram(t, program.String())
+			if !reflect.DeepEqual(program, reparsed) {
+				t.Fatalf("rendered notation does not round trip:\nexp=%+v\ngot=%+v", program, reparsed)
+			}
+		})
+	}
+
+	errs := []struct {
+		input string
+		err   string
+	}{
+		{input: "max(1d6, 1d6)", err: `found unexpected token "(" at column 4`},
+		{input: "max{}", err: `found unexpected token "}" at column 5`},
+		{input: "max{1d6 1d6}", err: `found unexpected token "1" at column 9`},
+		{input: "count{1d6, 1d6}", err: `found unexpected token "" at column 16`},
+		{input: "count{1d6, 1d6}6", err: `found unexpected token "6" at column 16`},
+		{input: "count{1d6, 1d6} 6", err: `found unexpected token "6" at column 17`},
+		{input: "floor{7/2}", err: `found unexpected token "{" at column 6`},
+		{input: "floor(7/2", err: `found unexpected token "" at column 10`},
+		{input: "1 + repeat(2, 1d6)", err: `found unexpected token "repeat" at column 5`},
+		{input: "maximum{1d6}", err: `found unexpected token "maximum" at column 1`},
+	}
+	for _, tt := range errs {
+		if _, err := CompileString(tt.input); err == nil || err.Error() != tt.err {
+			t.Errorf("%q: unexpected parse error: exp=%q got=%v", tt.input, tt.err, err)
+		}
+	}
+}
+
 func TestParser_ParseRejectsUnsafeDie(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -112,13 +674,19 @@ func TestParser_ParseRejectsUnsafeDie(t *testing.T) {
 			name:   "reject d1",
 			input:  "d1",
 			limits: DefaultLimits,
-			err:    `unsafe die type "d1"`,
+			err:    `unsafe die type "d1" at column 1`,
 		},
 		{
 			name:   "reject oversized die",
 			input:  "d1001",
 			limits: Limits{MaxDieSize: 1000},
-			err:    "die size 1001 exceeds maximum 1000",
+			err:    "die size 1001 exceeds maximum 1000 at column 1",
+		},
+		{
+			name:   "reject constant computed die",
+			input:  "2d(1)",
+			limits: DefaultLimits,
+			err:    `unsafe die type "d1" at column 5`,
 		},
 	}
 
@@ -135,15 +703,33 @@ func TestParser_ParseRejectsUnsafeDie(t *testing.T) {
 	}
 }
 
+func TestParser_ParseRejectsDeepNesting(t *testing.T) {
+	input := strings.Repeat("(", 5) + "1" + strings.Repeat(")", 5)
+	_, err := NewParserWithLimits(strings.NewReader(input), Limits{MaxEvalDepth: 4}).Parse()
+	if err == nil {
+		t.Fatal("expected depth error")
+	}
+	if got, want := err.Error(), "roll exceeded maximum evaluation depth of 4 at column 5"; got != want {
+		t.Fatalf("unexpected parse error: exp=%q got=%q", want, got)
+	}
+}
+
 func TestParser_ParseErrors(t *testing.T) {
 	tests := []struct {
 		input string
 		err   string
 	}{
-		{input: "foo", err: `found unexpected token "f"`},
-		{input: "dX", err: `unrecognised die type "dX"`},
-		{input: "d4--", err: `found unexpected token "-"`},
-		{input: "3d4d5", err: `found unexpected token "d5"`},
+		{input: "foo", err: `found unexpected token "f" at column 1`},
+		{input: "dX", err: `unrecognised die type "dX" at column 1`},
+		{input: "d4--", err: `found unexpected token "-" at column 4`},
+		{input: "3d4d5", err: `found unexpected token "d5" at column 4`},
+		{input: "(1d6", err: `found unexpected token "" at column 5`},
+		{input: "1d6)", err: `found unexpected token ")" at column 4`},
+		{input: "2**3", err: `found unexpected token "*" at column 3`},
+		{input: "--3", err: `found unexpected token "-" at column 2`},
+		{input: "1d6[]", err: `found unexpected token "[]" at column 4`},
+		{input: "1d6[fire", err: `found unexpected token "[fire" at column 4`},
+		{input: "(1d6)[fire]", err: `found unexpected token "[fire]" at column 6`},
 	}
 
 	for _, tt := range tests {
@@ -158,3 +744,96 @@ func TestParser_ParseErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestParser_ParseErrorDetails(t *testing.T) {
+	tests := []struct {
+		input    string
+		span     string
+		column   int
+		expected []string
+		render   string
+		target   any
+	}{
+		{
+			input:    "3d6 + 2dX",
+			span:     "dX",
+			column:   8,
+			expected: []string{"dN", "dF", "d%", "d{face,...}"},
+			render:   "3d6 + 2dX\n       ^^",
+			target:   new(ErrUnknownDie),
+		},
+		{
+			input:    "{2d6, 1d8",
+			column:   10,
+			expected: []string{"+", "-", "*", "/", ",", "}"},
+			render:   "{2d6, 1d8\n         ^",
+			target:   new(ErrUnexpectedToken),
+		},
+		{
+			input:    "1d20 + 5 * +",
+			column:   13,
+			expected: []string{"number", "die", "(", "{", "?{", "@{"},
+			render:   "1d20 + 5 * +\n            ^",
+			target:   new(ErrUnexpectedToken),
+		},
+		{
+			input:    "1d6>",
+			column:   5,
+			expected: []string{"number", "="},
+			render:   "1d6>\n    ^",
+			target:   new(ErrUnexpectedToken),
+		},
+		{
+			input:  "\t4d1",
+			span:   "d1",
+			column: 3,
+			render: "\t4d1\n\t ^^",
+			target: new(ErrUnsafeDie),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := NewParser(strings.NewReader(tt.input)).Parse()
+
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("expected ParseError, got %T: %v", err, err)
+			}
+			if parseErr.Span != tt.span {
+				t.Errorf("span mismatch: exp=%q got=%q", tt.span, parseErr.Span)
+			}
+			if parseErr.Pos.Column != tt.column {
+				t.Errorf("column mismatch: exp=%d got=%d", tt.column, parseErr.Pos.Column)
+			}
+			if !reflect.DeepEqual(parseErr.Expected, tt.expected) {
+				t.Errorf("expected tokens mismatch: exp=%q got=%q", tt.expected, parseErr.Expected)
+			}
+			if got := parseErr.Render(tt.input); got != tt.render {
+				t.Errorf("render mismatch:\nexp=%q\ngot=%q", tt.render, got)
+			}
+			if !errors.As(err, tt.target) {
+				t.Errorf("underlying error %T not reachable with errors.As", tt.target)
+			}
+		})
+	}
+}
+
+func TestParseStringWithOptions_Dice(t *testing.T) {
+	dice := map[string]CustomDie{"TESTFOUR": {Faces: []DieFace{{Value: 4}, {Value: 4}}}}
+	out, err := ParseStringWithOptions("2dTESTFOUR+1", EvalOptions{Dice: dice})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := `Rolled "2dTESTFOUR+1" and got 4, 4 for a total of 9`; out != want {
+		t.Fatalf("output mismatch: exp=%q got=%q", want, out)
+	}
+
+	inline, err := ParseInlineWithOptions("Hit for [[dTESTFOUR]]", EvalOptions{Dice: dice})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "Hit for 4"; inline.Text != want {
+		t.Fatalf("inline text mismatch: exp=%q got=%q", want, inline.Text)
+	}
+}
@@ -0,0 +1,146 @@
+package roll
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrUnansweredQuery is raised when a query has neither an answer nor a
+// default.
+type ErrUnansweredQuery string
+
+func (e ErrUnansweredQuery) Error() string {
+	return fmt.Sprintf("query %q was not answered", string(e))
+}
+
+// ErrInvalidQueryAnswer is raised when the answer to a dropdown query is not
+// one of its options.
+type ErrInvalidQueryAnswer string
+
+func (e ErrInvalidQueryAnswer) Error() string {
+	return fmt.Sprintf("invalid query answer: %s", string(e))
+}
+
+// Query is a Roll20 style ?{...} roll query asking the player for input.
+//
+// ?{Bonus|0} asks for a value with a default of 0, while
+// ?{Weapon|Sword,1d8|Axe,1d10} offers a choice of options, each with the
+// label shown to the player and the value used in the roll.
+type Query struct {
+	Prompt  string
+	Default string
+	Options []QueryOption
+}
+
+// QueryOption is one choice of a dropdown query.
+type QueryOption struct {
+	Label string
+	Value string
+}
+
+// DefaultAnswer returns the answer used when a query is left blank: its
+// default, or the value of its first option.
+func (q Query) DefaultAnswer() string {
+	if len(q.Options) > 0 {
+		return q.Options[0].Value
+	}
+	return q.Default
+}
+
+// String returns the query in ?{...} notation.
+func (q Query) String() string {
+	var output strings.Builder
+	output.WriteString("?{" + q.Prompt)
+	if q.Default != "" {
+		output.WriteString("|" + q.Default)
+	}
+	for _, option := range q.Options {
+		output.WriteString("|" + option.Label)
+		if option.Value != option.Label {
+			output.WriteString("," + option.Value)
+		}
+	}
+	output.WriteString("}")
+	return output.String()
+}
+
+// QueryResolver answers the roll queries met while compiling a roll.
+//
+// Resolve returns the answer as roll notation. A blank answer selects the
+// query's default. For dropdown queries the answer may be either the label
+// or the value of an option.
+type QueryResolver interface {
+	Resolve(query Query) (string, error)
+}
+
+// QueryResolverFunc adapts a function to a QueryResolver.
+type QueryResolverFunc func(query Query) (string, error)
+
+// Resolve calls f(query).
+func (f QueryResolverFunc) Resolve(query Query) (string, error) {
+	return f(query)
+}
+
+// parseQuery reads the ?{...} notation of a query. A single value after the
+// prompt is a default, while several values, or values with a comma, are
+// dropdown options.
+func parseQuery(lit string) (Query, error) {
+	body := strings.TrimSuffix(strings.TrimPrefix(lit, "?{"), "}")
+	parts := strings.Split(body, "|")
+
+	query := Query{Prompt: strings.TrimSpace(parts[0])}
+	if query.Prompt == "" {
+		return Query{}, ErrUnexpectedToken(lit)
+	}
+
+	parts = parts[1:]
+	if len(parts) == 1 && !strings.Contains(parts[0], ",") {
+		query.Default = strings.TrimSpace(parts[0])
+		return query, nil
+	}
+
+	for _, part := range parts {
+		label, value, ok := strings.Cut(part, ",")
+		label = strings.TrimSpace(label)
+		if !ok {
+			value = label
+		}
+		option := QueryOption{Label: label, Value: strings.TrimSpace(value)}
+		if option.Label == "" || option.Value == "" {
+			return Query{}, ErrUnexpectedToken(lit)
+		}
+		query.Options = append(query.Options, option)
+	}
+	return query, nil
+}
+
+// resolve asks resolver to answer the query, falling back to its default,
+// and returns the notation to roll in its place. A nil resolver always
+// takes the default.
+func (q Query) resolve(resolver QueryResolver) (string, error) {
+	var answer string
+	if resolver != nil {
+		var err error
+		if answer, err = resolver.Resolve(q); err != nil {
+			return "", err
+		}
+	}
+
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		answer = q.DefaultAnswer()
+	}
+	if answer == "" {
+		return "", ErrUnansweredQuery(q.Prompt)
+	}
+	if len(q.Options) == 0 {
+		return answer, nil
+	}
+
+	for _, option := range q.Options {
+		if answer == option.Value || answer == option.Label {
+			return option.Value, nil
+		}
+	}
+	return "", ErrInvalidQueryAnswer(fmt.Sprintf("%q is not an option of query %q", answer, q.Prompt))
+}
@@ -0,0 +1,184 @@
+package roll
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		lit   string
+		query Query
+	}{
+		{lit: "?{Bonus}", query: Query{Prompt: "Bonus"}},
+		{lit: "?{Bonus|0}", query: Query{Prompt: "Bonus", Default: "0"}},
+		{lit: "?{ Bonus | 1d4 }", query: Query{Prompt: "Bonus", Default: "1d4"}},
+		{lit: "?{Weapon|Sword,1d8|Axe,1d10}", query: Query{Prompt: "Weapon", Options: []QueryOption{
+			{Label: "Sword", Value: "1d8"},
+			{Label: "Axe", Value: "1d10"},
+		}}},
+		{lit: "?{Dice|1d6|2d6}", query: Query{Prompt: "Dice", Options: []QueryOption{
+			{Label: "1d6", Value: "1d6"},
+			{Label: "2d6", Value: "2d6"},
+		}}},
+		{lit: "?{Size|Small,{1d4,1d6}kh1}", query: Query{Prompt: "Size", Options: []QueryOption{
+			{Label: "Small", Value: "{1d4,1d6}kh1"},
+		}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lit, func(t *testing.T) {
+			query, err := parseQuery(tt.lit)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(tt.query, query) {
+				t.Fatalf("query mismatch: exp=%+v got=%+v", tt.query, query)
+			}
+			if reparsed, err := parseQuery(query.String()); err != nil || !reflect.DeepEqual(query, reparsed) {
+				t.Fatalf("query notation %q does not round trip: %+v %v", query.String(), reparsed, err)
+			}
+		})
+	}
+
+	for _, lit := range []string{"?{}", "?{|0}", "?{Weapon|Sword,|Axe,1d10}"} {
+		if _, err := parseQuery(lit); err == nil {
+			t.Errorf("%q: expected error", lit)
+		}
+	}
+}
+
+func TestCompileWithOptions_Queries(t *testing.T) {
+	answers := map[string]string{
+		"Bonus":  "3",
+		"Weapon": "Axe",
+		"Damage": "1d4+1",
+		"Minus":  "-2",
+		"Nested": "?{Bonus}*2",
+	}
+	resolver := QueryResolverFunc(func(query Query) (string, error) {
+		return answers[query.Prompt], nil
+	})
+
+	tests := []struct {
+		input    string
+		rendered string
+	}{
+		{input: "1d20+?{Bonus|0}", rendered: "d20+3"},
+		{input: "1d20+?{Unasked|0}", rendered: "d20+0"},
+		{input: "?{Weapon|Sword,1d8|Axe,1d10}+2", rendered: "d10+2"},
+		{input: "?{Unasked|Sword,1d8|Axe,1d10}", rendered: "d8"},
+		{input: "2*?{Damage}", rendered: "2*(d4+1)"},
+		{input: "5-?{Minus}", rendered: "5-(-2)"},
+		{input: "{?{Damage}, 1d6}kh1", rendered: "{(d4+1), d6}kh"},
+		{input: "1+?{Nested}", rendered: "1+(3*2)"},
+		{input: "?{Twice|1}+?{Twice|2}", rendered: "1+1"},
+		{input: "4d6kh?{Bonus}", rendered: "4d6kh3"},
+		{input: "1d20>=?{Unasked|15}", rendered: "d20>=15"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			program, err := CompileStringWithOptions(tt.input, CompileOptions{Queries: resolver})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := program.String(); got != tt.rendered {
+				t.Fatalf("program string mismatch: exp=%q got=%q", tt.rendered, got)
+			}
+		})
+	}
+}
+
+func TestCompileWithOptions_QueryErrors(t *testing.T) {
+	errResolver := errors.New("no terminal")
+	tests := []struct {
+		input    string
+		resolver QueryResolver
+		err      string
+		target   error
+	}{
+		{
+			input: "1d20+?{Bonus}",
+			err:   `query "Bonus" was not answered at column 6`,
+		},
+		{
+			input:    "?{Weapon|Sword,1d8|Axe,1d10}",
+			resolver: QueryResolverFunc(func(Query) (string, error) { return "Mace", nil }),
+			err:      `invalid query answer: "Mace" is not an option of query "Weapon" at column 1`,
+		},
+		{
+			input:    "?{Bonus}",
+			resolver: QueryResolverFunc(func(Query) (string, error) { return "1d", nil }),
+			err:      `answer "1d" to query "Bonus": unrecognised die type "d" at column 1`,
+		},
+		{
+			input:    "?{Bonus}",
+			resolver: QueryResolverFunc(func(Query) (string, error) { return "", errResolver }),
+			err:      `no terminal at column 1`,
+			target:   errResolver,
+		},
+		{
+			input:    "?{Loop}",
+			resolver: QueryResolverFunc(func(Query) (string, error) { return "?{Loop}", nil }),
+			err:      `answer "?{Loop}" to query "Loop": invalid query answer: answer to query "Loop" refers to itself at column 1`,
+		},
+		{
+			input: "1+?{Bonus",
+			err:   `found unexpected token "?{Bonus" at column 3`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := CompileStringWithOptions(tt.input, CompileOptions{Queries: tt.resolver})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("error mismatch: exp=%q got=%q", tt.err, err.Error())
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Fatalf("expected %v to wrap %v", err, tt.target)
+			}
+		})
+	}
+}
+
+func TestParseStringWithOptions_Queries(t *testing.T) {
+	resolver := QueryResolverFunc(func(query Query) (string, error) { return "2", nil })
+	withTestSeed(0, func() {
+		out, err := ParseStringWithOptions("?{Dice|1}d6", EvalOptions{Queries: resolver})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := `Rolled "2d6" and got 1, 1 for a total of 2`; out != want {
+			t.Fatalf("output mismatch: exp=%q got=%q", want, out)
+		}
+
+		out, err = ParseStringWithOptions("1d6+?{Bonus}", EvalOptions{Queries: resolver})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := `Rolled "d6+2" and got 2 for a total of 4`; out != want {
+			t.Fatalf("output mismatch: exp=%q got=%q", want, out)
+		}
+
+		asked := 0
+		counting := QueryResolverFunc(func(query Query) (string, error) {
+			asked++
+			return resolver.Resolve(query)
+		})
+		inline, err := ParseInlineWithOptions("I gain [[?{Bonus}+1]] hit points and [[?{Bonus}]] temporary", EvalOptions{Queries: counting})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if asked != 1 {
+			t.Fatalf("expected query to be asked once, was asked %d times", asked)
+		}
+		if want := "I gain 3 hit points and 2 temporary"; inline.Text != want {
+			t.Fatalf("inline text mismatch: exp=%q got=%q", want, inline.Text)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package roll
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RepeatTerm describes a roll repeated within a program, as in 6 x 4d6kh3
+// or repeat(6, 4d6dl1)sd.
+type RepeatTerm struct {
+	// Count is the number of repetitions.
+	Count int
+	// Sort orders the repetitions by total.
+	Sort SortType
+	// Notation is the normalized notation of the roll being repeated.
+	Notation string
+}
+
+// ErrInvalidRepeat is raised when a roll is repeated fewer than once.
+type ErrInvalidRepeat int
+
+func (e ErrInvalidRepeat) Error() string {
+	return fmt.Sprintf("cannot repeat a roll %d times", int(e))
+}
+
+// evalRepeatTerm lists the results of the repetitions of a roll. Its total,
+// successes and crits are those of the repetitions added together, and its
+// rolls those of every repetition in turn.
+func evalRepeatTerm(term RepeatTerm, repeats []Result) Result {
+	var result Result
+	for _, repeat := range repeats {
+		result.Total += repeat.Total
+		result.Successes += repeat.Successes
+		result.CritSuccesses += repeat.CritSuccesses
+		result.CritFailures += repeat.CritFailures
+		result.Rolls = append(result.Rolls, repeat.Rolls...)
+		result.Matches = append(result.Matches, repeat.Matches...)
+		result.Truncated = result.Truncated || repeat.Truncated
+	}
+
+	result.Repeats = repeats
+	switch term.Sort {
+	case Ascending:
+		slices.SortStableFunc(result.Repeats, func(a, b Result) int { return a.Total - b.Total })
+	case Descending:
+		slices.SortStableFunc(result.Repeats, func(a, b Result) int { return b.Total - a.Total })
+	}
+	return result
+}
+
+// formatRepeats lists the totals of a repeated roll, or the outcomes of a
+// repeated comparison, as in "[14, 12, 9]". Repetitions of narrative dice
+// list their net symbols instead and are separated by semicolons, as in
+// "[1 advantage, 1 success; 2 success]".
+func formatRepeats(repeats []Result) string {
+	parts := make([]string, len(repeats))
+	sep := ", "
+	for i, repeat := range repeats {
+		if repeat.Comparison != nil {
+			parts[i] = formatComparison(repeat.Comparison)
+		} else {
+			parts[i] = formatOutcome(repeat)
+		}
+		if hasSymbols(repeat.Rolls) {
+			sep = "; "
+		}
+	}
+	return "[" + strings.Join(parts, sep) + "]"
+}
+
+// RepeatOptions configures the repeated evaluation of a program.
+type RepeatOptions struct {
+	EvalOptions
+	// Workers is the number of goroutines sharing the repetitions. Zero or
+	// one evaluates them in turn on the calling goroutine.
+	Workers int
+	// Seed, when set, gives every repetition its own random stream derived
+	// from the seed and the repetition's index, so the results are the same
+	// however many workers there are. EvalOptions.Source is then ignored.
+	Seed *uint64
+}
+
+// Repeat evaluates the program n times, returning the results in order.
+//
+// The repetitions share one rolling context, so MaxDuration bounds the whole
+// batch, while MaxRollsPerDie and MaxRollsTotal apply to each repetition on
+// its own. The first error stops the batch. With more than one worker and no
+// Seed, the worker streams are seeded from EvalOptions.Source, which is never
+// used by more than one goroutine.
+func (p *Program) Repeat(n int, opts RepeatOptions) ([]Result, error) {
+	results := make([]Result, max(n, 0))
+	if n <= 0 {
+		return results, nil
+	}
+
+	base := newRollContext(context.Background(), opts.EvalOptions)
+	seed, seeded := repeatSeed(base.source, opts)
+	workers := min(max(opts.Workers, 1), n)
+
+	if workers == 1 {
+		for i := range results {
+			if seeded {
+				base.source = repetitionSource(seed, i)
+			}
+			var err error
+			if results[i], err = base.repeat(p); err != nil {
+				return nil, err
+			}
+		}
+		return results, nil
+	}
+
+	var (
+		next   atomic.Int64
+		failed atomic.Bool
+		wg     sync.WaitGroup
+	)
+	errs := make([]error, n)
+	for range workers {
+		ctx := base.fork()
+		wg.Go(func() {
+			for !failed.Load() {
+				i := int(next.Add(1) - 1)
+				if i >= n {
+					return
+				}
+				ctx.source = repetitionSource(seed, i)
+				if results[i], errs[i] = ctx.repeat(p); errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	// Report the error of the earliest repetition so the outcome does not
+	// depend on how the work was scheduled.
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// Rolls returns an endless sequence of evaluations of the program using the
+// default limits and random source.
+func Rolls(program *Program) iter.Seq2[Result, error] {
+	return RollsWithOptions(program, EvalOptions{Limits: DefaultLimits})
+}
+
+// RollsWithOptions returns an endless sequence of evaluations of the program
+// sharing one rolling context, as Repeat does on a single goroutine. The
+// sequence ends after the first error, which is yielded with an empty Result.
+func RollsWithOptions(program *Program, opts EvalOptions) iter.Seq2[Result, error] {
+	return func(yield func(Result, error) bool) {
+		ctx := newRollContext(context.Background(), opts)
+		for {
+			result, err := ctx.repeat(program)
+			if !yield(result, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// repeat evaluates one repetition of a program, counting its rolls afresh.
+func (ctx *rollContext) repeat(program *Program) (Result, error) {
+	ctx.totalRolls = 0
+	return ctx.evaluate(program)
+}
+
+// fork returns a copy of the context for use on another goroutine, sharing
+// its limits and deadline but not its source or buffers.
+func (ctx *rollContext) fork() *rollContext {
+	fork := *ctx
+	fork.source = nil
+	fork.stack = nil
+	fork.totalRolls = 0
+	return &fork
+}
+
+// repeatSeed returns the seed the repetition streams are derived from, and
+// whether repetitions need a stream of their own.
+func repeatSeed(source Source, opts RepeatOptions) (uint64, bool) {
+	if opts.Seed != nil {
+		return *opts.Seed, true
+	}
+	if opts.Workers > 1 {
+		return uint64(source.IntN(math.MaxInt)), true
+	}
+	return 0, false
+}
+
+// repetitionSource returns the random stream of the i'th repetition.
+func repetitionSource(seed uint64, i int) Source {
+	return NewPCGSource(seed, uint64(i))
+}
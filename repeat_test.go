@@ -0,0 +1,118 @@
+package roll
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProgram_Repeat(t *testing.T) {
+	program := compileProgram(t, "4d6kh3+{1d8, 1d10!>9}kh1")
+	seed := uint64(42)
+
+	sequential, err := program.Repeat(50, RepeatOptions{Seed: &seed})
+	if err != nil {
+		t.Fatalf("repeat: %v", err)
+	}
+	if len(sequential) != 50 {
+		t.Fatalf("expected 50 results, got %d", len(sequential))
+	}
+
+	for _, workers := range []int{2, 8, 64} {
+		parallel, err := program.Repeat(50, RepeatOptions{Workers: workers, Seed: &seed})
+		if err != nil {
+			t.Fatalf("repeat with %d workers: %v", workers, err)
+		}
+		if !reflect.DeepEqual(sequential, parallel) {
+			t.Fatalf("results with %d workers differ from sequential results", workers)
+		}
+	}
+
+	// Repetitions have their own streams, so they are not all alike.
+	distinct := map[int]bool{}
+	for _, result := range sequential {
+		distinct[result.Total] = true
+	}
+	if len(distinct) < 2 {
+		t.Fatalf("expected repetitions to differ, got totals %v", distinct)
+	}
+}
+
+func TestProgram_RepeatSource(t *testing.T) {
+	program := compileProgram(t, "3d6")
+
+	results, err := program.Repeat(3, RepeatOptions{EvalOptions: EvalOptions{Source: newSeededSource(0)}})
+	if err != nil {
+		t.Fatalf("repeat: %v", err)
+	}
+
+	// Without a seed the repetitions draw from the one source in turn.
+	source := newSeededSource(0)
+	for i, result := range results {
+		want, err := EvaluateProgramWithOptions(program, EvalOptions{Source: source})
+		if err != nil {
+			t.Fatalf("evaluate: %v", err)
+		}
+		if !reflect.DeepEqual(want, result) {
+			t.Fatalf("%d. result mismatch: exp=%v got=%v", i, want, result)
+		}
+	}
+}
+
+func TestProgram_RepeatLimits(t *testing.T) {
+	limits := Limits{MaxDieSize: 100, MaxRollsPerDie: 10, MaxRollsTotal: 10, MaxEvalDepth: 10}
+
+	// Each repetition has the whole roll budget to itself.
+	results, err := compileProgram(t, "5d6+5d6").Repeat(20, RepeatOptions{EvalOptions: EvalOptions{Limits: limits}})
+	if err != nil {
+		t.Fatalf("repeat: %v", err)
+	}
+	if len(results) != 20 {
+		t.Fatalf("expected 20 results, got %d", len(results))
+	}
+
+	for _, workers := range []int{1, 4} {
+		_, err = compileProgram(t, "5d6+6d6").Repeat(20, RepeatOptions{EvalOptions: EvalOptions{Limits: limits}, Workers: workers})
+		if err == nil || err.Error() != "roll exceeded maximum total roll count of 10" {
+			t.Fatalf("expected limit error with %d workers, got %v", workers, err)
+		}
+	}
+}
+
+func TestRolls(t *testing.T) {
+	program := compileProgram(t, "2d6+1")
+
+	var totals []int
+	for result, err := range RollsWithOptions(program, EvalOptions{Source: newSeededSource(0)}) {
+		if err != nil {
+			t.Fatalf("roll: %v", err)
+		}
+		totals = append(totals, result.Total)
+		if len(totals) == 5 {
+			break
+		}
+	}
+
+	results, err := program.Repeat(5, RepeatOptions{EvalOptions: EvalOptions{Source: newSeededSource(0)}})
+	if err != nil {
+		t.Fatalf("repeat: %v", err)
+	}
+	for i, result := range results {
+		if totals[i] != result.Total {
+			t.Fatalf("%d. total mismatch: exp=%d got=%d", i, result.Total, totals[i])
+		}
+	}
+
+	t.Run("stops at the first error", func(t *testing.T) {
+		limits := Limits{MaxDieSize: 4}
+		count := 0
+		for _, err := range RollsWithOptions(compileProgram(t, "1d6"), EvalOptions{Limits: limits}) {
+			count++
+			if err == nil {
+				t.Fatal("expected die size error")
+			}
+		}
+		if count != 1 {
+			t.Fatalf("expected a single error, got %d results", count)
+		}
+	})
+}
@@ -23,7 +23,17 @@ func Compile(r io.Reader) (*Program, error) {
 
 // CompileWithLimits reads from an io.Reader and compiles a VM program using explicit limits.
 func CompileWithLimits(r io.Reader, limits Limits) (*Program, error) {
-	parser := NewParserWithLimits(r, limits)
+	return CompileWithOptions(r, CompileOptions{Limits: limits})
+}
+
+// CompileStringWithOptions compiles a dice expression string using explicit options.
+func CompileStringWithOptions(rollStr string, opts CompileOptions) (*Program, error) {
+	return CompileWithOptions(strings.NewReader(rollStr), opts)
+}
+
+// CompileWithOptions reads from an io.Reader and compiles a VM program using explicit options.
+func CompileWithOptions(r io.Reader, opts CompileOptions) (*Program, error) {
+	parser := NewParserWithOptions(r, opts)
 	return parser.Parse()
 }
 
@@ -44,21 +54,60 @@ func Parse(r io.Reader) (string, error) {
 
 // ParseWithLimits reads from an io.Reader and generates a dice roll result string using explicit limits.
 func ParseWithLimits(r io.Reader, limits Limits) (string, error) {
-	program, err := CompileWithLimits(r, limits)
+	return ParseWithOptions(r, EvalOptions{Limits: limits})
+}
+
+// ParseStringWithOptions takes a string and executes a dice roll using explicit evaluation options.
+func ParseStringWithOptions(rollStr string, opts EvalOptions) (string, error) {
+	return ParseWithOptions(strings.NewReader(rollStr), opts)
+}
+
+// ParseWithOptions reads from an io.Reader and generates a dice roll result string using explicit evaluation options.
+func ParseWithOptions(r io.Reader, opts EvalOptions) (string, error) {
+	program, err := CompileWithOptions(r, CompileOptions{Limits: opts.Limits, Queries: opts.Queries, Attributes: opts.Attributes, Dice: opts.Dice})
 	if err != nil {
 		return "", err
 	}
 
-	results, err := EvaluateProgramWithLimits(program, limits)
+	results, err := EvaluateProgramWithOptions(program, opts)
 	if err != nil {
 		return "", err
 	}
 
+	if results.Repeats != nil {
+		return fmt.Sprintf("Rolled %q and got %s", program.String(), formatRepeats(results.Repeats)), nil
+	}
+
+	if results.Comparison != nil {
+		return fmt.Sprintf("Rolled %q and got %s", program.String(), formatComparison(results.Comparison)), nil
+	}
+
+	if len(results.Results) == 0 {
+		return fmt.Sprintf("Rolled %q for a total of %d", program.String(), results.Total) + formatLabels(results.Labels), nil
+	}
+
 	output := fmt.Sprintf("Rolled %q and got ", program.String())
 	for _, result := range results.Results {
 		output += result.Symbol + ", "
 	}
 
-	output = strings.TrimSuffix(output, ", ") + fmt.Sprintf(" for a total of %d", results.Total)
-	return output, nil
+	output = strings.TrimSuffix(output, ", ")
+	if hasSymbols(results.Rolls) {
+		return output + " for " + formatSymbols(results.Symbols), nil
+	}
+	output += fmt.Sprintf(" for a total of %d", results.Total)
+	return output + formatLabels(results.Labels), nil
+}
+
+// formatLabels returns the label subtotals of a roll as a parenthesised
+// suffix, such as " (fire 14, cold 3)".
+func formatLabels(labels []LabelTotal) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = fmt.Sprintf("%s %d", l.Label, l.Total)
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
 }
@@ -39,9 +39,14 @@ func TestParse(t *testing.T) {
 		{seed: 0, in: "{3d6 + 2d8}>3", out: `Rolled "{3d6 + 2d8}>3" and got 1, 1, 2, 3, 4 for a total of 1`},
 		{seed: 0, in: "{3d6 + 2d8}>2f=1", out: `Rolled "{3d6 + 2d8}>2f=1" and got 1, 1, 2, 3, 4 for a total of 0`},
 
+		// Functions
+		{seed: 0, in: "max{2d{3,3}, 1d{9,9}}", out: `Rolled "max{2d{3,3}, d{9,9}}" and got 6, 9 for a total of 9`},
+		{seed: 0, in: "count{1d{5,5}, 1d{9,9}}>8", out: `Rolled "count{d{5,5}, d{9,9}}>8" and got 5, 9 for a total of 1`},
+		{seed: 0, in: "floor(7/2)", out: `Rolled "floor(7/2)" for a total of 3`},
+
 		// Errors
-		{seed: 0, in: "3dX-2", out: `unrecognised die type "dX"`},
-		{seed: 0, in: "CRAP", out: `found unexpected token "C"`},
+		{seed: 0, in: "3dX-2", out: `unrecognised die type "dX" at column 2`},
+		{seed: 0, in: "CRAP", out: `found unexpected token "C" at column 1`},
 	}
 
 	for i, tt := range tests {
@@ -78,9 +83,31 @@ func TestParseString(t *testing.T) {
 		{seed: 0, in: "3d6+4", out: `Rolled "3d6+4" and got 1, 1, 2 for a total of 8`},
 		{seed: 0, in: "d6-1", out: `Rolled "d6-1" and got 1 for a total of 0`},
 
+		// Arithmetic
+		{seed: 0, in: "2d6+1d8", out: `Rolled "2d6+d8" and got 1, 1, 2 for a total of 4`},
+		{seed: 0, in: "(1d8+3)*2", out: `Rolled "(d8+3)*2" and got 3 for a total of 12`},
+		{seed: 0, in: "10/4", out: `Rolled "10/4" for a total of 3`},
+
+		// Labels
+		{seed: 0, in: "1d20+5[STR]+2[prof]", out: `Rolled "d20+5[STR]+2[prof]" and got 15 for a total of 22 (STR 5, prof 2)`},
+
+		// Comparisons
+		{seed: 0, in: "1d{7,7} vs 1d{7,7}+2", out: `Rolled "d{7,7} vs d{7,7}+2" and got 7 vs 9 for a loss by 2`},
+		{seed: 0, in: "2d{4,4} vs 8", out: `Rolled "2d{4,4} vs 8" and got 8 vs 8 for a tie`},
+		{seed: 0, in: "2d{4,4} >= 8", out: `Rolled "2d{4,4} >= 8" and got 8 against 8 for a pass`},
+		{seed: 0, in: "1d{50,50} < 40", out: `Rolled "d{50,50} < 40" and got 50 against 40 for a fail by 10`},
+		{seed: 0, in: "d{success,success} vs d{failure,failure}", out: `Rolled "d{success,success} vs d{failure,failure}" and got 1 success vs 1 failure for a tie`},
+
+		// Repeats
+		{seed: 0, in: "3 x 2d{4,4}+1", out: `Rolled "3 x 2d{4,4}+1" and got [9, 9, 9]`},
+		{seed: 0, in: "2 x 1d{7,7} vs 8", out: `Rolled "2 x d{7,7} vs 8" and got [7 vs 8 for a loss by 1, 7 vs 8 for a loss by 1]`},
+		{seed: 0, in: "2 x d{success,success}", out: `Rolled "2 x d{success,success}" and got [1 success; 1 success]`},
+		{seed: 0, in: "2 x d{success+advantage,success+advantage}", out: `Rolled "2 x d{advantage+success,advantage+success}" and got [1 advantage, 1 success; 1 advantage, 1 success]`},
+
 		// Errors
-		{seed: 0, in: "3dX-2", out: `unrecognised die type "dX"`},
-		{seed: 0, in: "CRAP", out: `found unexpected token "C"`},
+		{seed: 0, in: "3dX-2", out: `unrecognised die type "dX" at column 2`},
+		{seed: 0, in: "CRAP", out: `found unexpected token "C" at column 1`},
+		{seed: 0, in: "1/0", out: `division by zero`},
 	}
 
 	for i, tt := range tests {
@@ -125,17 +152,17 @@ func TestParseStringWithLimits(t *testing.T) {
 			name:   "reject d1",
 			input:  "d1",
 			limits: DefaultLimits,
-			err:    `unsafe die type "d1"`,
+			err:    `unsafe die type "d1" at column 1`,
 		},
 		{
 			name:   "per die roll limit",
-			input:  "d2!>0",
+			input:  "d4!>1",
 			limits: Limits{MaxDieSize: 10, MaxRollsPerDie: 3, MaxRollsTotal: 10, MaxEvalDepth: 10},
 			err:    "die term exceeded maximum roll count of 3",
 		},
 		{
 			name:   "total roll limit",
-			input:  "{d2!>0, d2!>0}",
+			input:  "{d4!>2, d4!>2}",
 			limits: Limits{MaxDieSize: 10, MaxRollsPerDie: 10, MaxRollsTotal: 5, MaxEvalDepth: 20},
 			err:    "roll exceeded maximum total roll count of 5",
 		},
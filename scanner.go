@@ -33,6 +33,11 @@ func isModifier(ch rune) bool {
 	return ch == '+' || ch == '-'
 }
 
+// Return true if ch is an arithmetic operator or parenthesis character
+func isOperator(ch rune) bool {
+	return ch == '*' || ch == '/' || ch == '(' || ch == ')'
+}
+
 // Return true if ch is an exploding character
 func isExploding(ch rune) bool {
 	return ch == '!'
@@ -48,11 +53,62 @@ func isSort(ch rune) bool {
 	return ch == 's'
 }
 
+// Return true if ch is a matching character
+func isMatch(ch rune) bool {
+	return ch == 'm'
+}
+
+// Return true if ch is a critical success or failure character
+func isCrit(ch rune) bool {
+	return ch == 'c'
+}
+
+// Return true if ch starts the vs keyword of an opposed roll
+func isVersus(ch rune) bool {
+	return ch == 'v'
+}
+
+// Return true if ch repeats a roll, as in 6 x 4d6kh3
+func isTimes(ch rune) bool {
+	return ch == 'x'
+}
+
+// Return true if ch may be part of the name of a function
+func isFunctionChar(ch rune) bool {
+	return ch >= 'a' && ch <= 'z'
+}
+
+// Return true if name is a function a roll may call
+func isFunction(name string) bool {
+	_, ok := functionOpcodes[name]
+	return ok || name == "repeat"
+}
+
 // Return true if ch is a grouping character
 func isGrouping(ch rune) bool {
 	return ch == '{' || ch == ',' || ch == '}'
 }
 
+// Return true if ch opens or closes a label
+func isLabel(ch rune) bool {
+	return ch == '[' || ch == ']'
+}
+
+// Return true if ch starts a query
+func isQuery(ch rune) bool {
+	return ch == '?'
+}
+
+// Return true if ch starts an attribute reference
+func isAttribute(ch rune) bool {
+	return ch == '@'
+}
+
+// Return true if ch may start the name of a registered die
+func isDieNameStart(ch rune) bool {
+	return ch >= 'A' && ch <= 'Z'
+}
+
 // Return true if ch is a keep limit character
 func isKeepLimit(ch rune) bool {
 	return ch == 'k'
@@ -60,21 +116,42 @@ func isKeepLimit(ch rune) bool {
 
 // Return true if ch is a valid character for indicating a die roll
 func isValidDieRoll(ch rune) bool {
-	return !isWhitespace(ch) && !isGrouping(ch) && !isReroll(ch) && !isSort(ch) && !isExploding(ch) && !isCompare(ch) && !isModifier(ch) && !isKeepLimit(ch) && ch != 'd' && ch != 'D'
+	return !isWhitespace(ch) && !isGrouping(ch) && !isReroll(ch) && !isSort(ch) && !isMatch(ch) && !isCrit(ch) && !isVersus(ch) && !isTimes(ch) && !isExploding(ch) && !isCompare(ch) && !isModifier(ch) && !isOperator(ch) && !isLabel(ch) && !isQuery(ch) && !isAttribute(ch) && !isKeepLimit(ch) && ch != 'd' && ch != 'D'
+}
+
+// Position is a location in the source of a roll.
+type Position struct {
+	// Offset is the byte offset, starting at 0.
+	Offset int
+	// Line is the line number, starting at 1.
+	Line int
+	// Column is the column in runes, starting at 1.
+	Column int
 }
 
 // Scanner is our lexical scanner for dice roll strings
 type Scanner struct {
-	r *bufio.Reader
+	r     *bufio.Reader
+	pos   Position
+	prev  Position
+	start Position
 }
 
 // NewScanner returns a new instance of scanner
 func NewScanner(r io.Reader) *Scanner {
-	return &Scanner{r: bufio.NewReader(r)}
+	start := Position{Line: 1, Column: 1}
+	return &Scanner{r: bufio.NewReader(r), pos: start, start: start}
+}
+
+// Pos returns the position of the first character of the token most
+// recently returned by Scan.
+func (s *Scanner) Pos() Position {
+	return s.start
 }
 
 // Scan returns the next token and literal value
 func (s *Scanner) Scan() (tok Token, lit string) {
+	s.start = s.pos
 	ch := s.read()
 
 	switch {
@@ -88,7 +165,11 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 		s.unread()
 		return s.scanDieOrDrop()
 	case ch == 'f':
-		return tFAILURES, string(ch)
+		s.unread()
+		return s.scanFailures()
+	case ch == 'a':
+		s.unread()
+		return s.scanFunction(&bytes.Buffer{})
 	case ch == '!':
 		s.unread()
 		return s.scanExplosions()
@@ -101,10 +182,29 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 	case ch == 's':
 		s.unread()
 		return s.scanSort()
+	case ch == 'm':
+		s.unread()
+		return s.scanMatch()
+	case ch == 'c':
+		s.unread()
+		return s.scanCrit()
+	case ch == 'v':
+		s.unread()
+		return s.scanVersus()
+	case ch == 'x':
+		return tTIMES, string(ch)
 	case ch == '-':
 		return tMINUS, string(ch)
 	case ch == '+':
 		return tPLUS, string(ch)
+	case ch == '*':
+		return tMULTIPLY, string(ch)
+	case ch == '/':
+		return tDIVIDE, string(ch)
+	case ch == '(':
+		return tPARENSTART, string(ch)
+	case ch == ')':
+		return tPARENEND, string(ch)
 	case ch == '>':
 		return tGREATER, string(ch)
 	case ch == '<':
@@ -117,6 +217,15 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 		return tGROUPEND, string(ch)
 	case ch == ',':
 		return tGROUPSEP, string(ch)
+	case ch == '[':
+		s.unread()
+		return s.scanLabel()
+	case ch == '?':
+		s.unread()
+		return s.scanQuery()
+	case ch == '@':
+		s.unread()
+		return s.scanAttribute()
 	case ch == eof:
 		return tEOF, ""
 	}
@@ -128,7 +237,7 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 func (s *Scanner) scanWhitespace() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	_, _ = buf.WriteRune(s.read())
 
 	// Read every subsequent whitespace character into the buffer.
 	// Non-whitespace characters and EOF will cause the loop to exit.
@@ -150,7 +259,7 @@ func (s *Scanner) scanWhitespace() (tok Token, lit string) {
 func (s *Scanner) scanNumber() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	_, _ = buf.WriteRune(s.read())
 
 	// Read every subsequent number character into the buffer.
 	// Non-number characters and EOF will cause the loop to exit.
@@ -173,7 +282,27 @@ func (s *Scanner) scanNumber() (tok Token, lit string) {
 func (s *Scanner) scanDieOrDrop() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	_, _ = buf.WriteRune(s.read())
+
+	// Inline custom dice and registered die names are read whole.
+	switch ch := s.read(); {
+	case ch == '{':
+		buf.WriteRune(ch)
+		return s.scanCustomDie(&buf)
+	case isDieNameStart(ch):
+		buf.WriteRune(ch)
+		for {
+			if ch = s.read(); !isDieNameStart(ch) && !isNumber(ch) {
+				if ch != eof {
+					s.unread()
+				}
+				return tDIE, buf.String()
+			}
+			buf.WriteRune(ch)
+		}
+	case ch != eof:
+		s.unread()
+	}
 
 	// Read every subsequent character into the buffer.
 	// We assume a die token by default and switch based on subsequent chars.
@@ -207,11 +336,26 @@ func (s *Scanner) scanDieOrDrop() (tok Token, lit string) {
 	return tok, buf.String()
 }
 
+// scanCustomDie consumes the faces of an inline custom die up to the closing
+// brace. A die that is never closed is illegal.
+func (s *Scanner) scanCustomDie(buf *bytes.Buffer) (tok Token, lit string) {
+	for {
+		ch := s.read()
+		if ch == eof {
+			return tILLEGAL, buf.String()
+		}
+		_, _ = buf.WriteRune(ch)
+		if ch == '}' {
+			return tDIE, buf.String()
+		}
+	}
+}
+
 // scanKeep consumes the current rune and all contiguous keep runes.
 func (s *Scanner) scanKeep() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	_, _ = buf.WriteRune(s.read())
 
 	// Read every subsequent character into the buffer.
 	// We assume an illegal token by default and switch based on later chars.
@@ -240,7 +384,7 @@ func (s *Scanner) scanKeep() (tok Token, lit string) {
 func (s *Scanner) scanExplosions() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	_, _ = buf.WriteRune(s.read())
 
 	// Read every subsequent character into the buffer.
 	// We assume an explode token by default and switch based on later chars.
@@ -254,10 +398,21 @@ func (s *Scanner) scanExplosions() (tok Token, lit string) {
 	if ch == '!' {
 		tok = tCOMPOUND
 		_, _ = buf.WriteRune(ch)
+		ch = s.read()
 	} else if ch == 'p' {
 		tok = tPENETRATE
 		_, _ = buf.WriteRune(ch)
-	} else {
+		ch = s.read()
+	}
+
+	// An o caps how often each die explodes, optionally followed by the cap.
+	if ch == 'o' {
+		_, _ = buf.WriteRune(ch)
+		for ch = s.read(); isNumber(ch); ch = s.read() {
+			_, _ = buf.WriteRune(ch)
+		}
+	}
+	if ch != eof {
 		s.unread()
 	}
 
@@ -269,7 +424,7 @@ func (s *Scanner) scanExplosions() (tok Token, lit string) {
 func (s *Scanner) scanReroll() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	_, _ = buf.WriteRune(s.read())
 
 	// Read every subsequent character into the buffer.
 	// Rerolls are simple flags with an optional modifier
@@ -280,9 +435,21 @@ func (s *Scanner) scanReroll() (tok Token, lit string) {
 		return tok, buf.String()
 	}
 
-	if ch == 'o' {
+	switch ch {
+	case 'o':
 		_, _ = buf.WriteRune(ch)
-	} else {
+		// No reroll is followed by ou or e, so these start the names of
+		// round and repeat.
+		if ch = s.read(); ch == 'u' {
+			s.unread()
+			return s.scanFunction(&buf)
+		} else if ch != eof {
+			s.unread()
+		}
+	case 'e':
+		s.unread()
+		return s.scanFunction(&buf)
+	default:
 		s.unread()
 	}
 
@@ -294,7 +461,7 @@ func (s *Scanner) scanReroll() (tok Token, lit string) {
 func (s *Scanner) scanSort() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	_, _ = buf.WriteRune(s.read())
 
 	// Read every subsequent character into the buffer.
 	// Sorts are simple flags with an optional modifier
@@ -305,9 +472,47 @@ func (s *Scanner) scanSort() (tok Token, lit string) {
 		return tok, buf.String()
 	}
 
-	if ch == 'd' || ch == 'a' {
+	switch ch {
+	case 'd', 'a':
 		_, _ = buf.WriteRune(ch)
-	} else {
+	case 'u':
+		// No sort is followed by a u, so this is the name of sum.
+		s.unread()
+		return s.scanFunction(&buf)
+	default:
+		s.unread()
+	}
+
+	// Otherwise return as a regular identifier.
+	return tok, buf.String()
+}
+
+// scanMatch consumes the current rune and all contiguous match runes.
+func (s *Scanner) scanMatch() (tok Token, lit string) {
+	// Create a buffer and read the current character into it.
+	var buf bytes.Buffer
+	_, _ = buf.WriteRune(s.read())
+
+	// Read every subsequent character into the buffer.
+	// Matches are a flag with an optional t and minimum set size.
+	tok = tMATCH
+
+	ch := s.read()
+	if ch == 'a' || ch == 'i' {
+		// No match is followed by an a or i, so this is the name of max or
+		// min.
+		s.unread()
+		return s.scanFunction(&buf)
+	}
+	if ch == 't' {
+		_, _ = buf.WriteRune(ch)
+		ch = s.read()
+	}
+	for isNumber(ch) {
+		_, _ = buf.WriteRune(ch)
+		ch = s.read()
+	}
+	if ch != eof {
 		s.unread()
 	}
 
@@ -315,15 +520,179 @@ func (s *Scanner) scanSort() (tok Token, lit string) {
 	return tok, buf.String()
 }
 
+// scanCrit consumes a critical success or failure marker, cs or cf.
+func (s *Scanner) scanCrit() (tok Token, lit string) {
+	var buf bytes.Buffer
+	_, _ = buf.WriteRune(s.read())
+
+	ch := s.read()
+	switch ch {
+	case 's':
+		tok = tCRITSUCCESS
+	case 'f':
+		tok = tCRITFAILURE
+	case 'o', 'e':
+		// Otherwise this is the name of count or ceil.
+		s.unread()
+		return s.scanFunction(&buf)
+	default:
+		if ch != eof {
+			s.unread()
+		}
+		return tILLEGAL, buf.String()
+	}
+	_, _ = buf.WriteRune(ch)
+	return tok, buf.String()
+}
+
+// scanVersus consumes the vs keyword of an opposed roll.
+func (s *Scanner) scanVersus() (tok Token, lit string) {
+	var buf bytes.Buffer
+	_, _ = buf.WriteRune(s.read())
+
+	ch := s.read()
+	if ch != 's' {
+		if ch != eof {
+			s.unread()
+		}
+		return tILLEGAL, buf.String()
+	}
+	_, _ = buf.WriteRune(ch)
+	return tVERSUS, buf.String()
+}
+
+// scanFailures consumes a failure marker, or the name of floor.
+func (s *Scanner) scanFailures() (tok Token, lit string) {
+	var buf bytes.Buffer
+	_, _ = buf.WriteRune(s.read())
+
+	ch := s.read()
+	if ch == 'l' {
+		s.unread()
+		return s.scanFunction(&buf)
+	}
+	if ch != eof {
+		s.unread()
+	}
+	return tFAILURES, buf.String()
+}
+
+// scanFunction consumes the rest of a function name begun in buf. A name
+// that is not a known function is illegal.
+func (s *Scanner) scanFunction(buf *bytes.Buffer) (tok Token, lit string) {
+	for {
+		ch := s.read()
+		if !isFunctionChar(ch) {
+			if ch != eof {
+				s.unread()
+			}
+			break
+		}
+		_, _ = buf.WriteRune(ch)
+	}
+
+	if !isFunction(buf.String()) {
+		return tILLEGAL, buf.String()
+	}
+	return tFUNCTION, buf.String()
+}
+
+// scanLabel consumes a bracketed label, brackets included. A label that is
+// never closed is illegal.
+func (s *Scanner) scanLabel() (tok Token, lit string) {
+	var buf bytes.Buffer
+	_, _ = buf.WriteRune(s.read())
+
+	for {
+		ch := s.read()
+		if ch == eof {
+			return tILLEGAL, buf.String()
+		}
+		_, _ = buf.WriteRune(ch)
+		if ch == ']' {
+			return tLABEL, buf.String()
+		}
+	}
+}
+
+// scanQuery consumes a ?{...} query up to its matching closing brace. A
+// query that is never closed is illegal.
+func (s *Scanner) scanQuery() (tok Token, lit string) {
+	var buf bytes.Buffer
+	_, _ = buf.WriteRune(s.read())
+
+	if ch := s.read(); ch != '{' {
+		if ch != eof {
+			s.unread()
+		}
+		return tILLEGAL, buf.String()
+	}
+	buf.WriteRune('{')
+
+	for depth := 1; depth > 0; {
+		ch := s.read()
+		if ch == eof {
+			return tILLEGAL, buf.String()
+		}
+		switch ch {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+		_, _ = buf.WriteRune(ch)
+	}
+	return tQUERY, buf.String()
+}
+
+// scanAttribute consumes an @{...} attribute reference. A reference that is
+// never closed is illegal.
+func (s *Scanner) scanAttribute() (tok Token, lit string) {
+	var buf bytes.Buffer
+	_, _ = buf.WriteRune(s.read())
+
+	if ch := s.read(); ch != '{' {
+		if ch != eof {
+			s.unread()
+		}
+		return tILLEGAL, buf.String()
+	}
+	buf.WriteRune('{')
+
+	for {
+		ch := s.read()
+		if ch == eof {
+			return tILLEGAL, buf.String()
+		}
+		_, _ = buf.WriteRune(ch)
+		if ch == '}' {
+			return tATTRIBUTE, buf.String()
+		}
+	}
+}
+
 // read reads the next rune from the buffered reader.
 // Returns the rune(0) if an error occurs (or io.EOF is returned).
 func (s *Scanner) read() rune {
-	ch, _, err := s.r.ReadRune()
+	ch, size, err := s.r.ReadRune()
 	if err != nil {
 		return eof
 	}
+
+	s.prev = s.pos
+	s.pos.Offset += size
+	if ch == '\n' {
+		s.pos.Line++
+		s.pos.Column = 1
+	} else {
+		s.pos.Column++
+	}
 	return ch
 }
 
 // unread places the previously read rune back on the reader.
-func (s *Scanner) unread() { _ = s.r.UnreadRune() }
+func (s *Scanner) unread() {
+	if s.r.UnreadRune() == nil {
+		s.pos = s.prev
+	}
+}
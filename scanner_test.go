@@ -33,16 +33,25 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `d6}`, tok: tDIE, lit: "d6"},
 		{s: `d6 `, tok: tDIE, lit: "d6"},
 		{s: `d6kh3`, tok: tDIE, lit: "d6"},
+		{s: `d6*2`, tok: tDIE, lit: "d6"},
+		{s: `d6)`, tok: tDIE, lit: "d6"},
 
 		// Modifiers
 		{s: `+`, tok: tPLUS, lit: "+"},
 		{s: `-`, tok: tMINUS, lit: "-"},
 
+		// Arithmetic
+		{s: `*`, tok: tMULTIPLY, lit: "*"},
+		{s: `/`, tok: tDIVIDE, lit: "/"},
+
 		// Extra rules
 		{s: `f`, tok: tFAILURES, lit: "f"},
 		{s: `!`, tok: tEXPLODE, lit: "!"},
 		{s: `!!`, tok: tCOMPOUND, lit: "!!"},
 		{s: `!p`, tok: tPENETRATE, lit: "!p"},
+		{s: `!o>5`, tok: tEXPLODE, lit: "!o"},
+		{s: `!!o3=6`, tok: tCOMPOUND, lit: "!!o3"},
+		{s: `!po12`, tok: tPENETRATE, lit: "!po12"},
 		{s: `kh`, tok: tKEEPHIGH, lit: "kh"},
 		{s: `kh3`, tok: tKEEPHIGH, lit: "kh3"},
 		{s: `kl`, tok: tKEEPLOW, lit: "kl"},
@@ -57,16 +66,75 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `s`, tok: tSORT, lit: "s"},
 		{s: `sa`, tok: tSORT, lit: "sa"},
 		{s: `sd`, tok: tSORT, lit: "sd"},
+		{s: `m`, tok: tMATCH, lit: "m"},
+		{s: `mt`, tok: tMATCH, lit: "mt"},
+		{s: `m3`, tok: tMATCH, lit: "m3"},
+		{s: `mt3>4`, tok: tMATCH, lit: "mt3"},
+		{s: `d6mt`, tok: tDIE, lit: "d6"},
+		{s: `cs>19`, tok: tCRITSUCCESS, lit: "cs"},
+		{s: `cf1`, tok: tCRITFAILURE, lit: "cf"},
+		{s: `cx`, tok: tILLEGAL, lit: "c"},
+		{s: `d20cs`, tok: tDIE, lit: "d20"},
 
 		// Tests
 		{s: `>`, tok: tGREATER, lit: ">"},
 		{s: `<`, tok: tLESS, lit: "<"},
 		{s: `=`, tok: tEQUAL, lit: "="},
+		{s: `vs`, tok: tVERSUS, lit: "vs"},
+		{s: `vs1d20`, tok: tVERSUS, lit: "vs"},
+		{s: `vx`, tok: tILLEGAL, lit: "v"},
+
+		// Repetition
+		{s: `x`, tok: tTIMES, lit: "x"},
+		{s: `x4d6`, tok: tTIMES, lit: "x"},
+		{s: `repeat(6, 4d6)`, tok: tFUNCTION, lit: "repeat"},
+		{s: `rep`, tok: tILLEGAL, lit: "rep"},
+		{s: `ro<2`, tok: tREROLL, lit: "ro"},
+
+		// Functions
+		{s: `max{1d20, 1d20}`, tok: tFUNCTION, lit: "max"},
+		{s: `min{`, tok: tFUNCTION, lit: "min"},
+		{s: `sum{`, tok: tFUNCTION, lit: "sum"},
+		{s: `avg{`, tok: tFUNCTION, lit: "avg"},
+		{s: `count{`, tok: tFUNCTION, lit: "count"},
+		{s: `floor(7/2)`, tok: tFUNCTION, lit: "floor"},
+		{s: `ceil(`, tok: tFUNCTION, lit: "ceil"},
+		{s: `round(`, tok: tFUNCTION, lit: "round"},
+		{s: `abs(`, tok: tFUNCTION, lit: "abs"},
+		{s: `mix{`, tok: tILLEGAL, lit: "mix"},
+		{s: `flo`, tok: tILLEGAL, lit: "flo"},
+		{s: `f<3`, tok: tFAILURES, lit: "f"},
+		{s: `mt>3`, tok: tMATCH, lit: "mt"},
+		{s: `cs=20`, tok: tCRITSUCCESS, lit: "cs"},
+		{s: `sd+1`, tok: tSORT, lit: "sd"},
 
 		// Grouping
 		{s: `{`, tok: tGROUPSTART, lit: "{"},
 		{s: `}`, tok: tGROUPEND, lit: "}"},
 		{s: `,`, tok: tGROUPSEP, lit: ","},
+		{s: `(`, tok: tPARENSTART, lit: "("},
+		{s: `)`, tok: tPARENEND, lit: ")"},
+
+		// Annotations
+		{s: `[fire]`, tok: tLABEL, lit: "[fire]"},
+		{s: `[cold damage]`, tok: tLABEL, lit: "[cold damage]"},
+		{s: `[fire`, tok: tILLEGAL, lit: "[fire"},
+		{s: `d6[fire]`, tok: tDIE, lit: "d6"},
+
+		// Input
+		{s: `?{Bonus|0}`, tok: tQUERY, lit: "?{Bonus|0}"},
+		{s: `?{Size|Small,{1d4,1d6}kh1}+1`, tok: tQUERY, lit: "?{Size|Small,{1d4,1d6}kh1}"},
+		{s: `?{Bonus`, tok: tILLEGAL, lit: "?{Bonus"},
+		{s: `@{strength_mod}+1`, tok: tATTRIBUTE, lit: "@{strength_mod}"},
+		{s: `@{Bob|level}d6`, tok: tATTRIBUTE, lit: "@{Bob|level}"},
+		{s: `@{level`, tok: tILLEGAL, lit: "@{level"},
+		{s: `d{0,0,1,1,2,3}kh1`, tok: tDIE, lit: "d{0,0,1,1,2,3}"},
+		{s: `d{-1:minus, 0, 1:plus}`, tok: tDIE, lit: "d{-1:minus, 0, 1:plus}"},
+		{s: `d{0,1`, tok: tILLEGAL, lit: "d{0,1"},
+		{s: `dAVG+1`, tok: tDIE, lit: "dAVG"},
+		{s: `dBOOST2kh1`, tok: tDIE, lit: "dBOOST2"},
+		{s: `@level`, tok: tILLEGAL, lit: "@"},
+		{s: `?Bonus`, tok: tILLEGAL, lit: "?"},
 	}
 
 	for i, tt := range tests {
@@ -79,3 +147,32 @@ func TestScanner_Scan(t *testing.T) {
 		}
 	}
 }
+
+// Ensure the scanner reports where each token starts.
+func TestScanner_Pos(t *testing.T) {
+	s := NewScanner(strings.NewReader("3d6 +\n\t{dF}"))
+	want := []struct {
+		tok Token
+		pos Position
+	}{
+		{tok: tNUM, pos: Position{Offset: 0, Line: 1, Column: 1}},
+		{tok: tDIE, pos: Position{Offset: 1, Line: 1, Column: 2}},
+		{tok: tWS, pos: Position{Offset: 3, Line: 1, Column: 4}},
+		{tok: tPLUS, pos: Position{Offset: 4, Line: 1, Column: 5}},
+		{tok: tWS, pos: Position{Offset: 5, Line: 1, Column: 6}},
+		{tok: tGROUPSTART, pos: Position{Offset: 7, Line: 2, Column: 2}},
+		{tok: tDIE, pos: Position{Offset: 8, Line: 2, Column: 3}},
+		{tok: tGROUPEND, pos: Position{Offset: 10, Line: 2, Column: 5}},
+		{tok: tEOF, pos: Position{Offset: 11, Line: 2, Column: 6}},
+	}
+
+	for i, w := range want {
+		tok, lit := s.Scan()
+		if tok != w.tok {
+			t.Fatalf("%d. token mismatch: exp=%v got=%v (%q)", i, w.tok, tok, lit)
+		}
+		if got := s.Pos(); got != w.pos {
+			t.Fatalf("%d. position mismatch: exp=%+v got=%+v", i, w.pos, got)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package roll
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand/v2"
+)
+
+// Source provides the random numbers used to roll dice.
+//
+// Implementations need not be safe for concurrent use; a Source is only used
+// by one evaluation at a time unless the caller shares it explicitly.
+type Source interface {
+	// IntN returns a uniformly distributed integer in the half-open interval [0, n).
+	IntN(n int) int
+}
+
+// globalSource draws from the automatically seeded math/rand/v2 generator.
+type globalSource struct{}
+
+func (globalSource) IntN(n int) int { return rand.IntN(n) }
+
+// defaultSource is used by evaluations that do not supply their own Source.
+var defaultSource Source = globalSource{}
+
+// NewPCGSource returns a deterministic Source backed by a PCG generator
+// seeded with the given values.
+func NewPCGSource(seed1, seed2 uint64) Source {
+	return rand.New(rand.NewPCG(seed1, seed2))
+}
+
+// NewChaCha8Source returns a deterministic Source backed by a ChaCha8
+// generator seeded with the given value.
+func NewChaCha8Source(seed [32]byte) Source {
+	return rand.New(rand.NewChaCha8(seed))
+}
+
+// NewCryptoSource returns a Source backed by crypto/rand, suitable when rolls
+// must not be predictable from previous results.
+func NewCryptoSource() Source {
+	return rand.New(cryptoSource{})
+}
+
+// cryptoSource adapts crypto/rand to the math/rand/v2 Source interface.
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var buf [8]byte
+	_, _ = crand.Read(buf[:])
+	return binary.LittleEndian.Uint64(buf[:])
+}
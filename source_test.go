@@ -0,0 +1,67 @@
+package roll
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestEvaluateProgramWithOptions_Source(t *testing.T) {
+	program := compileProgram(t, "10d20!>19+{4d6kh3, 4d6kh3}")
+
+	evaluate := func(src Source) Result {
+		t.Helper()
+		result, err := EvaluateProgramWithOptions(program, EvalOptions{Source: src})
+		if err != nil {
+			t.Fatalf("evaluate: %v", err)
+		}
+		return result
+	}
+
+	t.Run("pcg is reproducible", func(t *testing.T) {
+		a := evaluate(NewPCGSource(1, 2))
+		b := evaluate(NewPCGSource(1, 2))
+		if !reflect.DeepEqual(a, b) {
+			t.Fatalf("results differ for identical seeds: %v vs %v", a, b)
+		}
+	})
+
+	t.Run("chacha8 is reproducible", func(t *testing.T) {
+		seed := [32]byte{1, 2, 3}
+		a := evaluate(NewChaCha8Source(seed))
+		b := evaluate(NewChaCha8Source(seed))
+		if !reflect.DeepEqual(a, b) {
+			t.Fatalf("results differ for identical seeds: %v vs %v", a, b)
+		}
+	})
+
+	t.Run("parallel evaluations are independent", func(t *testing.T) {
+		want := evaluate(NewPCGSource(7, 7))
+
+		var wg sync.WaitGroup
+		results := make([]Result, 8)
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i], _ = EvaluateProgramWithOptions(program, EvalOptions{Source: NewPCGSource(7, 7)})
+			}()
+		}
+		wg.Wait()
+
+		for i, got := range results {
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("%d. result mismatch: exp=%v got=%v", i, want, got)
+			}
+		}
+	})
+}
+
+func TestNewCryptoSource(t *testing.T) {
+	src := NewCryptoSource()
+	for i := 0; i < 1000; i++ {
+		if roll := NormalDie(6).Roll(src); roll.Result < 1 || roll.Result > 6 {
+			t.Fatalf("roll out of range: %d", roll.Result)
+		}
+	}
+}
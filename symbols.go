@@ -0,0 +1,126 @@
+package roll
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Cancellation is a rule by which two narrative symbols cancel each other
+// out one for one, as successes cancel failures in Genesys.
+type Cancellation struct {
+	Symbol   string
+	Opposite string
+}
+
+// NarrativeCancellations are the cancellation rules of the Genesys and Star
+// Wars roleplaying games. Triumphs and despairs are not cancelled, so their
+// dice faces also carry the success or failure they count as.
+var NarrativeCancellations = []Cancellation{
+	{Symbol: "success", Opposite: "failure"},
+	{Symbol: "advantage", Opposite: "threat"},
+}
+
+// tallySymbols adds up the narrative symbols of every die in rolls that was
+// not dropped, then applies the cancellation rules in order. It returns nil
+// when no die carried symbols.
+func tallySymbols(rolls []DieRoll, rules []Cancellation) map[string]int {
+	var pool map[string]int
+	for _, roll := range rolls {
+		if roll.Dropped || len(roll.Symbols) == 0 {
+			continue
+		}
+		if pool == nil {
+			pool = map[string]int{}
+		}
+		for symbol, n := range roll.Symbols {
+			pool[symbol] += n
+		}
+	}
+	if pool == nil {
+		return nil
+	}
+
+	for _, rule := range rules {
+		cancelled := min(pool[rule.Symbol], pool[rule.Opposite])
+		pool[rule.Symbol] -= cancelled
+		pool[rule.Opposite] -= cancelled
+	}
+	maps.DeleteFunc(pool, func(_ string, n int) bool { return n <= 0 })
+	return pool
+}
+
+// hasSymbols reports whether any die in rolls carried narrative symbols.
+func hasSymbols(rolls []DieRoll) bool {
+	return slices.ContainsFunc(rolls, func(roll DieRoll) bool { return len(roll.Symbols) > 0 })
+}
+
+// addSymbols adds the symbols of src to dst, allocating dst if needed.
+func addSymbols(dst, src map[string]int) map[string]int {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]int, len(src))
+	}
+	for symbol, n := range src {
+		dst[symbol] += n
+	}
+	return dst
+}
+
+// parseSymbols reads narrative symbols joined by +, as in success+advantage.
+// It returns false if text is not made up of symbol names.
+func parseSymbols(text string) (map[string]int, bool) {
+	symbols := map[string]int{}
+	for _, part := range strings.Split(text, "+") {
+		name := strings.TrimSpace(part)
+		if !validSymbol(name) {
+			return nil, false
+		}
+		symbols[name]++
+	}
+	return symbols, true
+}
+
+func validSymbol(name string) bool {
+	if name == "" || isNumber(rune(name[0])) {
+		return false
+	}
+	for _, ch := range name {
+		if !isLetter(ch) && !isNumber(ch) && ch != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetter(ch rune) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+// formatSymbols returns symbols in alphabetical order, such as
+// "1 advantage, 2 success", or "no net symbols" when all have cancelled.
+func formatSymbols(symbols map[string]int) string {
+	if len(symbols) == 0 {
+		return "no net symbols"
+	}
+	parts := make([]string, 0, len(symbols))
+	for _, symbol := range slices.Sorted(maps.Keys(symbols)) {
+		parts = append(parts, fmt.Sprintf("%d %s", symbols[symbol], symbol))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// renderSymbols returns symbols joined by + in alphabetical order, repeating
+// symbols that appear more than once.
+func renderSymbols(symbols map[string]int) string {
+	var parts []string
+	for _, symbol := range slices.Sorted(maps.Keys(symbols)) {
+		for range symbols[symbol] {
+			parts = append(parts, symbol)
+		}
+	}
+	return strings.Join(parts, "+")
+}
@@ -0,0 +1,101 @@
+package roll
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTallySymbols(t *testing.T) {
+	rolls := []DieRoll{
+		{Symbols: map[string]int{"success": 1, "advantage": 1}},
+		{Symbols: map[string]int{"success": 2}},
+		{Symbols: map[string]int{"failure": 1, "despair": 1}},
+		{Symbols: map[string]int{"threat": 3}},
+		{Symbols: map[string]int{"success": 5}, Dropped: true},
+		{Result: 4},
+	}
+
+	tests := []struct {
+		name  string
+		rolls []DieRoll
+		rules []Cancellation
+		want  map[string]int
+	}{
+		{
+			name:  "no cancellation",
+			rolls: rolls,
+			want:  map[string]int{"success": 3, "advantage": 1, "failure": 1, "despair": 1, "threat": 3},
+		},
+		{
+			name:  "narrative",
+			rolls: rolls,
+			rules: NarrativeCancellations,
+			want:  map[string]int{"success": 2, "despair": 1, "threat": 2},
+		},
+		{
+			name:  "all cancelled",
+			rolls: rolls[:2],
+			rules: []Cancellation{{Symbol: "success", Opposite: "success"}, {Symbol: "advantage", Opposite: "advantage"}},
+			want:  map[string]int{},
+		},
+		{
+			name:  "no symbols",
+			rolls: rolls[5:],
+			rules: NarrativeCancellations,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tallySymbols(tt.rolls, tt.rules); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("symbols mismatch: exp=%v got=%v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseSymbols(t *testing.T) {
+	tests := []struct {
+		text string
+		want map[string]int
+	}{
+		{text: "success", want: map[string]int{"success": 1}},
+		{text: " success + advantage ", want: map[string]int{"success": 1, "advantage": 1}},
+		{text: "threat+threat", want: map[string]int{"threat": 2}},
+		{text: "light_side", want: map[string]int{"light_side": 1}},
+		{text: ""},
+		{text: "success+"},
+		{text: "2x"},
+		{text: "dark side"},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseSymbols(tt.text)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: exp=%v got=%v,%v", tt.text, tt.want, got, ok)
+		}
+	}
+}
+
+func TestParseStringWithOptions_Symbols(t *testing.T) {
+	faces := "d{0,success,advantage+success,advantage,failure,threat+threat}"
+	tests := []struct {
+		rules []Cancellation
+		want  string
+	}{
+		{want: `Rolled "3` + faces + `" and got threat+threat, advantage, threat+threat for 1 advantage, 4 threat`},
+		{rules: NarrativeCancellations, want: `Rolled "3` + faces + `" and got threat+threat, advantage, threat+threat for 3 threat`},
+	}
+
+	for _, tt := range tests {
+		withTestSeed(1, func() {
+			out, err := ParseStringWithOptions("3"+faces, EvalOptions{Cancellations: tt.rules})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tt.want {
+				t.Fatalf("output mismatch:\nexp=%q\ngot=%q", tt.want, out)
+			}
+		})
+	}
+}
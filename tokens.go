@@ -16,6 +16,10 @@ const (
 	tPLUS
 	tMINUS
 
+	// Arithmetic
+	tMULTIPLY
+	tDIVIDE
+
 	// Extra rules
 	tFAILURES
 	tEXPLODE
@@ -27,14 +31,33 @@ const (
 	tDROPLOW
 	tREROLL
 	tSORT
+	tMATCH
+	tCRITSUCCESS
+	tCRITFAILURE
 
 	// Tests
 	tGREATER
 	tLESS
 	tEQUAL
+	tVERSUS
+
+	// Repetition
+	tTIMES
+
+	// Functions
+	tFUNCTION
 
 	// Grouping
 	tGROUPSTART
 	tGROUPEND
 	tGROUPSEP
+	tPARENSTART
+	tPARENEND
+
+	// Annotations
+	tLABEL
+
+	// Input
+	tQUERY
+	tATTRIBUTE
 )
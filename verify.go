@@ -0,0 +1,283 @@
+package roll
+
+import "fmt"
+
+// ErrInvalidProgram is raised when a program fails verification.
+type ErrInvalidProgram string
+
+func (e ErrInvalidProgram) Error() string {
+	return fmt.Sprintf("invalid program: %s", string(e))
+}
+
+func invalidInstruction(pc int, format string, args ...any) error {
+	return ErrInvalidProgram(fmt.Sprintf("instruction %d: %s", pc, fmt.Sprintf(format, args...)))
+}
+
+// Verify statically checks that a program is safe to execute: every opcode is
+// known, every Arg indexes an existing term or label, every group has the child values
+// it asks for, the stack ends with exactly one value and MaxDepth is at least
+// the real nesting depth of the code. Terms are checked for missing dice and
+// comparisons and for out of range enumerations.
+//
+// Programs produced by the compiler always verify. Verify is intended for
+// programs loaded from elsewhere, such as with UnmarshalBinary.
+func (p *Program) Verify() error {
+	if p == nil {
+		return ErrInvalidProgram("nil program")
+	}
+
+	for i, term := range p.DiceTerms {
+		if err := verifyDiceTerm(term); err != nil {
+			return ErrInvalidProgram(fmt.Sprintf("dice term %d: %s", i, err))
+		}
+	}
+	for i, term := range p.GroupTerms {
+		if err := verifyGroupTerm(term); err != nil {
+			return ErrInvalidProgram(fmt.Sprintf("group term %d: %s", i, err))
+		}
+	}
+	for i, term := range p.RepeatTerms {
+		if err := verifyRepeatTerm(term); err != nil {
+			return ErrInvalidProgram(fmt.Sprintf("repeat term %d: %s", i, err))
+		}
+	}
+	for i, term := range p.AggregateTerms {
+		if err := verifyAggregateTerm(term); err != nil {
+			return ErrInvalidProgram(fmt.Sprintf("aggregate term %d: %s", i, err))
+		}
+	}
+
+	// depths mirrors the VM stack, holding the nesting depth of each value.
+	depths := make([]int, 0, len(p.Code))
+	for pc, instruction := range p.Code {
+		switch instruction.Op {
+		case OpRollDice:
+			if instruction.Arg < 0 || instruction.Arg >= len(p.DiceTerms) {
+				return invalidInstruction(pc, "invalid dice term index %d", instruction.Arg)
+			}
+			depths = append(depths, 1)
+		case OpRollDiceCount, OpRollDiceSides, OpRollDiceCountSides:
+			if instruction.Arg < 0 || instruction.Arg >= len(p.DiceTerms) {
+				return invalidInstruction(pc, "invalid dice term index %d", instruction.Arg)
+			}
+			n := instruction.Op.operands()
+			if n > len(depths) {
+				return invalidInstruction(pc, "%s requires %d operands, stack has %d", instruction.Op, n, len(depths))
+			}
+			depth := 1
+			for _, operand := range depths[len(depths)-n:] {
+				depth = max(depth, 1+operand)
+			}
+			depths = append(depths[:len(depths)-n], depth)
+		case OpRollGroup:
+			if instruction.Arg < 0 || instruction.Arg >= len(p.GroupTerms) {
+				return invalidInstruction(pc, "invalid group term index %d", instruction.Arg)
+			}
+			count := p.GroupTerms[instruction.Arg].ChildCount
+			if count > len(depths) {
+				return invalidInstruction(pc, "group term %d requires %d child values, stack has %d", instruction.Arg, count, len(depths))
+			}
+			depth := 1
+			for _, child := range depths[len(depths)-count:] {
+				depth = max(depth, 1+child)
+			}
+			depths = append(depths[:len(depths)-count], depth)
+		case OpConst:
+			depths = append(depths, 1)
+		case OpNeg:
+			if len(depths) < 1 {
+				return invalidInstruction(pc, "%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			depths[len(depths)-1]++
+		case OpLabel:
+			if instruction.Arg < 0 || instruction.Arg >= len(p.Labels) {
+				return invalidInstruction(pc, "invalid label index %d", instruction.Arg)
+			}
+			if len(depths) < 1 {
+				return invalidInstruction(pc, "%s requires 1 operand, stack has 0", instruction.Op)
+			}
+		case OpCompare:
+			if instruction.Arg < int(CompareVersus) || instruction.Arg > int(CompareLessOrEqual) {
+				return invalidInstruction(pc, "unknown comparison kind %d", instruction.Arg)
+			}
+			if pc != len(p.Code)-1 && (pc != len(p.Code)-2 || p.Code[pc+1].Op != OpRepeat) {
+				return invalidInstruction(pc, "%s must be the last instruction", instruction.Op)
+			}
+			if len(depths) < 2 {
+				return invalidInstruction(pc, "%s requires 2 operands, stack has %d", instruction.Op, len(depths))
+			}
+			depth := 1 + max(depths[len(depths)-2], depths[len(depths)-1])
+			depths = append(depths[:len(depths)-2], depth)
+		case OpRepeat:
+			if instruction.Arg < 0 || instruction.Arg >= len(p.RepeatTerms) {
+				return invalidInstruction(pc, "invalid repeat term index %d", instruction.Arg)
+			}
+			if pc != len(p.Code)-1 {
+				return invalidInstruction(pc, "%s must be the last instruction", instruction.Op)
+			}
+			if len(depths) != 1 {
+				return invalidInstruction(pc, "%s requires 1 operand, stack has %d", instruction.Op, len(depths))
+			}
+			depths[0]++
+		case OpMax, OpMin, OpSum, OpAvg, OpCount:
+			if instruction.Arg < 0 || instruction.Arg >= len(p.AggregateTerms) {
+				return invalidInstruction(pc, "invalid aggregate term index %d", instruction.Arg)
+			}
+			term := p.AggregateTerms[instruction.Arg]
+			if instruction.Op == OpCount && term.Count == nil {
+				return invalidInstruction(pc, "%s has no comparison", instruction.Op)
+			}
+			if term.ChildCount > len(depths) {
+				return invalidInstruction(pc, "aggregate term %d requires %d child values, stack has %d", instruction.Arg, term.ChildCount, len(depths))
+			}
+			depth := 1
+			for _, child := range depths[len(depths)-term.ChildCount:] {
+				depth = max(depth, 1+child)
+			}
+			depths = append(depths[:len(depths)-term.ChildCount], depth)
+		case OpFloor, OpCeil, OpRound, OpAbs:
+			if len(depths) < 1 {
+				return invalidInstruction(pc, "%s requires 1 operand, stack has 0", instruction.Op)
+			}
+			depths[len(depths)-1]++
+		case OpAdd, OpSub, OpMul, OpDiv:
+			if len(depths) < 2 {
+				return invalidInstruction(pc, "%s requires 2 operands, stack has %d", instruction.Op, len(depths))
+			}
+			depth := 1 + max(depths[len(depths)-2], depths[len(depths)-1])
+			depths = append(depths[:len(depths)-2], depth)
+		default:
+			return invalidInstruction(pc, "unsupported opcode %d", instruction.Op)
+		}
+	}
+
+	if len(depths) != 1 {
+		return ErrInvalidProgram(fmt.Sprintf("program leaves %d results on the VM stack", len(depths)))
+	}
+	if depths[0] > p.MaxDepth {
+		return ErrInvalidProgram(fmt.Sprintf("program nests %d deep but declares a maximum depth of %d", depths[0], p.MaxDepth))
+	}
+	return nil
+}
+
+func verifyDiceTerm(term DiceTerm) error {
+	switch d := term.Die.(type) {
+	case NormalDie, PercentileDie, FateDie:
+	case CustomDie:
+		if len(d.Faces) == 0 {
+			return fmt.Errorf("custom die has no faces")
+		}
+	case nil:
+		return fmt.Errorf("missing die")
+	default:
+		return fmt.Errorf("unsupported die type %T", term.Die)
+	}
+
+	if term.Exploding != nil {
+		if _, ok := explodingTypeNames[term.Exploding.Type]; !ok {
+			return fmt.Errorf("unknown exploding type %d", term.Exploding.Type)
+		}
+		if err := verifyComparison("exploding", term.Exploding.ComparisonOp); err != nil {
+			return err
+		}
+		if term.Exploding.MaxExplosions < 0 {
+			return fmt.Errorf("negative explosion cap %d", term.Exploding.MaxExplosions)
+		}
+	}
+	for _, reroll := range term.Rerolls {
+		if err := verifyComparison("reroll", reroll.ComparisonOp); err != nil {
+			return err
+		}
+	}
+	if term.Match != nil {
+		if term.Match.MinSize < 2 {
+			return fmt.Errorf("match set size %d is less than 2", term.Match.MinSize)
+		}
+		if term.Match.Compare != nil {
+			if err := verifyComparison("match", term.Match.Compare); err != nil {
+				return err
+			}
+		}
+	}
+	if _, ok := sortTypeNames[term.Sort]; !ok {
+		return fmt.Errorf("unknown sort type %d", term.Sort)
+	}
+	if err := verifyCrits(term.CritSuccess, term.CritFailure); err != nil {
+		return err
+	}
+	return verifyChecks(term.Limit, term.Success, term.Failure)
+}
+
+func verifyGroupTerm(term GroupTerm) error {
+	if term.ChildCount < 0 {
+		return fmt.Errorf("negative child count %d", term.ChildCount)
+	}
+	if err := verifyCrits(term.CritSuccess, term.CritFailure); err != nil {
+		return err
+	}
+	return verifyChecks(term.Limit, term.Success, term.Failure)
+}
+
+func verifyRepeatTerm(term RepeatTerm) error {
+	if term.Count < 1 {
+		return ErrInvalidRepeat(term.Count)
+	}
+	if _, ok := sortTypeNames[term.Sort]; !ok {
+		return fmt.Errorf("unknown sort type %d", term.Sort)
+	}
+	return nil
+}
+
+func verifyAggregateTerm(term AggregateTerm) error {
+	if term.ChildCount < 1 {
+		return fmt.Errorf("child count %d is less than 1", term.ChildCount)
+	}
+	if term.Count != nil {
+		return verifyComparison("count", term.Count)
+	}
+	return nil
+}
+
+// verifyChecks checks the limit and comparisons shared by dice and group terms.
+func verifyChecks(limit *LimitOp, success, failure *ComparisonOp) error {
+	if limit != nil {
+		if _, ok := limitTypeNames[limit.Type]; !ok {
+			return fmt.Errorf("unknown limit type %d", limit.Type)
+		}
+		if limit.Amount < 0 {
+			return fmt.Errorf("negative limit amount %d", limit.Amount)
+		}
+	}
+	if success != nil {
+		if err := verifyComparison("success", success); err != nil {
+			return err
+		}
+	}
+	if failure != nil {
+		return verifyComparison("failure", failure)
+	}
+	return nil
+}
+
+// verifyCrits checks the optional critical success and failure comparisons.
+func verifyCrits(success, failure *ComparisonOp) error {
+	if success != nil {
+		if err := verifyComparison("critical success", success); err != nil {
+			return err
+		}
+	}
+	if failure != nil {
+		return verifyComparison("critical failure", failure)
+	}
+	return nil
+}
+
+func verifyComparison(name string, op *ComparisonOp) error {
+	if op == nil {
+		return fmt.Errorf("%s op has no comparison", name)
+	}
+	if _, ok := comparisonTypeNames[op.Type]; !ok {
+		return fmt.Errorf("unknown %s comparison type %d", name, op.Type)
+	}
+	return nil
+}
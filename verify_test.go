@@ -0,0 +1,191 @@
+package roll
+
+import "testing"
+
+func TestProgram_Verify(t *testing.T) {
+	d6 := DiceTerm{Multiplier: 1, Die: NormalDie(6)}
+
+	tests := []struct {
+		name    string
+		program *Program
+		err     string
+	}{
+		{
+			name:    "compiled",
+			program: compileProgram(t, "{4d6kh3, -(1d6+2)*3}kh1/2"),
+		},
+		{
+			name:    "compiled computed dice",
+			program: compileProgram(t, "({1d4}d6)d(1d3*2)"),
+		},
+		{
+			name:    "computed dice operands",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 6}, {Op: OpRollDiceCountSides}}, DiceTerms: []DiceTerm{d6}, MaxDepth: 2},
+			err:     "invalid program: instruction 1: roll_dice_count_sides requires 2 operands, stack has 1",
+		},
+		{
+			name:    "match size",
+			program: &Program{Code: []Instruction{{Op: OpRollDice}}, DiceTerms: []DiceTerm{{Multiplier: 1, Die: NormalDie(6), Match: &MatchOp{MinSize: 1}}}, MaxDepth: 1},
+			err:     "invalid program: dice term 0: match set size 1 is less than 2",
+		},
+		{
+			name:    "explosion cap",
+			program: &Program{Code: []Instruction{{Op: OpRollDice}}, DiceTerms: []DiceTerm{{Multiplier: 1, Die: NormalDie(6), Exploding: &ExplodingOp{ComparisonOp: &ComparisonOp{Value: 6}, MaxExplosions: -1}}}, MaxDepth: 1},
+			err:     "invalid program: dice term 0: negative explosion cap -1",
+		},
+		{
+			name:    "crit comparison",
+			program: &Program{Code: []Instruction{{Op: OpRollDice}}, DiceTerms: []DiceTerm{{Multiplier: 1, Die: NormalDie(6), CritFailure: &ComparisonOp{Type: ComparisonType(9)}}}, MaxDepth: 1},
+			err:     "invalid program: dice term 0: unknown critical failure comparison type 9",
+		},
+		{
+			name:    "dice index",
+			program: &Program{Code: []Instruction{{Op: OpRollDice, Arg: 1}}, DiceTerms: []DiceTerm{d6}, MaxDepth: 1},
+			err:     "invalid program: instruction 0: invalid dice term index 1",
+		},
+		{
+			name:    "group index",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpRollGroup, Arg: -1}}, MaxDepth: 2},
+			err:     "invalid program: instruction 1: invalid group term index -1",
+		},
+		{
+			name: "child count",
+			program: &Program{
+				Code:       []Instruction{{Op: OpRollDice}, {Op: OpRollGroup}},
+				DiceTerms:  []DiceTerm{d6},
+				GroupTerms: []GroupTerm{{ChildCount: 2}},
+				MaxDepth:   2,
+			},
+			err: "invalid program: instruction 1: group term 0 requires 2 child values, stack has 1",
+		},
+		{
+			name:    "operands",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpAdd}}, MaxDepth: 2},
+			err:     "invalid program: instruction 1: add requires 2 operands, stack has 1",
+		},
+		{
+			name:    "opcode",
+			program: &Program{Code: []Instruction{{Op: Opcode(200)}}, MaxDepth: 1},
+			err:     "invalid program: instruction 0: unsupported opcode 200",
+		},
+		{
+			name:    "label index",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpLabel, Arg: 0}}, MaxDepth: 1},
+			err:     "invalid program: instruction 1: invalid label index 0",
+		},
+		{
+			name:    "compare kind",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpConst, Arg: 2}, {Op: OpCompare, Arg: 9}}, MaxDepth: 2},
+			err:     "invalid program: instruction 2: unknown comparison kind 9",
+		},
+		{
+			name:    "compare not last",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpConst, Arg: 2}, {Op: OpCompare}, {Op: OpNeg}}, MaxDepth: 2},
+			err:     "invalid program: instruction 2: compare must be the last instruction",
+		},
+		{
+			name:    "compiled repeat",
+			program: compileProgram(t, "repeat(3, 1d20+5 vs 15)sd"),
+		},
+		{
+			name:    "repeat count",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpRepeat}}, RepeatTerms: []RepeatTerm{{Count: 0}}, MaxDepth: 2},
+			err:     "invalid program: repeat term 0: cannot repeat a roll 0 times",
+		},
+		{
+			name:    "repeat index",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpRepeat, Arg: 1}}, RepeatTerms: []RepeatTerm{{Count: 2}}, MaxDepth: 2},
+			err:     "invalid program: instruction 1: invalid repeat term index 1",
+		},
+		{
+			name:    "repeat operands",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpConst, Arg: 2}, {Op: OpRepeat}, {Op: OpAdd}}, RepeatTerms: []RepeatTerm{{Count: 2}}, MaxDepth: 2},
+			err:     "invalid program: instruction 2: repeat must be the last instruction",
+		},
+		{
+			name:    "compiled functions",
+			program: compileProgram(t, "max{1d20, 1d20}+floor(7/2)-count{4d6kh3, 3d6}>10+abs(1d4-3)"),
+		},
+		{
+			name:    "aggregate child count",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpMax}}, AggregateTerms: []AggregateTerm{{ChildCount: 0}}, MaxDepth: 2},
+			err:     "invalid program: aggregate term 0: child count 0 is less than 1",
+		},
+		{
+			name:    "aggregate index",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpSum, Arg: 1}}, AggregateTerms: []AggregateTerm{{ChildCount: 1}}, MaxDepth: 2},
+			err:     "invalid program: instruction 1: invalid aggregate term index 1",
+		},
+		{
+			name:    "aggregate children",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpMin}}, AggregateTerms: []AggregateTerm{{ChildCount: 2}}, MaxDepth: 2},
+			err:     "invalid program: instruction 1: aggregate term 0 requires 2 child values, stack has 1",
+		},
+		{
+			name:    "count comparison",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpCount}}, AggregateTerms: []AggregateTerm{{ChildCount: 1}}, MaxDepth: 2},
+			err:     "invalid program: instruction 1: count has no comparison",
+		},
+		{
+			name:    "count comparison type",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpCount}}, AggregateTerms: []AggregateTerm{{ChildCount: 1, Count: &ComparisonOp{Type: 9}}}, MaxDepth: 2},
+			err:     "invalid program: aggregate term 0: unknown count comparison type 9",
+		},
+		{
+			name:    "rounding operands",
+			program: &Program{Code: []Instruction{{Op: OpFloor}}, MaxDepth: 1},
+			err:     "invalid program: instruction 0: floor requires 1 operand, stack has 0",
+		},
+		{
+			name:    "empty",
+			program: &Program{},
+			err:     "invalid program: program leaves 0 results on the VM stack",
+		},
+		{
+			name:    "depth",
+			program: &Program{Code: []Instruction{{Op: OpConst, Arg: 1}, {Op: OpNeg}, {Op: OpNeg}}, MaxDepth: 1},
+			err:     "invalid program: program nests 3 deep but declares a maximum depth of 1",
+		},
+		{
+			name:    "missing die",
+			program: &Program{Code: []Instruction{{Op: OpRollDice}}, DiceTerms: []DiceTerm{{Multiplier: 1}}, MaxDepth: 1},
+			err:     "invalid program: dice term 0: missing die",
+		},
+		{
+			name: "missing comparison",
+			program: &Program{
+				Code:      []Instruction{{Op: OpRollDice}},
+				DiceTerms: []DiceTerm{{Multiplier: 1, Die: NormalDie(6), Exploding: &ExplodingOp{}}},
+				MaxDepth:  1,
+			},
+			err: "invalid program: dice term 0: exploding op has no comparison",
+		},
+		{
+			name: "limit type",
+			program: &Program{
+				Code:       []Instruction{{Op: OpConst}, {Op: OpRollGroup}},
+				GroupTerms: []GroupTerm{{ChildCount: 1, Limit: &LimitOp{Type: LimitType(9)}}},
+				MaxDepth:   2,
+			},
+			err: "invalid program: group term 0: unknown limit type 9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.program.Verify()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected verification error")
+			}
+			if err.Error() != tt.err {
+				t.Fatalf("unexpected error: exp=%q got=%q", tt.err, err.Error())
+			}
+		})
+	}
+}